@@ -0,0 +1,450 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultUserName = "default"
+
+// aclCategories groups commands the way ACL rules such as +@string refer to
+// them. The read and write categories come from the command table.
+var aclCategories = map[string][]string{
+	"keyspace":    {"DEL", "EXISTS", "TYPE", "KEYS", "SCAN", "DBSIZE", "RANDOMKEY", "RENAME", "RENAMENX", "MOVE", "FLUSHDB", "FLUSHALL", "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT", "TTL", "PTTL", "PERSIST", "DUMP", "RESTORE", "MIGRATE"},
+	"string":      {"SET", "GET", "INCR", "INCRBY", "DECR", "DECRBY", "INCRBYFLOAT", "APPEND", "STRLEN", "GETRANGE", "SETRANGE", "GETSET", "GETDEL", "SETNX", "MSET", "MSETNX", "MGET"},
+	"list":        {"LPUSH", "RPUSH", "LPOP", "RPOP", "LRANGE", "LLEN", "LMOVE", "BLPOP", "BRPOP", "BLMOVE"},
+	"blocking":    {"BLPOP", "BRPOP", "BLMOVE"},
+	"hash":        {"HSET", "HGET", "HDEL", "HGETALL", "HINCRBY"},
+	"set":         {"SADD", "SREM", "SMEMBERS", "SISMEMBER", "SINTER", "SUNION"},
+	"sortedset":   {"ZADD", "ZINCRBY", "ZRANGE", "ZRANGEBYSCORE", "ZRANK"},
+	"pubsub":      {"SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE", "PUBLISH"},
+	"transaction": {"MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH"},
+	"scripting":   {"EVAL", "EVALSHA", "SCRIPT"},
+	"connection":  {"PING", "ECHO", "SELECT", "AUTH", "ASKING"},
+	"admin":       {"SAVE", "BGSAVE", "LASTSAVE", "SHUTDOWN", "BGREWRITEAOF", "REPLICAOF", "SYNC", "REPLCONF", "ACL", "CLIENT", "CONFIG", "COMPACT", "INFO", "SLOWLOG", "MONITOR", "CLUSTER"},
+	"dangerous":   {"KEYS", "FLUSHDB", "FLUSHALL", "RESTORE", "MIGRATE", "SAVE", "BGSAVE", "SHUTDOWN", "BGREWRITEAOF", "REPLICAOF", "SYNC", "REPLCONF", "ACL", "CLIENT", "CONFIG", "COMPACT", "INFO", "SLOWLOG", "MONITOR", "CLUSTER"},
+}
+
+// categoryCommands returns the commands of a category, or false if there is
+// no such category.
+func categoryCommands(category string) ([]string, bool) {
+	var commands []string
+	switch category {
+	case "all", "read", "write":
+		for name, info := range commandTable {
+			write := info.flags&cmdWrite != 0
+			if category == "all" || (category == "write" && write) || (category == "read" && !write && info.firstKey != 0) {
+				commands = append(commands, name)
+			}
+		}
+		return commands, true
+	}
+	commands, ok := aclCategories[category]
+	return commands, ok
+}
+
+// User is an ACL user: who may log in with which password, and what the
+// connections authenticated as the user may run and touch.
+type User struct {
+	name      string
+	enabled   bool
+	noPass    bool
+	passwords map[string]struct{} // SHA-256 hashes in hex
+
+	commands     map[string]bool
+	commandRules []string // the rules that produced commands, for ACL LIST
+
+	allKeys     bool
+	keyPatterns []string
+
+	allDBs bool
+	dbs    map[int]bool
+}
+
+func newUser(name string) *User {
+	return &User{
+		name:      name,
+		passwords: make(map[string]struct{}),
+		commands:  make(map[string]bool),
+		allDBs:    true,
+		dbs:       make(map[int]bool),
+	}
+}
+
+func (u *User) clone() *User {
+	clone := *u
+	clone.passwords = make(map[string]struct{}, len(u.passwords))
+	for hash := range u.passwords {
+		clone.passwords[hash] = struct{}{}
+	}
+	clone.commands = make(map[string]bool, len(u.commands))
+	for name, allowed := range u.commands {
+		clone.commands[name] = allowed
+	}
+	clone.commandRules = append([]string(nil), u.commandRules...)
+	clone.keyPatterns = append([]string(nil), u.keyPatterns...)
+	clone.dbs = make(map[int]bool, len(u.dbs))
+	for db := range u.dbs {
+		clone.dbs[db] = true
+	}
+	return &clone
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkPassword compares hashes in constant time.
+func (u *User) checkPassword(password string) bool {
+	if u.noPass {
+		return true
+	}
+	hash := hashPassword(password)
+	matched := false
+	for stored := range u.passwords {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// applyRule changes the user according to one ACL SETUSER rule. Database
+// indexes must be below dbCount.
+func (u *User) applyRule(rule string, dbCount int) error {
+	lower := strings.ToLower(rule)
+	switch {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.noPass = true
+		u.passwords = make(map[string]struct{})
+	case lower == "resetpass":
+		u.noPass = false
+		u.passwords = make(map[string]struct{})
+	case strings.HasPrefix(rule, ">"):
+		u.passwords[hashPassword(rule[1:])] = struct{}{}
+		u.noPass = false
+	case strings.HasPrefix(rule, "<"):
+		delete(u.passwords, hashPassword(rule[1:]))
+	case strings.HasPrefix(rule, "#"):
+		if len(rule) != 65 {
+			return fmt.Errorf("the password hash must be exactly 64 characters")
+		}
+		u.passwords[strings.ToLower(rule[1:])] = struct{}{}
+		u.noPass = false
+	case lower == "allkeys":
+		u.allKeys, u.keyPatterns = true, nil
+	case lower == "resetkeys":
+		u.allKeys, u.keyPatterns = false, nil
+	case strings.HasPrefix(rule, "~"):
+		if rule == "~*" {
+			u.allKeys, u.keyPatterns = true, nil
+		} else if !u.allKeys {
+			u.keyPatterns = append(u.keyPatterns, rule[1:])
+		}
+	case lower == "alldbs":
+		u.allDBs, u.dbs = true, make(map[int]bool)
+	case lower == "resetdbs":
+		u.allDBs, u.dbs = false, make(map[int]bool)
+	case strings.HasPrefix(lower, "db="):
+		dbs := make(map[int]bool)
+		for _, field := range strings.Split(rule[3:], ",") {
+			n, err := strconv.Atoi(field)
+			if err != nil || n < 0 || n >= dbCount {
+				return fmt.Errorf("invalid database index %q", field)
+			}
+			dbs[n] = true
+		}
+		u.allDBs, u.dbs = false, dbs
+	case lower == "allcommands":
+		return u.applyRule("+@all", dbCount)
+	case lower == "nocommands":
+		return u.applyRule("-@all", dbCount)
+	case strings.HasPrefix(rule, "+") || strings.HasPrefix(rule, "-"):
+		allow := rule[0] == '+'
+		var commands []string
+		if strings.HasPrefix(lower[1:], "@") {
+			var ok bool
+			if commands, ok = categoryCommands(lower[2:]); !ok {
+				return fmt.Errorf("unknown command or category name in ACL")
+			}
+		} else {
+			name := strings.ToUpper(rule[1:])
+			if _, ok := commandTable[name]; !ok {
+				return fmt.Errorf("unknown command or category name in ACL")
+			}
+			commands = []string{name}
+		}
+		for _, name := range commands {
+			if allow {
+				u.commands[name] = true
+			} else {
+				delete(u.commands, name)
+			}
+		}
+		if lower[1:] == "@all" {
+			u.commandRules = nil
+		}
+		u.commandRules = append(u.commandRules, lower)
+	case lower == "reset":
+		*u = *newUser(u.name)
+	default:
+		return fmt.Errorf("syntax error")
+	}
+	return nil
+}
+
+// describe renders the user the way ACL LIST prints it.
+func (u *User) describe() string {
+	parts := []string{"user", u.name}
+	if u.enabled {
+		parts = append(parts, "on")
+	} else {
+		parts = append(parts, "off")
+	}
+	if u.noPass {
+		parts = append(parts, "nopass")
+	}
+	hashes := make([]string, 0, len(u.passwords))
+	for hash := range u.passwords {
+		hashes = append(hashes, "#"+hash)
+	}
+	sort.Strings(hashes)
+	parts = append(parts, hashes...)
+	if u.allKeys {
+		parts = append(parts, "~*")
+	} else if len(u.keyPatterns) == 0 {
+		parts = append(parts, "resetkeys")
+	}
+	for _, pattern := range u.keyPatterns {
+		parts = append(parts, "~"+pattern)
+	}
+	if u.allDBs {
+		parts = append(parts, "alldbs")
+	} else if len(u.dbs) == 0 {
+		parts = append(parts, "resetdbs")
+	} else {
+		dbs := make([]int, 0, len(u.dbs))
+		for db := range u.dbs {
+			dbs = append(dbs, db)
+		}
+		sort.Ints(dbs)
+		fields := make([]string, len(dbs))
+		for i, db := range dbs {
+			fields[i] = strconv.Itoa(db)
+		}
+		parts = append(parts, "db="+strings.Join(fields, ","))
+	}
+	// Rules start from no commands unless the first one sets all of them
+	if len(u.commandRules) == 0 || (u.commandRules[0] != "+@all" && u.commandRules[0] != "-@all") {
+		parts = append(parts, "-@all")
+	}
+	parts = append(parts, u.commandRules...)
+	return strings.Join(parts, " ")
+}
+
+func (u *User) canAccessDB(db int) bool {
+	return u.allDBs || u.dbs[db]
+}
+
+func (u *User) canAccessKey(key string) bool {
+	if u.allKeys {
+		return true
+	}
+	for _, pattern := range u.keyPatterns {
+		if globMatch(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL is the set of users. Users are changed in place so that connections
+// authenticated as them see the new permissions at once.
+type ACL struct {
+	mutex   sync.RWMutex
+	users   map[string]*User
+	dbCount int
+}
+
+// NewACL starts with a default user that needs no password and may run
+// everything, which is how a server without requirepass behaves.
+func NewACL(dbCount int) *ACL {
+	defaultUser := newUser(defaultUserName)
+	for _, rule := range []string{"on", "nopass", "~*", "+@all"} {
+		defaultUser.applyRule(rule, dbCount)
+	}
+	return &ACL{users: map[string]*User{defaultUserName: defaultUser}, dbCount: dbCount}
+}
+
+// setDefaultPassword is what requirepass does: the default user needs
+// password from now on, or no password at all when it is empty.
+func (acl *ACL) setDefaultPassword(password string) {
+	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
+	user := acl.users[defaultUserName]
+	user.applyRule("resetpass", acl.dbCount)
+	if password == "" {
+		user.applyRule("nopass", acl.dbCount)
+	} else {
+		user.applyRule(">"+password, acl.dbCount)
+	}
+}
+
+// defaultLogin returns the default user when new connections are logged in
+// as it without AUTH.
+func (acl *ACL) defaultLogin() *User {
+	acl.mutex.RLock()
+	defer acl.mutex.RUnlock()
+	user := acl.users[defaultUserName]
+	if user != nil && user.enabled && user.noPass {
+		return user
+	}
+	return nil
+}
+
+// authenticate returns the user if the password is right and it is enabled.
+func (acl *ACL) authenticate(name, password string) *User {
+	acl.mutex.RLock()
+	defer acl.mutex.RUnlock()
+	user := acl.users[name]
+	if user == nil || !user.enabled || !user.checkPassword(password) {
+		return nil
+	}
+	return user
+}
+
+// checkPermission returns a NOAUTH or NOPERM error if the client may not run
+// the command, and nil if it may.
+func (s *Server) checkPermission(c *Client, command string, args []string) Reply {
+	if c.master {
+		return nil
+	}
+	if c.user == nil {
+		if command == "AUTH" || command == "PING" {
+			return nil
+		}
+		return ErrorReply("NOAUTH Authentication required.")
+	}
+	if command == "AUTH" || (command == "ACL" && len(args) > 0 && strings.EqualFold(args[0], "WHOAMI")) {
+		return nil
+	}
+	info, known := commandTable[command]
+	if !known {
+		return nil
+	}
+	acl := s.acl
+	acl.mutex.RLock()
+	defer acl.mutex.RUnlock()
+	user := c.user
+	if !user.commands[command] {
+		return ErrorReply(fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command", user.name, strings.ToLower(command)))
+	}
+	if (command == "SELECT" || command == "MOVE") && len(args) > 0 {
+		if n, err := strconv.Atoi(args[len(args)-1]); err == nil && !user.canAccessDB(n) {
+			return ErrorReply(fmt.Sprintf("NOPERM No permissions to access database %d", n))
+		}
+	}
+	if command == "FLUSHALL" && !user.allDBs {
+		return ErrorReply("NOPERM No permissions to access every database")
+	}
+	if info.flags&cmdNoKeyspace == 0 && !user.canAccessDB(c.dbIndex) {
+		return ErrorReply(fmt.Sprintf("NOPERM No permissions to access database %d", c.dbIndex))
+	}
+	for _, key := range commandKeys(command, args) {
+		if !user.canAccessKey(key) {
+			return ErrorReply("NOPERM No permissions to access a key")
+		}
+	}
+	return nil
+}
+
+// authCommand implements AUTH [username] password.
+func (s *Server) authCommand(c *Client, args []string) Reply {
+	var name, password string
+	switch len(args) {
+	case 1:
+		name, password = defaultUserName, args[0]
+		if s.acl.defaultLogin() != nil {
+			return ErrorReply("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		}
+	case 2:
+		name, password = args[0], args[1]
+	default:
+		return ErrorReply("ERR wrong number of arguments for 'auth' command")
+	}
+	user := s.acl.authenticate(name, password)
+	if user == nil {
+		return ErrorReply("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	c.user = user
+	return okReply
+}
+
+// aclCommand implements ACL SETUSER, ACL LIST and ACL WHOAMI.
+func (s *Server) aclCommand(c *Client, args []string) Reply {
+	if len(args) == 0 {
+		return ErrorReply("ERR wrong number of arguments for 'acl' command")
+	}
+	acl := s.acl
+	switch strings.ToUpper(args[0]) {
+	case "WHOAMI":
+		if len(args) != 1 {
+			return ErrorReply("ERR wrong number of arguments for 'acl|whoami' command")
+		}
+		if c.user == nil {
+			return BulkString(defaultUserName)
+		}
+		return BulkString(c.user.name)
+	case "LIST":
+		if len(args) != 1 {
+			return ErrorReply("ERR wrong number of arguments for 'acl|list' command")
+		}
+		acl.mutex.RLock()
+		defer acl.mutex.RUnlock()
+		names := make([]string, 0, len(acl.users))
+		for name := range acl.users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		lines := make(Array, len(names))
+		for i, name := range names {
+			lines[i] = BulkString(acl.users[name].describe())
+		}
+		return lines
+	case "SETUSER":
+		if len(args) < 2 {
+			return ErrorReply("ERR wrong number of arguments for 'acl|setuser' command")
+		}
+		acl.mutex.Lock()
+		defer acl.mutex.Unlock()
+		user, exists := acl.users[args[1]]
+		// Rules are applied to a copy so a bad rule leaves the user untouched
+		updated := newUser(args[1])
+		if exists {
+			updated = user.clone()
+		}
+		for _, rule := range args[2:] {
+			if err := updated.applyRule(rule, acl.dbCount); err != nil {
+				return ErrorReply(fmt.Sprintf("ERR Error in ACL SETUSER modifier '%s': %v", rule, err))
+			}
+		}
+		if exists {
+			*user = *updated
+		} else {
+			acl.users[args[1]] = updated
+		}
+		return okReply
+	}
+	return ErrorReply(fmt.Sprintf("ERR unknown subcommand '%s'. Try ACL HELP.", args[0]))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func startServerWithPassword(t *testing.T, password string) (*Server, string) {
+	t.Helper()
+	srv := NewServer()
+	srv.acl.setDefaultPassword(password)
+	return srv, serveOnFreePort(t, srv)
+}
+
+func TestRequirePass(t *testing.T) {
+	_, addr := startServerWithPassword(t, "secret")
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("GET", "key"), ErrorReply("NOAUTH Authentication required."))
+	expectReply(t, c.do("PING"), SimpleString("PONG"))
+	expectReply(t, c.do("AUTH", "wrong"), ErrorReply("WRONGPASS invalid username-password pair or user is disabled."))
+	expectReply(t, c.do("SET", "key", "value"), ErrorReply("NOAUTH Authentication required."))
+	expectReply(t, c.do("AUTH", "secret"), SimpleString("OK"))
+	expectReply(t, c.do("SET", "key", "value"), SimpleString("OK"))
+	expectReply(t, c.do("ACL", "WHOAMI"), BulkString("default"))
+
+	other := dialTestServer(t, addr)
+	expectReply(t, other.do("AUTH", "default", "secret"), SimpleString("OK"))
+	expectReply(t, other.do("GET", "key"), BulkString("value"))
+}
+
+func TestAuthWithoutPassword(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("AUTH", "anything"), ErrorReply("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"))
+	expectReply(t, c.do("AUTH", "nobody", "anything"), ErrorReply("WRONGPASS invalid username-password pair or user is disabled."))
+	expectReply(t, c.do("ACL", "LIST"), Array{BulkString("user default on nopass ~* alldbs +@all")})
+}
+
+func TestACLUserPermissions(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	admin := dialTestServer(t, addr)
+
+	expectReply(t, admin.do("ACL", "SETUSER", "reader", "on", ">pw", "~cache:*", "db=0,2", "+@read", "+@connection", "-select"), SimpleString("OK"))
+	expectReply(t, admin.do("SET", "cache:a", "1"), SimpleString("OK"))
+
+	c := dialTestServer(t, addr)
+	expectReply(t, c.do("AUTH", "reader", "nope"), ErrorReply("WRONGPASS invalid username-password pair or user is disabled."))
+	expectReply(t, c.do("AUTH", "reader", "pw"), SimpleString("OK"))
+	expectReply(t, c.do("ACL", "WHOAMI"), BulkString("reader"))
+	expectReply(t, c.do("GET", "cache:a"), BulkString("1"))
+	expectReply(t, c.do("GET", "secret"), ErrorReply("NOPERM No permissions to access a key"))
+	expectReply(t, c.do("SET", "cache:a", "2"), ErrorReply("NOPERM User reader has no permissions to run the 'set' command"))
+	expectReply(t, c.do("SELECT", "2"), ErrorReply("NOPERM User reader has no permissions to run the 'select' command"))
+	expectReply(t, c.do("ACL", "LIST"), ErrorReply("NOPERM User reader has no permissions to run the 'acl' command"))
+
+	// Changes apply to connections already authenticated as the user
+	expectReply(t, admin.do("ACL", "SETUSER", "reader", "+select", "+set"), SimpleString("OK"))
+	expectReply(t, c.do("SELECT", "1"), ErrorReply("NOPERM No permissions to access database 1"))
+	expectReply(t, c.do("SELECT", "2"), SimpleString("OK"))
+	expectReply(t, c.do("SET", "cache:b", "2"), SimpleString("OK"))
+
+	// The user stays selected on an allowed database even if it loses access
+	expectReply(t, admin.do("ACL", "SETUSER", "reader", "db=0"), SimpleString("OK"))
+	expectReply(t, c.do("GET", "cache:b"), ErrorReply("NOPERM No permissions to access database 2"))
+
+	expectReply(t, admin.do("ACL", "SETUSER", "reader", "off"), SimpleString("OK"))
+	other := dialTestServer(t, addr)
+	expectReply(t, other.do("AUTH", "reader", "pw"), ErrorReply("WRONGPASS invalid username-password pair or user is disabled."))
+}
+
+func TestACLSetUserErrors(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("ACL", "SETUSER", "bob", "on", "nopass", "~*", "+get"), SimpleString("OK"))
+	expectReply(t, c.do("ACL", "SETUSER", "bob", "+set", "+nosuchcommand"), ErrorReply("ERR Error in ACL SETUSER modifier '+nosuchcommand': unknown command or category name in ACL"))
+	expectReply(t, c.do("ACL", "SETUSER", "bob", "db=99"), ErrorReply(`ERR Error in ACL SETUSER modifier 'db=99': invalid database index "99"`))
+	expectReply(t, c.do("ACL", "SETUSER", "bob", "sideways"), ErrorReply("ERR Error in ACL SETUSER modifier 'sideways': syntax error"))
+
+	// A failed SETUSER leaves the user as it was
+	expectReply(t, c.do("ACL", "LIST"), Array{
+		BulkString("user bob on nopass ~* alldbs -@all +get"),
+		BulkString("user default on nopass ~* alldbs +@all"),
+	})
+	expectReply(t, c.do("ACL", "SETUSER", "bob", "reset"), SimpleString("OK"))
+	expectReply(t, c.do("ACL", "LIST"), Array{
+		BulkString("user bob off resetkeys alldbs -@all"),
+		BulkString("user default on nopass ~* alldbs +@all"),
+	})
+	expectReply(t, c.do("ACL", "NOPE"), ErrorReply("ERR unknown subcommand 'NOPE'. Try ACL HELP."))
+}
+
+func TestReplicaAuthenticatesWithLeader(t *testing.T) {
+	_, leaderAddr := startServerWithPassword(t, "secret")
+	follower, followerAddr := startServerOnFreePort(t)
+	t.Cleanup(follower.stopReplication)
+	follower.replication.masterAuth = "secret"
+	leader, replica := dialTestServer(t, leaderAddr), dialTestServer(t, followerAddr)
+
+	leader.do("AUTH", "secret")
+	leader.do("SET", "key", "value")
+	host, port, _ := net.SplitHostPort(leaderAddr)
+	expectReply(t, replica.do("REPLICAOF", host, port), okReply)
+	waitForReply(t, replica, BulkString("value"), "GET", "key")
+}
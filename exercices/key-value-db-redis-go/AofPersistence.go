@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fsyncAlways   = "always"
+	fsyncEverySec = "everysec"
+	fsyncNo       = "no"
+)
+
+// AppendOnlyFile logs every write command as a RESP array so the dataset can
+// be rebuilt by replaying it. SELECT is written whenever the database changes.
+type AppendOnlyFile struct {
+	path      string
+	fsync     string
+	mutex     sync.Mutex
+	file      *os.File
+	writer    *bufio.Writer
+	currentDB int
+
+	// While a rewrite runs, writes are also collected here and appended to
+	// the rewritten file before it replaces the current one.
+	rewriting  bool
+	rewriteBuf *bytes.Buffer
+	rewriteDB  int
+
+	lastRewriteFailed bool
+
+	stop chan struct{}
+}
+
+func validFsyncPolicy(policy string) bool {
+	return policy == fsyncAlways || policy == fsyncEverySec || policy == fsyncNo
+}
+
+func openAppendOnlyFile(path, fsync string) (*AppendOnlyFile, error) {
+	if !validFsyncPolicy(fsync) {
+		return nil, fmt.Errorf("invalid appendfsync policy %q", fsync)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	aof := &AppendOnlyFile{
+		path:      path,
+		fsync:     fsync,
+		file:      file,
+		writer:    bufio.NewWriter(file),
+		currentDB: -1,
+		stop:      make(chan struct{}),
+	}
+	if fsync == fsyncEverySec {
+		go aof.syncEverySecond()
+	}
+	return aof, nil
+}
+
+// append logs one command executed against dbIndex. The command reaches the
+// operating system before append returns; whether it also reaches the disk
+// depends on the fsync policy.
+func (aof *AppendOnlyFile) append(dbIndex int, args []string) {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+	if aof.currentDB != dbIndex {
+		writeCommand(aof.writer, []string{"SELECT", strconv.Itoa(dbIndex)})
+		aof.currentDB = dbIndex
+	}
+	writeCommand(aof.writer, args)
+	if aof.rewriting {
+		w := bufio.NewWriter(aof.rewriteBuf)
+		if aof.rewriteDB != dbIndex {
+			writeCommand(w, []string{"SELECT", strconv.Itoa(dbIndex)})
+			aof.rewriteDB = dbIndex
+		}
+		writeCommand(w, args)
+		w.Flush()
+	}
+	if err := aof.writer.Flush(); err != nil {
+		log.Println("Error writing append only file:", err)
+		return
+	}
+	if aof.fsync == fsyncAlways {
+		if err := aof.file.Sync(); err != nil {
+			log.Println("Error syncing append only file:", err)
+		}
+	}
+}
+
+func (aof *AppendOnlyFile) syncEverySecond() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			aof.mutex.Lock()
+			aof.writer.Flush()
+			aof.file.Sync()
+			aof.mutex.Unlock()
+		case <-aof.stop:
+			return
+		}
+	}
+}
+
+// close flushes and syncs the log regardless of the fsync policy.
+func (aof *AppendOnlyFile) close() error {
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+	select {
+	case <-aof.stop:
+		return nil
+	default:
+		close(aof.stop)
+	}
+	if err := aof.writer.Flush(); err != nil {
+		return err
+	}
+	if err := aof.file.Sync(); err != nil {
+		return err
+	}
+	return aof.file.Close()
+}
+
+// enableAOF replays an existing log into the server and then starts
+// appending every write command to it.
+func (s *Server) enableAOF(path, fsync string) error {
+	if err := s.loadAOF(path); err != nil {
+		return err
+	}
+	aof, err := openAppendOnlyFile(path, fsync)
+	if err != nil {
+		return err
+	}
+	s.aof = aof
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// loadAOF executes every command of the log at path. A log that ends in the
+// middle of a command or of a MULTI/EXEC block, as left behind by a crash, is
+// truncated to the last complete command.
+func (s *Server) loadAOF(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	counter := &countingReader{r: file}
+	buffered := bufio.NewReader(counter)
+	reader := NewRespReader(buffered)
+	loader := &Client{master: true}
+	var validUpTo, multiStart int64
+	commands := 0
+	for {
+		args, _, err := reader.ReadCommand()
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Println("Append only file is truncated, discarding the incomplete command")
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("bad append only file %s at offset %d: %v", path, validUpTo, err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+		command := strings.ToUpper(args[0])
+		if command == "MULTI" {
+			multiStart = validUpTo
+		}
+		if reply, ok := s.executeCommand(loader, command, args[1:]).(ErrorReply); ok {
+			return fmt.Errorf("bad append only file %s: %s failed: %s", path, command, reply)
+		}
+		validUpTo = counter.n - int64(buffered.Buffered())
+		commands++
+	}
+	if loader.inMulti {
+		log.Println("Append only file ends inside MULTI, discarding the unfinished transaction")
+		validUpTo = multiStart
+	}
+	if info, err := file.Stat(); err == nil && info.Size() > validUpTo {
+		if err := os.Truncate(path, validUpTo); err != nil {
+			return err
+		}
+	}
+	log.Printf("Loaded %d commands from the append only file %s", commands, path)
+	return nil
+}
+
+// propagate records a write command that changed the dataset and streams
+// it to the replicas.
+func (s *Server) propagate(dbIndex int, args []string) {
+	if s.aof != nil {
+		s.aof.append(dbIndex, args)
+	}
+	s.feedReplicas(dbIndex, args)
+}
+
+// propagatedForm turns a command into one that has the same effect when it is
+// replayed later: relative expiry times become absolute deadlines, blocking
+// pops become the pop they ended with, and float increments the value they
+// produced, which replays without rounding differences.
+func propagatedForm(db *Database, command string, args []string, reply Reply) []string {
+	switch command {
+	case "BLPOP", "BRPOP":
+		// The reply is the key that was popped and its element
+		return []string{command[1:], string(reply.(Array)[0].(BulkString))}
+	case "BLMOVE":
+		return []string{"LMOVE", args[0], args[1], args[2], args[3]}
+	case "INCRBYFLOAT":
+		return []string{"SET", args[0], string(reply.(BulkString)), "KEEPTTL"}
+	case "SET":
+		argv := []string{"SET", args[0], args[1]}
+		if deadline, ok := db.deadline(args[0]); ok {
+			argv = append(argv, "PXAT", strconv.FormatInt(deadline, 10))
+		}
+		return argv
+	case "EXPIRE", "PEXPIRE", "EXPIREAT":
+		if deadline, ok := db.deadline(args[0]); ok {
+			return []string{"PEXPIREAT", args[0], strconv.FormatInt(deadline, 10)}
+		}
+		return []string{"DEL", args[0]}
+	case "RESTORE":
+		deadline, _ := db.deadline(args[0])
+		return []string{"RESTORE", args[0], strconv.FormatInt(deadline, 10), args[2], "REPLACE", "ABSTTL"}
+	}
+	return append([]string{command}, args...)
+}
+
+// rewriteAOF writes the current dataset as a compact log next to the current
+// one and atomically renames it into place. Writes that happen meanwhile are
+// buffered and appended to the new log before the swap.
+func (s *Server) rewriteAOF() error {
+	dbCommands, err := s.beginAOFRewrite()
+	if err != nil {
+		return err
+	}
+	return s.finishAOFRewrite(dbCommands)
+}
+
+func (s *Server) finishAOFRewrite(dbCommands [][][]string) error {
+	if err := s.aof.writeRewrite(dbCommands); err != nil {
+		s.aof.mutex.Lock()
+		s.aof.rewriting = false
+		s.aof.rewriteBuf = nil
+		s.aof.lastRewriteFailed = true
+		s.aof.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// beginAOFRewrite captures the dataset and starts buffering writes, both
+// while every database is locked so no write is lost or logged twice.
+func (s *Server) beginAOFRewrite() ([][][]string, error) {
+	aof := s.aof
+	if aof == nil {
+		return nil, errors.New("ERR AOF is not enabled")
+	}
+	s.lockAll()
+	defer s.unlockAll()
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+	if aof.rewriting {
+		return nil, errors.New("ERR Background append only file rewriting already in progress")
+	}
+	aof.rewriting = true
+	aof.rewriteBuf = &bytes.Buffer{}
+	aof.rewriteDB = -1
+	dbCommands := make([][][]string, len(s.databases))
+	for i, db := range s.databases {
+		dbCommands[i] = db.compactCommands()
+	}
+	return dbCommands, nil
+}
+
+func (aof *AppendOnlyFile) writeRewrite(dbCommands [][][]string) error {
+	tmpPath := aof.path + ".rewrite.tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	lastDB := -1
+	for i, commands := range dbCommands {
+		if len(commands) == 0 {
+			continue
+		}
+		writeCommand(w, []string{"SELECT", strconv.Itoa(i)})
+		lastDB = i
+		for _, args := range commands {
+			writeCommand(w, args)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	aof.mutex.Lock()
+	defer aof.mutex.Unlock()
+	// The buffered writes start with their own SELECT, so it does not matter
+	// which database the compacted part ended in.
+	if _, err := tmp.Write(aof.rewriteBuf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if aof.rewriteDB != -1 {
+		lastDB = aof.rewriteDB
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmpPath, aof.path); err != nil {
+		tmp.Close()
+		return err
+	}
+	aof.writer.Flush()
+	aof.file.Close()
+	aof.file = tmp
+	aof.writer = bufio.NewWriter(tmp)
+	aof.currentDB = lastDB
+	aof.rewriting = false
+	aof.rewriteBuf = nil
+	aof.lastRewriteFailed = false
+	return nil
+}
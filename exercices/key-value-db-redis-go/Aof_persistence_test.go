@@ -0,0 +1,197 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startServerWithAOF(t *testing.T, path string) (*Server, *testClient) {
+	t.Helper()
+	srv := NewServer()
+	if err := srv.enableAOF(path, fsyncAlways); err != nil {
+		t.Fatalf("Failed to enable AOF: %v", err)
+	}
+	t.Cleanup(func() { srv.aof.close() })
+	return srv, dialTestServer(t, serveOnFreePort(t, srv))
+}
+
+func TestAOFReplaysWritesOnStartup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	srv, c := startServerWithAOF(t, path)
+
+	c.do("SET", "name", "John")
+	c.do("INCR", "counter")
+	c.do("INCR", "counter")
+	c.do("SET", "session", "abc", "EX", "100")
+	c.do("SELECT", "5")
+	c.do("SET", "name", "in five")
+	c.do("DEL", "missing")
+	c.do("GET", "name")
+	c.do("MULTI")
+	c.do("INCR", "tx")
+	c.do("SELECT", "0")
+	c.do("SET", "flag", "on")
+	c.do("EXEC")
+	srv.aof.close()
+
+	content, _ := os.ReadFile(path)
+	if strings.Contains(string(content), "GET") || strings.Contains(string(content), "missing") {
+		t.Errorf("Reads and no-op writes should not be logged:\n%q", content)
+	}
+	if !strings.Contains(string(content), "PXAT") {
+		t.Errorf("Relative expiry should be logged as an absolute deadline:\n%q", content)
+	}
+
+	_, c2 := startServerWithAOF(t, path)
+	expectReply(t, c2.do("GET", "name"), BulkString("John"))
+	expectReply(t, c2.do("GET", "counter"), BulkString("2"))
+	expectReply(t, c2.do("GET", "flag"), BulkString("on"))
+	if ttl, ok := c2.do("TTL", "session").(Integer); !ok || ttl < 99 || ttl > 100 {
+		t.Errorf("Expected the session TTL to survive a restart, got %v", ttl)
+	}
+	c2.do("SELECT", "5")
+	expectReply(t, c2.do("GET", "name"), BulkString("in five"))
+	expectReply(t, c2.do("GET", "tx"), BulkString("1"))
+}
+
+func TestAOFLogsExpireAsAbsoluteDeadline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	srv, c := startServerWithAOF(t, path)
+
+	c.do("SET", "k", "v")
+	c.do("EXPIRE", "k", "100")
+	c.do("SET", "gone", "v")
+	c.do("EXPIRE", "gone", "0")
+	srv.aof.close()
+
+	content, _ := os.ReadFile(path)
+	if !strings.Contains(string(content), "PEXPIREAT") || !strings.Contains(string(content), "$3\r\nDEL\r\n$4\r\ngone") {
+		t.Errorf("Unexpected log contents:\n%q", content)
+	}
+}
+
+func TestAOFTruncatesIncompleteTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	complete := encodeCommand("SET", "a", "1") + encodeCommand("SET", "b", "2")
+	unfinishedTx := encodeCommand("MULTI") + encodeCommand("SET", "c", "3")
+	partial := "*3\r\n$3\r\nSET\r\n$1\r\nd"
+	os.WriteFile(path, []byte(complete+unfinishedTx+partial), 0644)
+
+	_, c := startServerWithAOF(t, path)
+	expectReply(t, c.do("GET", "b"), BulkString("2"))
+	expectReply(t, c.do("GET", "c"), NullBulk{})
+	expectReply(t, c.do("GET", "d"), NullBulk{})
+
+	content, _ := os.ReadFile(path)
+	if !strings.HasPrefix(string(content), complete) || strings.Contains(string(content), "MULTI") {
+		t.Errorf("Expected the log to be truncated after the last complete command, got:\n%q", content)
+	}
+}
+
+func TestAOFRejectsCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	os.WriteFile(path, []byte(encodeCommand("SET", "a", "1")+"*2\r\n:1\r\n"), 0644)
+	if err := NewServer().enableAOF(path, fsyncNo); err == nil {
+		t.Error("Expected an error for a corrupt append only file")
+	}
+	if err := NewServer().enableAOF(filepath.Join(t.TempDir(), "x.aof"), "sometimes"); err == nil {
+		t.Error("Expected an error for an unknown fsync policy")
+	}
+}
+
+func TestAOFRewriteCompactsLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	srv, c := startServerWithAOF(t, path)
+
+	for i := 0; i < 100; i++ {
+		c.do("INCR", "counter")
+	}
+	c.do("SELECT", "2")
+	c.do("SET", "other", "value with spaces")
+	before, _ := os.Stat(path)
+
+	if err := srv.rewriteAOF(); err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Errorf("Expected the rewritten log to be smaller: %d >= %d", after.Size(), before.Size())
+	}
+
+	// Writes after the swap go to the new file and keep their database
+	c.do("SET", "later", "x")
+	c.do("SELECT", "0")
+	c.do("INCR", "counter")
+	srv.aof.close()
+
+	_, c2 := startServerWithAOF(t, path)
+	expectReply(t, c2.do("GET", "counter"), BulkString("101"))
+	c2.do("SELECT", "2")
+	expectReply(t, c2.do("GET", "other"), BulkString("value with spaces"))
+	expectReply(t, c2.do("GET", "later"), BulkString("x"))
+}
+
+func TestAOFRewriteKeepsConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	srv, c := startServerWithAOF(t, path)
+	c.do("SET", "before", "1")
+
+	dbCommands, err := srv.beginAOFRewrite()
+	if err != nil {
+		t.Fatalf("Failed to start rewrite: %v", err)
+	}
+	expectReply(t, c.do("BGREWRITEAOF"), ErrorReply("ERR Background append only file rewriting already in progress"))
+	for i := 0; i < 50; i++ {
+		c.do("INCR", "during")
+	}
+	c.do("SELECT", "1")
+	c.do("SET", "other-db", "x")
+	if err := srv.aof.writeRewrite(dbCommands); err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+	c.do("SET", "after", "y")
+	srv.aof.close()
+
+	content, _ := os.ReadFile(path)
+	if strings.Count(string(content), "before") != 1 {
+		t.Errorf("Expected the rewritten log to hold the key once:\n%q", content)
+	}
+	_, c2 := startServerWithAOF(t, path)
+	expectReply(t, c2.do("GET", "before"), BulkString("1"))
+	expectReply(t, c2.do("GET", "during"), BulkString("50"))
+	c2.do("SELECT", "1")
+	expectReply(t, c2.do("GET", "other-db"), BulkString("x"))
+	expectReply(t, c2.do("GET", "after"), BulkString("y"))
+}
+
+func TestBGREWRITEAOF(t *testing.T) {
+	_, plain := startServerOnFreePort(t)
+	expectReply(t, dialTestServer(t, plain).do("BGREWRITEAOF"), ErrorReply("ERR AOF is not enabled"))
+
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	srv, c := startServerWithAOF(t, path)
+	for i := 0; i < 20; i++ {
+		c.do("INCR", "counter")
+	}
+	expectReply(t, c.do("BGREWRITEAOF"), SimpleString("Background append only file rewriting started"))
+	for i := 0; i < 100; i++ {
+		srv.aof.mutex.Lock()
+		rewriting := srv.aof.rewriting
+		srv.aof.mutex.Unlock()
+		if !rewriting {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	content, _ := os.ReadFile(path)
+	if strings.Count(string(content), "INCR") != 0 {
+		t.Errorf("Expected the rewritten log to replace the INCRs with a SET:\n%q", content)
+	}
+
+	c.do("MULTI")
+	expectReply(t, c.do("BGREWRITEAOF"), ErrorReply("ERR Command not allowed inside a transaction"))
+	c.do("DISCARD")
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// blockedClient is a client waiting in BLPOP, BRPOP or BLMOVE for a list to
+// appear at one of its keys. It sits in the queue of each key, and pushes
+// wake the oldest waiters first, see wakeBlocked.
+type blockedClient struct {
+	db       *Database
+	keys     []string
+	deadline time.Time   // zero to wait forever
+	woken    atomic.Bool // a push was handed to it and it has not run again yet
+	wake     chan struct{}
+}
+
+// blockingCommand implements BLPOP, BRPOP and BLMOVE. When the keys hold no
+// list, a client that can wait is queued on them and nil is returned, and the
+// connection then waits in waitBlocked. Inside MULTI or a script the command
+// does not block and replies as if it timed out.
+func (s *Server) blockingCommand(c *Client, db *Database, command string, args []string) Reply {
+	name := strings.ToLower(command)
+	if (command == "BLMOVE" && len(args) != 5) || len(args) < 2 {
+		return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+	}
+	timeout, errReply := parseBlockTimeout(args[len(args)-1])
+	if errReply != nil {
+		return errReply
+	}
+	keys := args[:len(args)-1]
+	if command == "BLMOVE" {
+		keys = args[:1]
+		if reply := listMove(db, args[0], args[1], strings.ToUpper(args[2]), strings.ToUpper(args[3])); reply != (NullBulk{}) {
+			return reply
+		}
+	} else {
+		for _, key := range keys {
+			list, exists, errReply := lookupAs[*ListValue](db, key)
+			if errReply != nil {
+				return errReply
+			}
+			if !exists {
+				continue
+			}
+			var value string
+			if command == "BLPOP" {
+				value = list.popFront()
+			} else {
+				value = list.popBack()
+			}
+			if list.len() == 0 {
+				db.deleteKey(key)
+			} else {
+				db.touch(key)
+			}
+			return Array{BulkString(key), BulkString(value)}
+		}
+	}
+	if !c.mayBlock() {
+		return blockTimeoutReply(command)
+	}
+	s.block(c, db, keys, timeout)
+	return nil
+}
+
+// parseBlockTimeout parses a timeout in seconds, where 0 means forever.
+func parseBlockTimeout(arg string) (time.Duration, Reply) {
+	seconds, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds > math.MaxInt64/float64(time.Second) {
+		return 0, ErrorReply("ERR timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return 0, ErrorReply("ERR timeout is negative")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func blockTimeoutReply(command string) Reply {
+	if command == "BLMOVE" {
+		return NullBulk{}
+	}
+	return NullArray{}
+}
+
+// mayBlock reports whether c is a connection that can wait for a push.
+// Transactions, scripts and the leader of a replica must not stall.
+func (c *Client) mayBlock() bool {
+	return c.conn != nil && !c.inExec && !c.inScript && !c.master
+}
+
+// block queues c on keys of db, whose shards the caller holds the write
+// locks of. A client that was woken but lost the race for the element keeps
+// its place in the queues.
+func (s *Server) block(c *Client, db *Database, keys []string, timeout time.Duration) {
+	if b := c.blocked; b != nil {
+		b.woken.Store(false)
+		return
+	}
+	b := &blockedClient{db: db, wake: make(chan struct{}, 1)}
+	if timeout > 0 {
+		b.deadline = time.Now().Add(timeout)
+	}
+	for _, key := range keys {
+		if slices.Contains(b.keys, key) {
+			continue
+		}
+		b.keys = append(b.keys, key)
+		sh := db.shardOf(key)
+		sh.blocked[key] = append(sh.blocked[key], b)
+	}
+	c.blocked = b
+	s.blockedClients.Add(1)
+}
+
+// wakeBlocked wakes the oldest client waiting for key if it holds a list.
+// Only one waiter of a key is awake at a time, and its pop touches the key
+// again to wake the next one, so clients are served in the order they
+// blocked. Caller holds the write lock of the key's shard.
+func (db *Database) wakeBlocked(key string) {
+	sh := db.shardOf(key)
+	queue := sh.blocked[key]
+	if len(queue) == 0 {
+		return
+	}
+	if _, ok := sh.data[key].(*ListValue); !ok {
+		return
+	}
+	if b := queue[0]; b.woken.CompareAndSwap(false, true) {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// unblock removes c from the queues it waits in. Elements it was woken for
+// and did not take go to the next waiters. It must not be called while
+// holding a shard lock.
+func (s *Server) unblock(c *Client) {
+	b := c.blocked
+	if b == nil {
+		return
+	}
+	c.blocked = nil
+	s.blockedClients.Add(-1)
+	for _, key := range b.keys {
+		sh := b.db.shardOf(key)
+		sh.mutex.Lock()
+		queue := slices.DeleteFunc(sh.blocked[key], func(other *blockedClient) bool { return other == b })
+		if len(queue) == 0 {
+			delete(sh.blocked, key)
+		} else {
+			sh.blocked[key] = queue
+		}
+		if b.woken.Load() {
+			b.db.wakeBlocked(key)
+		}
+		sh.mutex.Unlock()
+	}
+}
+
+// waitBlocked waits until the blocked command of c can run or times out, and
+// returns its reply. It reports false if the client disconnected or was
+// killed, or the server shuts down, while waiting.
+func (s *Server) waitBlocked(c *Client, reader *RespReader, command string, args []string) (Reply, bool) {
+	defer s.unblock(c)
+	c.flush()
+	b := c.blocked
+	var expired <-chan time.Time
+	if !b.deadline.IsZero() {
+		timer := time.NewTimer(time.Until(b.deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	// Nothing is read while blocked, but a pending read of one byte more than
+	// is buffered notices the client leaving. The commands it sent meanwhile
+	// stay buffered for later. Once the buffer is full the client is polled
+	// instead.
+	closed, watching := make(chan error, 1), false
+	watch := func() {
+		n := reader.Buffered() + 1
+		if n > ioBufferSize {
+			watching = false
+			return
+		}
+		watching = true
+		c.conn.SetReadDeadline(time.Time{})
+		go func() { closed <- reader.Peek(n) }()
+	}
+	stopWatching := func() {
+		if watching {
+			c.conn.SetReadDeadline(time.Now())
+			<-closed
+		}
+	}
+	watch()
+	poll := time.NewTicker(100 * time.Millisecond)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-b.wake:
+			// A nil reply means another client took the element first
+			if reply := s.call(c, command, args); reply != nil {
+				stopWatching()
+				return reply, true
+			}
+		case <-expired:
+			stopWatching()
+			return blockTimeoutReply(command), true
+		case err := <-closed:
+			if err != nil {
+				return nil, false
+			}
+			watch()
+		case <-poll.C:
+			if !watching && (c.killed.Load() || s.draining.Load()) {
+				return nil, false
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (c *testClient) send(args ...string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(encodeCommand(args...))); err != nil {
+		c.t.Fatalf("Failed to send %q: %v", args, err)
+	}
+}
+
+// waitForBlocked waits until n clients are blocked.
+func waitForBlocked(t *testing.T, c *testClient, n string) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if infoField(t, c, "clients", "blocked_clients") == n {
+			return
+		}
+	}
+	t.Fatalf("Expected %s blocked clients, got %s", n, infoField(t, c, "clients", "blocked_clients"))
+}
+
+func TestBlockingPops(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+	worker := dialTestServer(t, addr)
+
+	// Lists that exist are popped at once, in the order of the keys
+	c.do("RPUSH", "b", "1", "2")
+	expectReply(t, c.do("BLPOP", "a", "b", "0"), Array{BulkString("b"), BulkString("1")})
+	expectReply(t, c.do("BRPOP", "a", "b", "0"), Array{BulkString("b"), BulkString("2")})
+	expectReply(t, c.do("EXISTS", "b"), Integer(0))
+
+	worker.send("BLPOP", "a", "b", "0")
+	waitForBlocked(t, c, "1")
+	expectReply(t, c.do("RPUSH", "b", "job"), Integer(1))
+	expectReply(t, worker.receive(), Array{BulkString("b"), BulkString("job")})
+	expectReply(t, c.do("LLEN", "b"), Integer(0))
+	waitForBlocked(t, c, "0")
+
+	start := time.Now()
+	expectReply(t, worker.do("BRPOP", "a", "0.1"), NullArray{})
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected BRPOP to wait for its timeout, returned after %v", elapsed)
+	}
+	// The blocked client still answers its next commands
+	expectReply(t, worker.do("PING"), SimpleString("PONG"))
+
+	c.do("SET", "s", "v")
+	expectReply(t, c.do("BLPOP", "s", "0"), ErrorReply("WRONGTYPE Operation against a key holding the wrong kind of value"))
+	expectReply(t, c.do("BLPOP", "a", "-1"), ErrorReply("ERR timeout is negative"))
+	expectReply(t, c.do("BLPOP", "a", "soon"), ErrorReply("ERR timeout is not a float or out of range"))
+	expectReply(t, c.do("BLPOP", "a"), ErrorReply("ERR wrong number of arguments for 'blpop' command"))
+}
+
+func TestBlockedClientsAreServedInOrder(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+	workers := make([]*testClient, 3)
+	for i := range workers {
+		workers[i] = dialTestServer(t, addr)
+		workers[i].send("BLPOP", "jobs", "other", "0")
+		waitForBlocked(t, c, string(rune('1'+i)))
+	}
+
+	c.do("RPUSH", "jobs", "j1", "j2")
+	expectReply(t, workers[0].receive(), Array{BulkString("jobs"), BulkString("j1")})
+	expectReply(t, workers[1].receive(), Array{BulkString("jobs"), BulkString("j2")})
+	waitForBlocked(t, c, "1")
+	c.do("LPUSH", "other", "j3")
+	expectReply(t, workers[2].receive(), Array{BulkString("other"), BulkString("j3")})
+}
+
+func TestBlockingMove(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+	worker := dialTestServer(t, addr)
+
+	c.do("RPUSH", "src", "a", "b")
+	expectReply(t, c.do("LMOVE", "src", "dst", "LEFT", "RIGHT"), BulkString("a"))
+	expectReply(t, c.do("LMOVE", "src", "src", "right", "left"), BulkString("b"))
+	expectReply(t, c.do("LMOVE", "src", "dst", "UP", "LEFT"), ErrorReply("ERR syntax error"))
+	expectReply(t, c.do("LMOVE", "missing", "dst", "LEFT", "LEFT"), NullBulk{})
+
+	c.do("DEL", "src")
+	worker.send("BLMOVE", "src", "dst", "RIGHT", "LEFT", "0")
+	waitForBlocked(t, c, "1")
+	c.do("LPUSH", "src", "c")
+	expectReply(t, worker.receive(), BulkString("c"))
+	expectReply(t, c.do("LRANGE", "dst", "0", "-1"), Array{BulkString("c"), BulkString("a")})
+	expectReply(t, c.do("EXISTS", "src"), Integer(0))
+	expectReply(t, worker.do("BLMOVE", "src", "dst", "LEFT", "LEFT", "0.01"), NullBulk{})
+}
+
+// Transactions and scripts cannot wait, so the commands reply at once.
+func TestBlockingPopsDoNotBlockInMultiOrScripts(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	c.do("MULTI")
+	c.do("BLPOP", "q", "0")
+	c.do("BLMOVE", "q", "d", "LEFT", "LEFT", "0")
+	expectReply(t, c.do("EXEC"), Array{NullArray{}, NullBulk{}})
+	expectReply(t, c.do("EVAL", "return redis.call('BRPOP', KEYS[1], 0)", "1", "q"), NullBulk{})
+	c.do("RPUSH", "q", "x")
+	expectReply(t, c.do("EVAL", "return redis.call('BRPOP', KEYS[1], 0)", "1", "q"), Array{BulkString("q"), BulkString("x")})
+}
+
+func TestBlockedClientsDisconnect(t *testing.T) {
+	srv, addr := startServerOnFreePort(t)
+	srv.snapshotPath = filepath.Join(t.TempDir(), "dump.kvsnap")
+	c := dialTestServer(t, addr)
+
+	gone := dialTestServer(t, addr)
+	gone.send("BLPOP", "q", "0")
+	killed := dialTestServer(t, addr)
+	id := killed.do("CLIENT", "ID").(Integer)
+	killed.send("BRPOP", "q", "0")
+	waitForBlocked(t, c, "2")
+
+	gone.conn.Close()
+	waitForBlocked(t, c, "1")
+	// A client that sent more commands after the pop is still watched
+	pipelined := dialTestServer(t, addr)
+	pipelined.conn.Write([]byte(encodeCommand("BLPOP", "q", "0") + encodeCommand("PING")))
+	waitForBlocked(t, c, "2")
+	pipelined.conn.Close()
+	waitForBlocked(t, c, "1")
+	expectReply(t, c.do("CLIENT", "KILL", "ID", strconv.FormatInt(int64(id), 10)), Integer(1))
+	waitForBlocked(t, c, "0")
+	if clients := infoField(t, c, "clients", "connected_clients"); clients != "1" {
+		t.Errorf("Expected the blocked clients to be removed, got %s connected", clients)
+	}
+	// Nobody is left to take the element
+	c.do("RPUSH", "q", "x")
+	expectReply(t, c.do("LLEN", "q"), Integer(1))
+
+	waiting := dialTestServer(t, addr)
+	waiting.send("BLPOP", "other", "0")
+	waitForBlocked(t, c, "1")
+	// Shutdown does not wait for the timeout of blocked clients
+	start := time.Now()
+	if err := srv.Shutdown(5 * time.Second); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	expectDisconnected(t, waiting)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected blocked clients to be disconnected at once, took %v", elapsed)
+	}
+}
+
+// A pop that waited is logged as the pop that happened.
+func TestBlockingPopsPropagateThePop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	srv, c := startServerWithAOF(t, path)
+	worker := dialTestServer(t, c.conn.RemoteAddr().String())
+
+	worker.send("BLPOP", "empty", "q", "0")
+	waitForBlocked(t, c, "1")
+	c.do("RPUSH", "q", "a", "b")
+	worker.receive()
+	worker.do("BLMOVE", "q", "d", "LEFT", "RIGHT", "0")
+	srv.aof.close()
+
+	content, _ := os.ReadFile(path)
+	if strings.Contains(string(content), "BLPOP") || strings.Contains(string(content), "BLMOVE") {
+		t.Errorf("Expected blocking commands to be logged as the pops they made:\n%q", content)
+	}
+	_, c2 := startServerWithAOF(t, path)
+	expectReply(t, c2.do("EXISTS", "q"), Integer(0))
+	expectReply(t, c2.do("LRANGE", "d", "0", "-1"), Array{BulkString("b")})
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"megh-golang-learning/exercices/key-value-db-redis-go/client"
+)
+
+func newLibraryClient(t *testing.T, opts *client.Options) *client.Client {
+	t.Helper()
+	c := client.NewClient(opts)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClientLibraryCommands(t *testing.T) {
+	ctx := context.Background()
+	_, addr := startServerOnFreePort(t)
+	c := newLibraryClient(t, &client.Options{Addr: addr})
+
+	if err := c.Set(ctx, "key", "value", 0).Err(); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	if value, err := c.Get(ctx, "key").Result(); err != nil || value != "value" {
+		t.Errorf("Expected value, got %q (%v)", value, err)
+	}
+	if err := c.Get(ctx, "missing").Err(); err != client.Nil {
+		t.Errorf("Expected Nil for a missing key, got %v", err)
+	}
+	if ok, _ := c.SetNX(ctx, "key", "other", 0).Result(); ok {
+		t.Error("Expected SETNX on an existing key to fail")
+	}
+	if n, _ := c.Incr(ctx, "counter").Result(); n != 1 {
+		t.Errorf("Expected INCR to return 1, got %d", n)
+	}
+	if n, _ := c.DecrBy(ctx, "n", 5).Result(); n != -5 {
+		t.Errorf("Expected DECRBY to return -5, got %d", n)
+	}
+	if f, _ := c.IncrByFloat(ctx, "n", 1.5).Result(); f != -3.5 {
+		t.Errorf("Expected INCRBYFLOAT to return -3.5, got %v", f)
+	}
+	c.Append(ctx, "n", "!")
+	if value, _ := c.GetRange(ctx, "n", -2, -1).Result(); value != "5!" {
+		t.Errorf("Expected 5!, got %q", value)
+	}
+	if ok, _ := c.MSetNX(ctx, "m1", "a", "m2", "b").Result(); !ok {
+		t.Error("Expected MSETNX of new keys to succeed")
+	}
+	if values, _ := c.MGet(ctx, "m1", "missing", "m2").Result(); !reflect.DeepEqual(values, []interface{}{"a", nil, "b"}) {
+		t.Errorf("Unexpected MGET %v", values)
+	}
+	for _, key := range []string{"n", "m1", "m2"} {
+		if err := c.GetDel(ctx, key).Err(); err != nil || c.Exists(ctx, key).Val() != 0 {
+			t.Errorf("Expected GETDEL to remove %s (%v)", key, err)
+		}
+	}
+
+	c.Set(ctx, "temp", "value", 10*time.Second)
+	if ttl, _ := c.TTL(ctx, "temp").Result(); ttl <= 0 || ttl > 10*time.Second {
+		t.Errorf("Expected a TTL of up to 10s, got %v", ttl)
+	}
+	if ttl, _ := c.TTL(ctx, "key").Result(); ttl != client.NoExpiration {
+		t.Errorf("Expected no expiration, got %v", ttl)
+	}
+	if err := c.PTTL(ctx, "missing").Err(); err != client.Nil {
+		t.Errorf("Expected Nil for the TTL of a missing key, got %v", err)
+	}
+
+	c.RPush(ctx, "list", "a", "b", "c")
+	if values, _ := c.LRange(ctx, "list", 0, -1).Result(); !reflect.DeepEqual(values, []string{"a", "b", "c"}) {
+		t.Errorf("Unexpected LRANGE %v", values)
+	}
+	if values, _ := c.LPopCount(ctx, "list", 2).Result(); !reflect.DeepEqual(values, []string{"a", "b"}) {
+		t.Errorf("Unexpected LPOP with count %v", values)
+	}
+
+	c.HSet(ctx, "hash", "f1", "v1", "f2", "v2")
+	if fields, _ := c.HGetAll(ctx, "hash").Result(); !reflect.DeepEqual(fields, map[string]string{"f1": "v1", "f2": "v2"}) {
+		t.Errorf("Unexpected HGETALL %v", fields)
+	}
+	if ok, _ := c.SIsMember(ctx, "set", "x").Result(); ok {
+		t.Error("Expected SISMEMBER on a missing set to be false")
+	}
+
+	c.ZAdd(ctx, "zset", client.Z{Score: 1, Member: "one"}, client.Z{Score: 2, Member: "two"})
+	if score, _ := c.ZIncrBy(ctx, "zset", 2.5, "one").Result(); score != 3.5 {
+		t.Errorf("Expected ZINCRBY to return 3.5, got %v", score)
+	}
+	members, _ := c.ZRangeWithScores(ctx, "zset", 0, -1).Result()
+	if !reflect.DeepEqual(members, []client.Z{{Score: 2, Member: "two"}, {Score: 3.5, Member: "one"}}) {
+		t.Errorf("Unexpected ZRANGE WITHSCORES %v", members)
+	}
+	if byScore, _ := c.ZRangeByScore(ctx, "zset", client.ZRangeBy{Min: "(2", Max: "+inf"}).Result(); !reflect.DeepEqual(byScore, []string{"one"}) {
+		t.Errorf("Unexpected ZRANGEBYSCORE %v", byScore)
+	}
+	if err := c.ZRank(ctx, "zset", "none").Err(); err != client.Nil {
+		t.Errorf("Expected Nil for the rank of a missing member, got %v", err)
+	}
+
+	var keys []string
+	var cursor uint64
+	for {
+		page, err := c.Scan(ctx, cursor, "*", 2).Result()
+		if err != nil {
+			t.Fatalf("SCAN failed: %v", err)
+		}
+		keys = append(keys, page.Keys...)
+		if cursor = page.Cursor; cursor == 0 {
+			break
+		}
+	}
+	sort.Strings(keys)
+	if expected := []string{"counter", "hash", "key", "list", "temp", "zset"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected SCAN to return %v, got %v", expected, keys)
+	}
+
+	if typ, _ := c.Type(ctx, "zset").Result(); typ != "zset" {
+		t.Errorf("Expected zset, got %q", typ)
+	}
+	if raw, _ := c.Do(ctx, "ECHO", "raw").Result(); raw != "raw" {
+		t.Errorf("Expected Do to return the raw reply, got %#v", raw)
+	}
+	if config, _ := c.ConfigGet(ctx, "maxmemory-policy").Result(); config["maxmemory-policy"] != "noeviction" {
+		t.Errorf("Unexpected CONFIG GET %v", config)
+	}
+
+	c.ConfigSet(ctx, "slowlog-log-slower-than", "0")
+	c.Echo(ctx, "slow")
+	logs, err := c.SlowLogGet(ctx, 1).Result()
+	if err != nil || len(logs) != 1 || !reflect.DeepEqual(logs[0].Args, []string{"ECHO", "slow"}) {
+		t.Errorf("Unexpected SLOWLOG GET %+v (%v)", logs, err)
+	}
+
+	script := "return {KEYS[1], ARGV[1], redis.call('INCR', KEYS[1])}"
+	if reply, err := c.Eval(ctx, script, []string{"counter"}, "arg").Result(); err != nil || !reflect.DeepEqual(reply, []interface{}{"counter", "arg", int64(2)}) {
+		t.Errorf("Unexpected EVAL reply %#v (%v)", reply, err)
+	}
+	sha, err := c.ScriptLoad(ctx, "return redis.call('GET', KEYS[1])").Result()
+	if err != nil {
+		t.Fatalf("SCRIPT LOAD failed: %v", err)
+	}
+	if err := c.EvalSha(ctx, sha, []string{"missing"}).Err(); err != client.Nil {
+		t.Errorf("Expected Nil from a script returning false, got %v", err)
+	}
+	c.ScriptFlush(ctx)
+	if exists, _ := c.ScriptExists(ctx, sha).Result(); !reflect.DeepEqual(exists, []bool{false}) {
+		t.Errorf("Expected the script to be flushed, got %v", exists)
+	}
+}
+
+func TestClientLibraryServerErrors(t *testing.T) {
+	ctx := context.Background()
+	_, addr := startServerOnFreePort(t)
+	c := newLibraryClient(t, &client.Options{Addr: addr})
+
+	c.LPush(ctx, "list", "a")
+	err := c.Get(ctx, "list").Err()
+	var serverErr *client.ServerError
+	if !errors.As(err, &serverErr) || serverErr.Code != "WRONGTYPE" {
+		t.Fatalf("Expected a WRONGTYPE error, got %v", err)
+	}
+	if err := c.Do(ctx, "NOPE").Err(); !client.IsServerError(err) {
+		t.Errorf("Expected a server error for an unknown command, got %v", err)
+	}
+	// Error replies leave the connection usable
+	if err := c.Ping(ctx).Err(); err != nil {
+		t.Errorf("Expected PING to work after errors, got %v", err)
+	}
+}
+
+// Blocking commands wait longer than the read timeout without failing.
+func TestClientLibraryBlockingCommands(t *testing.T) {
+	ctx := context.Background()
+	_, addr := startServerOnFreePort(t)
+	c := newLibraryClient(t, &client.Options{Addr: addr, ReadTimeout: 100 * time.Millisecond})
+
+	if err := c.BLPop(ctx, 300*time.Millisecond, "jobs").Err(); err != client.Nil {
+		t.Errorf("Expected Nil once the timeout expired, got %v", err)
+	}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		c.RPush(ctx, "jobs", "a", "b")
+	}()
+	if popped, err := c.BRPop(ctx, 0, "other", "jobs").Result(); err != nil || !reflect.DeepEqual(popped, []string{"jobs", "b"}) {
+		t.Errorf("Expected [jobs b], got %v (%v)", popped, err)
+	}
+	if moved, err := c.BLMove(ctx, "jobs", "done", "LEFT", "RIGHT", time.Second).Result(); err != nil || moved != "a" {
+		t.Errorf("Expected BLMOVE to move a, got %q (%v)", moved, err)
+	}
+	if moved, err := c.LMove(ctx, "done", "jobs", "RIGHT", "LEFT").Result(); err != nil || moved != "a" {
+		t.Errorf("Expected LMOVE to move a, got %q (%v)", moved, err)
+	}
+}
+
+func TestClientLibraryOptions(t *testing.T) {
+	ctx := context.Background()
+	_, addr := startServerWithPassword(t, "secret")
+
+	wrong := newLibraryClient(t, &client.Options{Addr: addr, Password: "wrong"})
+	var serverErr *client.ServerError
+	if err := wrong.Ping(ctx).Err(); !errors.As(err, &serverErr) || serverErr.Code != "WRONGPASS" {
+		t.Fatalf("Expected WRONGPASS, got %v", err)
+	}
+
+	c := newLibraryClient(t, &client.Options{Addr: addr, Password: "secret", DB: 2, ClientName: "library"})
+	c.Set(ctx, "key", "in db 2", 0)
+	if name, _ := c.ClientGetName(ctx).Result(); name != "library" {
+		t.Errorf("Expected the connection to be named, got %q", name)
+	}
+	other := newLibraryClient(t, &client.Options{Addr: addr, Password: "secret"})
+	if err := other.Get(ctx, "key").Err(); err != client.Nil {
+		t.Errorf("Expected the key to be in database 2 only, got %v", err)
+	}
+
+	conn, err := other.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Select(ctx, 2)
+	if value, _ := conn.Get(ctx, "key").Result(); value != "in db 2" {
+		t.Errorf("Expected SELECT to switch the connection, got %q", value)
+	}
+	conn.Close()
+	// The connection that ran SELECT is not given back to the pool
+	if err := other.Get(ctx, "key").Err(); err != client.Nil {
+		t.Errorf("Expected a pooled connection on database 0, got %v", err)
+	}
+}
+
+func TestClientLibraryPipeline(t *testing.T) {
+	ctx := context.Background()
+	_, addr := startServerOnFreePort(t)
+	c := newLibraryClient(t, &client.Options{Addr: addr})
+
+	var incr *client.IntCmd
+	var get *client.StringCmd
+	cmds, err := c.Pipelined(ctx, func(p *client.Pipeline) error {
+		for i := 0; i < 100; i++ {
+			incr = p.Incr(ctx, "counter")
+		}
+		get = p.Get(ctx, "missing")
+		p.LPush(ctx, "counter", "x")
+		return nil
+	})
+	if len(cmds) != 102 {
+		t.Fatalf("Expected 102 commands, got %d", len(cmds))
+	}
+	if !client.IsServerError(err) {
+		t.Errorf("Expected the WRONGTYPE error of the pipeline, got %v", err)
+	}
+	if incr.Val() != 100 || get.Err() != client.Nil {
+		t.Errorf("Unexpected pipeline replies %v and %v", incr, get)
+	}
+}
+
+func TestClientLibraryTransactions(t *testing.T) {
+	ctx := context.Background()
+	_, addr := startServerOnFreePort(t)
+	c := newLibraryClient(t, &client.Options{Addr: addr})
+
+	var incr *client.IntCmd
+	_, err := c.TxPipelined(ctx, func(p *client.Pipeline) error {
+		p.Set(ctx, "key", "1", 0)
+		incr = p.Incr(ctx, "key")
+		return nil
+	})
+	if err != nil || incr.Val() != 2 {
+		t.Fatalf("Expected the transaction to run, got %v and %v", incr, err)
+	}
+
+	// A command the server refuses to queue aborts the whole transaction
+	var set *client.StatusCmd
+	_, err = c.TxPipelined(ctx, func(p *client.Pipeline) error {
+		set = p.Set(ctx, "key", "2", 0)
+		p.Do(ctx, "NOPE")
+		return nil
+	})
+	var serverErr *client.ServerError
+	if !errors.As(err, &serverErr) || serverErr.Code != "EXECABORT" || !client.IsServerError(set.Err()) {
+		t.Errorf("Expected EXECABORT, got %v and %v", err, set.Err())
+	}
+
+	// Optimistic locking: a write from another client fails the transaction
+	err = c.Watch(ctx, func(conn *client.Conn) error {
+		value, _ := conn.Get(ctx, "key").Result()
+		c.Set(ctx, "key", "changed", 0)
+		_, err := conn.TxPipelined(ctx, func(p *client.Pipeline) error {
+			p.Set(ctx, "key", value+"1", 0)
+			return nil
+		})
+		return err
+	}, "key")
+	if err != client.ErrTxFailed {
+		t.Errorf("Expected ErrTxFailed, got %v", err)
+	}
+	if value, _ := c.Get(ctx, "key").Result(); value != "changed" {
+		t.Errorf("Expected the other write to win, got %q", value)
+	}
+
+	// Retrying without interference succeeds
+	increment := func(conn *client.Conn) error {
+		value, err := conn.Get(ctx, "counter").Result()
+		if err != nil && err != client.Nil {
+			return err
+		}
+		n, _ := strconv.Atoi(value)
+		_, err = conn.TxPipelined(ctx, func(p *client.Pipeline) error {
+			p.Set(ctx, "counter", strconv.Itoa(n+1), 0)
+			return nil
+		})
+		return err
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := c.Watch(ctx, increment, "counter")
+				if err != client.ErrTxFailed {
+					if err != nil {
+						t.Error(err)
+					}
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if value, _ := c.Get(ctx, "counter").Result(); value != "10" {
+		t.Errorf("Expected 10 increments, got %q", value)
+	}
+}
+
+func TestClientLibraryPubSub(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, addr := startServerOnFreePort(t)
+	c := newLibraryClient(t, &client.Options{Addr: addr})
+
+	sub, err := c.Subscribe(ctx, "news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	received, err := sub.Receive(ctx)
+	if subscription, ok := received.(*client.Subscription); !ok || subscription.Channel != "news" || subscription.Count != 1 {
+		t.Fatalf("Expected the subscription confirmation, got %#v (%v)", received, err)
+	}
+	sub.PSubscribe(ctx, "sport.*")
+	sub.Receive(ctx)
+
+	// Waiting for nothing times out without breaking the subscription
+	short, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	if _, err := sub.Receive(short); err != context.DeadlineExceeded {
+		t.Errorf("Expected the receive to time out, got %v", err)
+	}
+	cancelShort()
+
+	c.Publish(ctx, "news", "hello")
+	c.Publish(ctx, "sport.tennis", "ace")
+	msg, err := sub.ReceiveMessage(ctx)
+	if err != nil || *msg != (client.Message{Channel: "news", Payload: "hello"}) {
+		t.Errorf("Unexpected message %v (%v)", msg, err)
+	}
+	msg, err = sub.ReceiveMessage(ctx)
+	if err != nil || *msg != (client.Message{Channel: "sport.tennis", Pattern: "sport.*", Payload: "ace"}) {
+		t.Errorf("Unexpected pattern message %v (%v)", msg, err)
+	}
+
+	sub.Ping(ctx, "alive")
+	if pong, _ := sub.Receive(ctx); !reflect.DeepEqual(pong, &client.Pong{Payload: "alive"}) {
+		t.Errorf("Expected a pong, got %#v", pong)
+	}
+
+	ch := sub.Channel()
+	c.Publish(ctx, "news", "through the channel")
+	select {
+	case msg := <-ch:
+		if msg.Payload != "through the channel" {
+			t.Errorf("Unexpected message %v", msg)
+		}
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for the message")
+	}
+	sub.Close()
+	if _, ok := <-ch; ok {
+		t.Error("Expected the channel to be closed with the subscription")
+	}
+}
+
+func TestClientLibraryConcurrentPool(t *testing.T) {
+	ctx := context.Background()
+	_, addr := startServerOnFreePort(t)
+	c := newLibraryClient(t, &client.Options{Addr: addr, PoolSize: 4})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := c.Incr(ctx, "counter").Err(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if value, _ := c.Get(ctx, "counter").Result(); value != "1000" {
+		t.Errorf("Expected 1000, got %q", value)
+	}
+	if list, _ := c.ClientList(ctx).Result(); strings.Count(list, "\n") > 4 {
+		t.Errorf("Expected at most 4 connections, got %q", list)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientInfo is what CLIENT LIST shows about a client. The connection's own
+// goroutine refreshes it after every command so others can read it.
+type clientInfo struct {
+	mutex       sync.Mutex
+	name        string
+	user        string
+	db          int
+	sub, psub   int
+	multi       int // queued commands, -1 outside of MULTI
+	lastCommand string
+	lastActive  time.Time
+}
+
+// containerCommands have subcommands, which CLIENT LIST shows as
+// "client|kill".
+var containerCommands = map[string]bool{"ACL": true, "CLIENT": true, "CONFIG": true, "SCRIPT": true, "SLOWLOG": true}
+
+func fullCommandName(command string, args []string) string {
+	if containerCommands[command] && len(args) > 0 {
+		return strings.ToLower(command + "|" + args[0])
+	}
+	return strings.ToLower(command)
+}
+
+// recordCommand refreshes the client info after a command ran.
+func (c *Client) recordCommand(name string) {
+	multi := -1
+	if c.inMulti {
+		multi = len(c.queued)
+	}
+	user := ""
+	if c.user != nil {
+		user = c.user.name
+	}
+	c.info.mutex.Lock()
+	defer c.info.mutex.Unlock()
+	c.info.user = user
+	c.info.db = c.dbIndex
+	c.info.sub, c.info.psub = len(c.channels), len(c.patterns)
+	c.info.multi = multi
+	c.info.lastCommand = name
+	c.info.lastActive = time.Now()
+}
+
+// describe renders the client the way CLIENT LIST prints it.
+func (c *Client) describe(now time.Time) string {
+	c.info.mutex.Lock()
+	defer c.info.mutex.Unlock()
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d db=%d sub=%d psub=%d multi=%d cmd=%s user=%s",
+		c.id, c.conn.RemoteAddr(), c.conn.LocalAddr(), c.info.name,
+		int64(now.Sub(c.created).Seconds()), int64(now.Sub(c.info.lastActive).Seconds()),
+		c.info.db, c.info.sub, c.info.psub, c.info.multi, c.info.lastCommand, c.info.user)
+}
+
+// kill disconnects the client. A client killing itself is disconnected by
+// its own goroutine once the reply is written.
+func (c *Client) kill(self *Client) {
+	if c.killed.Swap(true) || c == self {
+		return
+	}
+	c.conn.Close()
+}
+
+func (c *Client) userName() string {
+	c.info.mutex.Lock()
+	defer c.info.mutex.Unlock()
+	return c.info.user
+}
+
+// validClientName reports whether name fits on a CLIENT LIST line.
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// clientCommand implements CLIENT LIST, CLIENT INFO, CLIENT ID, CLIENT KILL,
+// CLIENT SETNAME and CLIENT GETNAME.
+func (s *Server) clientCommand(c *Client, args []string) Reply {
+	if len(args) == 0 {
+		return ErrorReply("ERR wrong number of arguments for 'client' command")
+	}
+	sub := strings.ToUpper(args[0])
+	wrongArgs := ErrorReply(fmt.Sprintf("ERR wrong number of arguments for 'client|%s' command", strings.ToLower(sub)))
+	switch sub {
+	case "ID":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		return Integer(c.id)
+	case "INFO":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		c.recordCommand("client|info")
+		return BulkString(c.describe(time.Now()) + "\n")
+	case "LIST":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		c.recordCommand("client|list")
+		var b strings.Builder
+		now := time.Now()
+		for _, client := range s.clientsByID() {
+			b.WriteString(client.describe(now))
+			b.WriteByte('\n')
+		}
+		return BulkString(b.String())
+	case "SETNAME":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		if !validClientName(args[1]) {
+			return ErrorReply("ERR Client names cannot contain spaces, newlines or special characters.")
+		}
+		c.info.mutex.Lock()
+		c.info.name = args[1]
+		c.info.mutex.Unlock()
+		return okReply
+	case "GETNAME":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		c.info.mutex.Lock()
+		defer c.info.mutex.Unlock()
+		if c.info.name == "" {
+			return NullBulk{}
+		}
+		return BulkString(c.info.name)
+	case "KILL":
+		return s.clientKill(c, args[1:])
+	}
+	return ErrorReply(fmt.Sprintf("ERR unknown subcommand '%s'. Try CLIENT HELP.", args[0]))
+}
+
+// clientKill implements CLIENT KILL addr and CLIENT KILL [ID id] [ADDR addr]
+// [USER name] [SKIPME yes|no].
+func (s *Server) clientKill(c *Client, args []string) Reply {
+	switch {
+	case len(args) == 1:
+		for _, client := range s.clientsByID() {
+			if client.conn.RemoteAddr().String() == args[0] {
+				client.kill(c)
+				return okReply
+			}
+		}
+		return ErrorReply("ERR No such client")
+	case len(args) == 0 || len(args)%2 != 0:
+		return ErrorReply("ERR syntax error")
+	}
+	var id int64
+	addr, user, skipMe := "", "", true
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1]
+		switch strings.ToUpper(args[i]) {
+		case "ID":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				return ErrorReply("ERR client-id should be greater than 0")
+			}
+			id = n
+		case "ADDR":
+			addr = value
+		case "USER":
+			user = value
+		case "SKIPME":
+			switch strings.ToLower(value) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				return ErrorReply("ERR syntax error")
+			}
+		default:
+			return ErrorReply("ERR syntax error")
+		}
+	}
+	killed := 0
+	for _, client := range s.clientsByID() {
+		switch {
+		case id != 0 && client.id != id,
+			addr != "" && client.conn.RemoteAddr().String() != addr,
+			user != "" && client.userName() != user,
+			skipMe && client == c:
+			continue
+		}
+		client.kill(c)
+		killed++
+	}
+	return Integer(killed)
+}
+
+// clientsByID returns the connected clients, oldest first.
+func (s *Server) clientsByID() []*Client {
+	s.mutex.Lock()
+	clients := make([]*Client, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, client)
+	}
+	s.mutex.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	return clients
+}
+
+// shutdownMode tells Shutdown whether to save a snapshot when the append
+// only file is off.
+type shutdownMode int
+
+const (
+	shutdownDefault shutdownMode = iota // save when save-on-shutdown is set
+	shutdownSave
+	shutdownNoSave
+)
+
+// Shutdown stops the server gracefully: it stops accepting connections,
+// following a leader and running background jobs, lets every client finish
+// the command it is running, writes the data to disk and closes the remaining
+// connections. Clients that are still busy after timeout are disconnected.
+// Only the first call shuts the server down, later ones wait for it.
+func (s *Server) Shutdown(timeout time.Duration) error {
+	return s.shutdown(timeout, shutdownDefault)
+}
+
+func (s *Server) shutdown(timeout time.Duration, mode shutdownMode) error {
+	s.shutdownOnce.Do(func() {
+		s.shutdownErr = s.drain(timeout, mode)
+		close(s.stopped)
+	})
+	<-s.stopped
+	return s.shutdownErr
+}
+
+func (s *Server) drain(timeout time.Duration, mode shutdownMode) error {
+	deadline := time.Now().Add(timeout)
+	s.mutex.Lock()
+	s.draining.Store(true)
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	s.mutex.Unlock()
+	close(s.stop)
+	s.stopReplication()
+
+	// Idle clients are woken up from their reads, busy ones notice the drain
+	// once their command is done. Deadlines are set again until everyone left
+	// because a client may extend its own deadline right after finishing one.
+	for {
+		s.mutex.Lock()
+		remaining := len(s.clients)
+		for conn := range s.clients {
+			conn.SetReadDeadline(time.Now())
+		}
+		s.mutex.Unlock()
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Println("Shutdown deadline reached, closing", remaining, "busy clients")
+			for _, client := range s.clientsByID() {
+				client.kill(nil)
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.handlers.Wait()
+
+	var aofErr error
+	if s.aof != nil {
+		aofErr = s.aof.close()
+	} else if mode == shutdownDefault {
+		s.configMutex.Lock()
+		if s.config.SaveOnShutdown {
+			mode = shutdownSave
+		}
+		s.configMutex.Unlock()
+	}
+	if mode != shutdownSave {
+		return aofErr
+	}
+	if err := s.save(); err != nil {
+		return fmt.Errorf("error saving snapshot: %v", err)
+	}
+	return aofErr
+}
+
+// shutdownCommand implements SHUTDOWN [NOSAVE|SAVE]. The shutdown runs in
+// the background since it waits for this client to finish its command; main
+// reports its error and exits once it is done.
+func (s *Server) shutdownCommand(args []string) Reply {
+	mode := shutdownDefault
+	if len(args) > 1 {
+		return ErrorReply("ERR syntax error")
+	}
+	if len(args) == 1 {
+		switch strings.ToUpper(args[0]) {
+		case "SAVE":
+			mode = shutdownSave
+		case "NOSAVE":
+			mode = shutdownNoSave
+		default:
+			return ErrorReply("ERR syntax error")
+		}
+	}
+	s.configMutex.Lock()
+	timeout := time.Duration(s.config.ShutdownWait) * time.Second
+	s.configMutex.Unlock()
+	go s.shutdown(timeout, mode)
+	return okReply
+}
+
+// addListener registers a listener so Shutdown can close it. It reports
+// false if the server is already shutting down.
+func (s *Server) addListener(listener net.Listener) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.draining.Load() {
+		listener.Close()
+		return false
+	}
+	s.listeners[listener] = struct{}{}
+	return true
+}
+
+func (s *Server) removeListener(listener net.Listener) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.listeners, listener)
+}
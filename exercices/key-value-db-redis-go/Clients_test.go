@@ -0,0 +1,237 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientListLine returns the CLIENT LIST line of the client with the name.
+func clientListLine(t *testing.T, c *testClient, name string) string {
+	t.Helper()
+	list, ok := c.do("CLIENT", "LIST").(BulkString)
+	if !ok {
+		t.Fatalf("Expected CLIENT LIST to return a bulk string")
+	}
+	for _, line := range strings.Split(string(list), "\n") {
+		if strings.Contains(line, " name="+name+" ") {
+			return line
+		}
+	}
+	t.Fatalf("Client %s not found in %q", name, list)
+	return ""
+}
+
+func expectDisconnected(t *testing.T, c *testClient) {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.reader.ReadByte(); err == nil || os.IsTimeout(err) {
+		t.Fatalf("Expected the client to be disconnected, got %v", err)
+	}
+}
+
+func TestClientNamesAndList(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+	other := dialTestServer(t, addr)
+
+	expectReply(t, c.do("CLIENT", "GETNAME"), NullBulk{})
+	expectReply(t, c.do("CLIENT", "SETNAME", "worker-1"), SimpleString("OK"))
+	expectReply(t, c.do("CLIENT", "GETNAME"), BulkString("worker-1"))
+	expectReply(t, c.do("CLIENT", "SETNAME", "has space"), ErrorReply("ERR Client names cannot contain spaces, newlines or special characters."))
+	expectReply(t, c.do("CLIENT", "NOPE"), ErrorReply("ERR unknown subcommand 'NOPE'. Try CLIENT HELP."))
+
+	other.do("CLIENT", "SETNAME", "subscriber")
+	other.do("SELECT", "3")
+	other.do("SUBSCRIBE", "news")
+	line := clientListLine(t, c, "subscriber")
+	for _, field := range []string{"addr=" + other.conn.LocalAddr().String(), "db=3", "sub=1", "psub=0", "multi=-1", "cmd=subscribe", "user=default"} {
+		if !strings.Contains(line, " "+field+" ") && !strings.HasSuffix(line, " "+field) {
+			t.Errorf("Expected %s in %q", field, line)
+		}
+	}
+	if line := clientListLine(t, c, "worker-1"); !strings.Contains(line, "cmd=client|list") {
+		t.Errorf("Expected the current command in %q", line)
+	}
+
+	id, ok := c.do("CLIENT", "ID").(Integer)
+	if !ok || id <= 0 {
+		t.Fatalf("Expected a positive client id, got %v", id)
+	}
+	info, _ := c.do("CLIENT", "INFO").(BulkString)
+	if !strings.HasPrefix(string(info), "id="+strconv.FormatInt(int64(id), 10)+" ") || !strings.Contains(string(info), "name=worker-1") {
+		t.Errorf("Unexpected CLIENT INFO %q", info)
+	}
+}
+
+func TestClientKill(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	admin := dialTestServer(t, addr)
+	first := dialTestServer(t, addr)
+	second := dialTestServer(t, addr)
+	first.do("PING")
+	second.do("PING")
+
+	expectReply(t, admin.do("CLIENT", "KILL", first.conn.LocalAddr().String()), SimpleString("OK"))
+	expectDisconnected(t, first)
+	expectReply(t, admin.do("CLIENT", "KILL", "127.0.0.1:1"), ErrorReply("ERR No such client"))
+
+	secondID, _ := second.do("CLIENT", "ID").(Integer)
+	expectReply(t, admin.do("CLIENT", "KILL", "ID", strconv.FormatInt(int64(secondID), 10)), Integer(1))
+	expectDisconnected(t, second)
+	expectReply(t, admin.do("CLIENT", "KILL", "ID", "0"), ErrorReply("ERR client-id should be greater than 0"))
+
+	// Filters skip the calling client unless told otherwise, which then gets
+	// its reply before being disconnected
+	expectReply(t, admin.do("CLIENT", "KILL", "USER", "default"), Integer(0))
+	expectReply(t, admin.do("CLIENT", "KILL", "USER", "default", "SKIPME", "no"), Integer(1))
+	expectDisconnected(t, admin)
+}
+
+func TestShutdownLetsCommandsFinish(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	srv := NewServer()
+	if err := srv.enableAOF(path, fsyncNo); err != nil {
+		t.Fatal(err)
+	}
+	addr := serveOnFreePort(t, srv)
+	busy, idle := dialTestServer(t, addr), dialTestServer(t, addr)
+	idle.do("SET", "before", "shutdown")
+
+	// Holding the shard locks keeps the SET running while shutdown starts
+	db := srv.databases[0]
+	db.lock(allShards)
+	busy.conn.Write([]byte(encodeCommand("SET", "during", "shutdown")))
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan error)
+	go func() { done <- srv.Shutdown(5 * time.Second) }()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("Expected new connections to be refused while draining")
+	}
+	expectDisconnected(t, idle)
+	db.unlock(allShards)
+
+	expectReply(t, busy.receive(), SimpleString("OK"))
+	expectDisconnected(t, busy)
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	content, _ := os.ReadFile(path)
+	if !strings.Contains(string(content), "before") || !strings.Contains(string(content), "during") {
+		t.Errorf("Expected both writes in the append only file, got %q", content)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.kvsnap")
+	srv := NewServer()
+	srv.snapshotPath = path
+	srv.config.SaveOnShutdown = true
+	c := dialTestServer(t, serveOnFreePort(t, srv))
+	c.do("SET", "key", "value")
+
+	db := srv.databases[0]
+	db.lock(allShards)
+	c.conn.Write([]byte(encodeCommand("SET", "stuck", "value")))
+	done := make(chan error)
+	go func() { done <- srv.Shutdown(100 * time.Millisecond) }()
+	expectDisconnected(t, c)
+	db.unlock(allShards)
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	// With save-on-shutdown and without an append only file the dataset is
+	// saved as a snapshot
+	_, client := startServerWithSnapshot(t, path)
+	expectReply(t, client.do("GET", "key"), BulkString("value"))
+}
+
+func TestShutdownSaveModes(t *testing.T) {
+	for _, tc := range []struct {
+		saveOnShutdown bool
+		aof            bool
+		command        []string // SHUTDOWN arguments, Shutdown is called when nil
+		saved          bool
+	}{
+		{false, false, nil, false},
+		{true, false, nil, true},
+		{true, true, nil, false},
+		{false, false, []string{"SHUTDOWN"}, false},
+		{false, false, []string{"SHUTDOWN", "SAVE"}, true},
+		{false, true, []string{"SHUTDOWN", "SAVE"}, true},
+		{true, false, []string{"SHUTDOWN", "NOSAVE"}, false},
+	} {
+		// An existing dump must only be replaced when saving
+		path := filepath.Join(t.TempDir(), "dump.kvsnap")
+		old, c := startServerWithSnapshot(t, path)
+		c.do("SET", "key", "old")
+		if err := old.save(); err != nil {
+			t.Fatal(err)
+		}
+
+		srv := NewServer()
+		srv.snapshotPath = path
+		srv.config.SaveOnShutdown = tc.saveOnShutdown
+		if err := srv.loadSnapshot(path); err != nil {
+			t.Fatal(err)
+		}
+		if tc.aof {
+			if err := srv.enableAOF(filepath.Join(t.TempDir(), "appendonly.aof"), fsyncAlways); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c = dialTestServer(t, serveOnFreePort(t, srv))
+		c.do("SET", "key", "new")
+		if tc.command == nil {
+			if err := srv.Shutdown(time.Second); err != nil {
+				t.Fatalf("Shutdown failed: %v", err)
+			}
+		} else {
+			expectReply(t, c.do(tc.command...), SimpleString("OK"))
+			<-srv.stopped
+		}
+		expected := BulkString("old")
+		if tc.saved {
+			expected = BulkString("new")
+		}
+		_, client := startServerWithSnapshot(t, path)
+		if got := client.do("GET", "key"); got != expected {
+			t.Errorf("save-on-shutdown %v, aof %v, %v: expected %q in the dump, got %v", tc.saveOnShutdown, tc.aof, tc.command, expected, got)
+		}
+	}
+}
+
+func TestShutdownCommandErrors(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("SHUTDOWN", "LATER"), ErrorReply("ERR syntax error"))
+	expectReply(t, c.do("SHUTDOWN", "SAVE", "NOSAVE"), ErrorReply("ERR syntax error"))
+	c.do("MULTI")
+	expectReply(t, c.do("SHUTDOWN"), ErrorReply("ERR Command not allowed inside a transaction"))
+	c.do("DISCARD")
+	expectReply(t, c.do("EVAL", "return redis.call('SHUTDOWN')", "0"), ErrorReply("ERR This command is not allowed from script"))
+	expectReply(t, c.do("PING"), SimpleString("PONG"))
+}
+
+func TestShutdownStopsBackgroundGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	srv := NewServer()
+	if err := srv.Shutdown(time.Second); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the server goroutines to stop, %d left of %d before", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
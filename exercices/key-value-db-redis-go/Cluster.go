@@ -0,0 +1,770 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	clusterSlots          = 16384
+	clusterGossipInterval = time.Second
+	clusterLinkTimeout    = time.Second // to connect to a node and get its reply
+)
+
+// Cluster is what a node in cluster mode knows about the cluster: the nodes
+// and which of them serves each of the hash slots keys map to. Nodes send
+// each other their view with CLUSTER GOSSIP over the client port, see
+// clusterGossip.
+type Cluster struct {
+	mutex        sync.Mutex
+	myself       *clusterNode
+	nodes        map[string]*clusterNode
+	slots        [clusterSlots]*clusterNode
+	migrating    map[int]*clusterNode // slots of this node being moved to another
+	importing    map[int]*clusterNode // slots being moved here from another node
+	currentEpoch uint64               // greatest config epoch seen
+	changed      chan struct{}        // wakes clusterGossip to announce a change
+}
+
+// clusterNode is a node of the cluster. When two nodes claim a slot, the one
+// with the greater config epoch gets it.
+type clusterNode struct {
+	id       string
+	addr     string // host:port clients are redirected to, empty for myself
+	epoch    uint64
+	linkUp   bool // the last gossip exchange with the node succeeded
+	lastPong time.Time
+}
+
+func NewCluster() *Cluster {
+	// Node IDs look like replication IDs, 40 random hex characters
+	myself := &clusterNode{id: newReplicationID(), linkUp: true}
+	return &Cluster{
+		myself:    myself,
+		nodes:     map[string]*clusterNode{myself.id: myself},
+		migrating: make(map[int]*clusterNode),
+		importing: make(map[int]*clusterNode),
+		changed:   make(chan struct{}, 1),
+	}
+}
+
+var crc16Table = func() (table [256]uint16) {
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc16 is the CRC-16/XMODEM checksum of s.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^s[i]]
+	}
+	return crc
+}
+
+// keyHashSlot maps a key to its hash slot. When the key has a non-empty hash
+// tag between its first { and the next }, only the tag is hashed, so keys
+// such as {user1000}.following and {user1000}.followers share a slot.
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) & (clusterSlots - 1)
+}
+
+// slotRanges returns the runs of consecutive slots of node, in order.
+// Caller holds the mutex.
+func (cl *Cluster) slotRanges(node *clusterNode) [][2]int {
+	var ranges [][2]int
+	for slot := 0; slot < clusterSlots; slot++ {
+		if cl.slots[slot] != node {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1][1] == slot-1 {
+			ranges[n-1][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+func formatSlotRange(r [2]int) string {
+	if r[0] == r[1] {
+		return strconv.Itoa(r[0])
+	}
+	return fmt.Sprintf("%d-%d", r[0], r[1])
+}
+
+// parseSlotRanges reads the slots of a gossip message, such as "0-99,200".
+func parseSlotRanges(s string) ([]int, error) {
+	var slots []int
+	if s == "" {
+		return slots, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(field, "-")
+		if !isRange {
+			to = from
+		}
+		start, err1 := strconv.Atoi(from)
+		end, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || start < 0 || start > end || end >= clusterSlots {
+			return nil, fmt.Errorf("invalid slot range %q", field)
+		}
+		for slot := start; slot <= end; slot++ {
+			slots = append(slots, slot)
+		}
+	}
+	return slots, nil
+}
+
+func parseSlot(arg string) (int, Reply) {
+	slot, err := strconv.Atoi(arg)
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return 0, ErrorReply("ERR Invalid or out of range slot")
+	}
+	return slot, nil
+}
+
+// announce wakes clusterGossip so the other nodes learn a change at once.
+func (cl *Cluster) announce() {
+	select {
+	case cl.changed <- struct{}{}:
+	default:
+	}
+}
+
+// claim gives slot to node if the slot is free or held by a node with an
+// older config epoch. Caller holds the mutex.
+func (cl *Cluster) claim(node *clusterNode, slot int) {
+	owner := cl.slots[slot]
+	if owner == node || (owner != nil && owner.epoch >= node.epoch) {
+		return
+	}
+	cl.slots[slot] = node
+	if cl.migrating[slot] == node {
+		delete(cl.migrating, slot)
+	}
+	if node != cl.myself {
+		delete(cl.importing, slot)
+	}
+}
+
+// bumpEpoch gives this node a config epoch greater than any other, so that
+// its claims win. Caller holds the mutex.
+func (cl *Cluster) bumpEpoch() {
+	cl.currentEpoch++
+	cl.myself.epoch = cl.currentEpoch
+}
+
+// myAddr is the address other nodes and clients reach this node at: the
+// announced IP, or the local address of the connection of c.
+func (s *Server) myAddr(c *Client) string {
+	s.configMutex.Lock()
+	host := s.config.ClusterAnnounceIP
+	s.configMutex.Unlock()
+	if host == "" {
+		host = "127.0.0.1"
+		if c.conn != nil {
+			host, _, _ = net.SplitHostPort(c.conn.LocalAddr().String())
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return net.JoinHostPort(host, strconv.Itoa(s.port))
+}
+
+// gossipArgs describes this node and the nodes it knows as the arguments of
+//
+//	CLUSTER GOSSIP id host port epoch current-epoch slots [id addr]...
+//
+// where slots reads like "0-99,200" and an empty host asks the receiver to
+// use the address the message came from.
+func (s *Server) gossipArgs() []string {
+	s.configMutex.Lock()
+	host := s.config.ClusterAnnounceIP
+	s.configMutex.Unlock()
+	s.mutex.Lock()
+	port := s.port
+	s.mutex.Unlock()
+	cl := s.cluster
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	var ranges []string
+	for _, r := range cl.slotRanges(cl.myself) {
+		ranges = append(ranges, formatSlotRange(r))
+	}
+	args := []string{cl.myself.id, host, strconv.Itoa(port), strconv.FormatUint(cl.myself.epoch, 10),
+		strconv.FormatUint(cl.currentEpoch, 10), strings.Join(ranges, ",")}
+	for _, node := range cl.nodes {
+		if node != cl.myself {
+			args = append(args, node.id, node.addr)
+		}
+	}
+	return args
+}
+
+// applyGossip updates the view of this node with a message of gossipArgs
+// that came from remoteHost.
+func (cl *Cluster) applyGossip(args []string, remoteHost string) error {
+	if len(args) < 6 || len(args)%2 != 0 {
+		return errors.New("wrong number of arguments in gossip")
+	}
+	id, host, port := args[0], args[1], args[2]
+	epoch, err1 := strconv.ParseUint(args[3], 10, 64)
+	current, err2 := strconv.ParseUint(args[4], 10, 64)
+	if err1 != nil || err2 != nil {
+		return errors.New("invalid epoch in gossip")
+	}
+	slots, err := parseSlotRanges(args[5])
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		host = remoteHost
+	}
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	// A node asked to meet itself
+	if id == cl.myself.id {
+		return nil
+	}
+	node := cl.nodes[id]
+	if node == nil {
+		node = &clusterNode{id: id}
+		cl.nodes[id] = node
+	}
+	node.addr = net.JoinHostPort(host, port)
+	node.epoch, node.linkUp, node.lastPong = epoch, true, time.Now()
+	cl.currentEpoch = max(cl.currentEpoch, current, epoch)
+	for _, slot := range slots {
+		cl.claim(node, slot)
+	}
+	for i := 6; i < len(args); i += 2 {
+		if _, known := cl.nodes[args[i]]; !known && args[i] != cl.myself.id {
+			cl.nodes[args[i]] = &clusterNode{id: args[i], addr: args[i+1]}
+		}
+	}
+	return nil
+}
+
+// exchangeGossip sends the view of this node to the node at addr and applies
+// the view it replies with. Nodes authenticate to each other as replicas do
+// to their leader, with masteruser and masterauth.
+func (s *Server) exchangeGossip(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, clusterLinkTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clusterLinkTimeout))
+	repl := s.replication
+	repl.mutex.Lock()
+	user, password := repl.masterUser, repl.masterAuth
+	repl.mutex.Unlock()
+	writer := bufio.NewWriter(conn)
+	if password != "" {
+		if user != "" {
+			writeCommand(writer, []string{"AUTH", user, password})
+		} else {
+			writeCommand(writer, []string{"AUTH", password})
+		}
+	}
+	writeCommand(writer, append([]string{"CLUSTER", "GOSSIP"}, s.gossipArgs()...))
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	if password != "" {
+		if line, err := readReplyLine(reader); err != nil {
+			return err
+		} else if line != "+OK" {
+			return errors.New("node rejected AUTH: " + line)
+		}
+	}
+	if first, err := reader.Peek(1); err != nil {
+		return err
+	} else if first[0] != '*' {
+		line, _ := readReplyLine(reader)
+		return errors.New("node rejected gossip: " + line)
+	}
+	// The reply is an array of bulk strings, encoded like a command
+	reply, _, err := NewRespReader(reader).ReadCommand()
+	if err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	return s.cluster.applyGossip(reply, host)
+}
+
+// clusterGossip exchanges views with every other node once per
+// clusterGossipInterval, and at once when this node's view changed, until
+// the server shuts down.
+func (s *Server) clusterGossip() {
+	cl := s.cluster
+	ticker := time.NewTicker(clusterGossipInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-cl.changed:
+		case <-s.stop:
+			return
+		}
+		cl.mutex.Lock()
+		var peers []*clusterNode
+		for _, node := range cl.nodes {
+			if node != cl.myself {
+				peers = append(peers, node)
+			}
+		}
+		cl.mutex.Unlock()
+		for _, node := range peers {
+			go func() {
+				cl.mutex.Lock()
+				addr := node.addr
+				cl.mutex.Unlock()
+				err := s.exchangeGossip(addr)
+				if err != nil {
+					cl.mutex.Lock()
+					node.linkUp = false
+					cl.mutex.Unlock()
+				}
+			}()
+		}
+	}
+}
+
+// clusterRedirect returns the error that sends a client to the node serving
+// the keys of a command, or nil if the command runs here: its keys are in a
+// slot of this node and have not been moved away yet, or in a slot being
+// imported and the client sent ASKING first.
+func (s *Server) clusterRedirect(c *Client, command string, args []string, asking bool) Reply {
+	keys := commandKeys(command, args)
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := keyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if keyHashSlot(key) != slot {
+			return ErrorReply("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+	cl := s.cluster
+	cl.mutex.Lock()
+	owner, migrating, importing := cl.slots[slot], cl.migrating[slot], cl.importing[slot]
+	myself := cl.myself
+	cl.mutex.Unlock()
+	switch {
+	case owner == nil:
+		return ErrorReply("CLUSTERDOWN Hash slot not served")
+	case c.inScript:
+		// The script holds every lock, and its declared keys were checked
+		// before it started
+		if owner != myself && importing == nil {
+			return ErrorReply("ERR Script attempted to access a non local key in a cluster node")
+		}
+		return nil
+	case owner == myself:
+		if migrating == nil {
+			return nil
+		}
+		missing := s.missingKeys(c.dbIndex, keys)
+		if missing == 0 {
+			return nil
+		}
+		if missing < len(keys) {
+			return ErrorReply("TRYAGAIN Multiple keys request during rehashing of slot")
+		}
+		cl.mutex.Lock()
+		defer cl.mutex.Unlock()
+		return ErrorReply(fmt.Sprintf("ASK %d %s", slot, migrating.addr))
+	case importing != nil && asking:
+		if len(keys) > 1 && s.missingKeys(c.dbIndex, keys) > 0 {
+			return ErrorReply("TRYAGAIN Multiple keys request during rehashing of slot")
+		}
+		return nil
+	}
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return ErrorReply(fmt.Sprintf("MOVED %d %s", slot, owner.addr))
+}
+
+// missingKeys counts the keys that do not exist in database dbIndex.
+func (s *Server) missingKeys(dbIndex int, keys []string) int {
+	db := s.databases[dbIndex]
+	shards := keyShards(keys)
+	db.rlock(shards)
+	defer db.runlock(shards)
+	missing := 0
+	for _, key := range keys {
+		if _, exists := db.value(key); !exists || db.isExpired(key) {
+			missing++
+		}
+	}
+	return missing
+}
+
+// keysInSlot returns up to count keys of slot, or all of them when count is
+// negative. There is no index by slot, so every key is hashed.
+func (db *Database) keysInSlot(slot, count int) []string {
+	keys := []string{}
+	for _, sh := range db.shards {
+		sh.mutex.RLock()
+		for key := range sh.data {
+			if len(keys) == count {
+				break
+			}
+			if !sh.isExpired(key) && keyHashSlot(key) == slot {
+				keys = append(keys, key)
+			}
+		}
+		sh.mutex.RUnlock()
+	}
+	return keys
+}
+
+// clusterCommand implements CLUSTER and its subcommands.
+func (s *Server) clusterCommand(c *Client, args []string) Reply {
+	cl := s.cluster
+	if cl == nil {
+		return ErrorReply("ERR This instance has cluster support disabled")
+	}
+	if len(args) == 0 {
+		return ErrorReply("ERR wrong number of arguments for 'cluster' command")
+	}
+	sub := strings.ToUpper(args[0])
+	wrongArgs := ErrorReply(fmt.Sprintf("ERR wrong number of arguments for 'cluster|%s' command", strings.ToLower(sub)))
+	switch sub {
+	case "MYID":
+		return BulkString(cl.myself.id)
+	case "KEYSLOT":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		return Integer(keyHashSlot(args[1]))
+	case "INFO":
+		return BulkString(s.clusterInfoFields())
+	case "NODES":
+		return BulkString(s.clusterNodes(c))
+	case "SLOTS":
+		return s.clusterSlots(c)
+	case "MEET":
+		if len(args) != 3 {
+			return wrongArgs
+		}
+		if port, err := strconv.Atoi(args[2]); err != nil || port <= 0 || port > 65535 {
+			return ErrorReply(fmt.Sprintf("ERR Invalid node address specified: %s:%s", args[1], args[2]))
+		}
+		if err := s.exchangeGossip(net.JoinHostPort(args[1], args[2])); err != nil {
+			return ErrorReply("ERR " + err.Error())
+		}
+		cl.announce()
+		return okReply
+	case "GOSSIP":
+		host := ""
+		if c.conn != nil {
+			host, _, _ = net.SplitHostPort(c.conn.RemoteAddr().String())
+		}
+		if err := cl.applyGossip(args[1:], host); err != nil {
+			return ErrorReply("ERR " + err.Error())
+		}
+		reply := Array{}
+		for _, arg := range s.gossipArgs() {
+			reply = append(reply, BulkString(arg))
+		}
+		return reply
+	case "ADDSLOTS", "ADDSLOTSRANGE", "DELSLOTS":
+		if len(args) < 2 || (sub == "ADDSLOTSRANGE" && len(args)%2 == 0) {
+			return wrongArgs
+		}
+		var slots []int
+		for i := 1; i < len(args); i++ {
+			slot, errReply := parseSlot(args[i])
+			if errReply != nil {
+				return errReply
+			}
+			if sub != "ADDSLOTSRANGE" {
+				slots = append(slots, slot)
+				continue
+			}
+			end, errReply := parseSlot(args[i+1])
+			if errReply != nil {
+				return errReply
+			}
+			for ; slot <= end; slot++ {
+				slots = append(slots, slot)
+			}
+			i++
+		}
+		return cl.assignSlots(sub == "DELSLOTS", slots)
+	case "SETSLOT":
+		if len(args) < 3 {
+			return wrongArgs
+		}
+		return s.setSlot(c, args[1:])
+	case "COUNTKEYSINSLOT", "GETKEYSINSLOT":
+		if (sub == "COUNTKEYSINSLOT" && len(args) != 2) || (sub == "GETKEYSINSLOT" && len(args) != 3) {
+			return wrongArgs
+		}
+		slot, errReply := parseSlot(args[1])
+		if errReply != nil {
+			return errReply
+		}
+		db := s.databases[c.dbIndex]
+		if sub == "COUNTKEYSINSLOT" {
+			return Integer(len(db.keysInSlot(slot, -1)))
+		}
+		count, err := strconv.Atoi(args[2])
+		if err != nil || count < 0 {
+			return ErrorReply("ERR Invalid number of keys")
+		}
+		reply := Array{}
+		for _, key := range db.keysInSlot(slot, count) {
+			reply = append(reply, BulkString(key))
+		}
+		return reply
+	}
+	return ErrorReply(fmt.Sprintf("ERR unknown subcommand '%s'. Try CLUSTER HELP.", args[0]))
+}
+
+// assignSlots implements ADDSLOTS, which gives free slots to this node, and
+// DELSLOTS, which forgets who serves slots.
+func (cl *Cluster) assignSlots(remove bool, slots []int) Reply {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	seen := make(map[int]bool)
+	for _, slot := range slots {
+		switch {
+		case seen[slot]:
+			return ErrorReply(fmt.Sprintf("ERR Slot %d specified multiple times", slot))
+		case remove && cl.slots[slot] == nil:
+			return ErrorReply(fmt.Sprintf("ERR Slot %d is already unassigned", slot))
+		case !remove && cl.slots[slot] != nil:
+			return ErrorReply(fmt.Sprintf("ERR Slot %d is already busy", slot))
+		}
+		seen[slot] = true
+	}
+	for _, slot := range slots {
+		if remove {
+			cl.slots[slot] = nil
+			delete(cl.migrating, slot)
+			delete(cl.importing, slot)
+		} else {
+			cl.slots[slot] = cl.myself
+		}
+	}
+	cl.announce()
+	return okReply
+}
+
+// setSlot implements CLUSTER SETSLOT slot IMPORTING|MIGRATING|NODE node-id
+// and CLUSTER SETSLOT slot STABLE, the steps of moving a slot between nodes:
+// the target imports it, the source migrates it and moves its keys with
+// MIGRATE, and then both are told the slot belongs to the target.
+func (s *Server) setSlot(c *Client, args []string) Reply {
+	cl := s.cluster
+	slot, errReply := parseSlot(args[0])
+	if errReply != nil {
+		return errReply
+	}
+	action := strings.ToUpper(args[1])
+	if (action == "STABLE" && len(args) != 2) || (action != "STABLE" && len(args) != 3) {
+		return ErrorReply("ERR syntax error")
+	}
+	var node *clusterNode
+	if action != "STABLE" {
+		cl.mutex.Lock()
+		node = cl.nodes[args[2]]
+		cl.mutex.Unlock()
+		if node == nil {
+			return ErrorReply(fmt.Sprintf("ERR I don't know about node %s", args[2]))
+		}
+	}
+	// Counting the keys takes the shard locks, so it comes first
+	if action == "NODE" && node != cl.myself && len(s.databases[c.dbIndex].keysInSlot(slot, 1)) > 0 {
+		cl.mutex.Lock()
+		owned := cl.slots[slot] == cl.myself
+		cl.mutex.Unlock()
+		if owned {
+			return ErrorReply(fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+		}
+	}
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	switch action {
+	case "MIGRATING":
+		if cl.slots[slot] != cl.myself {
+			return ErrorReply(fmt.Sprintf("ERR I'm not the owner of hash slot %d", slot))
+		}
+		if node == cl.myself {
+			return ErrorReply("ERR I can't migrate a slot to myself")
+		}
+		cl.migrating[slot] = node
+	case "IMPORTING":
+		if cl.slots[slot] == cl.myself {
+			return ErrorReply(fmt.Sprintf("ERR I'm already the owner of hash slot %d", slot))
+		}
+		if node == cl.myself {
+			return ErrorReply("ERR I can't import a slot from myself")
+		}
+		cl.importing[slot] = node
+	case "STABLE":
+		delete(cl.migrating, slot)
+		delete(cl.importing, slot)
+	case "NODE":
+		delete(cl.migrating, slot)
+		// The importing node takes the slot with a new epoch, so the
+		// other nodes prefer its claim over the old owner's
+		if node == cl.myself && cl.importing[slot] != nil {
+			delete(cl.importing, slot)
+			cl.bumpEpoch()
+		}
+		cl.slots[slot] = node
+		cl.announce()
+	default:
+		return ErrorReply("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+	return okReply
+}
+
+// sortedNodes returns the nodes ordered by ID. Caller holds the mutex.
+func (cl *Cluster) sortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(cl.nodes))
+	for _, node := range cl.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	return nodes
+}
+
+// clusterInfoFields returns the fields of CLUSTER INFO. The cluster is ok once
+// every slot is served.
+func (s *Server) clusterInfoFields() string {
+	cl := s.cluster
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	assigned, ok := 0, 0
+	size := make(map[*clusterNode]bool)
+	for _, owner := range cl.slots {
+		if owner == nil {
+			continue
+		}
+		assigned++
+		size[owner] = true
+		if owner.linkUp {
+			ok++
+		}
+	}
+	state := "fail"
+	if assigned == clusterSlots {
+		state = "ok"
+	}
+	return fmt.Sprintf("cluster_state:%s\r\ncluster_slots_assigned:%d\r\ncluster_slots_ok:%d\r\ncluster_known_nodes:%d\r\ncluster_size:%d\r\ncluster_current_epoch:%d\r\ncluster_my_epoch:%d\r\n",
+		state, assigned, ok, len(cl.nodes), len(size), cl.currentEpoch, cl.myself.epoch)
+}
+
+// clusterNodes returns CLUSTER NODES, one line per node:
+//
+//	id host:port@port flags master ping-sent pong-received epoch link slots...
+//
+// There is no separate cluster bus, so the bus port is the client port.
+func (s *Server) clusterNodes(c *Client) string {
+	myAddr := s.myAddr(c)
+	cl := s.cluster
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	var sb strings.Builder
+	for _, node := range cl.sortedNodes() {
+		addr, flags, pong, link := node.addr, "master", int64(0), "connected"
+		if node == cl.myself {
+			addr, flags = myAddr, "myself,master"
+		} else {
+			if !node.lastPong.IsZero() {
+				pong = node.lastPong.UnixMilli()
+			}
+			if !node.linkUp {
+				flags, link = "master,fail?", "disconnected"
+			}
+		}
+		_, port, _ := net.SplitHostPort(addr)
+		fmt.Fprintf(&sb, "%s %s@%s %s - 0 %d %d %s", node.id, addr, port, flags, pong, node.epoch, link)
+		for _, r := range cl.slotRanges(node) {
+			sb.WriteString(" " + formatSlotRange(r))
+		}
+		if node == cl.myself {
+			for _, slot := range sortedSlots(cl.migrating) {
+				fmt.Fprintf(&sb, " [%d->-%s]", slot, cl.migrating[slot].id)
+			}
+			for _, slot := range sortedSlots(cl.importing) {
+				fmt.Fprintf(&sb, " [%d-<-%s]", slot, cl.importing[slot].id)
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func sortedSlots(m map[int]*clusterNode) []int {
+	slots := make([]int, 0, len(m))
+	for slot := range m {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	return slots
+}
+
+// clusterSlots returns CLUSTER SLOTS: for each range of consecutive slots of
+// a node, its first and last slot and the node's host, port and ID.
+func (s *Server) clusterSlots(c *Client) Reply {
+	myAddr := s.myAddr(c)
+	cl := s.cluster
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	reply := Array{}
+	for slot := 0; slot < clusterSlots; {
+		owner := cl.slots[slot]
+		end := slot
+		for end+1 < clusterSlots && cl.slots[end+1] == owner {
+			end++
+		}
+		if owner != nil {
+			addr := owner.addr
+			if owner == cl.myself {
+				addr = myAddr
+			}
+			host, port, _ := net.SplitHostPort(addr)
+			portNum, _ := strconv.Atoi(port)
+			reply = append(reply, Array{Integer(slot), Integer(end), Array{BulkString(host), Integer(portNum), BulkString(owner.id)}})
+		}
+		slot = end + 1
+	}
+	return reply
+}
+
+func (s *Server) clusterInfo() string {
+	if s.cluster == nil {
+		return "cluster_enabled:0\r\n"
+	}
+	return "cluster_enabled:1\r\n"
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyHashSlot(t *testing.T) {
+	for key, expected := range map[string]int{
+		"somekey":       11058,
+		"foo":           12182,
+		"foo{hash_tag}": 2515,
+		"{foo}bar":      12182,
+	} {
+		if slot := keyHashSlot(key); slot != expected {
+			t.Errorf("Expected %q in slot %d, got %d", key, expected, slot)
+		}
+	}
+	if keyHashSlot("{user1000}.following") != keyHashSlot("{user1000}.followers") {
+		t.Error("Expected keys with the same hash tag in the same slot")
+	}
+	// An empty tag hashes the whole key
+	if keyHashSlot("{}foo") != int(crc16("{}foo"))%clusterSlots {
+		t.Error("Expected an empty hash tag to be ignored")
+	}
+}
+
+func TestClusterDisabled(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("CLUSTER", "INFO"), ErrorReply("ERR This instance has cluster support disabled"))
+	expectReply(t, c.do("ASKING"), ErrorReply("ERR This instance has cluster support disabled"))
+	if enabled := infoField(t, c, "cluster", "cluster_enabled"); enabled != "0" {
+		t.Errorf("Expected cluster_enabled:0, got %q", enabled)
+	}
+}
+
+// startClusterNode starts a server in cluster mode and returns a client of it,
+// its address and its node ID.
+func startClusterNode(t *testing.T) (*testClient, string, string) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.ClusterEnabled = true
+	srv, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveOnFreePort(t, srv)
+	c := dialTestServer(t, addr)
+	id, ok := c.do("CLUSTER", "MYID").(BulkString)
+	if !ok || len(id) != 40 {
+		t.Fatalf("Expected a node ID, got %v", id)
+	}
+	return c, addr, string(id)
+}
+
+func clusterInfoField(t *testing.T, c *testClient, field string) string {
+	t.Helper()
+	info, ok := c.do("CLUSTER", "INFO").(BulkString)
+	if !ok {
+		t.Fatalf("CLUSTER INFO did not return a bulk string")
+	}
+	for _, line := range strings.Split(string(info), "\r\n") {
+		if value, found := strings.CutPrefix(line, field+":"); found {
+			return value
+		}
+	}
+	return ""
+}
+
+func TestClusterRedirections(t *testing.T) {
+	a, addrA, idA := startClusterNode(t)
+	b, addrB, idB := startClusterNode(t)
+	_, portA, _ := net.SplitHostPort(addrA)
+	_, portB, _ := net.SplitHostPort(addrB)
+
+	expectReply(t, a.do("GET", "foo"), ErrorReply("CLUSTERDOWN Hash slot not served"))
+	expectReply(t, a.do("CLUSTER", "ADDSLOTSRANGE", "0", "8191"), okReply)
+	expectReply(t, b.do("CLUSTER", "ADDSLOTSRANGE", "8192", "16383"), okReply)
+	expectReply(t, a.do("CLUSTER", "MEET", "127.0.0.1", portB), okReply)
+
+	// Each node learns the slots of the other by gossip
+	waitForReply(t, a, ErrorReply("MOVED 12182 "+addrB), "GET", "foo")
+	waitForReply(t, b, ErrorReply("MOVED 2515 "+addrA), "GET", "foo{hash_tag}")
+	expectReply(t, b.do("CLUSTER", "ADDSLOTS", "100"), ErrorReply("ERR Slot 100 is already busy"))
+	if state := clusterInfoField(t, a, "cluster_state"); state != "ok" {
+		t.Errorf("Expected cluster_state:ok, got %q", state)
+	}
+	if known := clusterInfoField(t, b, "cluster_known_nodes"); known != "2" {
+		t.Errorf("Expected 2 known nodes, got %q", known)
+	}
+
+	expectReply(t, a.do("SET", "foo{hash_tag}", "v"), okReply)
+	expectReply(t, b.do("SET", "foo", "bar"), okReply)
+	expectReply(t, a.do("MSET", "{foo}1", "x", "foo{hash_tag}", "y"), ErrorReply("CROSSSLOT Keys in request don't hash to the same slot"))
+	expectReply(t, a.do("MGET", "foo{hash_tag}", "{hash_tag}2"), Array{BulkString("v"), NullBulk{}})
+	expectReply(t, a.do("EVAL", "return redis.call('GET', KEYS[1])", "1", "foo"), ErrorReply("MOVED 12182 "+addrB))
+	expectReply(t, a.do("SELECT", "1"), ErrorReply("ERR SELECT is not allowed in cluster mode"))
+	expectReply(t, a.do("CLUSTER", "KEYSLOT", "somekey"), Integer(11058))
+	expectReply(t, a.do("CLUSTER", "COUNTKEYSINSLOT", "2515"), Integer(1))
+
+	portANum, _ := strconv.Atoi(portA)
+	portBNum, _ := strconv.Atoi(portB)
+	expectReply(t, b.do("CLUSTER", "SLOTS"), Array{
+		Array{Integer(0), Integer(8191), Array{BulkString("127.0.0.1"), Integer(portANum), BulkString(idA)}},
+		Array{Integer(8192), Integer(16383), Array{BulkString("127.0.0.1"), Integer(portBNum), BulkString(idB)}},
+	})
+	nodes := string(a.do("CLUSTER", "NODES").(BulkString))
+	for _, expected := range []string{
+		idA + " " + addrA + "@" + portA + " myself,master - ",
+		" connected 0-8191\n",
+		idB + " " + addrB + "@" + portB + " master - ",
+		" connected 8192-16383\n",
+	} {
+		if !strings.Contains(nodes, expected) {
+			t.Errorf("Expected CLUSTER NODES to contain %q, got %q", expected, nodes)
+		}
+	}
+
+	expectReply(t, a.do("CLUSTER", "DELSLOTS", "2515"), okReply)
+	expectReply(t, a.do("GET", "foo{hash_tag}"), ErrorReply("CLUSTERDOWN Hash slot not served"))
+	expectReply(t, a.do("CLUSTER", "ADDSLOTS", "2515"), okReply)
+	expectReply(t, a.do("GET", "foo{hash_tag}"), BulkString("v"))
+}
+
+func TestClusterSlotMigration(t *testing.T) {
+	a, addrA, idA := startClusterNode(t)
+	b, addrB, idB := startClusterNode(t)
+	c, _, _ := startClusterNode(t)
+	_, portA, _ := net.SplitHostPort(addrA)
+	_, portB, _ := net.SplitHostPort(addrB)
+
+	a.do("CLUSTER", "ADDSLOTSRANGE", "0", "8191")
+	b.do("CLUSTER", "ADDSLOTSRANGE", "8192", "16383")
+	expectReply(t, a.do("CLUSTER", "MEET", "127.0.0.1", portB), okReply)
+	expectReply(t, c.do("CLUSTER", "MEET", "127.0.0.1", portA), okReply)
+	waitForReply(t, c, ErrorReply("MOVED 12182 "+addrB), "GET", "foo")
+
+	b.do("SET", "foo", "bar", "EX", "100")
+	b.do("RPUSH", "{foo}list", "a", "b")
+
+	// Slot 12182 of foo moves from b to a
+	expectReply(t, a.do("CLUSTER", "SETSLOT", "12182", "IMPORTING", idB), okReply)
+	expectReply(t, b.do("CLUSTER", "SETSLOT", "12182", "MIGRATING", idA), okReply)
+	expectReply(t, b.do("CLUSTER", "SETSLOT", "12182", "NODE", idA), ErrorReply("ERR Can't assign hashslot 12182 to a different node while I still hold keys for this hash slot."))
+	if nodes := string(b.do("CLUSTER", "NODES").(BulkString)); !strings.Contains(nodes, "[12182->-"+idA+"]") {
+		t.Errorf("Expected CLUSTER NODES to show the migration, got %q", nodes)
+	}
+
+	// Keys still on b are served there, missing ones are asked of a
+	expectReply(t, b.do("GET", "foo"), BulkString("bar"))
+	expectReply(t, b.do("GET", "{foo}missing"), ErrorReply("ASK 12182 "+addrA))
+	expectReply(t, b.do("MGET", "foo", "{foo}missing"), ErrorReply("TRYAGAIN Multiple keys request during rehashing of slot"))
+	expectReply(t, a.do("GET", "{foo}missing"), ErrorReply("MOVED 12182 "+addrB))
+	expectReply(t, a.do("ASKING"), okReply)
+	expectReply(t, a.do("SET", "{foo}new", "1"), okReply)
+	expectReply(t, a.do("GET", "{foo}new"), ErrorReply("MOVED 12182 "+addrB))
+
+	expectReply(t, b.do("CLUSTER", "COUNTKEYSINSLOT", "12182"), Integer(2))
+	keys := b.do("CLUSTER", "GETKEYSINSLOT", "12182", "10").(Array)
+	args := []string{"MIGRATE", "127.0.0.1", portA, "", "0", "5000", "KEYS"}
+	for _, key := range keys {
+		args = append(args, string(key.(BulkString)))
+	}
+	expectReply(t, b.do(args...), okReply)
+	expectReply(t, b.do("CLUSTER", "COUNTKEYSINSLOT", "12182"), Integer(0))
+	expectReply(t, b.do("GET", "foo"), ErrorReply("ASK 12182 "+addrA))
+	a.do("ASKING")
+	if ttl, ok := a.do("TTL", "foo").(Integer); !ok || ttl <= 0 {
+		t.Errorf("Expected MIGRATE to keep the TTL, got %v", ttl)
+	}
+	a.do("ASKING")
+	expectReply(t, a.do("LRANGE", "{foo}list", "0", "-1"), Array{BulkString("a"), BulkString("b")})
+
+	expectReply(t, a.do("CLUSTER", "SETSLOT", "12182", "NODE", idA), okReply)
+	expectReply(t, b.do("CLUSTER", "SETSLOT", "12182", "NODE", idA), okReply)
+	expectReply(t, a.do("GET", "foo"), BulkString("bar"))
+	expectReply(t, b.do("GET", "foo"), ErrorReply("MOVED 12182 "+addrA))
+	// The third node learns the new owner by gossip
+	waitForReply(t, c, ErrorReply("MOVED 12182 "+addrA), "GET", "foo")
+	expectReply(t, c.do("GET", "somekey"), ErrorReply("MOVED 11058 "+addrB))
+}
+
+func TestDumpRestore(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	c.do("HSET", "h", "f", "v")
+	payload, ok := c.do("DUMP", "h").(BulkString)
+	if !ok {
+		t.Fatalf("Expected DUMP to return a payload")
+	}
+	expectReply(t, c.do("DUMP", "missing"), NullBulk{})
+	expectReply(t, c.do("RESTORE", "copy", "0", string(payload)), okReply)
+	expectReply(t, c.do("HGETALL", "copy"), Array{BulkString("f"), BulkString("v")})
+	expectReply(t, c.do("TTL", "copy"), Integer(-1))
+	expectReply(t, c.do("RESTORE", "copy", "0", string(payload)), ErrorReply("BUSYKEY Target key name already exists."))
+	expectReply(t, c.do("RESTORE", "copy", "100000", string(payload), "REPLACE"), okReply)
+	if ttl, ok := c.do("TTL", "copy").(Integer); !ok || ttl <= 0 {
+		t.Errorf("Expected RESTORE to set the TTL, got %v", ttl)
+	}
+	expectReply(t, c.do("RESTORE", "bad", "0", "garbage"), ErrorReply("ERR DUMP payload version or checksum are wrong"))
+	expectReply(t, c.do("RESTORE", "bad", "-1", string(payload)), ErrorReply("ERR Invalid TTL value, must be >= 0"))
+	expectReply(t, c.do("RESTORE", "bad", "9223372036854775807", string(payload)), ErrorReply("ERR invalid expire time in 'restore' command"))
+	expectReply(t, c.do("DEL", "h", "copy", "missing"), Integer(2))
+}
+
+// RESTORE is logged with an absolute deadline, and MIGRATE as the deletion
+// of the keys that moved.
+func TestDumpRestorePropagate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	srv, c := startServerWithAOF(t, path)
+	_, targetAddr := startServerOnFreePort(t)
+	host, port, _ := net.SplitHostPort(targetAddr)
+	c.do("SET", "a", "1")
+	c.do("SET", "b", "2")
+	payload := c.do("DUMP", "a").(BulkString)
+	c.do("RESTORE", "c", "100000", string(payload))
+	c.do("MIGRATE", host, port, "", "0", "1000", "KEYS", "a", "b")
+	srv.aof.close()
+
+	_, c2 := startServerWithAOF(t, path)
+	expectReply(t, c2.do("MGET", "a", "b", "c"), Array{NullBulk{}, NullBulk{}, BulkString("1")})
+	if ttl, ok := c2.do("TTL", "c").(Integer); !ok || ttl <= 0 {
+		t.Errorf("Expected RESTORE to keep the TTL, got %v", ttl)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	source := dialTestServer(t, addr)
+	_, targetAddr := startServerOnFreePort(t)
+	target := dialTestServer(t, targetAddr)
+	host, port, _ := net.SplitHostPort(targetAddr)
+
+	source.do("SET", "a", "1")
+	source.do("SET", "b", "2")
+	target.do("SELECT", "1")
+	target.do("SET", "b", "taken")
+
+	expectReply(t, source.do("MIGRATE", host, port, "a", "1", "1000"), okReply)
+	expectReply(t, source.do("EXISTS", "a"), Integer(0))
+	expectReply(t, target.do("GET", "a"), BulkString("1"))
+	expectReply(t, source.do("MIGRATE", host, port, "missing", "1", "1000"), SimpleString("NOKEY"))
+	expectReply(t, source.do("MIGRATE", host, port, "b", "1", "1000"), ErrorReply("ERR Target instance replied with error: BUSYKEY Target key name already exists."))
+	expectReply(t, source.do("GET", "b"), BulkString("2"))
+	expectReply(t, source.do("MIGRATE", host, port, "", "1", "1000", "COPY", "REPLACE", "KEYS", "b"), okReply)
+	expectReply(t, source.do("GET", "b"), BulkString("2"))
+	expectReply(t, target.do("GET", "b"), BulkString("2"))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, closedPort, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+	expectReply(t, source.do("MIGRATE", "127.0.0.1", closedPort, "b", "0", "1000"), ErrorReply("IOERR error or timeout connecting to the client"))
+}
+
+// MIGRATE holds no lock while it waits for the target, and keeps the keys a
+// client changed in the meantime.
+func TestMigrateReleasesLocksDuringRoundTrip(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		// Answers the RESTORE of a and b once the test lets it
+		reader := NewRespReader(conn)
+		for i := 0; i < 2; i++ {
+			if _, _, err := reader.ReadCommand(); err != nil {
+				return
+			}
+		}
+		received <- conn
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	_, addr := startServerOnFreePort(t)
+	source, other := dialTestServer(t, addr), dialTestServer(t, addr)
+	source.do("SET", "a", "1")
+	source.do("SET", "b", "2")
+	done := make(chan Reply)
+	go func() { done <- source.do("MIGRATE", host, port, "", "0", "5000", "KEYS", "a", "b") }()
+
+	conn := <-received
+	defer conn.Close()
+	other.conn.SetDeadline(time.Now().Add(time.Second))
+	expectReply(t, other.do("GET", "a"), BulkString("1"))
+	expectReply(t, other.do("SET", "b", "changed"), okReply)
+	conn.Write([]byte("+OK\r\n+OK\r\n"))
+	expectReply(t, <-done, okReply)
+	expectReply(t, other.do("MGET", "a", "b"), Array{NullBulk{}, BulkString("changed")})
+
+	other.do("MULTI")
+	expectReply(t, other.do("MIGRATE", host, port, "b", "0", "1000"), ErrorReply("ERR Command not allowed inside a transaction"))
+}
@@ -0,0 +1,158 @@
+package main
+
+const (
+	cmdWrite        = 1 << iota // modifies the keyspace
+	cmdNoKeyspace               // does not touch the selected database
+	cmdTransaction              // MULTI/EXEC family, never queued
+	cmdNoMulti                  // rejected inside MULTI
+	cmdPubSub                   // allowed while the client is subscribed
+	cmdDenyOOM                  // may grow the dataset, refused above maxmemory
+	cmdAllDatabases             // needs the lock of every database
+	cmdNoScript                 // rejected inside EVAL
+	cmdSelfLocking              // takes the locks it needs and propagates its writes itself
+)
+
+// commandInfo describes how the server runs a command. Key positions count
+// the command name as position 0, and a negative lastKey counts from the end.
+// Commands with keys elsewhere are listed in movableKeys.
+type commandInfo struct {
+	flags    int
+	firstKey int
+	lastKey  int
+	keyStep  int
+}
+
+var commandTable = map[string]commandInfo{
+	"PING":          {flags: cmdNoKeyspace | cmdPubSub},
+	"ECHO":          {flags: cmdNoKeyspace},
+	"SELECT":        {flags: cmdNoKeyspace},
+	"SET":           {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"GET":           {0, 1, 1, 1},
+	"DEL":           {cmdWrite, 1, -1, 1},
+	"INCR":          {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"INCRBY":        {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"DECR":          {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"DECRBY":        {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"INCRBYFLOAT":   {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"APPEND":        {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"STRLEN":        {0, 1, 1, 1},
+	"GETRANGE":      {0, 1, 1, 1},
+	"SETRANGE":      {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"GETSET":        {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"GETDEL":        {cmdWrite, 1, 1, 1},
+	"SETNX":         {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"MSET":          {cmdWrite | cmdDenyOOM, 1, -1, 2},
+	"MSETNX":        {cmdWrite | cmdDenyOOM, 1, -1, 2},
+	"MGET":          {0, 1, -1, 1},
+	"DUMP":          {0, 1, 1, 1},
+	"RESTORE":       {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"MIGRATE":       {flags: cmdWrite | cmdNoMulti | cmdNoScript | cmdSelfLocking},
+	"EXPIRE":        {cmdWrite, 1, 1, 1},
+	"PEXPIRE":       {cmdWrite, 1, 1, 1},
+	"PERSIST":       {cmdWrite, 1, 1, 1},
+	"EXPIREAT":      {cmdWrite, 1, 1, 1},
+	"PEXPIREAT":     {cmdWrite, 1, 1, 1},
+	"TTL":           {0, 1, 1, 1},
+	"PTTL":          {0, 1, 1, 1},
+	"LPUSH":         {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"RPUSH":         {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"LPOP":          {cmdWrite, 1, 1, 1},
+	"RPOP":          {cmdWrite, 1, 1, 1},
+	"LRANGE":        {0, 1, 1, 1},
+	"LLEN":          {0, 1, 1, 1},
+	"LMOVE":         {cmdWrite | cmdDenyOOM, 1, 2, 1},
+	"BLPOP":         {cmdWrite, 1, -2, 1},
+	"BRPOP":         {cmdWrite, 1, -2, 1},
+	"BLMOVE":        {cmdWrite | cmdDenyOOM, 1, 2, 1},
+	"HSET":          {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"HGET":          {0, 1, 1, 1},
+	"HDEL":          {cmdWrite, 1, 1, 1},
+	"HGETALL":       {0, 1, 1, 1},
+	"HINCRBY":       {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"SADD":          {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"SREM":          {cmdWrite, 1, 1, 1},
+	"SMEMBERS":      {0, 1, 1, 1},
+	"SISMEMBER":     {0, 1, 1, 1},
+	"SINTER":        {0, 1, -1, 1},
+	"SUNION":        {0, 1, -1, 1},
+	"ZADD":          {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"ZINCRBY":       {cmdWrite | cmdDenyOOM, 1, 1, 1},
+	"ZRANGE":        {0, 1, 1, 1},
+	"ZRANGEBYSCORE": {0, 1, 1, 1},
+	"ZRANK":         {0, 1, 1, 1},
+	"KEYS":          {},
+	"SCAN":          {},
+	"EXISTS":        {0, 1, -1, 1},
+	"TYPE":          {0, 1, 1, 1},
+	"DBSIZE":        {},
+	"RANDOMKEY":     {},
+	"RENAME":        {cmdWrite, 1, 2, 1},
+	"RENAMENX":      {cmdWrite, 1, 2, 1},
+	"MOVE":          {cmdWrite | cmdAllDatabases, 1, 1, 1},
+	"FLUSHDB":       {flags: cmdWrite},
+	"FLUSHALL":      {flags: cmdWrite | cmdAllDatabases},
+	"COMPACT":       {},
+	"BGREWRITEAOF":  {flags: cmdNoKeyspace | cmdNoMulti | cmdNoScript},
+	"SAVE":          {flags: cmdNoKeyspace | cmdNoMulti | cmdNoScript},
+	"BGSAVE":        {flags: cmdNoKeyspace | cmdNoMulti | cmdNoScript},
+	"LASTSAVE":      {flags: cmdNoKeyspace},
+	"SHUTDOWN":      {flags: cmdNoKeyspace | cmdNoMulti | cmdNoScript},
+	"SUBSCRIBE":     {flags: cmdNoKeyspace | cmdNoMulti | cmdPubSub | cmdNoScript},
+	"UNSUBSCRIBE":   {flags: cmdNoKeyspace | cmdNoMulti | cmdPubSub | cmdNoScript},
+	"PSUBSCRIBE":    {flags: cmdNoKeyspace | cmdNoMulti | cmdPubSub | cmdNoScript},
+	"PUNSUBSCRIBE":  {flags: cmdNoKeyspace | cmdNoMulti | cmdPubSub | cmdNoScript},
+	"PUBLISH":       {flags: cmdNoKeyspace},
+	"REPLICAOF":     {flags: cmdNoKeyspace | cmdNoMulti | cmdNoScript},
+	"SYNC":          {flags: cmdNoKeyspace | cmdNoMulti | cmdNoScript},
+	"REPLCONF":      {flags: cmdNoKeyspace | cmdNoMulti | cmdNoScript},
+	"INFO":          {flags: cmdNoKeyspace | cmdNoScript},
+	"SLOWLOG":       {flags: cmdNoKeyspace},
+	"MONITOR":       {flags: cmdNoKeyspace | cmdNoMulti | cmdNoScript},
+	"AUTH":          {flags: cmdNoKeyspace | cmdNoScript},
+	"ACL":           {flags: cmdNoKeyspace | cmdNoMulti},
+	"CONFIG":        {flags: cmdNoKeyspace},
+	"CLIENT":        {flags: cmdNoKeyspace},
+	"CLUSTER":       {flags: cmdNoKeyspace | cmdNoMulti | cmdNoScript},
+	"ASKING":        {flags: cmdNoKeyspace},
+	"EVAL":          {flags: cmdAllDatabases | cmdDenyOOM | cmdNoScript},
+	"EVALSHA":       {flags: cmdAllDatabases | cmdDenyOOM | cmdNoScript},
+	"SCRIPT":        {flags: cmdNoKeyspace | cmdNoScript},
+	"MULTI":         {flags: cmdTransaction | cmdNoScript},
+	"EXEC":          {flags: cmdTransaction | cmdNoScript},
+	"DISCARD":       {flags: cmdTransaction | cmdNoScript},
+	"WATCH":         {flags: cmdTransaction | cmdNoScript},
+	"UNWATCH":       {flags: cmdTransaction | cmdNoScript},
+}
+
+// movableKeys finds the keys of the commands whose key positions depend on
+// their other arguments.
+var movableKeys = map[string]func(args []string) []string{
+	"WATCH":   func(args []string) []string { return args },
+	"EVAL":    scriptKeys,
+	"EVALSHA": scriptKeys,
+	"MIGRATE": migrateKeys,
+}
+
+// commandKeys returns the key arguments of a command, args excluding the
+// command name.
+func commandKeys(command string, args []string) []string {
+	if find, ok := movableKeys[command]; ok {
+		return find(args)
+	}
+	info := commandTable[command]
+	if info.firstKey == 0 || len(args) < info.firstKey {
+		return nil
+	}
+	last := info.lastKey
+	if last < 0 {
+		last = len(args) + 1 + last
+	}
+	if last > len(args) {
+		last = len(args)
+	}
+	var keys []string
+	for i := info.firstKey; i <= last; i += info.keyStep {
+		keys = append(keys, args[i-1])
+	}
+	return keys
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the startup configuration of the server: the defaults, then the
+// config file, then the command line flags, which override the file.
+type Config struct {
+	Bind           string // space separated addresses, empty for every interface
+	Port           int
+	TLSPort        int
+	TLSCertFile    string
+	TLSKeyFile     string
+	TLSCACertFile  string
+	TLSAuthClients bool
+	MetricsPort    int // HTTP port serving /metrics, 0 to disable it
+	Databases      int
+	MaxClients     int
+	Timeout        int // seconds a client may stay idle, 0 for no limit
+	ShutdownWait   int // seconds clients get to finish their commands on shutdown
+
+	AppendOnly     bool
+	AppendFilename string
+	AppendFsync    string
+	DBFilename     string
+	SaveOnShutdown bool // save a snapshot on shutdown when the append only file is off
+
+	ReplicaOf       string
+	ReplicaReadOnly bool
+	ReplTimeout     int // seconds without data from the leader before a follower reconnects
+	RequirePass     string
+	MasterUser      string
+	MasterAuth      string
+
+	MaxMemory       string
+	MaxMemoryPolicy string
+
+	SlowlogLogSlowerThan int // microseconds, negative to disable the slow log
+	SlowlogMaxLen        int
+
+	NotifyKeyspaceEvents string // event classes published over pub/sub, see parseNotifyFlags
+
+	LuaTimeLimit int // milliseconds after which a script is killed
+
+	ClusterEnabled    bool
+	ClusterAnnounceIP string // address other nodes reach this one at, see myAddr
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Port:            9736,
+		TLSAuthClients:  true,
+		Databases:       defaultDBCount,
+		MaxClients:      10000,
+		ShutdownWait:    10,
+		AppendFilename:  "appendonly.aof",
+		AppendFsync:     fsyncEverySec,
+		DBFilename:      "dump.kvsnap",
+		ReplicaReadOnly: true,
+		ReplTimeout:     60,
+		MaxMemory:       "0",
+		MaxMemoryPolicy: policyNoEviction,
+
+		SlowlogLogSlowerThan: 10000,
+		SlowlogMaxLen:        128,
+
+		LuaTimeLimit: int(luaTimeLimit / time.Millisecond),
+	}
+}
+
+// registerFlags binds every setting to a flag named like its config file
+// directive, so both are parsed the same way.
+func (cfg *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Bind, "bind", cfg.Bind, "addresses to listen on, separated by spaces; every interface when empty")
+	fs.IntVar(&cfg.Port, "port", cfg.Port, "plaintext port to listen on, 0 to only listen with TLS")
+	fs.IntVar(&cfg.TLSPort, "tls-port", cfg.TLSPort, "TLS port to listen on, 0 to disable TLS")
+	fs.StringVar(&cfg.TLSCertFile, "tls-cert-file", cfg.TLSCertFile, "PEM certificate of the TLS listener")
+	fs.StringVar(&cfg.TLSKeyFile, "tls-key-file", cfg.TLSKeyFile, "PEM private key of the TLS listener")
+	fs.StringVar(&cfg.TLSCACertFile, "tls-ca-cert-file", cfg.TLSCACertFile, "PEM CA bundle to verify client certificates against")
+	fs.BoolVar(&cfg.TLSAuthClients, "tls-auth-clients", cfg.TLSAuthClients, "require a client certificate when -tls-ca-cert-file is set")
+	fs.IntVar(&cfg.MetricsPort, "metrics-port", cfg.MetricsPort, "HTTP port serving Prometheus metrics at /metrics, 0 to disable it")
+	fs.IntVar(&cfg.Databases, "databases", cfg.Databases, "number of databases")
+	fs.IntVar(&cfg.MaxClients, "maxclients", cfg.MaxClients, "maximum number of connected clients")
+	fs.IntVar(&cfg.Timeout, "timeout", cfg.Timeout, "close clients idle for this many seconds, 0 to never close them")
+	fs.IntVar(&cfg.ShutdownWait, "shutdown-timeout", cfg.ShutdownWait, "seconds clients get to finish their commands on shutdown before they are disconnected")
+	fs.BoolVar(&cfg.AppendOnly, "appendonly", cfg.AppendOnly, "log every write command and replay the log on startup")
+	fs.StringVar(&cfg.AppendFilename, "appendfilename", cfg.AppendFilename, "path of the append only file")
+	fs.StringVar(&cfg.AppendFsync, "appendfsync", cfg.AppendFsync, "fsync policy of the append only file: always, everysec or no")
+	fs.StringVar(&cfg.DBFilename, "dbfilename", cfg.DBFilename, "path of the snapshot written by SAVE and BGSAVE")
+	fs.BoolVar(&cfg.SaveOnShutdown, "save-on-shutdown", cfg.SaveOnShutdown, "save a snapshot to -dbfilename on shutdown when the append only file is off")
+	fs.StringVar(&cfg.ReplicaOf, "replicaof", cfg.ReplicaOf, "follow the leader at \"host port\"")
+	fs.BoolVar(&cfg.ReplicaReadOnly, "replica-read-only", cfg.ReplicaReadOnly, "reject writes from clients while following a leader")
+	fs.IntVar(&cfg.ReplTimeout, "repl-timeout", cfg.ReplTimeout, "seconds without data from the leader after which a follower reconnects")
+	fs.StringVar(&cfg.RequirePass, "requirepass", cfg.RequirePass, "password clients must send with AUTH")
+	fs.StringVar(&cfg.MasterUser, "masteruser", cfg.MasterUser, "user to authenticate as with the leader")
+	fs.StringVar(&cfg.MasterAuth, "masterauth", cfg.MasterAuth, "password to authenticate with the leader")
+	fs.StringVar(&cfg.MaxMemory, "maxmemory", cfg.MaxMemory, "memory limit of the dataset, such as 100mb; 0 for no limit")
+	fs.StringVar(&cfg.MaxMemoryPolicy, "maxmemory-policy", cfg.MaxMemoryPolicy, "what to evict at the memory limit: noeviction, allkeys-lru, allkeys-lfu, volatile-lru, volatile-ttl or allkeys-random")
+	fs.IntVar(&cfg.SlowlogLogSlowerThan, "slowlog-log-slower-than", cfg.SlowlogLogSlowerThan, "log commands taking at least this many microseconds in the slow log, -1 to disable it")
+	fs.IntVar(&cfg.SlowlogMaxLen, "slowlog-max-len", cfg.SlowlogMaxLen, "number of entries the slow log keeps")
+	fs.IntVar(&cfg.LuaTimeLimit, "lua-time-limit", cfg.LuaTimeLimit, "milliseconds after which a script is killed; the writes it made until then stay")
+	fs.StringVar(&cfg.NotifyKeyspaceEvents, "notify-keyspace-events", cfg.NotifyKeyspaceEvents, "keyspace events to publish, such as KEA; empty to publish none")
+	fs.BoolVar(&cfg.ClusterEnabled, "cluster-enabled", cfg.ClusterEnabled, "serve the hash slots assigned with CLUSTER ADDSLOTS and redirect clients for the others")
+	fs.StringVar(&cfg.ClusterAnnounceIP, "cluster-announce-ip", cfg.ClusterAnnounceIP, "address announced to the other cluster nodes; the one they were met at when empty")
+}
+
+// parseConfig reads the configuration from the command line arguments, using
+// fs for the flags, and from the config file they name with -config.
+func parseConfig(fs *flag.FlagSet, args []string) (Config, error) {
+	cfg := DefaultConfig()
+	cfg.registerFlags(fs)
+	configFile := fs.String("config", "", "redis.conf style file to read the settings from; flags override it")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	if *configFile != "" {
+		// Flags given on the command line override the file
+		explicit := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+		if err := loadConfigFile(fs, *configFile, explicit); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, cfg.validate()
+}
+
+// loadConfigFile applies the directives of a redis.conf style file, one
+// "name value..." per line with # comments, except those in skip.
+func loadConfigFile(fs *flag.FlagSet, path string, skip map[string]bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields, ok := splitArgs(line)
+		if !ok {
+			return fmt.Errorf("%s:%d: unbalanced quotes", path, lineNo)
+		}
+		name := strings.ToLower(fields[0])
+		f := fs.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("%s:%d: unknown directive %q", path, lineNo, fields[0])
+		}
+		if skip[name] {
+			continue
+		}
+		value := strings.Join(fields[1:], " ")
+		if _, isBool := f.Value.(interface{ IsBoolFlag() bool }); isBool {
+			value = yesNoToBool(value)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: invalid %s %q", path, lineNo, name, value)
+		}
+	}
+	return scanner.Err()
+}
+
+// yesNoToBool translates the yes and no of redis.conf for strconv.ParseBool.
+func yesNoToBool(value string) string {
+	switch strings.ToLower(value) {
+	case "yes":
+		return "true"
+	case "no":
+		return "false"
+	}
+	return value
+}
+
+func boolToYesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func (cfg *Config) validate() error {
+	switch {
+	case cfg.Port < 0 || cfg.Port > 65535:
+		return fmt.Errorf("invalid port %d", cfg.Port)
+	case cfg.TLSPort < 0 || cfg.TLSPort > 65535:
+		return fmt.Errorf("invalid tls-port %d", cfg.TLSPort)
+	case cfg.MetricsPort < 0 || cfg.MetricsPort > 65535:
+		return fmt.Errorf("invalid metrics-port %d", cfg.MetricsPort)
+	case cfg.Port == 0 && cfg.TLSPort == 0:
+		return errors.New("nothing to listen on, set port or tls-port")
+	case cfg.Databases < 1 || cfg.Databases > maxDBCount:
+		return fmt.Errorf("databases must be between 1 and %d", maxDBCount)
+	case cfg.MaxClients < 1:
+		return errors.New("maxclients must be at least 1")
+	case cfg.Timeout < 0:
+		return errors.New("timeout must not be negative")
+	case cfg.ShutdownWait < 0:
+		return errors.New("shutdown-timeout must not be negative")
+	case cfg.ReplTimeout < 1:
+		return errors.New("repl-timeout must be at least 1")
+	case cfg.SlowlogMaxLen < 0:
+		return errors.New("slowlog-max-len must not be negative")
+	case cfg.LuaTimeLimit < 1:
+		return errors.New("lua-time-limit must be at least 1")
+	case !validFsyncPolicy(cfg.AppendFsync):
+		return fmt.Errorf("invalid appendfsync %q", cfg.AppendFsync)
+	case !validEvictionPolicy(cfg.MaxMemoryPolicy):
+		return fmt.Errorf("invalid maxmemory-policy %q", cfg.MaxMemoryPolicy)
+	case cfg.ReplicaOf != "" && len(strings.Fields(cfg.ReplicaOf)) != 2:
+		return fmt.Errorf("invalid replicaof %q, expected \"host port\"", cfg.ReplicaOf)
+	case cfg.ReplicaOf != "" && cfg.ClusterEnabled:
+		return errors.New("replicaof is not allowed with cluster-enabled")
+	}
+	if _, err := parseNotifyFlags(cfg.NotifyKeyspaceEvents); err != nil {
+		return fmt.Errorf("invalid notify-keyspace-events %q: %v", cfg.NotifyKeyspaceEvents, err)
+	}
+	_, err := parseMemory(cfg.MaxMemory)
+	return err
+}
+
+// configParam is a setting as CONFIG GET and CONFIG SET see it.
+type configParam struct {
+	name string
+	get  func(s *Server) string
+	set  func(s *Server, value string) error // nil for settings only read at startup
+}
+
+// startupParam is a setting that CONFIG SET cannot change.
+func startupParam(name string, get func(cfg *Config) string) configParam {
+	return configParam{name: name, get: func(s *Server) string {
+		s.configMutex.Lock()
+		defer s.configMutex.Unlock()
+		return get(&s.config)
+	}}
+}
+
+var configParams = []configParam{
+	startupParam("bind", func(cfg *Config) string { return cfg.Bind }),
+	{name: "port", get: func(s *Server) string {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return strconv.Itoa(s.port)
+	}},
+	startupParam("tls-port", func(cfg *Config) string { return strconv.Itoa(cfg.TLSPort) }),
+	startupParam("tls-cert-file", func(cfg *Config) string { return cfg.TLSCertFile }),
+	startupParam("tls-key-file", func(cfg *Config) string { return cfg.TLSKeyFile }),
+	startupParam("tls-ca-cert-file", func(cfg *Config) string { return cfg.TLSCACertFile }),
+	startupParam("tls-auth-clients", func(cfg *Config) string { return boolToYesNo(cfg.TLSAuthClients) }),
+	startupParam("metrics-port", func(cfg *Config) string { return strconv.Itoa(cfg.MetricsPort) }),
+	{name: "databases", get: func(s *Server) string { return strconv.Itoa(len(s.databases)) }},
+	{
+		name: "maxclients",
+		get:  func(s *Server) string { return strconv.FormatInt(s.maxClients.Load(), 10) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 1 {
+				return errors.New("argument must be a positive integer")
+			}
+			s.maxClients.Store(n)
+			return nil
+		},
+	},
+	{
+		name: "timeout",
+		get:  func(s *Server) string { return strconv.FormatInt(s.timeout.Load(), 10) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			s.timeout.Store(n)
+			return nil
+		},
+	},
+	startupParam("shutdown-timeout", func(cfg *Config) string { return strconv.Itoa(cfg.ShutdownWait) }),
+	startupParam("appendonly", func(cfg *Config) string { return boolToYesNo(cfg.AppendOnly) }),
+	startupParam("appendfilename", func(cfg *Config) string { return cfg.AppendFilename }),
+	startupParam("appendfsync", func(cfg *Config) string { return cfg.AppendFsync }),
+	startupParam("dbfilename", func(cfg *Config) string { return cfg.DBFilename }),
+	startupParam("save-on-shutdown", func(cfg *Config) string { return boolToYesNo(cfg.SaveOnShutdown) }),
+	startupParam("cluster-enabled", func(cfg *Config) string { return boolToYesNo(cfg.ClusterEnabled) }),
+	startupParam("cluster-announce-ip", func(cfg *Config) string { return cfg.ClusterAnnounceIP }),
+	{
+		name: "repl-timeout",
+		get: func(s *Server) string {
+			repl := s.replication
+			repl.mutex.Lock()
+			defer repl.mutex.Unlock()
+			return strconv.Itoa(int(repl.timeout / time.Second))
+		},
+		set: func(s *Server, value string) error {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 1 {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			repl := s.replication
+			repl.mutex.Lock()
+			defer repl.mutex.Unlock()
+			repl.timeout = time.Duration(seconds) * time.Second
+			return nil
+		},
+	},
+	{
+		name: "replica-read-only",
+		get: func(s *Server) string {
+			repl := s.replication
+			repl.mutex.Lock()
+			defer repl.mutex.Unlock()
+			return boolToYesNo(repl.readOnly)
+		},
+		set: func(s *Server, value string) error {
+			readOnly, err := strconv.ParseBool(yesNoToBool(value))
+			if err != nil {
+				return errors.New("argument must be 'yes' or 'no'")
+			}
+			repl := s.replication
+			repl.mutex.Lock()
+			defer repl.mutex.Unlock()
+			repl.readOnly = readOnly
+			repl.updateRejecting()
+			return nil
+		},
+	},
+	{
+		name: "requirepass",
+		get: func(s *Server) string {
+			s.configMutex.Lock()
+			defer s.configMutex.Unlock()
+			return s.config.RequirePass
+		},
+		set: func(s *Server, value string) error {
+			s.configMutex.Lock()
+			defer s.configMutex.Unlock()
+			s.config.RequirePass = value
+			s.acl.setDefaultPassword(value)
+			return nil
+		},
+	},
+	{
+		name: "masteruser",
+		get: func(s *Server) string {
+			repl := s.replication
+			repl.mutex.Lock()
+			defer repl.mutex.Unlock()
+			return repl.masterUser
+		},
+		set: func(s *Server, value string) error {
+			repl := s.replication
+			repl.mutex.Lock()
+			defer repl.mutex.Unlock()
+			repl.masterUser = value
+			return nil
+		},
+	},
+	{
+		name: "masterauth",
+		get: func(s *Server) string {
+			repl := s.replication
+			repl.mutex.Lock()
+			defer repl.mutex.Unlock()
+			return repl.masterAuth
+		},
+		set: func(s *Server, value string) error {
+			repl := s.replication
+			repl.mutex.Lock()
+			defer repl.mutex.Unlock()
+			repl.masterAuth = value
+			return nil
+		},
+	},
+	{
+		name: "maxmemory",
+		get: func(s *Server) string {
+			maxMemory, _, _ := s.eviction.config()
+			return strconv.FormatInt(maxMemory, 10)
+		},
+		set: func(s *Server, value string) error {
+			limit, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			_, policy, _ := s.eviction.config()
+			return s.eviction.setMaxMemory(limit, policy)
+		},
+	},
+	{
+		name: "maxmemory-policy",
+		get: func(s *Server) string {
+			_, policy, _ := s.eviction.config()
+			return policy
+		},
+		set: func(s *Server, value string) error {
+			maxMemory, _, _ := s.eviction.config()
+			return s.eviction.setMaxMemory(maxMemory, strings.ToLower(value))
+		},
+	},
+	{
+		name: "slowlog-log-slower-than",
+		get:  func(s *Server) string { return strconv.FormatInt(s.slowlog.threshold.Load(), 10) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			s.slowlog.threshold.Store(n)
+			return nil
+		},
+	},
+	{
+		name: "slowlog-max-len",
+		get:  func(s *Server) string { return strconv.FormatInt(s.slowlog.maxLen.Load(), 10) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return errors.New("argument must be a non-negative integer")
+			}
+			s.slowlog.setMaxLen(n)
+			return nil
+		},
+	},
+	{
+		name: "lua-time-limit",
+		get:  func(s *Server) string { return strconv.FormatInt(s.scripts.timeLimit.Load(), 10) },
+		set: func(s *Server, value string) error {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 1 {
+				return errors.New("argument must be a positive integer")
+			}
+			s.scripts.timeLimit.Store(n)
+			return nil
+		},
+	},
+	{
+		name: "notify-keyspace-events",
+		get:  func(s *Server) string { return formatNotifyFlags(int(s.notifyFlags.Load())) },
+		set: func(s *Server, value string) error {
+			flags, err := parseNotifyFlags(value)
+			if err != nil {
+				return err
+			}
+			s.notifyFlags.Store(int64(flags))
+			return nil
+		},
+	},
+}
+
+// configCommand implements CONFIG GET pattern... and CONFIG SET name value....
+func (s *Server) configCommand(args []string) Reply {
+	if len(args) == 0 {
+		return ErrorReply("ERR wrong number of arguments for 'config' command")
+	}
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if len(args) < 2 {
+			return ErrorReply("ERR wrong number of arguments for 'config|get' command")
+		}
+		reply := Array{}
+		for _, param := range configParams {
+			for _, pattern := range args[1:] {
+				if globMatch(strings.ToLower(pattern), param.name) {
+					reply = append(reply, BulkString(param.name), BulkString(param.get(s)))
+					break
+				}
+			}
+		}
+		return reply
+	case "SET":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return ErrorReply("ERR wrong number of arguments for 'config|set' command")
+		}
+		// Every name is checked before anything changes, and the values
+		// already applied are restored when a later one is rejected, so the
+		// pairs are set all together or not at all.
+		params := make([]*configParam, 0, len(args)/2)
+		for i := 1; i < len(args); i += 2 {
+			name := strings.ToLower(args[i])
+			var param *configParam
+			for j := range configParams {
+				if configParams[j].name == name {
+					param = &configParams[j]
+				}
+			}
+			if param == nil {
+				return ErrorReply(fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i]))
+			}
+			if param.set == nil {
+				return ErrorReply(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name))
+			}
+			for _, other := range params {
+				if other == param {
+					return ErrorReply(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - duplicate parameter", name))
+				}
+			}
+			params = append(params, param)
+		}
+		previous := make([]string, len(params))
+		for i, param := range params {
+			previous[i] = param.get(s)
+		}
+		for i, param := range params {
+			if err := param.set(s, args[2*i+2]); err != nil {
+				for j := i - 1; j >= 0; j-- {
+					params[j].set(s, previous[j])
+				}
+				return ErrorReply(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", param.name, err))
+			}
+		}
+		return okReply
+	}
+	return ErrorReply(fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", args[0]))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseConfigFileAndOverrides(t *testing.T) {
+	path := writeConfigFile(t, `# A comment
+port 7000
+bind 127.0.0.1 ::1
+databases 4
+
+appendonly yes
+appendfilename "my log.aof"
+replicaof 10.0.0.1 6379
+maxmemory 100mb
+timeout 30
+`)
+	cfg, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", path, "-port", "7001", "-appendonly=false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := DefaultConfig()
+	expected.Port = 7001
+	expected.Bind = "127.0.0.1 ::1"
+	expected.Databases = 4
+	expected.AppendFilename = "my log.aof"
+	expected.ReplicaOf = "10.0.0.1 6379"
+	expected.MaxMemory = "100mb"
+	expected.Timeout = 30
+	if cfg != expected {
+		t.Errorf("Expected %+v, got %+v", expected, cfg)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for content, expected := range map[string]string{
+		"port 7000\nnosuchdirective 1\n":                 "redis.conf:2: unknown directive \"nosuchdirective\"",
+		"databases many\n":                               "redis.conf:1: invalid databases \"many\"",
+		"appendonly maybe\n":                             "redis.conf:1: invalid appendonly \"maybe\"",
+		"bind \"127.0.0.1\n":                             "redis.conf:1: unbalanced quotes",
+		"databases 0\n":                                  "databases must be between 1 and 65536",
+		"maxmemory-policy sometimes\n":                   "invalid maxmemory-policy \"sometimes\"",
+		"port 0\n":                                       "nothing to listen on, set port or tls-port",
+		"replicaof 10.0.0.1 6379\ncluster-enabled yes\n": "replicaof is not allowed with cluster-enabled",
+	} {
+		_, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", writeConfigFile(t, content)})
+		if err == nil || !strings.HasSuffix(err.Error(), expected) {
+			t.Errorf("Expected error %q for %q, got %v", expected, content, err)
+		}
+	}
+	if _, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", filepath.Join(t.TempDir(), "missing.conf")}); err == nil {
+		t.Error("Expected an error for a missing config file")
+	}
+}
+
+func startServerWithConfig(t *testing.T, cfg Config) (*Server, *testClient) {
+	t.Helper()
+	srv, err := NewServerWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, dialTestServer(t, serveOnFreePort(t, srv))
+}
+
+func TestDatabaseCount(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Databases = 2
+	_, c := startServerWithConfig(t, cfg)
+
+	expectReply(t, c.do("SELECT", "1"), SimpleString("OK"))
+	expectReply(t, c.do("SELECT", "2"), ErrorReply("ERR DB index is out of range"))
+	expectReply(t, c.do("CONFIG", "GET", "databases"), Array{BulkString("databases"), BulkString("2")})
+	expectReply(t, c.do("ACL", "SETUSER", "bob", "db=2"), ErrorReply(`ERR Error in ACL SETUSER modifier 'db=2': invalid database index "2"`))
+}
+
+func TestConfigGetSet(t *testing.T) {
+	srv, c := startServerWithConfig(t, DefaultConfig())
+
+	expectReply(t, c.do("CONFIG", "GET", "maxmemory*"), Array{
+		BulkString("maxmemory"), BulkString("0"),
+		BulkString("maxmemory-policy"), BulkString("noeviction"),
+	})
+	expectReply(t, c.do("CONFIG", "SET", "maxmemory", "1mb", "maxmemory-policy", "ALLKEYS-LRU"), SimpleString("OK"))
+	if maxMemory, policy, _ := srv.eviction.config(); maxMemory != 1<<20 || policy != policyAllKeysLRU {
+		t.Errorf("Expected 1mb and allkeys-lru, got %d and %s", maxMemory, policy)
+	}
+	expectReply(t, c.do("CONFIG", "GET", "maxmemory"), Array{BulkString("maxmemory"), BulkString("1048576")})
+	expectReply(t, c.do("CONFIG", "SET", "replica-read-only", "no"), SimpleString("OK"))
+	expectReply(t, c.do("CONFIG", "GET", "replica-read-only", "appendonly"), Array{
+		BulkString("appendonly"), BulkString("no"),
+		BulkString("replica-read-only"), BulkString("no"),
+	})
+
+	expectReply(t, c.do("CONFIG", "SET", "port", "1234"), ErrorReply("ERR CONFIG SET failed (possibly related to argument 'port') - can't set immutable config"))
+	expectReply(t, c.do("CONFIG", "SET", "nosuchparam", "1"), ErrorReply("ERR Unknown option or number of arguments for CONFIG SET - 'nosuchparam'"))
+	expectReply(t, c.do("CONFIG", "SET", "maxclients", "none"), ErrorReply("ERR CONFIG SET failed (possibly related to argument 'maxclients') - argument must be a positive integer"))
+	expectReply(t, c.do("CONFIG", "SET", "maxmemory"), ErrorReply("ERR wrong number of arguments for 'config|set' command"))
+	expectReply(t, c.do("CONFIG", "GET", "nosuch*"), Array{})
+
+	// A rejected pair leaves the ones before and after it unchanged
+	expectReply(t, c.do("CONFIG", "SET", "timeout", "30", "maxclients", "none", "repl-timeout", "5"), ErrorReply("ERR CONFIG SET failed (possibly related to argument 'maxclients') - argument must be a positive integer"))
+	expectReply(t, c.do("CONFIG", "SET", "maxmemory", "2mb", "port", "1234"), ErrorReply("ERR CONFIG SET failed (possibly related to argument 'port') - can't set immutable config"))
+	expectReply(t, c.do("CONFIG", "SET", "timeout", "30", "TIMEOUT", "40"), ErrorReply("ERR CONFIG SET failed (possibly related to argument 'timeout') - duplicate parameter"))
+	expectReply(t, c.do("CONFIG", "GET", "timeout", "repl-timeout", "maxmemory"), Array{
+		BulkString("timeout"), BulkString("0"),
+		BulkString("repl-timeout"), BulkString("60"),
+		BulkString("maxmemory"), BulkString("1048576"),
+	})
+
+	// requirepass applies to connections made from now on
+	expectReply(t, c.do("CONFIG", "SET", "requirepass", "secret"), SimpleString("OK"))
+	expectReply(t, c.do("CONFIG", "GET", "requirepass"), Array{BulkString("requirepass"), BulkString("secret")})
+	other := dialTestServer(t, c.conn.RemoteAddr().String())
+	expectReply(t, other.do("GET", "key"), ErrorReply("NOAUTH Authentication required."))
+}
+
+func TestMaxClients(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxClients = 2
+	_, first := startServerWithConfig(t, cfg)
+	addr := first.conn.RemoteAddr().String()
+	second := dialTestServer(t, addr)
+	expectReply(t, second.do("PING"), SimpleString("PONG"))
+
+	third := dialTestServer(t, addr)
+	expectReply(t, third.do("PING"), ErrorReply("ERR max number of clients reached"))
+
+	// Raising the limit lets new clients in
+	expectReply(t, first.do("CONFIG", "SET", "maxclients", "3"), SimpleString("OK"))
+	fourth := dialTestServer(t, addr)
+	expectReply(t, fourth.do("PING"), SimpleString("PONG"))
+}
+
+func TestIdleTimeout(t *testing.T) {
+	_, c := startServerWithConfig(t, DefaultConfig())
+	addr := c.conn.RemoteAddr().String()
+	sub := dialTestServer(t, addr)
+	sub.do("SUBSCRIBE", "news")
+	expectReply(t, c.do("CONFIG", "SET", "timeout", "1"), SimpleString("OK"))
+
+	idle := dialTestServer(t, addr)
+	expectReply(t, idle.do("PING"), SimpleString("PONG"))
+	idle.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idle.reader.ReadByte(); err == nil || os.IsTimeout(err) {
+		t.Fatalf("Expected the idle client to be disconnected, got %v", err)
+	}
+
+	// Subscribers are not idle, they wait for messages
+	pub := dialTestServer(t, addr)
+	expectReply(t, pub.do("PUBLISH", "news", "still here"), Integer(1))
+	expectReply(t, sub.receive(), Array{BulkString("message"), BulkString("news"), BulkString("still here")})
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Values stored in Database.data are one of string, *ListValue, HashValue,
+// SetValue or *SortedSetValue.
+
+var wrongTypeError = ErrorReply("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// lookupAs returns the value at key if it has type T. A missing key returns
+// ok == false, a key of another type returns a WRONGTYPE error reply.
+// Caller holds at least the read lock of the key's shard.
+func lookupAs[T any](db *Database, key string) (value T, ok bool, errReply Reply) {
+	v, exists := db.lookup(key)
+	if !exists {
+		return value, false, nil
+	}
+	value, ok = v.(T)
+	if !ok {
+		return value, false, wrongTypeError
+	}
+	return value, true, nil
+}
+
+// typeName is the name TYPE reports for a value.
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case *ListValue:
+		return "list"
+	case HashValue:
+		return "hash"
+	case SetValue:
+		return "set"
+	case *SortedSetValue:
+		return "zset"
+	}
+	return "none"
+}
+
+// cloneValue returns a copy that later in-place writes do not affect.
+func cloneValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case *ListValue:
+		return val.clone()
+	case HashValue:
+		clone := make(HashValue, len(val))
+		for f, fv := range val {
+			clone[f] = fv
+		}
+		return clone
+	case SetValue:
+		clone := make(SetValue, len(val))
+		for m := range val {
+			clone[m] = struct{}{}
+		}
+		return clone
+	case *SortedSetValue:
+		return val.clone()
+	}
+	return v
+}
+
+// ListValue is a double ended queue backed by a ring buffer, so pushes and
+// pops at both ends are O(1).
+type ListValue struct {
+	items []string
+	head  int
+	size  int
+}
+
+func (l *ListValue) len() int {
+	return l.size
+}
+
+func (l *ListValue) at(i int) string {
+	return l.items[(l.head+i)%len(l.items)]
+}
+
+func (l *ListValue) grow() {
+	if l.size < len(l.items) {
+		return
+	}
+	items := make([]string, max(8, 2*len(l.items)))
+	for i := 0; i < l.size; i++ {
+		items[i] = l.at(i)
+	}
+	l.items, l.head = items, 0
+}
+
+func (l *ListValue) pushFront(v string) {
+	l.grow()
+	l.head = (l.head - 1 + len(l.items)) % len(l.items)
+	l.items[l.head] = v
+	l.size++
+}
+
+func (l *ListValue) pushBack(v string) {
+	l.grow()
+	l.items[(l.head+l.size)%len(l.items)] = v
+	l.size++
+}
+
+func (l *ListValue) popFront() string {
+	v := l.items[l.head]
+	l.items[l.head] = ""
+	l.head = (l.head + 1) % len(l.items)
+	l.size--
+	return v
+}
+
+func (l *ListValue) popBack() string {
+	i := (l.head + l.size - 1) % len(l.items)
+	v := l.items[i]
+	l.items[i] = ""
+	l.size--
+	return v
+}
+
+func (l *ListValue) values() []string {
+	values := make([]string, l.size)
+	for i := range values {
+		values[i] = l.at(i)
+	}
+	return values
+}
+
+func (l *ListValue) clone() *ListValue {
+	return &ListValue{items: l.values(), size: l.size}
+}
+
+type HashValue map[string]string
+
+type SetValue map[string]struct{}
+
+func (set SetValue) members() []string {
+	members := make([]string, 0, len(set))
+	for m := range set {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
+
+type zsetEntry struct {
+	member string
+	score  float64
+}
+
+func (e zsetEntry) less(o zsetEntry) bool {
+	return e.score < o.score || (e.score == o.score && e.member < o.member)
+}
+
+// SortedSetValue keeps its members ordered by score and then by member, with
+// a map for O(1) score lookups.
+type SortedSetValue struct {
+	scores map[string]float64
+	sorted []zsetEntry
+}
+
+func newSortedSet() *SortedSetValue {
+	return &SortedSetValue{scores: make(map[string]float64)}
+}
+
+func (z *SortedSetValue) len() int {
+	return len(z.sorted)
+}
+
+// search returns the index of the first entry not less than e.
+func (z *SortedSetValue) search(e zsetEntry) int {
+	return sort.Search(len(z.sorted), func(i int) bool { return !z.sorted[i].less(e) })
+}
+
+// add sets the score of member and reports whether it is a new member.
+func (z *SortedSetValue) add(member string, score float64) bool {
+	old, exists := z.scores[member]
+	if exists {
+		if old == score {
+			return false
+		}
+		z.remove(member)
+	}
+	e := zsetEntry{member: member, score: score}
+	i := z.search(e)
+	z.sorted = append(z.sorted, zsetEntry{})
+	copy(z.sorted[i+1:], z.sorted[i:])
+	z.sorted[i] = e
+	z.scores[member] = score
+	return !exists
+}
+
+func (z *SortedSetValue) remove(member string) bool {
+	score, exists := z.scores[member]
+	if !exists {
+		return false
+	}
+	i := z.search(zsetEntry{member: member, score: score})
+	z.sorted = append(z.sorted[:i], z.sorted[i+1:]...)
+	delete(z.scores, member)
+	return true
+}
+
+func (z *SortedSetValue) rank(member string) (int, bool) {
+	score, exists := z.scores[member]
+	if !exists {
+		return 0, false
+	}
+	return z.search(zsetEntry{member: member, score: score}), true
+}
+
+func (z *SortedSetValue) clone() *SortedSetValue {
+	clone := &SortedSetValue{scores: make(map[string]float64, len(z.scores)), sorted: append([]zsetEntry(nil), z.sorted...)}
+	for m, s := range z.scores {
+		clone.scores[m] = s
+	}
+	return clone
+}
+
+// formatFloat prints a score the way Redis does: the shortest representation
+// that parses back to the same value, and inf/-inf for infinities.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// parseFloat accepts what Redis accepts for scores, including +inf and -inf,
+// and rejects NaN.
+func parseFloat(s string) (float64, bool) {
+	switch s {
+	case "+inf", "inf", "+Inf", "Inf":
+		return math.Inf(1), true
+	case "-inf", "-Inf":
+		return math.Inf(-1), true
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+// normalizeRange turns LRANGE/ZRANGE style start and stop indexes, which may
+// be negative to count from the end, into a half open [from, to) range.
+func normalizeRange(start, stop, length int) (int, int) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop || start >= length {
+		return 0, 0
+	}
+	return start, stop + 1
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestListValueRingBuffer(t *testing.T) {
+	list := &ListValue{}
+	for i := 0; i < 20; i++ {
+		list.pushBack(strconv.Itoa(i))
+		list.pushFront(strconv.Itoa(-i))
+	}
+	if list.len() != 40 || list.at(0) != "-19" || list.at(39) != "19" {
+		t.Fatalf("Unexpected list contents %q", list.values())
+	}
+	for i := 19; i >= 0; i-- {
+		if v := list.popBack(); v != strconv.Itoa(i) {
+			t.Fatalf("Expected %d from popBack, got %s", i, v)
+		}
+	}
+	if v := list.popFront(); v != "-19" || list.len() != 19 {
+		t.Errorf("Unexpected popFront %s, len %d", v, list.len())
+	}
+}
+
+func TestListCommands(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("RPUSH", "jobs", "a", "b", "c"), Integer(3))
+	expectReply(t, c.do("LPUSH", "jobs", "z", "y"), Integer(5))
+	expectReply(t, c.do("LRANGE", "jobs", "0", "-1"), stringsToArray([]string{"y", "z", "a", "b", "c"}))
+	expectReply(t, c.do("LRANGE", "jobs", "-2", "100"), stringsToArray([]string{"b", "c"}))
+	expectReply(t, c.do("LRANGE", "jobs", "3", "1"), Array{})
+	expectReply(t, c.do("LLEN", "jobs"), Integer(5))
+	expectReply(t, c.do("LPOP", "jobs"), BulkString("y"))
+	expectReply(t, c.do("RPOP", "jobs", "2"), stringsToArray([]string{"c", "b"}))
+	expectReply(t, c.do("LPOP", "jobs", "10"), stringsToArray([]string{"z", "a"}))
+	expectReply(t, c.do("LLEN", "jobs"), Integer(0))
+	expectReply(t, c.do("LPOP", "jobs"), NullBulk{})
+	expectReply(t, c.do("GET", "jobs"), NullBulk{})
+}
+
+func TestHashCommands(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("HSET", "user:1", "name", "Ann", "visits", "1"), Integer(2))
+	expectReply(t, c.do("HSET", "user:1", "name", "Anna"), Integer(0))
+	expectReply(t, c.do("HGET", "user:1", "name"), BulkString("Anna"))
+	expectReply(t, c.do("HGET", "user:1", "missing"), NullBulk{})
+	expectReply(t, c.do("HINCRBY", "user:1", "visits", "5"), Integer(6))
+	expectReply(t, c.do("HINCRBY", "user:1", "name", "1"), ErrorReply("ERR hash value is not an integer"))
+	expectReply(t, c.do("HINCRBY", "user:1", "visits", "9223372036854775807"), ErrorReply("ERR increment or decrement would overflow"))
+	expectReply(t, c.do("HGETALL", "user:1"), stringsToArray([]string{"name", "Anna", "visits", "6"}))
+	expectReply(t, c.do("HDEL", "user:1", "name", "nope"), Integer(1))
+	expectReply(t, c.do("HDEL", "user:1", "visits"), Integer(1))
+	expectReply(t, c.do("HGETALL", "user:1"), Array{})
+	expectReply(t, c.do("HSET", "user:1", "odd"), ErrorReply("ERR wrong number of arguments for 'hset' command"))
+}
+
+func TestSetCommands(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("SADD", "a", "x", "y", "z", "x"), Integer(3))
+	expectReply(t, c.do("SADD", "b", "y", "z", "w"), Integer(3))
+	expectReply(t, c.do("SISMEMBER", "a", "x"), Integer(1))
+	expectReply(t, c.do("SISMEMBER", "a", "w"), Integer(0))
+	expectReply(t, c.do("SINTER", "a", "b"), stringsToArray([]string{"y", "z"}))
+	expectReply(t, c.do("SINTER", "a", "missing"), Array{})
+	expectReply(t, c.do("SUNION", "a", "b", "missing"), stringsToArray([]string{"w", "x", "y", "z"}))
+	expectReply(t, c.do("SREM", "a", "x", "nope"), Integer(1))
+	expectReply(t, c.do("SMEMBERS", "a"), stringsToArray([]string{"y", "z"}))
+}
+
+func TestSortedSetCommands(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("ZADD", "board", "10", "ann", "20", "bob", "15", "cat"), Integer(3))
+	expectReply(t, c.do("ZADD", "board", "CH", "25", "bob", "1", "dan"), Integer(2))
+	expectReply(t, c.do("ZRANGE", "board", "0", "-1"), stringsToArray([]string{"dan", "ann", "cat", "bob"}))
+	expectReply(t, c.do("ZRANGE", "board", "0", "1", "REV", "WITHSCORES"), stringsToArray([]string{"bob", "25", "cat", "15"}))
+	expectReply(t, c.do("ZRANGEBYSCORE", "board", "(10", "+inf"), stringsToArray([]string{"cat", "bob"}))
+	expectReply(t, c.do("ZRANGEBYSCORE", "board", "-inf", "15", "WITHSCORES", "LIMIT", "1", "1"), stringsToArray([]string{"ann", "10"}))
+	expectReply(t, c.do("ZRANK", "board", "cat"), Integer(2))
+	expectReply(t, c.do("ZRANK", "board", "nobody"), NullBulk{})
+	expectReply(t, c.do("ZINCRBY", "board", "2.5", "ann"), BulkString("12.5"))
+	expectReply(t, c.do("ZADD", "board", "GT", "5", "ann"), Integer(0))
+	expectReply(t, c.do("ZADD", "board", "XX", "INCR", "1", "nobody"), NullBulk{})
+	expectReply(t, c.do("ZADD", "board", "NX", "XX", "1", "x"), ErrorReply("ERR XX and NX options at the same time are not compatible"))
+	expectReply(t, c.do("ZADD", "board", "abc", "x"), ErrorReply("ERR value is not a valid float"))
+	expectReply(t, c.do("ZRANGE", "board", "0", "-1", "WITHSCORES"), stringsToArray([]string{"dan", "1", "ann", "12.5", "cat", "15", "bob", "25"}))
+}
+
+func TestWrongTypeErrors(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	c.do("SET", "str", "v")
+	c.do("LPUSH", "list", "v")
+	for _, cmd := range [][]string{
+		{"GET", "list"},
+		{"INCR", "list"},
+		{"LPUSH", "str", "x"},
+		{"HGET", "list", "f"},
+		{"SADD", "str", "m"},
+		{"SINTER", "str"},
+		{"ZADD", "list", "1", "m"},
+		{"LRANGE", "str", "0", "-1"},
+	} {
+		expectReply(t, c.do(cmd...), wrongTypeError)
+	}
+	// SET replaces a value of any type
+	expectReply(t, c.do("SET", "list", "now a string"), okReply)
+	expectReply(t, c.do("GET", "list"), BulkString("now a string"))
+}
+
+func TestCompactEmitsCommandsPerType(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	c.do("RPUSH", "l", "a", "b c")
+	c.do("HSET", "h", "f", "v")
+	c.do("SADD", "s", "m")
+	c.do("ZADD", "z", "1.5", "m")
+	c.do("PEXPIREAT", "l", "99999999999999")
+	compacted, _ := c.do("COMPACT").(Array)
+	expected := map[string]bool{
+		`RPUSH l a "b c"`:            true,
+		`PEXPIREAT l 99999999999999`: true,
+		`HSET h f v`:                 true,
+		`SADD s m`:                   true,
+		`ZADD z 1.5 m`:               true,
+	}
+	if len(compacted) != len(expected) {
+		t.Fatalf("Expected %d COMPACT lines, got %v", len(expected), compacted)
+	}
+	for _, line := range compacted {
+		if !expected[string(line.(BulkString))] {
+			t.Errorf("Unexpected COMPACT line %q", line)
+		}
+	}
+
+	// Large collections are split into several commands
+	db := NewDatabase()
+	big := SetValue{}
+	for i := 0; i < 150; i++ {
+		big[strconv.Itoa(i)] = struct{}{}
+	}
+	db.set("big", big)
+	if commands := db.compactCommands(); len(commands) != 3 {
+		t.Errorf("Expected 150 members to take 3 SADD commands, got %d", len(commands))
+	}
+}
+
+func TestTypedValuesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	aofPath := filepath.Join(dir, "appendonly.aof")
+	snapPath := filepath.Join(dir, "dump.kvsnap")
+	srv, c := startServerWithAOF(t, aofPath)
+	srv.snapshotPath = snapPath
+
+	c.do("RPUSH", "l", "a", "b")
+	c.do("LPOP", "l")
+	c.do("HSET", "h", "f", "v")
+	c.do("HINCRBY", "h", "n", "3")
+	c.do("SADD", "s", "x", "y")
+	c.do("SREM", "s", "y")
+	c.do("ZADD", "z", "2", "b", "1", "a")
+	c.do("ZINCRBY", "z", "5", "a")
+	c.do("EXPIRE", "h", "100")
+	expectReply(t, c.do("SAVE"), okReply)
+	srv.aof.close()
+
+	check := func(c *testClient) {
+		expectReply(t, c.do("LRANGE", "l", "0", "-1"), stringsToArray([]string{"b"}))
+		expectReply(t, c.do("HGETALL", "h"), stringsToArray([]string{"f", "v", "n", "3"}))
+		expectReply(t, c.do("SMEMBERS", "s"), stringsToArray([]string{"x"}))
+		expectReply(t, c.do("ZRANGE", "z", "0", "-1", "WITHSCORES"), stringsToArray([]string{"b", "2", "a", "6"}))
+		if ttl, _ := c.do("TTL", "h").(Integer); ttl < 99 {
+			t.Errorf("Expected the hash to keep its TTL, got %d", ttl)
+		}
+	}
+	_, fromAOF := startServerWithAOF(t, aofPath)
+	check(fromAOF)
+	_, fromSnapshot := startServerWithSnapshot(t, snapPath)
+	check(fromSnapshot)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	policyNoEviction    = "noeviction"
+	policyAllKeysLRU    = "allkeys-lru"
+	policyAllKeysLFU    = "allkeys-lfu"
+	policyVolatileLRU   = "volatile-lru"
+	policyVolatileTTL   = "volatile-ttl"
+	policyAllKeysRandom = "allkeys-random"
+
+	// entryOverhead approximates what a key costs besides its bytes: map
+	// buckets, the value header and its statistics.
+	entryOverhead = 64
+	// sizeSamples is how many elements of a collection are looked at to
+	// estimate the average element size.
+	sizeSamples = 8
+
+	lfuInitValue = 5
+	lfuLogFactor = 10
+	// lfuDecayPeriod is how long a key must go unused for its LFU counter
+	// to drop by one.
+	lfuDecayPeriod = int64(time.Minute)
+)
+
+var errOOM = ErrorReply("OOM command not allowed when used memory > 'maxmemory'.")
+
+func validEvictionPolicy(policy string) bool {
+	switch policy {
+	case policyNoEviction, policyAllKeysLRU, policyAllKeysLFU, policyVolatileLRU, policyVolatileTTL, policyAllKeysRandom:
+		return true
+	}
+	return false
+}
+
+// Eviction holds the memory limit and what to do when it is reached.
+type Eviction struct {
+	mutex     sync.RWMutex
+	maxMemory int64 // bytes, 0 for no limit
+	policy    string
+	samples   int // keys sampled per database to pick one to evict
+
+	evictedKeys atomic.Int64
+}
+
+func NewEviction() *Eviction {
+	return &Eviction{policy: policyNoEviction, samples: 5}
+}
+
+func (e *Eviction) config() (int64, string, int) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.maxMemory, e.policy, e.samples
+}
+
+func (e *Eviction) setMaxMemory(maxMemory int64, policy string) error {
+	if !validEvictionPolicy(policy) {
+		return fmt.Errorf("invalid maxmemory policy %q", policy)
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.maxMemory, e.policy = maxMemory, policy
+	return nil
+}
+
+// keyStats is the size and access history of a key. The access fields are
+// updated by readers holding only the read lock, so they are atomic.
+type keyStats struct {
+	size       int64
+	lastAccess atomic.Int64 // unix nanoseconds
+	lfuCounter atomic.Uint32
+	lfuDecay   atomic.Int64 // unix nanoseconds of the last counter decay
+}
+
+// access records a read or write of the key for LRU and LFU.
+func (st *keyStats) access(now int64) {
+	st.lastAccess.Store(now)
+	counter := st.decayedCounter(now)
+	st.lfuDecay.Store(now)
+	// The counter grows logarithmically, so 255 is only reached by keys
+	// accessed about a million times
+	if counter < 255 {
+		base := float64(counter) - lfuInitValue
+		if base < 0 {
+			base = 0
+		}
+		if rand.Float64() < 1/(base*lfuLogFactor+1) {
+			counter++
+		}
+	}
+	st.lfuCounter.Store(counter)
+}
+
+func (st *keyStats) decayedCounter(now int64) uint32 {
+	counter := st.lfuCounter.Load()
+	periods := (now - st.lfuDecay.Load()) / lfuDecayPeriod
+	if periods >= int64(counter) {
+		return 0
+	}
+	return counter - uint32(periods)
+}
+
+// updateStats refreshes the accounting of a key after it was written or
+// deleted, and adds it to or removes it from the key index.
+// Caller holds the write lock of the key's shard.
+func (db *Database) updateStats(key string) {
+	sh := db.shardOf(key)
+	st := sh.stats[key]
+	value, exists := sh.data[key]
+	if !exists {
+		if st != nil {
+			db.used.Add(-st.size)
+			delete(sh.stats, key)
+			sh.index.remove(key)
+		}
+		return
+	}
+	now := time.Now().UnixNano()
+	if st == nil {
+		st = &keyStats{}
+		st.lfuCounter.Store(lfuInitValue)
+		st.lfuDecay.Store(now)
+		sh.stats[key] = st
+		sh.index.add(key)
+	}
+	size := entrySize(key, value)
+	db.used.Add(size - st.size)
+	st.size = size
+	st.access(now)
+}
+
+// entrySize approximates the memory used by a key and its value. Collections
+// are estimated from a few of their elements so this stays cheap.
+func entrySize(key string, value interface{}) int64 {
+	size := int64(entryOverhead + len(key))
+	switch v := value.(type) {
+	case string:
+		size += int64(len(v))
+	case *ListValue:
+		sampled, bytes := 0, 0
+		for ; sampled < v.len() && sampled < sizeSamples; sampled++ {
+			bytes += len(v.at(sampled))
+		}
+		size += estimate(v.len(), sampled, bytes, 16)
+	case HashValue:
+		sampled, bytes := 0, 0
+		for f, fv := range v {
+			if sampled == sizeSamples {
+				break
+			}
+			sampled++
+			bytes += len(f) + len(fv)
+		}
+		size += estimate(len(v), sampled, bytes, 48)
+	case SetValue:
+		sampled, bytes := 0, 0
+		for m := range v {
+			if sampled == sizeSamples {
+				break
+			}
+			sampled++
+			bytes += len(m)
+		}
+		size += estimate(len(v), sampled, bytes, 32)
+	case *SortedSetValue:
+		sampled, bytes := 0, 0
+		for ; sampled < v.len() && sampled < sizeSamples; sampled++ {
+			bytes += 2 * len(v.sorted[sampled].member)
+		}
+		size += estimate(v.len(), sampled, bytes, 72)
+	}
+	return size
+}
+
+// estimate extrapolates the size of count elements from a sample, adding
+// perElement bytes of bookkeeping for each.
+func estimate(count, sampled, sampledBytes, perElement int) int64 {
+	if sampled == 0 {
+		return 0
+	}
+	return int64(count) * (int64(sampledBytes)/int64(sampled) + int64(perElement))
+}
+
+// usedMemory is the approximate size of the dataset in bytes.
+func (s *Server) usedMemory() int64 {
+	var used int64
+	for _, db := range s.databases {
+		used += db.used.Load()
+	}
+	return used
+}
+
+// freeMemoryIfNeeded evicts keys until the dataset fits in maxmemory, and
+// reports whether it does. Caller holds no shard lock.
+func (s *Server) freeMemoryIfNeeded() bool {
+	maxMemory, policy, samples := s.eviction.config()
+	if maxMemory == 0 {
+		return true
+	}
+	for s.usedMemory() > maxMemory {
+		if policy == policyNoEviction || !s.evictOne(policy, samples) {
+			return false
+		}
+	}
+	return true
+}
+
+// evictOne samples keys from every database, deletes the best candidate for
+// the policy and propagates the deletion. It reports false when no key can
+// be evicted.
+func (s *Server) evictOne(policy string, samples int) bool {
+	bestDB, bestKey, bestScore := -1, "", math.Inf(-1)
+	now := time.Now().UnixNano()
+	for i, db := range s.databases {
+		sampled := 0
+		// Starting at a random shard spreads the samples over the database
+		start := rand.Intn(shardCount)
+		for j := 0; j < shardCount && sampled < samples; j++ {
+			sh := db.shards[(start+j)%shardCount]
+			sh.mutex.RLock()
+			consider := func(key string) {
+				sampled++
+				score := evictionScore(sh, key, policy, now)
+				if score > bestScore {
+					bestDB, bestKey, bestScore = i, key, score
+				}
+			}
+			if policy == policyVolatileLRU || policy == policyVolatileTTL {
+				for key := range sh.expires {
+					if sampled == samples {
+						break
+					}
+					consider(key)
+				}
+			} else {
+				for key := range sh.data {
+					if sampled == samples {
+						break
+					}
+					consider(key)
+				}
+			}
+			sh.mutex.RUnlock()
+		}
+	}
+	if bestDB < 0 {
+		return false
+	}
+
+	db := s.databases[bestDB]
+	sh := db.shardOf(bestKey)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	if _, exists := sh.data[bestKey]; exists {
+		db.deleteKey(bestKey)
+		s.propagate(bestDB, []string{"DEL", bestKey})
+		s.eviction.evictedKeys.Add(1)
+		db.notifyEvent(notifyEvicted, "evicted", bestKey)
+	}
+	return true
+}
+
+// evictionScore ranks a key for eviction, higher scores go first.
+// Caller holds at least the read lock of the shard.
+func evictionScore(sh *shard, key, policy string, now int64) float64 {
+	st := sh.stats[key]
+	switch policy {
+	case policyAllKeysLRU, policyVolatileLRU:
+		if st == nil {
+			return math.Inf(1)
+		}
+		return float64(now - st.lastAccess.Load())
+	case policyAllKeysLFU:
+		if st == nil {
+			return math.Inf(1)
+		}
+		return float64(255 - st.decayedCounter(now))
+	case policyVolatileTTL:
+		return -float64(sh.expires[key])
+	}
+	return rand.Float64()
+}
+
+// parseMemory parses a memory size such as 1048576, 100kb, 64mb or 1gb.
+func parseMemory(s string) (int64, error) {
+	lower := strings.ToLower(s)
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		factor int64
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1}} {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower, multiplier = strings.TrimSuffix(lower, unit.suffix), unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, errors.New("invalid memory size " + s)
+	}
+	return n * multiplier, nil
+}
+
+// humanBytes formats a size the way INFO prints used_memory_human.
+func humanBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2fK", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// memoryInfo is the memory section of INFO.
+func (s *Server) memoryInfo() string {
+	maxMemory, policy, _ := s.eviction.config()
+	used := s.usedMemory()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return fmt.Sprintf("used_memory:%d\r\nused_memory_human:%s\r\nmaxmemory:%d\r\nmaxmemory_human:%s\r\nmaxmemory_policy:%s\r\n"+
+		"go_heap_alloc:%d\r\ngo_heap_sys:%d\r\ngo_num_gc:%d\r\nnumber_of_cached_scripts:%d\r\n",
+		used, humanBytes(used), maxMemory, humanBytes(maxMemory), policy, mem.HeapAlloc, mem.HeapSys, mem.NumGC, s.scripts.count())
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func startServerWithMaxMemory(t *testing.T, maxMemory int64, policy string) (*Server, *testClient) {
+	t.Helper()
+	srv := NewServer()
+	if err := srv.eviction.setMaxMemory(maxMemory, policy); err != nil {
+		t.Fatal(err)
+	}
+	// Sampling every key makes the choice of the evicted key deterministic
+	srv.eviction.samples = 1000
+	return srv, dialTestServer(t, serveOnFreePort(t, srv))
+}
+
+func TestNoEvictionRefusesWrites(t *testing.T) {
+	srv, c := startServerWithMaxMemory(t, 4096, policyNoEviction)
+	value := strings.Repeat("x", 512)
+	for i := 0; i < 20; i++ {
+		c.do("SET", "key"+strconv.Itoa(i), value)
+	}
+	if used := srv.usedMemory(); used <= 4096 {
+		t.Fatalf("Expected to be above the limit, used %d", used)
+	}
+	expectReply(t, c.do("SET", "one", "more"), errOOM)
+	expectReply(t, c.do("LPUSH", "list", "x"), errOOM)
+	expectReply(t, c.do("MULTI"), okReply)
+	expectReply(t, c.do("SET", "one", "more"), errOOM)
+	expectReply(t, c.do("EXEC"), ErrorReply("EXECABORT Transaction discarded because of previous errors."))
+
+	// Reads and deletions still work, and free memory for new writes
+	expectReply(t, c.do("GET", "key0"), BulkString(value))
+	for i := 0; i < 20; i++ {
+		c.do("DEL", "key"+strconv.Itoa(i))
+	}
+	expectReply(t, c.do("SET", "one", "more"), okReply)
+	if used := srv.usedMemory(); used > 4096 {
+		t.Errorf("Expected memory to be released, used %d", used)
+	}
+}
+
+func TestAllKeysLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	srv, c := startServerWithMaxMemory(t, 8192, policyAllKeysLRU)
+	value := strings.Repeat("x", 512)
+	c.do("SET", "hot", value)
+	for i := 0; i < 40; i++ {
+		c.do("SET", "key"+strconv.Itoa(i), value)
+		c.do("GET", "hot")
+	}
+	// Eviction runs before a write, so the last write may overshoot
+	if used := srv.usedMemory(); used > 8192+1024 {
+		t.Errorf("Expected memory to stay around the limit, used %d", used)
+	}
+	expectReply(t, c.do("GET", "hot"), BulkString(value))
+	expectReply(t, c.do("GET", "key0"), NullBulk{})
+	expectReply(t, c.do("GET", "key39"), BulkString(value))
+	if evicted := infoField(t, c, "stats", "evicted_keys"); evicted == "0" || evicted == "" {
+		t.Errorf("Expected evicted_keys to count evictions, got %q", evicted)
+	}
+}
+
+func TestAllKeysLFUKeepsFrequentlyUsed(t *testing.T) {
+	_, c := startServerWithMaxMemory(t, 8192, policyAllKeysLFU)
+	value := strings.Repeat("x", 512)
+	c.do("SET", "popular", value)
+	for i := 0; i < 200; i++ {
+		c.do("GET", "popular")
+	}
+	for i := 0; i < 40; i++ {
+		c.do("SET", "key"+strconv.Itoa(i), value)
+	}
+	expectReply(t, c.do("GET", "popular"), BulkString(value))
+}
+
+func TestVolatileTTLEvictsSoonestExpiring(t *testing.T) {
+	_, c := startServerWithMaxMemory(t, 4096, policyVolatileTTL)
+	value := strings.Repeat("x", 512)
+	c.do("SET", "persistent", value)
+	c.do("SET", "soon", value, "EX", "100")
+	c.do("SET", "later", value, "EX", "1000")
+	for i := 0; i < 5; i++ {
+		c.do("SET", "filler"+strconv.Itoa(i), value, "EX", "5000")
+	}
+	c.do("SET", "last", value, "EX", "10000")
+	expectReply(t, c.do("GET", "soon"), NullBulk{})
+	expectReply(t, c.do("GET", "persistent"), BulkString(value))
+
+	// Keys without a TTL are never evicted, so the limit can be hit anyway
+	for i := 0; i < 20; i++ {
+		c.do("SET", "plain"+strconv.Itoa(i), value)
+	}
+	expectReply(t, c.do("SET", "plain", value), errOOM)
+}
+
+func TestAllKeysRandomStaysUnderLimit(t *testing.T) {
+	srv, c := startServerWithMaxMemory(t, 8192, policyAllKeysRandom)
+	for i := 0; i < 100; i++ {
+		expectReply(t, c.do("RPUSH", "list"+strconv.Itoa(i), strings.Repeat("y", 100), "z"), Integer(2))
+	}
+	if used := srv.usedMemory(); used > 8192+1024 {
+		t.Errorf("Expected memory to stay around the limit, used %d", used)
+	}
+	if used := infoField(t, c, "memory", "used_memory"); used != strconv.FormatInt(srv.usedMemory(), 10) {
+		t.Errorf("Unexpected used_memory %q", used)
+	}
+}
+
+func TestParseMemory(t *testing.T) {
+	tests := map[string]int64{"0": 0, "1024": 1024, "100kb": 100 << 10, "64MB": 64 << 20, "1gb": 1 << 30, "5k": 5000}
+	for input, expected := range tests {
+		if got, err := parseMemory(input); err != nil || got != expected {
+			t.Errorf("parseMemory(%q) = %d, %v, expected %d", input, got, err, expected)
+		}
+	}
+	for _, input := range []string{"lots", "-1mb", "9999999999gb", "9223372036854775807k"} {
+		if got, err := parseMemory(input); err == nil {
+			t.Errorf("Expected an error for %q, got %d", input, got)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	activeExpireInterval   = 100 * time.Millisecond
+	activeExpireSampleSize = 20
+)
+
+func nowMillis() int64 {
+	return time.Now().UnixMilli()
+}
+
+// set stores a value, keeping any expiry. Caller holds the write lock of the
+// key's shard.
+func (db *Database) set(key string, value interface{}) {
+	db.shardOf(key).data[key] = value
+	db.touch(key)
+}
+
+// deleteKey removes a key together with its expiry. Caller holds the write
+// lock of the key's shard.
+func (db *Database) deleteKey(key string) {
+	sh := db.shardOf(key)
+	delete(sh.data, key)
+	delete(sh.expires, key)
+	db.touch(key)
+}
+
+// flush removes every key. Caller holds the write lock of every shard.
+func (db *Database) flush() {
+	for _, sh := range db.shards {
+		for key := range sh.watchers {
+			db.touch(key)
+		}
+		sh.dirty++
+		sh.data = make(map[string]interface{})
+		sh.expires = make(map[string]int64)
+		sh.stats = make(map[string]*keyStats)
+		sh.index = newKeyIndex()
+	}
+	db.used.Store(0)
+}
+
+// isExpired reports whether key has a deadline that has passed.
+// Caller holds at least the read lock of the key's shard.
+func (db *Database) isExpired(key string) bool {
+	return db.shardOf(key).isExpired(key)
+}
+
+func (sh *shard) isExpired(key string) bool {
+	deadline, ok := sh.expires[key]
+	return ok && deadline <= nowMillis()
+}
+
+// lookup returns the value of key, treating expired keys as missing.
+// Caller holds at least the read lock of the key's shard.
+func (db *Database) lookup(key string) (interface{}, bool) {
+	sh := db.shardOf(key)
+	if sh.isExpired(key) {
+		db.keyspaceMisses.Add(1)
+		return nil, false
+	}
+	val, exists := sh.data[key]
+	if !exists {
+		db.keyspaceMisses.Add(1)
+		return nil, false
+	}
+	db.keyspaceHits.Add(1)
+	if st := sh.stats[key]; st != nil {
+		st.access(time.Now().UnixNano())
+	}
+	return val, exists
+}
+
+// anyExpired reports whether one of keys has a deadline that has passed.
+// Caller holds at least the read locks of their shards.
+func (db *Database) anyExpired(keys []string) bool {
+	for _, key := range keys {
+		if db.isExpired(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// expireIfNeeded lazily deletes key when its deadline has passed.
+// Caller holds the write lock of the key's shard.
+func (db *Database) expireIfNeeded(key string) bool {
+	if !db.isExpired(key) {
+		return false
+	}
+	db.deleteKey(key)
+	db.expiredKeys.Add(1)
+	db.notifyEvent(notifyExpired, "expired", key)
+	return true
+}
+
+// activeExpireCycle deletes expired keys from a random sample of the keys
+// that have a deadline in each shard, and keeps sampling a shard while more
+// than a quarter of its sample turned out to be expired. It returns how many
+// keys were deleted.
+func (db *Database) activeExpireCycle() int {
+	deleted := 0
+	for _, sh := range db.shards {
+		for {
+			sh.mutex.Lock()
+			sampled, expired := 0, 0
+			now := nowMillis()
+			// Map iteration order is randomised, which makes this a random sample
+			for key, deadline := range sh.expires {
+				if sampled == activeExpireSampleSize {
+					break
+				}
+				sampled++
+				if deadline <= now {
+					db.deleteKey(key)
+					db.notifyEvent(notifyExpired, "expired", key)
+					expired++
+				}
+			}
+			sh.mutex.Unlock()
+			db.expiredKeys.Add(int64(expired))
+			deleted += expired
+			if sampled == 0 || expired*4 <= sampled {
+				break
+			}
+		}
+	}
+	return deleted
+}
+
+// runActiveExpiry runs activeExpireCycle every activeExpireInterval until
+// stop is closed.
+func (db *Database) runActiveExpiry(stop <-chan struct{}) {
+	ticker := time.NewTicker(activeExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			db.activeExpireCycle()
+		case <-stop:
+			return
+		}
+	}
+}
+
+type setOptions struct {
+	nx, xx   bool
+	keepTTL  bool
+	deadline int64 // unix milliseconds, 0 when the key does not expire
+}
+
+// parseSetOptions parses the flags that may follow SET key value.
+func parseSetOptions(args []string) (setOptions, Reply) {
+	var opts setOptions
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			opts.nx = true
+		case "XX":
+			opts.xx = true
+		case "KEEPTTL":
+			opts.keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if opts.deadline != 0 || i+1 == len(args) {
+				return opts, ErrorReply("ERR syntax error")
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return opts, ErrorReply("ERR value is not an integer or out of range")
+			}
+			var base, unit int64 = 0, 1
+			switch strings.ToUpper(args[i]) {
+			case "EX":
+				base, unit = nowMillis(), 1000
+			case "PX":
+				base = nowMillis()
+			case "EXAT":
+				unit = 1000
+			}
+			deadline, ok := expireDeadline(base, n, unit)
+			if n <= 0 || !ok {
+				return opts, ErrorReply("ERR invalid expire time in 'set' command")
+			}
+			opts.deadline = deadline
+			i++
+		default:
+			return opts, ErrorReply("ERR syntax error")
+		}
+	}
+	if (opts.nx && opts.xx) || (opts.keepTTL && opts.deadline != 0) {
+		return opts, ErrorReply("ERR syntax error")
+	}
+	return opts, nil
+}
+
+// expireDeadline returns base + n*unit, in unix milliseconds, or false when
+// it does not fit in an int64.
+func expireDeadline(base, n, unit int64) (int64, bool) {
+	if n > math.MaxInt64/unit || n < math.MinInt64/unit {
+		return 0, false
+	}
+	n *= unit
+	if n > 0 && base > math.MaxInt64-n {
+		return 0, false
+	}
+	return base + n, true
+}
+
+// expireCommand implements EXPIRE and PEXPIRE. Like the other command helpers
+// it runs with the lock of the key's shard held by Server.call.
+func expireCommand(db *Database, args []string, unit int64, name string) Reply {
+	if len(args) != 2 {
+		return ErrorReply("ERR wrong number of arguments for '" + name + "' command")
+	}
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return ErrorReply("ERR value is not an integer or out of range")
+	}
+	deadline, ok := expireDeadline(nowMillis(), n, unit)
+	if !ok {
+		return ErrorReply("ERR invalid expire time in '" + name + "' command")
+	}
+	key := args[0]
+	if _, exists := db.value(key); !exists {
+		return Integer(0)
+	}
+	if n <= 0 {
+		db.deleteKey(key)
+		return Integer(1)
+	}
+	db.setDeadline(key, deadline)
+	db.touch(key)
+	return Integer(1)
+}
+
+// expireAtCommand implements EXPIREAT and PEXPIREAT, which take an absolute
+// unix time instead of a relative one.
+func expireAtCommand(db *Database, args []string, unit int64, name string) Reply {
+	if len(args) != 2 {
+		return ErrorReply("ERR wrong number of arguments for '" + name + "' command")
+	}
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return ErrorReply("ERR value is not an integer or out of range")
+	}
+	deadline, ok := expireDeadline(0, n, unit)
+	if !ok {
+		return ErrorReply("ERR invalid expire time in '" + name + "' command")
+	}
+	key := args[0]
+	if _, exists := db.value(key); !exists {
+		return Integer(0)
+	}
+	if deadline <= nowMillis() {
+		db.deleteKey(key)
+		return Integer(1)
+	}
+	db.setDeadline(key, deadline)
+	db.touch(key)
+	return Integer(1)
+}
+
+// ttlCommand implements TTL and PTTL: -2 for a missing key, -1 for a key
+// without a deadline, otherwise the remaining time in the given unit.
+func ttlCommand(db *Database, args []string, unit int64, name string) Reply {
+	if len(args) != 1 {
+		return ErrorReply("ERR wrong number of arguments for '" + name + "' command")
+	}
+	// Reading the TTL is not an access to the value
+	if _, exists := db.value(args[0]); !exists || db.isExpired(args[0]) {
+		return Integer(-2)
+	}
+	deadline, ok := db.deadline(args[0])
+	if !ok {
+		return Integer(-1)
+	}
+	remaining := deadline - nowMillis()
+	return Integer((remaining + unit/2) / unit)
+}
+
+func persistCommand(db *Database, args []string) Reply {
+	if len(args) != 1 {
+		return ErrorReply("ERR wrong number of arguments for 'persist' command")
+	}
+	if _, ok := db.deadline(args[0]); !ok {
+		return Integer(0)
+	}
+	db.removeDeadline(args[0])
+	db.touch(args[0])
+	return Integer(1)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSetOptionsAndTTL(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("SET", "session", "abc", "EX", "100"), okReply)
+	if ttl := c.do("TTL", "session"); ttl != Integer(100) {
+		t.Errorf("Expected TTL 100, got %v", ttl)
+	}
+	if pttl, ok := c.do("PTTL", "session").(Integer); !ok || pttl <= 99000 || pttl > 100000 {
+		t.Errorf("Unexpected PTTL %v", pttl)
+	}
+	expectReply(t, c.do("SET", "session", "abc", "NX"), NullBulk{})
+	expectReply(t, c.do("SET", "other", "x", "XX"), NullBulk{})
+	expectReply(t, c.do("SET", "other", "x", "NX"), okReply)
+	expectReply(t, c.do("SET", "session", "def", "XX", "KEEPTTL"), okReply)
+	expectReply(t, c.do("TTL", "session"), Integer(100))
+	expectReply(t, c.do("SET", "session", "ghi"), okReply)
+	expectReply(t, c.do("TTL", "session"), Integer(-1))
+	expectReply(t, c.do("TTL", "missing"), Integer(-2))
+	if hits, misses := infoField(t, c, "stats", "keyspace_hits"), infoField(t, c, "stats", "keyspace_misses"); hits != "0" || misses != "0" {
+		t.Errorf("Expected TTL to leave the keyspace stats alone, got %s hits and %s misses", hits, misses)
+	}
+
+	expectReply(t, c.do("SET", "k", "v", "EX", "0"), ErrorReply("ERR invalid expire time in 'set' command"))
+	expectReply(t, c.do("SET", "k", "v", "NX", "XX"), ErrorReply("ERR syntax error"))
+	expectReply(t, c.do("SET", "surname", "foo", "bar"), ErrorReply("ERR syntax error"))
+}
+
+func TestExpirePersistAndLazyExpiry(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("EXPIRE", "missing", "10"), Integer(0))
+	c.do("SET", "k", "v")
+	expectReply(t, c.do("EXPIRE", "k", "10"), Integer(1))
+	expectReply(t, c.do("PERSIST", "k"), Integer(1))
+	expectReply(t, c.do("PERSIST", "k"), Integer(0))
+	expectReply(t, c.do("TTL", "k"), Integer(-1))
+
+	expectReply(t, c.do("PEXPIRE", "k", "30"), Integer(1))
+	c.do("SET", "counter", "5", "PX", "30")
+	time.Sleep(60 * time.Millisecond)
+	expectReply(t, c.do("GET", "k"), NullBulk{})
+	expectReply(t, c.do("TTL", "k"), Integer(-2))
+	// INCR on an expired key starts from scratch
+	expectReply(t, c.do("INCR", "counter"), Integer(1))
+
+	c.do("SET", "gone", "v")
+	expectReply(t, c.do("EXPIRE", "gone", "-1"), Integer(1))
+	expectReply(t, c.do("GET", "gone"), NullBulk{})
+}
+
+func TestActiveExpiryDeletesUntouchedKeys(t *testing.T) {
+	db := NewDatabase()
+	past := nowMillis() - 1
+	for i := 0; i < 100; i++ {
+		key := "session:" + string(rune('a'+i%26)) + string(rune('a'+i/26))
+		db.set(key, "x")
+		db.setDeadline(key, past)
+	}
+	db.set("live", "y")
+	db.setDeadline("live", nowMillis()+60000)
+
+	if deleted := db.activeExpireCycle(); deleted != 100 {
+		t.Errorf("Expected 100 keys to be expired, got %d", deleted)
+	}
+	if keys, expires := db.sizes(); keys != 1 || expires != 1 {
+		t.Errorf("Expected only the live key to remain, got %d keys", keys)
+	}
+}
+
+func TestCompactKeepsDeadlines(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	c.do("SET", "k", "v", "PXAT", "99999999999999")
+	expectReply(t, c.do("COMPACT"), Array{BulkString("SET k v PXAT 99999999999999")})
+}
+
+// Deadlines that do not fit in an int64 are rejected instead of wrapping into
+// the past.
+func TestExpireTimeOverflow(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+	c.do("SET", "k", "v")
+
+	maxInt := strconv.FormatInt(math.MaxInt64, 10)
+	tooManySeconds := strconv.FormatInt(math.MaxInt64/1000+1, 10)
+	for _, option := range [][]string{{"EX", maxInt}, {"EX", tooManySeconds}, {"PX", maxInt}, {"EXAT", tooManySeconds}} {
+		expectReply(t, c.do("SET", "k", "v", option[0], option[1]), ErrorReply("ERR invalid expire time in 'set' command"))
+	}
+	expectReply(t, c.do("EXPIRE", "k", maxInt), ErrorReply("ERR invalid expire time in 'expire' command"))
+	expectReply(t, c.do("PEXPIRE", "k", maxInt), ErrorReply("ERR invalid expire time in 'pexpire' command"))
+	expectReply(t, c.do("EXPIREAT", "k", maxInt), ErrorReply("ERR invalid expire time in 'expireat' command"))
+	expectReply(t, c.do("EXPIRE", "k", strconv.FormatInt(math.MinInt64, 10)), ErrorReply("ERR invalid expire time in 'expire' command"))
+	expectReply(t, c.do("GET", "k"), BulkString("v"))
+	expectReply(t, c.do("TTL", "k"), Integer(-1))
+
+	// The largest deadlines that fit are kept
+	expectReply(t, c.do("PEXPIREAT", "k", maxInt), Integer(1))
+	expectReply(t, c.do("SET", "k", "v", "PXAT", maxInt), okReply)
+	expectReply(t, c.do("EXPIREAT", "k", strconv.FormatInt(math.MaxInt64/1000, 10)), Integer(1))
+	expectReply(t, c.do("GET", "k"), BulkString("v"))
+}
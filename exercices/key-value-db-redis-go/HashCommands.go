@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// hashCommand implements HSET, HGET, HDEL, HGETALL and HINCRBY.
+func hashCommand(db *Database, command string, args []string) Reply {
+	switch command {
+	case "HSET":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return ErrorReply("ERR wrong number of arguments for 'hset' command")
+		}
+		hash, exists, errReply := lookupAs[HashValue](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		if !exists {
+			hash = HashValue{}
+			db.set(args[0], hash)
+		}
+		added := 0
+		for i := 1; i < len(args); i += 2 {
+			if _, ok := hash[args[i]]; !ok {
+				added++
+			}
+			hash[args[i]] = args[i+1]
+		}
+		db.touch(args[0])
+		return Integer(added)
+	case "HGET":
+		if len(args) != 2 {
+			return ErrorReply("ERR wrong number of arguments for 'hget' command")
+		}
+		hash, _, errReply := lookupAs[HashValue](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		val, ok := hash[args[1]]
+		if !ok {
+			return NullBulk{}
+		}
+		return BulkString(val)
+	case "HDEL":
+		if len(args) < 2 {
+			return ErrorReply("ERR wrong number of arguments for 'hdel' command")
+		}
+		hash, exists, errReply := lookupAs[HashValue](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		if !exists {
+			return Integer(0)
+		}
+		removed := 0
+		for _, field := range args[1:] {
+			if _, ok := hash[field]; ok {
+				delete(hash, field)
+				removed++
+			}
+		}
+		if len(hash) == 0 {
+			db.deleteKey(args[0])
+		} else if removed > 0 {
+			db.touch(args[0])
+		}
+		return Integer(removed)
+	case "HGETALL":
+		if len(args) != 1 {
+			return ErrorReply("ERR wrong number of arguments for 'hgetall' command")
+		}
+		hash, _, errReply := lookupAs[HashValue](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		fields := make([]string, 0, len(hash))
+		for f := range hash {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		result := make(Array, 0, 2*len(hash))
+		for _, f := range fields {
+			result = append(result, BulkString(f), BulkString(hash[f]))
+		}
+		return result
+	case "HINCRBY":
+		if len(args) != 3 {
+			return ErrorReply("ERR wrong number of arguments for 'hincrby' command")
+		}
+		incr, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return ErrorReply("ERR value is not an integer or out of range")
+		}
+		hash, exists, errReply := lookupAs[HashValue](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		var current int64
+		if exists {
+			if val, ok := hash[args[1]]; ok {
+				current, err = strconv.ParseInt(val, 10, 64)
+				if err != nil {
+					return ErrorReply("ERR hash value is not an integer")
+				}
+			}
+		}
+		if (incr > 0 && current > math.MaxInt64-incr) || (incr < 0 && current < math.MinInt64-incr) {
+			return ErrorReply("ERR increment or decrement would overflow")
+		}
+		if !exists {
+			hash = HashValue{}
+			db.set(args[0], hash)
+		}
+		hash[args[1]] = strconv.FormatInt(current+incr, 10)
+		db.touch(args[0])
+		return Integer(current + incr)
+	}
+	return ErrorReply("ERR unknown command")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// avgTTLSample is the number of expiring keys INFO keyspace averages the
+// time to live of.
+const avgTTLSample = 100
+
+// serverStats are the server wide counters of INFO stats. The keyspace
+// counters live in each Database.
+type serverStats struct {
+	connections         atomic.Int64
+	rejectedConnections atomic.Int64
+	commands            atomic.Int64
+}
+
+// infoSections lists the INFO sections in the order they are printed. The
+// sections that read the keyspace have a lockedBody for callers that already
+// hold the locks of every database, such as EXEC.
+var infoSections = []struct {
+	name       string
+	title      string
+	body       func(s *Server) string
+	lockedBody func(s *Server) string
+}{
+	{"server", "Server", (*Server).serverInfo, nil},
+	{"clients", "Clients", (*Server).clientsInfo, nil},
+	{"memory", "Memory", (*Server).memoryInfo, nil},
+	{"stats", "Stats", (*Server).statsInfo, nil},
+	{"replication", "Replication", (*Server).replicationInfo, nil},
+	{"cluster", "Cluster", (*Server).clusterInfo, nil},
+	{"keyspace", "Keyspace", (*Server).keyspaceInfo, (*Server).keyspaceInfoLocked},
+}
+
+// infoCommand implements INFO [section ...]. Without arguments, or with
+// "all" or "default", every section is printed. locked tells that the caller
+// holds the locks of every database.
+func (s *Server) infoCommand(args []string, locked bool) Reply {
+	wanted := make(map[string]bool)
+	for _, arg := range args {
+		wanted[strings.ToLower(arg)] = true
+	}
+	all := len(args) == 0 || wanted["all"] || wanted["default"] || wanted["everything"]
+	var sb strings.Builder
+	for _, section := range infoSections {
+		if !all && !wanted[section.name] {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteString("\r\n")
+		}
+		body := section.body
+		if locked && section.lockedBody != nil {
+			body = section.lockedBody
+		}
+		sb.WriteString("# " + section.title + "\r\n")
+		sb.WriteString(body(s))
+	}
+	return BulkString(sb.String())
+}
+
+func (s *Server) serverInfo() string {
+	s.mutex.Lock()
+	port := s.port
+	s.mutex.Unlock()
+	now := time.Now()
+	uptime := int64(now.Sub(s.started).Seconds())
+	return fmt.Sprintf("go_version:%s\r\nos:%s\r\narch:%s\r\nprocess_id:%d\r\ntcp_port:%d\r\nserver_time_usec:%d\r\nuptime_in_seconds:%d\r\nuptime_in_days:%d\r\n",
+		runtime.Version(), runtime.GOOS, runtime.GOARCH, os.Getpid(), port, now.UnixMicro(), uptime, uptime/86400)
+}
+
+func (s *Server) clientsInfo() string {
+	clients := s.clientsByID()
+	pubsub := 0
+	for _, c := range clients {
+		c.info.mutex.Lock()
+		if c.info.sub+c.info.psub > 0 {
+			pubsub++
+		}
+		c.info.mutex.Unlock()
+	}
+	return fmt.Sprintf("connected_clients:%d\r\nblocked_clients:%d\r\npubsub_clients:%d\r\nmonitor_clients:%d\r\nmaxclients:%d\r\n",
+		len(clients), s.blockedClients.Load(), pubsub, s.monitors.count.Load(), s.maxClients.Load())
+}
+
+// statsInfo is the stats section of INFO.
+func (s *Server) statsInfo() string {
+	var expired, hits, misses int64
+	for _, db := range s.databases {
+		expired += db.expiredKeys.Load()
+		hits += db.keyspaceHits.Load()
+		misses += db.keyspaceMisses.Load()
+	}
+	s.pubsub.mutex.Lock()
+	channels, patterns := len(s.pubsub.channels), len(s.pubsub.patterns)
+	s.pubsub.mutex.Unlock()
+	return fmt.Sprintf("total_connections_received:%d\r\ntotal_commands_processed:%d\r\nrejected_connections:%d\r\n"+
+		"expired_keys:%d\r\nevicted_keys:%d\r\nkeyspace_hits:%d\r\nkeyspace_misses:%d\r\npubsub_channels:%d\r\npubsub_patterns:%d\r\n",
+		s.stats.connections.Load(), s.stats.commands.Load(), s.stats.rejectedConnections.Load(),
+		expired, s.eviction.evictedKeys.Load(), hits, misses, channels, patterns)
+}
+
+// keyspaceInfo prints a line per database that holds keys, with the average
+// time to live of a sample of its keys that expire.
+func (s *Server) keyspaceInfo() string {
+	return s.keyspaceLines(true)
+}
+
+// keyspaceInfoLocked is keyspaceInfo for a caller that holds the locks of
+// every database.
+func (s *Server) keyspaceInfoLocked() string {
+	return s.keyspaceLines(false)
+}
+
+func (s *Server) keyspaceLines(lock bool) string {
+	var sb strings.Builder
+	now := nowMillis()
+	for i, db := range s.databases {
+		var keys, expires int
+		var ttlSum, sampled int64
+		for _, sh := range db.shards {
+			if lock {
+				sh.mutex.RLock()
+			}
+			keys += len(sh.data)
+			expires += len(sh.expires)
+			for _, deadline := range sh.expires {
+				if sampled == avgTTLSample {
+					break
+				}
+				if deadline > now {
+					ttlSum += deadline - now
+					sampled++
+				}
+			}
+			if lock {
+				sh.mutex.RUnlock()
+			}
+		}
+		if keys == 0 {
+			continue
+		}
+		avgTTL := int64(0)
+		if sampled > 0 {
+			avgTTL = ttlSum / sampled
+		}
+		fmt.Fprintf(&sb, "db%d:keys=%d,expires=%d,avg_ttl=%d\r\n", i, keys, expires, avgTTL)
+	}
+	return sb.String()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInfoSections(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+	sub := dialTestServer(t, addr)
+	sub.do("SUBSCRIBE", "news")
+
+	c.do("SET", "key", "value")
+	c.do("SET", "temp", "value", "EX", "100")
+	c.do("GET", "key")
+	c.do("GET", "missing")
+	c.do("SELECT", "3")
+	c.do("SET", "other", "value")
+	c.do("PSETEX", "bogus")
+
+	info, _ := c.do("INFO").(BulkString)
+	for _, title := range []string{"# Server", "# Clients", "# Memory", "# Stats", "# Replication", "# Keyspace"} {
+		if !strings.Contains(string(info), title+"\r\n") {
+			t.Errorf("Expected the %s section in INFO", title)
+		}
+	}
+	if uptime, err := strconv.Atoi(infoField(t, c, "server", "uptime_in_seconds")); err != nil || uptime < 0 {
+		t.Errorf("Unexpected uptime %d (%v)", uptime, err)
+	}
+	expectFields := map[string]map[string]string{
+		"clients": {"connected_clients": "2", "pubsub_clients": "1", "maxclients": "10000"},
+		"stats":   {"total_connections_received": "2", "keyspace_hits": "1", "keyspace_misses": "1", "pubsub_channels": "1"},
+		"keyspace": {
+			"db0": "keys=2,expires=1,avg_ttl=",
+			"db3": "keys=1,expires=0,avg_ttl=0",
+		},
+	}
+	for section, fields := range expectFields {
+		for field, expected := range fields {
+			if got := infoField(t, c, section, field); !strings.HasPrefix(got, expected) {
+				t.Errorf("Expected %s %s to be %q, got %q", section, field, expected, got)
+			}
+		}
+	}
+	if ttl, _ := strconv.Atoi(strings.TrimPrefix(infoField(t, c, "keyspace", "db0"), "keys=2,expires=1,avg_ttl=")); ttl <= 90000 || ttl > 100000 {
+		t.Errorf("Expected an average ttl close to 100s, got %d", ttl)
+	}
+	// SELECT, SET and the unknown command were processed before this INFO
+	if n, _ := strconv.Atoi(infoField(t, c, "stats", "total_commands_processed")); n < 8 {
+		t.Errorf("Expected the commands to be counted, got %d", n)
+	}
+
+	c.do("SET", "short", "value", "PX", "1")
+	time.Sleep(5 * time.Millisecond)
+	c.do("GET", "short")
+	if expired := infoField(t, c, "stats", "expired_keys"); expired != "1" {
+		t.Errorf("Expected one expired key, got %q", expired)
+	}
+	if section, _ := c.do("INFO", "keyspace").(BulkString); strings.Contains(string(section), "# Server") {
+		t.Errorf("Expected only the keyspace section, got %q", section)
+	}
+}
+
+// EXEC holds every shard lock, which INFO keyspace must not take again.
+func TestInfoInsideMulti(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+	c.do("SET", "key", "value")
+
+	c.do("MULTI")
+	expectReply(t, c.do("SET", "other", "value"), SimpleString("QUEUED"))
+	expectReply(t, c.do("INFO", "keyspace"), SimpleString("QUEUED"))
+	c.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	replies, ok := c.do("EXEC").(Array)
+	c.conn.SetDeadline(time.Time{})
+	if !ok || len(replies) != 2 {
+		t.Fatalf("Expected two replies from EXEC, got %v", replies)
+	}
+	if section, _ := replies[1].(BulkString); !strings.Contains(string(section), "db0:keys=2,") {
+		t.Errorf("Expected INFO to count the keys inside the transaction, got %q", section)
+	}
+	if keys := infoField(t, c, "keyspace", "db0"); !strings.HasPrefix(keys, "keys=2,") {
+		t.Errorf("Expected INFO to work after the transaction, got %q", keys)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"math/rand"
+)
+
+const minIndexBuckets = 16
+
+var keyIndexSeed = maphash.MakeSeed()
+
+// keyIndex mirrors the keys of a database in a hash table with a power of two
+// number of buckets, which is what SCAN walks. Go maps cannot be resumed
+// after they change, while a cursor over these buckets can.
+type keyIndex struct {
+	buckets [][]string
+	count   int
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{buckets: make([][]string, minIndexBuckets)}
+}
+
+func (ki *keyIndex) bucketOf(key string) uint64 {
+	return maphash.String(keyIndexSeed, key) & uint64(len(ki.buckets)-1)
+}
+
+func (ki *keyIndex) add(key string) {
+	b := ki.bucketOf(key)
+	ki.buckets[b] = append(ki.buckets[b], key)
+	ki.count++
+	if ki.count > len(ki.buckets) {
+		ki.resize(2 * len(ki.buckets))
+	}
+}
+
+func (ki *keyIndex) remove(key string) {
+	b := ki.bucketOf(key)
+	bucket := ki.buckets[b]
+	for i, k := range bucket {
+		if k == key {
+			bucket[i] = bucket[len(bucket)-1]
+			ki.buckets[b] = bucket[:len(bucket)-1]
+			ki.count--
+			break
+		}
+	}
+	if len(ki.buckets) > minIndexBuckets && ki.count < len(ki.buckets)/4 {
+		ki.resize(len(ki.buckets) / 2)
+	}
+}
+
+func (ki *keyIndex) resize(size int) {
+	old := ki.buckets
+	ki.buckets = make([][]string, size)
+	for _, bucket := range old {
+		for _, key := range bucket {
+			b := ki.bucketOf(key)
+			ki.buckets[b] = append(ki.buckets[b], key)
+		}
+	}
+}
+
+// scan visits the bucket at cursor and returns the cursor of the next one, 0
+// once every bucket was visited. Cursors advance in reverse binary order, so
+// a key present for the whole iteration is visited at least once even if
+// the table grows or shrinks between calls.
+func (ki *keyIndex) scan(cursor uint64, visit func(key string)) uint64 {
+	mask := uint64(len(ki.buckets) - 1)
+	for _, key := range ki.buckets[cursor&mask] {
+		visit(key)
+	}
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
+
+// random returns a random key, or false when the index is empty.
+func (ki *keyIndex) random() (string, bool) {
+	if ki.count == 0 {
+		return "", false
+	}
+	for {
+		bucket := ki.buckets[rand.Intn(len(ki.buckets))]
+		if len(bucket) > 0 {
+			return bucket[rand.Intn(len(bucket))], true
+		}
+	}
+}
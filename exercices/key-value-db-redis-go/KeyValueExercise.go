@@ -2,6 +2,9 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
@@ -10,166 +13,811 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
-const defaultDBCount = 16
+const (
+	defaultDBCount = 16
+	// maxDBCount bounds the databases setting and the indexes read from files.
+	maxDBCount = 1 << 16
+)
+
+// ioBufferSize is the size of the per-connection read and write buffers.
+const ioBufferSize = 16 * 1024
 
+// Database is one of the numbered keyspaces. Go strings hold arbitrary bytes,
+// so keys and values arrive as length-prefixed RESP bulk strings and are stored
+// and returned without any re-encoding. See DataTypes.go for the value types.
+// The keys are spread over shards that are locked separately, see Shards.go.
 type Database struct {
-	data  map[string]string
-	mutex sync.RWMutex
+	shards [shardCount]*shard
+	used   atomic.Int64 // approximate bytes used by the keys
+
+	notify func(class int, event, key string) // publishes keyspace events, see notifyKeyspaceEvent
+
+	// Counters for INFO stats
+	expiredKeys    atomic.Int64
+	keyspaceHits   atomic.Int64
+	keyspaceMisses atomic.Int64
+}
+
+// Client is the per-connection state.
+type Client struct {
+	conn    net.Conn
+	writer  *bufio.Writer
+	inline  atomic.Bool // the last command was sent inline
+	dbIndex int
+
+	inMulti    bool
+	inExec     bool // runs the commands queued by MULTI
+	multiError bool // a command queued after MULTI was rejected
+	queued     [][]string
+	watched    []watchedKey
+	dirty      atomic.Bool // a watched key was modified
+
+	channels  map[string]struct{}
+	patterns  map[string]struct{}
+	push      chan Reply // replies waiting for the push writer, see startPush
+	pushDone  chan struct{}
+	pushBytes atomic.Int64
+	killed    atomic.Bool
+
+	id      int64
+	created time.Time
+	info    clientInfo
+
+	monitoring bool // MONITOR was run, see feedMonitors
+
+	blocked *blockedClient // waiting in BLPOP, BRPOP or BLMOVE, see waitBlocked
+
+	asking bool // ASKING was run, valid for the next command only
+
+	inScript     bool // runs the commands of a script, see runScript
+	scriptWrites bool // the script changed the dataset and MULTI was propagated
+
+	user        *User // nil until the client authenticates
+	master      bool  // the leader of this replica or a log being loaded, exempt from ACLs, READONLY and maxmemory
+	replicaPort int   // listening port announced by a replica with REPLCONF
 }
 
 type Server struct {
-	databases [defaultDBCount]*Database
-	clients   map[net.Conn]int
+	databases []*Database
+	clients   map[net.Conn]*Client
+	pubsub    *PubSub
+	monitors  *Monitors
+	nextID    atomic.Int64
+
+	blockedClients atomic.Int64
+	notifyFlags    atomic.Int64 // event classes of notify-keyspace-events
+
+	listeners map[net.Listener]struct{}
+	draining  atomic.Bool    // Shutdown was called, set while holding mutex
+	handlers  sync.WaitGroup // one per connection, see accept
+	stop      chan struct{}  // closed by Shutdown to stop the background goroutines
+	stopped   chan struct{}  // closed once Shutdown is done
+	aof       *AppendOnlyFile
 	mutex     sync.Mutex
+	port      int // first port served, announced to leaders
+
+	replication *Replication
+	eviction    *Eviction
+	acl         *ACL
+	slowlog     *Slowlog
+	metrics     *Metrics
+	scripts     *Scripts
+	cluster     *Cluster // nil unless cluster-enabled is set
+	stats       serverStats
+	started     time.Time
+
+	config      Config // settings read at startup, see configParams
+	configMutex sync.Mutex
+	maxClients  atomic.Int64
+	timeout     atomic.Int64 // seconds
+
+	snapshotPath   string
+	saveMutex      sync.Mutex
+	saving         bool
+	lastSave       int64 // unix seconds of the last successful snapshot
+	lastSaveFailed bool
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+}
+
+func NewDatabase() *Database {
+	db := &Database{}
+	for i := range db.shards {
+		db.shards[i] = newShard()
+	}
+	return db
 }
 
 func NewServer() *Server {
-	s := &Server{clients: make(map[net.Conn]int)}
-	for i := 0; i < defaultDBCount; i++ {
-		s.databases[i] = &Database{data: make(map[string]string)}
+	s, err := NewServerWithConfig(DefaultConfig())
+	if err != nil {
+		panic(err)
 	}
 	return s
 }
 
+// NewServerWithConfig creates a server with the databases and limits of cfg.
+// Loading the persisted data, listening and replicating are up to the caller.
+func NewServerWithConfig(cfg Config) (*Server, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	maxMemory, _ := parseMemory(cfg.MaxMemory)
+	s := &Server{
+		databases:    make([]*Database, cfg.Databases),
+		clients:      make(map[net.Conn]*Client),
+		listeners:    make(map[net.Listener]struct{}),
+		pubsub:       NewPubSub(),
+		monitors:     NewMonitors(),
+		replication:  NewReplication(),
+		eviction:     NewEviction(),
+		acl:          NewACL(cfg.Databases),
+		slowlog:      NewSlowlog(int64(cfg.SlowlogLogSlowerThan), int64(cfg.SlowlogMaxLen)),
+		metrics:      NewMetrics(),
+		scripts:      NewScripts(),
+		started:      time.Now(),
+		config:       cfg,
+		snapshotPath: cfg.DBFilename,
+		lastSave:     time.Now().Unix(),
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	if err := s.eviction.setMaxMemory(maxMemory, cfg.MaxMemoryPolicy); err != nil {
+		return nil, err
+	}
+	s.acl.setDefaultPassword(cfg.RequirePass)
+	s.replication.readOnly = cfg.ReplicaReadOnly
+	s.replication.timeout = time.Duration(cfg.ReplTimeout) * time.Second
+	s.replication.masterUser, s.replication.masterAuth = cfg.MasterUser, cfg.MasterAuth
+	s.maxClients.Store(int64(cfg.MaxClients))
+	s.timeout.Store(int64(cfg.Timeout))
+	s.scripts.timeLimit.Store(int64(cfg.LuaTimeLimit))
+	notifyFlags, _ := parseNotifyFlags(cfg.NotifyKeyspaceEvents)
+	s.notifyFlags.Store(int64(notifyFlags))
+	for i := range s.databases {
+		s.databases[i] = NewDatabase()
+		s.databases[i].notify = func(class int, event, key string) {
+			s.notifyKeyspaceEvent(i, class, event, key)
+		}
+		go s.databases[i].runActiveExpiry(s.stop)
+	}
+	go s.pingReplicas()
+	if cfg.ClusterEnabled {
+		s.cluster = NewCluster()
+		go s.clusterGossip()
+	}
+	return s, nil
+}
+
 func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
-	dbIndex := 0 // Default DB
-	reader := bufio.NewReader(conn)
+	if err := handshake(conn); err != nil {
+		return
+	}
+	c := &Client{
+		conn:     conn,
+		writer:   bufio.NewWriterSize(conn, ioBufferSize),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		user:     s.acl.defaultLogin(),
+		id:       s.nextID.Add(1),
+		created:  time.Now(),
+	}
+	c.recordCommand("NULL")
+	s.stats.connections.Add(1)
+	s.mutex.Lock()
+	if int64(len(s.clients)) >= s.maxClients.Load() {
+		s.mutex.Unlock()
+		s.stats.rejectedConnections.Add(1)
+		conn.Write([]byte("-ERR max number of clients reached\r\n"))
+		log.Println("Rejected client, max number of clients reached:", conn.RemoteAddr())
+		return
+	}
+	s.clients[conn] = c
+	s.mutex.Unlock()
+	defer func() {
+		s.unwatchAll(c)
+		s.unblock(c)
+		s.unsubscribeAll(c)
+		s.removeMonitor(c)
+		s.removeReplica(c)
+		c.stopPush()
+		s.mutex.Lock()
+		delete(s.clients, conn)
+		s.mutex.Unlock()
+	}()
+	reader := NewRespReader(bufio.NewReaderSize(conn, ioBufferSize))
 
 	for {
-		input, err := reader.ReadString('\n')
+		// Pipelined commands are answered in one write once the client has
+		// nothing more buffered
+		if reader.Buffered() == 0 {
+			c.flush()
+		}
+		if s.draining.Load() {
+			c.flush()
+			return
+		}
+		// Subscribers and replicas wait for the server, not the other way
+		// around, so they are never idle
+		if timeout := s.timeout.Load(); timeout > 0 && c.push == nil {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		args, inline, err := reader.ReadCommand()
+		c.inline.Store(inline)
 		if err != nil {
+			if isProtocolError(err) {
+				c.reply(ErrorReply("ERR " + err.Error()))
+				c.flush()
+			}
 			log.Println("Client disconnected:", conn.RemoteAddr())
-			s.mutex.Lock()
-			delete(s.clients, conn)
-			s.mutex.Unlock()
 			return
 		}
-		input = strings.TrimSpace(input)
-		args := strings.Fields(input)
 		if len(args) == 0 {
 			continue
 		}
 		command := strings.ToUpper(args[0])
-		response := s.executeCommand(command, args[1:], &dbIndex)
-		conn.Write([]byte(response + "\n"))
+		if command == "QUIT" {
+			c.reply(okReply)
+			c.flush()
+			return
+		}
+		start := time.Now()
+		reply := s.executeCommand(c, command, args[1:])
+		duration := time.Since(start)
+		// The time spent waiting for a push is not execution time
+		if c.blocked != nil {
+			var ok bool
+			if reply, ok = s.waitBlocked(c, reader, command, args[1:]); !ok {
+				log.Println("Client disconnected while blocked:", conn.RemoteAddr())
+				return
+			}
+		}
+		s.slowlog.record(c, args, duration)
+		s.metrics.record(command, duration)
+		s.stats.commands.Add(1)
+		c.reply(reply)
+		c.recordCommand(fullCommandName(command, args[1:]))
+		if c.killed.Load() {
+			c.flush()
+			return
+		}
+	}
+}
+
+// reply buffers the reply to a command. Once the client has subscribed it
+// goes through the push queue so that it stays ordered with published
+// messages. Subscription commands queue their own replies and return nil.
+func (c *Client) reply(reply Reply) {
+	switch {
+	case reply == nil:
+	case c.push != nil:
+		c.enqueue(reply)
+	default:
+		writeReply(c.writer, reply, c.inline.Load())
+	}
+}
+
+// flush writes the buffered replies. In push mode the push writer flushes
+// whenever its queue is empty.
+func (c *Client) flush() {
+	if c.push == nil {
+		c.writer.Flush()
+	}
+}
+
+// writeReply answers in the same protocol the client used for the request.
+func writeReply(w *bufio.Writer, reply Reply, inline bool) {
+	if inline {
+		writeInline(w, reply)
+	} else {
+		writeRESP(w, reply)
+	}
+}
+
+// executeCommand runs a command for a client, or queues it when the client
+// is inside MULTI.
+func (s *Server) executeCommand(c *Client, command string, args []string) Reply {
+	info, known := commandTable[command]
+	if c.monitoring {
+		return ErrorReply("ERR only QUIT is allowed while monitoring")
+	}
+	if errReply := s.checkPermission(c, command, args); errReply != nil {
+		c.multiError = c.inMulti
+		return errReply
+	}
+	asking := c.asking
+	c.asking = false
+	if s.cluster != nil && !c.master {
+		if errReply := s.clusterRedirect(c, command, args, asking); errReply != nil {
+			c.multiError = c.inMulti
+			return errReply
+		}
+	}
+	if info.flags&cmdTransaction != 0 {
+		// EXEC is shown after the commands it runs
+		if command != "EXEC" {
+			s.feedMonitors(c, c.dbIndex, command, args)
+		}
+		return s.transactionCommand(c, command, args)
+	}
+	if info.flags&cmdWrite != 0 && !c.master && s.isReadOnlyReplica() {
+		c.multiError = c.inMulti
+		return ErrorReply("READONLY You can't write against a read only replica.")
+	}
+	// Scripts are checked once before they start, and cannot evict while
+	// they hold every lock
+	if info.flags&cmdDenyOOM != 0 && !c.master && !c.inScript && !s.freeMemoryIfNeeded() {
+		c.multiError = c.inMulti
+		return errOOM
+	}
+	if c.inMulti {
+		if !known {
+			c.multiError = true
+			return ErrorReply("ERR unknown command")
+		}
+		if info.flags&cmdNoMulti != 0 {
+			c.multiError = true
+			return ErrorReply("ERR Command not allowed inside a transaction")
+		}
+		c.queued = append(c.queued, append([]string{command}, args...))
+		return SimpleString("QUEUED")
+	}
+	if !known {
+		return ErrorReply("ERR unknown command")
+	}
+	if c.subscriptions() > 0 && info.flags&cmdPubSub == 0 {
+		return ErrorReply(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(command)))
+	}
+	s.feedMonitors(c, c.dbIndex, command, args)
+	return s.call(c, command, args)
+}
+
+// call takes the locks of the shards of the selected database that the
+// command needs, lazily expires the keys it touches and runs it.
+func (s *Server) call(c *Client, command string, args []string) Reply {
+	info := commandTable[command]
+	if info.flags&cmdNoKeyspace != 0 {
+		return s.dispatch(c, command, args)
+	}
+	if info.flags&cmdSelfLocking != 0 {
+		return s.dispatch(c, command, args)
+	}
+	if c.inScript {
+		// The script holds every lock already
+		return s.callLocked(c, command, args)
+	}
+	if info.flags&cmdAllDatabases != 0 {
+		s.lockAll()
+		defer s.unlockAll()
+		return s.callLocked(c, command, args)
 	}
+	db := s.databases[c.dbIndex]
+	keys := commandKeys(command, args)
+	shards := commandShards(command, args)
+	if info.flags&cmdWrite == 0 {
+		db.rlock(shards)
+		if !db.anyExpired(keys) {
+			defer db.runlock(shards)
+			return s.dispatch(c, command, args)
+		}
+		db.runlock(shards)
+	}
+	db.lock(shards)
+	defer db.unlock(shards)
+	return s.callLocked(c, command, args)
+}
+
+// callLocked runs a command while the caller holds the write locks of the
+// shards it runs on, and propagates it if it changed the dataset.
+func (s *Server) callLocked(c *Client, command string, args []string) Reply {
+	info := commandTable[command]
+	db := s.databases[c.dbIndex]
+	for _, key := range commandKeys(command, args) {
+		db.expireIfNeeded(key)
+	}
+	shards := commandShards(command, args)
+	dirty := db.dirtyCount(shards)
+	reply := s.dispatch(c, command, args)
+	if info.flags&cmdWrite != 0 && db.dirtyCount(shards) != dirty {
+		if c.inScript && !c.scriptWrites {
+			c.scriptWrites = true
+			s.propagate(c.dbIndex, []string{"MULTI"})
+		}
+		s.propagate(c.dbIndex, propagatedForm(db, command, args, reply))
+		s.notifyCommand(db, command, args, reply)
+	}
+	return reply
 }
 
-func (s *Server) executeCommand(command string, args []string, dbIndex *int) string {
-	db := s.databases[*dbIndex]
+// dispatch executes a command. Commands that touch the keyspace run with the
+// locks of the shards of the selected database they need already held.
+func (s *Server) dispatch(c *Client, command string, args []string) Reply {
+	db := s.databases[c.dbIndex]
 	switch command {
-	case "SET":
-		if len(args) < 2 {
-			return "(error) ERR wrong number of arguments for 'set' command"
+	case "PING":
+		if len(args) > 1 {
+			return ErrorReply("ERR wrong number of arguments for 'ping' command")
 		}
-		key, value := args[0], strings.Join(args[1:], " ")
-		db.mutex.Lock()
-		db.data[key] = value
-		db.mutex.Unlock()
-		return "OK"
-	case "GET":
-		if len(args) != 1 {
-			return "(error) ERR wrong number of arguments for 'get' command"
+		if c.subscriptions() > 0 {
+			message := ""
+			if len(args) == 1 {
+				message = args[0]
+			}
+			return Array{BulkString("pong"), BulkString(message)}
 		}
-		db.mutex.RLock()
-		val, exists := db.data[args[0]]
-		db.mutex.RUnlock()
-		if !exists {
-			return "(nil)"
+		if len(args) == 1 {
+			return BulkString(args[0])
 		}
-		return fmt.Sprintf("\"%s\"", val)
-	case "DEL":
+		return SimpleString("PONG")
+	case "ECHO":
 		if len(args) != 1 {
-			return "(error) ERR wrong number of arguments for 'del' command"
+			return ErrorReply("ERR wrong number of arguments for 'echo' command")
+		}
+		return BulkString(args[0])
+	case "SET":
+		if len(args) < 2 {
+			return ErrorReply("ERR wrong number of arguments for 'set' command")
+		}
+		key, value := args[0], args[1]
+		opts, errReply := parseSetOptions(args[2:])
+		if errReply != nil {
+			return errReply
 		}
-		db.mutex.Lock()
-		_, exists := db.data[args[0]]
-		if exists {
-			delete(db.data, args[0])
+		_, exists := db.value(key)
+		if (opts.nx && exists) || (opts.xx && !exists) {
+			return NullBulk{}
 		}
-		db.mutex.Unlock()
-		if exists {
-			return "(integer) 1"
+		db.set(key, value)
+		if opts.deadline != 0 {
+			db.setDeadline(key, opts.deadline)
+		} else if !opts.keepTTL {
+			db.removeDeadline(key)
 		}
-		return "(integer) 0"
-	case "INCR":
+		return okReply
+	case "GET":
 		if len(args) != 1 {
-			return "(error) ERR wrong number of arguments for 'incr' command"
+			return ErrorReply("ERR wrong number of arguments for 'get' command")
+		}
+		val, exists, errReply := lookupAs[string](db, args[0])
+		if errReply != nil {
+			return errReply
 		}
-		key := args[0]
-		db.mutex.Lock()
-		val, exists := db.data[key]
 		if !exists {
-			db.data[key] = "1"
-			db.mutex.Unlock()
-			return "(integer) 1"
+			return NullBulk{}
 		}
-		intVal, err := strconv.Atoi(val)
-		if err != nil {
-			db.mutex.Unlock()
-			return "(error) ERR value is not an integer or out of range"
+		return BulkString(val)
+	case "DEL":
+		if len(args) == 0 {
+			return ErrorReply("ERR wrong number of arguments for 'del' command")
+		}
+		deleted := 0
+		for _, key := range args {
+			if _, exists := db.value(key); exists {
+				db.deleteKey(key)
+				db.notifyEvent(notifyGeneric, "del", key)
+				deleted++
+			}
 		}
-		intVal++
-		db.data[key] = strconv.Itoa(intVal)
-		db.mutex.Unlock()
-		return fmt.Sprintf("(integer) %d", intVal)
+		return Integer(deleted)
+	case "DUMP":
+		return dumpCommand(db, args)
+	case "RESTORE":
+		return restoreCommand(db, args)
+	case "MIGRATE":
+		return s.migrateCommand(c, args)
+	case "INCR", "INCRBY", "DECR", "DECRBY", "INCRBYFLOAT", "APPEND", "STRLEN", "GETRANGE", "SETRANGE",
+		"GETSET", "GETDEL", "SETNX", "MSET", "MSETNX", "MGET":
+		return stringCommand(db, command, args)
+	case "LPUSH", "RPUSH", "LPOP", "RPOP", "LRANGE", "LLEN", "LMOVE":
+		return listCommand(db, command, args)
+	case "BLPOP", "BRPOP", "BLMOVE":
+		return s.blockingCommand(c, db, command, args)
+	case "HSET", "HGET", "HDEL", "HGETALL", "HINCRBY":
+		return hashCommand(db, command, args)
+	case "SADD", "SREM", "SMEMBERS", "SISMEMBER", "SINTER", "SUNION":
+		return setCommand(db, command, args)
+	case "ZADD", "ZRANGE", "ZRANGEBYSCORE", "ZRANK", "ZINCRBY":
+		return sortedSetCommand(db, command, args)
+	case "EXPIRE":
+		return expireCommand(db, args, 1000, "expire")
+	case "PEXPIRE":
+		return expireCommand(db, args, 1, "pexpire")
+	case "EXPIREAT":
+		return expireAtCommand(db, args, 1000, "expireat")
+	case "PEXPIREAT":
+		return expireAtCommand(db, args, 1, "pexpireat")
+	case "TTL":
+		return ttlCommand(db, args, 1000, "ttl")
+	case "PTTL":
+		return ttlCommand(db, args, 1, "pttl")
+	case "PERSIST":
+		return persistCommand(db, args)
 	case "SELECT":
 		if len(args) != 1 {
-			return "(error) ERR wrong number of arguments for 'select' command"
+			return ErrorReply("ERR wrong number of arguments for 'select' command")
 		}
 		dbNum, err := strconv.Atoi(args[0])
-		if err != nil || dbNum < 0 || dbNum >= defaultDBCount {
-			return "(error) ERR DB index is out of range"
+		if err != nil || dbNum < 0 || dbNum >= len(s.databases) {
+			return ErrorReply("ERR DB index is out of range")
 		}
-		*dbIndex = dbNum
-		return "OK"
+		if s.cluster != nil && dbNum != 0 {
+			return ErrorReply("ERR SELECT is not allowed in cluster mode")
+		}
+		c.dbIndex = dbNum
+		return okReply
 	case "COMPACT":
-		db.mutex.RLock()
-		var compacted []string
-		for k, v := range db.data {
-			compacted = append(compacted, fmt.Sprintf("SET %s %s", k, v))
+		compacted := Array{}
+		for _, argv := range db.compactCommands() {
+			quoted := make([]string, len(argv))
+			for i, arg := range argv {
+				quoted[i] = quoteArg(arg)
+			}
+			compacted = append(compacted, BulkString(strings.Join(quoted, " ")))
+		}
+		return compacted
+	case "KEYS", "SCAN", "EXISTS", "TYPE", "DBSIZE", "RANDOMKEY", "RENAME", "RENAMENX", "MOVE", "FLUSHDB", "FLUSHALL":
+		return s.keyspaceCommand(c, command, args)
+	case "SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE":
+		return s.pubsubCommand(c, command, args)
+	case "PUBLISH":
+		if len(args) != 2 {
+			return ErrorReply("ERR wrong number of arguments for 'publish' command")
 		}
-		db.mutex.RUnlock()
-		if len(compacted) == 0 {
-			return "(nil)"
+		return Integer(s.publish(args[0], args[1]))
+	case "CLUSTER":
+		return s.clusterCommand(c, args)
+	case "ASKING":
+		if s.cluster == nil {
+			return ErrorReply("ERR This instance has cluster support disabled")
 		}
-		return strings.Join(compacted, "\n")
+		if len(args) != 0 {
+			return ErrorReply("ERR wrong number of arguments for 'asking' command")
+		}
+		c.asking = true
+		return okReply
+	case "REPLICAOF", "SYNC", "REPLCONF":
+		return s.replicationCommand(c, command, args)
+	case "AUTH":
+		return s.authCommand(c, args)
+	case "ACL":
+		return s.aclCommand(c, args)
+	case "CLIENT":
+		return s.clientCommand(c, args)
+	case "CONFIG":
+		return s.configCommand(args)
+	case "INFO":
+		return s.infoCommand(args, c.inExec)
+	case "SLOWLOG":
+		return s.slowlogCommand(args)
+	case "EVAL", "EVALSHA":
+		return s.evalCommand(c, command, args)
+	case "SCRIPT":
+		return s.scriptCommand(args)
+	case "MONITOR":
+		return s.monitorCommand(c, args)
+	case "SAVE", "BGSAVE", "LASTSAVE":
+		return s.snapshotCommand(command, args)
+	case "SHUTDOWN":
+		return s.shutdownCommand(args)
+	case "BGREWRITEAOF":
+		if len(args) != 0 {
+			return ErrorReply("ERR wrong number of arguments for 'bgrewriteaof' command")
+		}
+		dbCommands, err := s.beginAOFRewrite()
+		if err != nil {
+			return ErrorReply(err.Error())
+		}
+		go func() {
+			if err := s.finishAOFRewrite(dbCommands); err != nil {
+				log.Println("Background AOF rewrite failed:", err)
+			}
+		}()
+		return SimpleString("Background append only file rewriting started")
 	default:
-		return "(error) ERR unknown command"
+		return ErrorReply("ERR unknown command")
 	}
 }
 
-func main() {
-	port := "9736"
-	listener, err := net.Listen("tcp", ":"+port)
-	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+// itemsPerCommand bounds how many elements one compacted command carries, so
+// big collections do not turn into one huge command.
+const itemsPerCommand = 64
+
+// compactCommands returns the shortest list of commands that rebuilds the
+// database, one family of commands per value type. Caller holds at least the
+// read lock of every shard.
+func (db *Database) compactCommands() [][]string {
+	var commands [][]string
+	for _, sh := range db.shards {
+		for k, v := range sh.data {
+			if sh.isExpired(k) {
+				continue
+			}
+			deadline, expires := sh.expires[k]
+			if str, ok := v.(string); ok {
+				argv := []string{"SET", k, str}
+				if expires {
+					argv = append(argv, "PXAT", strconv.FormatInt(deadline, 10))
+				}
+				commands = append(commands, argv)
+				continue
+			}
+			commands = append(commands, collectionCommands(k, v)...)
+			if expires {
+				commands = append(commands, []string{"PEXPIREAT", k, strconv.FormatInt(deadline, 10)})
+			}
+		}
 	}
-	defer listener.Close()
-	fmt.Println("Redis-like server started on port", port)
+	return commands
+}
 
-	srv := NewServer()
+func collectionCommands(key string, v interface{}) [][]string {
+	var command string
+	var items []string
+	switch val := v.(type) {
+	case *ListValue:
+		command, items = "RPUSH", val.values()
+	case HashValue:
+		command = "HSET"
+		for f, fv := range val {
+			items = append(items, f, fv)
+		}
+	case SetValue:
+		command, items = "SADD", val.members()
+	case *SortedSetValue:
+		command = "ZADD"
+		for _, e := range val.sorted {
+			items = append(items, formatFloat(e.score), e.member)
+		}
+	}
+	step := itemsPerCommand
+	if command == "HSET" || command == "ZADD" {
+		step *= 2
+	}
+	var commands [][]string
+	for start := 0; start < len(items); start += step {
+		end := min(start+step, len(items))
+		commands = append(commands, append([]string{command, key}, items[start:end]...))
+	}
+	return commands
+}
 
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-		<-c
-		fmt.Println("Shutting down server...")
-		listener.Close()
-		os.Exit(0)
-	}()
+// serve accepts connections until the listener is closed.
+func (s *Server) serve(listener net.Listener) error {
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		s.mutex.Lock()
+		if s.port == 0 {
+			s.port = addr.Port
+		}
+		s.mutex.Unlock()
+	}
+	return s.accept(listener)
+}
 
+func (s *Server) accept(listener net.Listener) error {
+	if !s.addListener(listener) {
+		return net.ErrClosed
+	}
+	defer s.removeListener(listener)
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			log.Println("Connection error:", err)
 			continue
 		}
+		// Checked under the mutex so no handler starts once Shutdown waits
+		s.mutex.Lock()
+		if s.draining.Load() {
+			s.mutex.Unlock()
+			conn.Close()
+			continue
+		}
+		s.handlers.Add(1)
+		s.mutex.Unlock()
 		log.Println("New client connected:", conn.RemoteAddr())
-		go srv.handleConnection(conn)
+		go func() {
+			defer s.handlers.Done()
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+func main() {
+	cfg, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("Error in configuration: %v", err)
+	}
+	srv, err := NewServerWithConfig(cfg)
+	if err != nil {
+		log.Fatalf("Error in configuration: %v", err)
+	}
+	var tlsConfig *tls.Config
+	if cfg.TLSPort != 0 {
+		if tlsConfig, err = loadTLSConfig(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSCACertFile, cfg.TLSAuthClients); err != nil {
+			log.Fatalf("Error loading TLS configuration: %v", err)
+		}
+	}
+
+	hosts := strings.Fields(cfg.Bind)
+	if len(hosts) == 0 {
+		hosts = []string{""}
+	}
+	var listeners, tlsListeners, metricsListeners []net.Listener
+	for _, host := range hosts {
+		if cfg.Port != 0 {
+			listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(cfg.Port)))
+			if err != nil {
+				log.Fatalf("Error starting server: %v", err)
+			}
+			listeners = append(listeners, listener)
+			fmt.Println("Redis-like server started on", listener.Addr())
+		}
+		if cfg.TLSPort != 0 {
+			listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(cfg.TLSPort)))
+			if err != nil {
+				log.Fatalf("Error starting TLS server: %v", err)
+			}
+			tlsListeners = append(tlsListeners, listener)
+			fmt.Println("Redis-like server accepting TLS on", listener.Addr())
+		}
+		if cfg.MetricsPort != 0 {
+			listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(cfg.MetricsPort)))
+			if err != nil {
+				log.Fatalf("Error starting metrics server: %v", err)
+			}
+			metricsListeners = append(metricsListeners, listener)
+			fmt.Println("Serving metrics on", listener.Addr())
+		}
+	}
+
+	// The append only file is the more complete record, so it wins when enabled
+	if cfg.AppendOnly {
+		if err := srv.enableAOF(cfg.AppendFilename, cfg.AppendFsync); err != nil {
+			log.Fatalf("Error loading append only file: %v", err)
+		}
+	} else if err := srv.loadSnapshot(srv.snapshotPath); err != nil {
+		log.Fatalf("Error loading snapshot: %v", err)
+	}
+	if cfg.ReplicaOf != "" {
+		fields := strings.Fields(cfg.ReplicaOf)
+		srv.startReplication(net.JoinHostPort(fields[0], fields[1]))
+	}
+
+	for _, listener := range listeners {
+		go srv.serve(listener)
+	}
+	for _, listener := range tlsListeners {
+		go srv.serveTLS(listener, tlsConfig)
+	}
+	for _, listener := range metricsListeners {
+		go srv.serveMetrics(listener)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-signals:
+	case <-srv.stop: // SHUTDOWN
+	}
+	fmt.Println("Shutting down server...")
+	// A second signal skips the drain
+	go func() {
+		<-signals
+		log.Fatal("Shutdown interrupted")
+	}()
+	if err := srv.Shutdown(time.Duration(cfg.ShutdownWait) * time.Second); err != nil {
+		log.Fatalf("Error shutting down: %v", err)
 	}
+	fmt.Println("Server stopped")
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// keyspaceCommand implements KEYS, SCAN, EXISTS, TYPE, DBSIZE, RANDOMKEY,
+// RENAME, RENAMENX, MOVE, FLUSHDB and FLUSHALL.
+func (s *Server) keyspaceCommand(c *Client, command string, args []string) Reply {
+	db := s.databases[c.dbIndex]
+	name := strings.ToLower(command)
+	switch command {
+	case "KEYS":
+		if len(args) != 1 {
+			return ErrorReply("ERR wrong number of arguments for 'keys' command")
+		}
+		keys := Array{}
+		for _, sh := range db.shards {
+			for key := range sh.data {
+				if !sh.isExpired(key) && globMatch(args[0], key) {
+					keys = append(keys, BulkString(key))
+				}
+			}
+		}
+		return keys
+	case "SCAN":
+		return scanCommand(db, args)
+	case "EXISTS":
+		if len(args) == 0 {
+			return ErrorReply("ERR wrong number of arguments for 'exists' command")
+		}
+		count := 0
+		for _, key := range args {
+			if _, exists := db.lookup(key); exists {
+				count++
+			}
+		}
+		return Integer(count)
+	case "TYPE":
+		if len(args) != 1 {
+			return ErrorReply("ERR wrong number of arguments for 'type' command")
+		}
+		v, _ := db.lookup(args[0])
+		return SimpleString(typeName(v))
+	case "DBSIZE":
+		if len(args) != 0 {
+			return ErrorReply("ERR wrong number of arguments for 'dbsize' command")
+		}
+		return Integer(db.size())
+	case "RANDOMKEY":
+		if len(args) != 0 {
+			return ErrorReply("ERR wrong number of arguments for 'randomkey' command")
+		}
+		// Expired keys are still indexed until they are deleted, so give up
+		// after a few tries when most keys are expired
+		for tries := 0; tries < 100; tries++ {
+			key, ok := db.randomKey()
+			if !ok {
+				break
+			}
+			if !db.isExpired(key) {
+				return BulkString(key)
+			}
+		}
+		return NullBulk{}
+	case "RENAME", "RENAMENX":
+		if len(args) != 2 {
+			return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		}
+		src, dst := args[0], args[1]
+		value, exists := db.value(src)
+		if !exists {
+			return ErrorReply("ERR no such key")
+		}
+		if _, taken := db.value(dst); taken && command == "RENAMENX" {
+			return Integer(0)
+		}
+		if src == dst {
+			if command == "RENAMENX" {
+				return Integer(0)
+			}
+			return okReply
+		}
+		deadline, expires := db.deadline(src)
+		db.deleteKey(src)
+		db.deleteKey(dst)
+		db.set(dst, value)
+		if expires {
+			db.setDeadline(dst, deadline)
+		}
+		if command == "RENAMENX" {
+			return Integer(1)
+		}
+		return okReply
+	case "MOVE":
+		if len(args) != 2 {
+			return ErrorReply("ERR wrong number of arguments for 'move' command")
+		}
+		if s.cluster != nil {
+			return ErrorReply("ERR MOVE is not allowed in cluster mode")
+		}
+		dbNum, err := strconv.Atoi(args[1])
+		if err != nil || dbNum < 0 || dbNum >= len(s.databases) {
+			return ErrorReply("ERR DB index is out of range")
+		}
+		if dbNum == c.dbIndex {
+			return ErrorReply("ERR source and destination objects are the same")
+		}
+		key, target := args[0], s.databases[dbNum]
+		target.expireIfNeeded(key)
+		value, exists := db.value(key)
+		if _, taken := target.value(key); !exists || taken {
+			return Integer(0)
+		}
+		deadline, expires := db.deadline(key)
+		db.deleteKey(key)
+		target.set(key, value)
+		if expires {
+			target.setDeadline(key, deadline)
+		}
+		return Integer(1)
+	case "FLUSHDB", "FLUSHALL":
+		if len(args) > 1 || (len(args) == 1 && !strings.EqualFold(args[0], "ASYNC") && !strings.EqualFold(args[0], "SYNC")) {
+			return ErrorReply("ERR syntax error")
+		}
+		if command == "FLUSHDB" {
+			db.flush()
+			return okReply
+		}
+		for _, db := range s.databases {
+			db.flush()
+		}
+		return okReply
+	}
+	return ErrorReply("ERR unknown command")
+}
+
+// scanCommand implements SCAN cursor [MATCH pattern] [COUNT count] [TYPE type].
+// Caller holds at least the read lock of every shard.
+func scanCommand(db *Database, args []string) Reply {
+	if len(args) == 0 {
+		return ErrorReply("ERR wrong number of arguments for 'scan' command")
+	}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return ErrorReply("ERR invalid cursor")
+	}
+	pattern, count, typ := "", 10, ""
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return ErrorReply("ERR syntax error")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil {
+				return ErrorReply("ERR value is not an integer or out of range")
+			}
+			if count < 1 {
+				return ErrorReply("ERR syntax error")
+			}
+		case "TYPE":
+			typ = strings.ToLower(args[i+1])
+		default:
+			return ErrorReply("ERR syntax error")
+		}
+	}
+	keys := Array{}
+	// COUNT is the number of keys looked at, not returned, like in Redis
+	for visited := 0; visited < count; {
+		cursor = db.scan(cursor, func(key string) {
+			visited++
+			if db.isExpired(key) || (pattern != "" && !globMatch(pattern, key)) {
+				return
+			}
+			if typ != "" {
+				if v, _ := db.value(key); typeName(v) != typ {
+					return
+				}
+			}
+			keys = append(keys, BulkString(key))
+		})
+		if cursor == 0 {
+			break
+		}
+	}
+	return Array{BulkString(strconv.FormatUint(cursor, 10)), keys}
+}
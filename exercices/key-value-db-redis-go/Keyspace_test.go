@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func sortedStrings(t *testing.T, reply Reply) []string {
+	t.Helper()
+	arr, ok := reply.(Array)
+	if !ok {
+		t.Fatalf("Expected an array, got %s", formatInline(reply, ""))
+	}
+	values := make([]string, len(arr))
+	for i, v := range arr {
+		values[i] = string(v.(BulkString))
+	}
+	sort.Strings(values)
+	return values
+}
+
+func TestKeysExistsTypeDBSize(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+	c.do("SET", "user:1", "a")
+	c.do("SET", "user:2", "b")
+	c.do("RPUSH", "queue", "x")
+	c.do("SET", "gone", "x", "PX", "1")
+
+	expectReply(t, Array{BulkString("user:1"), BulkString("user:2")}, stringsToArray(sortedStrings(t, c.do("KEYS", "user:*"))))
+	expectReply(t, c.do("KEYS", "nothing*"), Array{})
+	expectReply(t, c.do("EXISTS", "user:1", "user:2", "user:1", "missing"), Integer(3))
+	expectReply(t, c.do("TYPE", "queue"), SimpleString("list"))
+	expectReply(t, c.do("TYPE", "user:1"), SimpleString("string"))
+	expectReply(t, c.do("TYPE", "missing"), SimpleString("none"))
+	waitForReply(t, c, Integer(0), "EXISTS", "gone")
+	expectReply(t, c.do("DBSIZE"), Integer(3))
+
+	key, ok := c.do("RANDOMKEY").(BulkString)
+	if !ok || (key != "user:1" && key != "user:2" && key != "queue") {
+		t.Errorf("Unexpected RANDOMKEY %q", key)
+	}
+	c.do("SELECT", "1")
+	expectReply(t, c.do("RANDOMKEY"), NullBulk{})
+}
+
+func TestRenameAndMove(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+	c.do("SET", "src", "value", "EX", "100")
+	c.do("SET", "other", "taken")
+
+	expectReply(t, c.do("RENAME", "missing", "dst"), ErrorReply("ERR no such key"))
+	expectReply(t, c.do("RENAMENX", "src", "other"), Integer(0))
+	expectReply(t, c.do("RENAME", "src", "dst"), okReply)
+	expectReply(t, c.do("GET", "src"), NullBulk{})
+	expectReply(t, c.do("GET", "dst"), BulkString("value"))
+	if ttl, _ := c.do("TTL", "dst").(Integer); ttl <= 0 {
+		t.Errorf("Expected RENAME to keep the TTL, got %d", ttl)
+	}
+	expectReply(t, c.do("RENAME", "dst", "other"), okReply)
+	expectReply(t, c.do("GET", "other"), BulkString("value"))
+	expectReply(t, c.do("RENAMENX", "other", "fresh"), Integer(1))
+
+	expectReply(t, c.do("MOVE", "fresh", "0"), ErrorReply("ERR source and destination objects are the same"))
+	expectReply(t, c.do("MOVE", "fresh", "16"), ErrorReply("ERR DB index is out of range"))
+	expectReply(t, c.do("MOVE", "fresh", "2"), Integer(1))
+	expectReply(t, c.do("EXISTS", "fresh"), Integer(0))
+	c.do("SELECT", "2")
+	expectReply(t, c.do("GET", "fresh"), BulkString("value"))
+	if ttl, _ := c.do("TTL", "fresh").(Integer); ttl <= 0 {
+		t.Errorf("Expected MOVE to keep the TTL, got %d", ttl)
+	}
+	c.do("SELECT", "0")
+	c.do("SET", "fresh", "local")
+	expectReply(t, c.do("MOVE", "fresh", "2"), Integer(0))
+	expectReply(t, c.do("GET", "fresh"), BulkString("local"))
+
+	// MOVE takes every database lock, which EXEC already holds
+	c.do("MULTI")
+	c.do("MOVE", "fresh", "3")
+	expectReply(t, c.do("EXEC"), Array{Integer(1)})
+}
+
+func TestFlushDBAndFlushAll(t *testing.T) {
+	srv, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+	c.do("SET", "a", "1")
+	c.do("SELECT", "1")
+	c.do("SET", "b", "1")
+
+	expectReply(t, c.do("FLUSHDB"), okReply)
+	expectReply(t, c.do("DBSIZE"), Integer(0))
+	c.do("SELECT", "0")
+	expectReply(t, c.do("DBSIZE"), Integer(1))
+	c.do("SELECT", "1")
+	c.do("SET", "b", "1")
+	expectReply(t, c.do("FLUSHALL"), okReply)
+	expectReply(t, c.do("DBSIZE"), Integer(0))
+	c.do("SELECT", "0")
+	expectReply(t, c.do("DBSIZE"), Integer(0))
+	if used := srv.usedMemory(); used != 0 {
+		t.Errorf("Expected no memory in use after FLUSHALL, got %d", used)
+	}
+}
+
+func TestScanWithMatchCountAndType(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+	for i := 0; i < 100; i++ {
+		c.do("SET", "key:"+strconv.Itoa(i), "v")
+	}
+	c.do("SADD", "key:set", "m")
+	c.do("SET", "other", "v")
+
+	seen := map[string]int{}
+	cursor := "0"
+	for {
+		reply := c.do("SCAN", cursor, "MATCH", "key:*", "COUNT", "7").(Array)
+		cursor = string(reply[0].(BulkString))
+		for _, key := range reply[1].(Array) {
+			seen[string(key.(BulkString))]++
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 101 || seen["other"] != 0 {
+		t.Errorf("Expected the 101 matching keys, got %d", len(seen))
+	}
+
+	reply := c.do("SCAN", "0", "TYPE", "set", "COUNT", "1000").(Array)
+	expectReply(t, reply, Array{BulkString("0"), Array{BulkString("key:set")}})
+	expectReply(t, c.do("SCAN", "abc"), ErrorReply("ERR invalid cursor"))
+	expectReply(t, c.do("SCAN", "0", "COUNT", "0"), ErrorReply("ERR syntax error"))
+}
+
+func TestKeyIndexScanSurvivesResizes(t *testing.T) {
+	ki := newKeyIndex()
+	for i := 0; i < 500; i++ {
+		ki.add("stable:" + strconv.Itoa(i))
+	}
+	seen := map[string]bool{}
+	cursor, step := uint64(0), 0
+	for {
+		cursor = ki.scan(cursor, func(key string) { seen[key] = true })
+		// Grow the table a lot, then shrink it, while the scan is running
+		if step < 50 {
+			for j := 0; j < 40; j++ {
+				ki.add("temp:" + strconv.Itoa(step*40+j))
+			}
+		} else if step < 100 {
+			for j := 0; j < 40; j++ {
+				ki.remove("temp:" + strconv.Itoa((step-50)*40+j))
+			}
+		}
+		step++
+		if cursor == 0 {
+			break
+		}
+	}
+	for i := 0; i < 500; i++ {
+		if !seen["stable:"+strconv.Itoa(i)] {
+			t.Fatalf("SCAN missed stable:%d", i)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// listCommand implements LPUSH, RPUSH, LPOP, RPOP, LRANGE, LLEN and LMOVE.
+func listCommand(db *Database, command string, args []string) Reply {
+	name := strings.ToLower(command)
+	switch command {
+	case "LPUSH", "RPUSH":
+		if len(args) < 2 {
+			return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		}
+		list, exists, errReply := lookupAs[*ListValue](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		if !exists {
+			list = &ListValue{}
+			db.set(args[0], list)
+		}
+		for _, v := range args[1:] {
+			if command == "LPUSH" {
+				list.pushFront(v)
+			} else {
+				list.pushBack(v)
+			}
+		}
+		db.touch(args[0])
+		return Integer(list.len())
+	case "LPOP", "RPOP":
+		if len(args) < 1 || len(args) > 2 {
+			return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		}
+		count, withCount := 1, len(args) == 2
+		if withCount {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 0 {
+				return ErrorReply("ERR value is out of range, must be positive")
+			}
+			count = n
+		}
+		list, exists, errReply := lookupAs[*ListValue](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		if !exists {
+			if withCount {
+				return NullArray{}
+			}
+			return NullBulk{}
+		}
+		popped := Array{}
+		for len(popped) < count && list.len() > 0 {
+			if command == "LPOP" {
+				popped = append(popped, BulkString(list.popFront()))
+			} else {
+				popped = append(popped, BulkString(list.popBack()))
+			}
+		}
+		if list.len() == 0 {
+			db.deleteKey(args[0])
+		} else if len(popped) > 0 {
+			db.touch(args[0])
+		}
+		if !withCount {
+			return popped[0]
+		}
+		return popped
+	case "LRANGE":
+		if len(args) != 3 {
+			return ErrorReply("ERR wrong number of arguments for 'lrange' command")
+		}
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			return ErrorReply("ERR value is not an integer or out of range")
+		}
+		list, exists, errReply := lookupAs[*ListValue](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		if !exists {
+			return Array{}
+		}
+		from, to := normalizeRange(start, stop, list.len())
+		result := make(Array, 0, to-from)
+		for i := from; i < to; i++ {
+			result = append(result, BulkString(list.at(i)))
+		}
+		return result
+	case "LLEN":
+		if len(args) != 1 {
+			return ErrorReply("ERR wrong number of arguments for 'llen' command")
+		}
+		list, _, errReply := lookupAs[*ListValue](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		if list == nil {
+			return Integer(0)
+		}
+		return Integer(list.len())
+	case "LMOVE":
+		if len(args) != 4 {
+			return ErrorReply("ERR wrong number of arguments for 'lmove' command")
+		}
+		return listMove(db, args[0], args[1], strings.ToUpper(args[2]), strings.ToUpper(args[3]))
+	}
+	return ErrorReply("ERR unknown command")
+}
+
+// listMove pops an element from the LEFT or RIGHT of source and pushes it on
+// the given side of destination, which may be the same list.
+func listMove(db *Database, source, destination, from, to string) Reply {
+	if (from != "LEFT" && from != "RIGHT") || (to != "LEFT" && to != "RIGHT") {
+		return ErrorReply("ERR syntax error")
+	}
+	src, exists, errReply := lookupAs[*ListValue](db, source)
+	if errReply != nil {
+		return errReply
+	}
+	dst, dstExists, errReply := lookupAs[*ListValue](db, destination)
+	if errReply != nil {
+		return errReply
+	}
+	if !exists {
+		return NullBulk{}
+	}
+	var value string
+	if from == "LEFT" {
+		value = src.popFront()
+	} else {
+		value = src.popBack()
+	}
+	if src.len() == 0 && source != destination {
+		db.deleteKey(source)
+	} else {
+		db.touch(source)
+	}
+	if !dstExists {
+		dst = &ListValue{}
+		db.set(destination, dst)
+	}
+	if to == "LEFT" {
+		dst.pushFront(value)
+	} else {
+		dst.pushBack(value)
+	}
+	db.touch(destination)
+	return BulkString(value)
+}
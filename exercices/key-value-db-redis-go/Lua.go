@@ -0,0 +1,1044 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file parses the subset of Lua 5.1 that scripts are written in: local
+// variables, functions and closures, tables, if, while, repeat, numeric and
+// generic for, and every operator. Varargs, goto, metatables and coroutines
+// are left out. LuaRuntime.go runs the parsed chunk.
+
+type luaTokenKind int
+
+const (
+	tokEOF luaTokenKind = iota
+	tokName
+	tokNumber
+	tokString
+	tokKeyword
+	tokSymbol
+)
+
+type luaToken struct {
+	kind luaTokenKind
+	text string // the name, keyword, symbol or decoded string
+	num  float64
+	line int
+}
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "if": true, "in": true, "local": true,
+	"nil": true, "not": true, "or": true, "repeat": true, "return": true, "then": true,
+	"true": true, "until": true, "while": true,
+}
+
+// luaSymbols are matched longest first.
+var luaSymbols = []string{
+	"...", "..", "==", "~=", "<=", ">=",
+	"+", "-", "*", "/", "%", "^", "#", "<", ">", "=", "(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+}
+
+type luaLexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (lx *luaLexer) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("user_script:%d: %s", lx.line, fmt.Sprintf(format, args...))
+}
+
+// skipSpace skips blanks and comments.
+func (lx *luaLexer) skipSpace() error {
+	for lx.pos < len(lx.src) {
+		ch := lx.src[lx.pos]
+		switch {
+		case ch == '\n':
+			lx.line++
+			lx.pos++
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			lx.pos++
+		case strings.HasPrefix(lx.src[lx.pos:], "--"):
+			lx.pos += 2
+			if level, ok := lx.longBracket(); ok {
+				if _, err := lx.readLong(level); err != nil {
+					return err
+				}
+				continue
+			}
+			for lx.pos < len(lx.src) && lx.src[lx.pos] != '\n' {
+				lx.pos++
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// longBracket reports whether a [[ or [==[ opens at pos and its level.
+func (lx *luaLexer) longBracket() (int, bool) {
+	if lx.pos >= len(lx.src) || lx.src[lx.pos] != '[' {
+		return 0, false
+	}
+	i := lx.pos + 1
+	for i < len(lx.src) && lx.src[i] == '=' {
+		i++
+	}
+	if i < len(lx.src) && lx.src[i] == '[' {
+		return i - lx.pos - 1, true
+	}
+	return 0, false
+}
+
+func (lx *luaLexer) readLong(level int) (string, error) {
+	lx.pos += level + 2
+	// A newline right after the opening bracket is skipped
+	if strings.HasPrefix(lx.src[lx.pos:], "\r\n") {
+		lx.pos += 2
+		lx.line++
+	} else if strings.HasPrefix(lx.src[lx.pos:], "\n") {
+		lx.pos++
+		lx.line++
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(lx.src[lx.pos:], closing)
+	if end < 0 {
+		return "", lx.errorf("unfinished long string")
+	}
+	s := lx.src[lx.pos : lx.pos+end]
+	lx.line += strings.Count(s, "\n")
+	lx.pos += end + len(closing)
+	return s, nil
+}
+
+func (lx *luaLexer) next() (luaToken, error) {
+	if err := lx.skipSpace(); err != nil {
+		return luaToken{}, err
+	}
+	tok := luaToken{line: lx.line}
+	if lx.pos >= len(lx.src) {
+		tok.kind = tokEOF
+		return tok, nil
+	}
+	ch := lx.src[lx.pos]
+	switch {
+	case isLuaNameStart(ch):
+		start := lx.pos
+		for lx.pos < len(lx.src) && (isLuaNameStart(lx.src[lx.pos]) || isDigit(lx.src[lx.pos])) {
+			lx.pos++
+		}
+		tok.text = lx.src[start:lx.pos]
+		tok.kind = tokName
+		if luaKeywords[tok.text] {
+			tok.kind = tokKeyword
+		}
+		return tok, nil
+	case isDigit(ch) || (ch == '.' && lx.pos+1 < len(lx.src) && isDigit(lx.src[lx.pos+1])):
+		return lx.readNumber(tok)
+	case ch == '"' || ch == '\'':
+		s, err := lx.readString(ch)
+		tok.kind, tok.text = tokString, s
+		return tok, err
+	case ch == '[':
+		if level, ok := lx.longBracket(); ok {
+			s, err := lx.readLong(level)
+			tok.kind, tok.text = tokString, s
+			return tok, err
+		}
+	}
+	for _, sym := range luaSymbols {
+		if strings.HasPrefix(lx.src[lx.pos:], sym) {
+			lx.pos += len(sym)
+			tok.kind, tok.text = tokSymbol, sym
+			return tok, nil
+		}
+	}
+	return tok, lx.errorf("unexpected symbol near '%c'", ch)
+}
+
+func isLuaNameStart(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func (lx *luaLexer) readNumber(tok luaToken) (luaToken, error) {
+	start := lx.pos
+	if strings.HasPrefix(lx.src[lx.pos:], "0x") || strings.HasPrefix(lx.src[lx.pos:], "0X") {
+		lx.pos += 2
+		for lx.pos < len(lx.src) && strings.IndexByte("0123456789abcdefABCDEF", lx.src[lx.pos]) >= 0 {
+			lx.pos++
+		}
+	} else {
+		for lx.pos < len(lx.src) {
+			ch := lx.src[lx.pos]
+			if isDigit(ch) || ch == '.' {
+				lx.pos++
+			} else if (ch == 'e' || ch == 'E') && lx.pos+1 < len(lx.src) {
+				lx.pos++
+				if lx.src[lx.pos] == '+' || lx.src[lx.pos] == '-' {
+					lx.pos++
+				}
+			} else {
+				break
+			}
+		}
+	}
+	n, ok := parseLuaNumber(lx.src[start:lx.pos])
+	if !ok {
+		return tok, lx.errorf("malformed number near '%s'", lx.src[start:lx.pos])
+	}
+	tok.kind, tok.num = tokNumber, n
+	return tok, nil
+}
+
+// parseLuaNumber converts a decimal or hexadecimal numeral, as tonumber does.
+func parseLuaNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	digits, negative := strings.CutPrefix(s, "-")
+	if hex, ok := strings.CutPrefix(strings.ToLower(digits), "0x"); ok {
+		n, err := strconv.ParseUint(hex, 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if negative {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+	if strings.ContainsAny(strings.ToLower(s), "inx_") {
+		return 0, false // rejects inf, nan and the forms only Go accepts
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	return n, err == nil
+}
+
+func (lx *luaLexer) readString(quote byte) (string, error) {
+	lx.pos++
+	var sb strings.Builder
+	for {
+		if lx.pos >= len(lx.src) || lx.src[lx.pos] == '\n' {
+			return "", lx.errorf("unfinished string")
+		}
+		ch := lx.src[lx.pos]
+		lx.pos++
+		if ch == quote {
+			return sb.String(), nil
+		}
+		if ch != '\\' {
+			sb.WriteByte(ch)
+			continue
+		}
+		if lx.pos >= len(lx.src) {
+			return "", lx.errorf("unfinished string")
+		}
+		esc := lx.src[lx.pos]
+		lx.pos++
+		switch esc {
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'a':
+			sb.WriteByte('\a')
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'v':
+			sb.WriteByte('\v')
+		case '\n':
+			sb.WriteByte('\n')
+			lx.line++
+		case '\\', '"', '\'':
+			sb.WriteByte(esc)
+		default:
+			if !isDigit(esc) {
+				return "", lx.errorf("invalid escape sequence '\\%c'", esc)
+			}
+			// \ddd is a byte in decimal
+			n := int(esc - '0')
+			for i := 0; i < 2 && lx.pos < len(lx.src) && isDigit(lx.src[lx.pos]); i++ {
+				n = n*10 + int(lx.src[lx.pos]-'0')
+				lx.pos++
+			}
+			if n > 255 {
+				return "", lx.errorf("escape sequence too large")
+			}
+			sb.WriteByte(byte(n))
+		}
+	}
+}
+
+// The syntax tree. Expressions evaluate to values, statements run for their
+// effects.
+type (
+	luaExpr interface{}
+	luaStmt interface{}
+
+	luaNil      struct{}
+	luaTrue     struct{}
+	luaFalse    struct{}
+	luaNumber   struct{ value float64 }
+	luaString   struct{ value string }
+	luaVarargs  struct{}
+	luaNameExpr struct {
+		name string
+		line int
+	}
+	luaIndexExpr struct {
+		object, key luaExpr
+		line        int
+	}
+	luaCallExpr struct {
+		fn   luaExpr
+		args []luaExpr
+		line int
+	}
+	luaMethodCall struct {
+		object luaExpr
+		method string
+		args   []luaExpr
+		line   int
+	}
+	luaFunctionExpr struct {
+		params []string
+		body   []luaStmt
+		name   string
+	}
+	luaBinaryExpr struct {
+		op          string
+		left, right luaExpr
+		line        int
+	}
+	luaUnaryExpr struct {
+		op      string
+		operand luaExpr
+		line    int
+	}
+	luaTableExpr struct {
+		items  []luaExpr // positional
+		keys   []luaExpr // keyed, with values
+		values []luaExpr
+	}
+	luaParenExpr struct{ inner luaExpr } // truncates multiple results to one
+
+	luaLocalStmt struct {
+		names  []string
+		values []luaExpr
+	}
+	luaAssignStmt struct {
+		targets []luaExpr
+		values  []luaExpr
+	}
+	luaCallStmt struct{ call luaExpr }
+	luaDoStmt   struct{ body []luaStmt }
+	luaIfStmt   struct {
+		conds  []luaExpr
+		blocks [][]luaStmt
+		orElse []luaStmt
+	}
+	luaWhileStmt struct {
+		cond luaExpr
+		body []luaStmt
+	}
+	luaRepeatStmt struct {
+		body []luaStmt
+		cond luaExpr
+	}
+	luaNumericFor struct {
+		name              string
+		start, stop, step luaExpr
+		body              []luaStmt
+	}
+	luaGenericFor struct {
+		names []string
+		exprs []luaExpr
+		body  []luaStmt
+	}
+	luaLocalFunction struct {
+		name string
+		fn   *luaFunctionExpr
+	}
+	luaReturnStmt struct{ values []luaExpr }
+	luaBreakStmt  struct{}
+)
+
+type luaParser struct {
+	lx   *luaLexer
+	tok  luaToken
+	peek *luaToken
+}
+
+// parseLua parses a chunk, the body of a script.
+func parseLua(src string) ([]luaStmt, error) {
+	p := &luaParser{lx: &luaLexer{src: src, line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("'<eof>' expected near '%s'", p.tok.text)
+	}
+	return body, nil
+}
+
+func (p *luaParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("user_script:%d: %s", p.tok.line, fmt.Sprintf(format, args...))
+}
+
+func (p *luaParser) advance() error {
+	if p.peek != nil {
+		p.tok, p.peek = *p.peek, nil
+		return nil
+	}
+	tok, err := p.lx.next()
+	p.tok = tok
+	return err
+}
+
+func (p *luaParser) lookahead() (luaToken, error) {
+	if p.peek == nil {
+		tok, err := p.lx.next()
+		if err != nil {
+			return tok, err
+		}
+		p.peek = &tok
+	}
+	return *p.peek, nil
+}
+
+func (p *luaParser) is(kind luaTokenKind, text string) bool {
+	return p.tok.kind == kind && p.tok.text == text
+}
+
+func (p *luaParser) isSymbol(text string) bool {
+	return p.is(tokSymbol, text)
+}
+
+func (p *luaParser) isKeyword(text string) bool {
+	return p.is(tokKeyword, text)
+}
+
+// accept consumes the symbol or keyword text if it is next.
+func (p *luaParser) accept(text string) (bool, error) {
+	if (p.tok.kind == tokSymbol || p.tok.kind == tokKeyword) && p.tok.text == text {
+		return true, p.advance()
+	}
+	return false, nil
+}
+
+func (p *luaParser) expect(text string) error {
+	ok, err := p.accept(text)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return p.errorf("'%s' expected near '%s'", text, p.tokenText())
+	}
+	return nil
+}
+
+func (p *luaParser) tokenText() string {
+	switch p.tok.kind {
+	case tokEOF:
+		return "<eof>"
+	case tokNumber:
+		return formatLuaNumber(p.tok.num)
+	}
+	return p.tok.text
+}
+
+func (p *luaParser) name() (string, error) {
+	if p.tok.kind != tokName {
+		return "", p.errorf("<name> expected near '%s'", p.tokenText())
+	}
+	name := p.tok.text
+	return name, p.advance()
+}
+
+// blockEnd reports whether the current token closes a block.
+func (p *luaParser) blockEnd() bool {
+	return p.tok.kind == tokEOF || p.isKeyword("end") || p.isKeyword("else") || p.isKeyword("elseif") || p.isKeyword("until")
+}
+
+func (p *luaParser) block() ([]luaStmt, error) {
+	var stmts []luaStmt
+	for !p.blockEnd() {
+		if p.isKeyword("return") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			ret := &luaReturnStmt{}
+			if !p.blockEnd() && !p.isSymbol(";") {
+				values, err := p.exprList()
+				if err != nil {
+					return nil, err
+				}
+				ret.values = values
+			}
+			if _, err := p.accept(";"); err != nil {
+				return nil, err
+			}
+			if !p.blockEnd() {
+				return nil, p.errorf("'end' expected near '%s'", p.tokenText())
+			}
+			return append(stmts, ret), nil
+		}
+		stmt, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		if stmt != nil {
+			stmts = append(stmts, stmt)
+		}
+	}
+	return stmts, nil
+}
+
+func (p *luaParser) statement() (luaStmt, error) {
+	line := p.tok.line
+	switch {
+	case p.isSymbol(";"):
+		return nil, p.advance()
+	case p.isKeyword("break"):
+		return &luaBreakStmt{}, p.advance()
+	case p.isKeyword("do"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &luaDoStmt{body}, p.expect("end")
+	case p.isKeyword("while"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		cond, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("do"); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		return &luaWhileStmt{cond, body}, p.expect("end")
+	case p.isKeyword("repeat"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("until"); err != nil {
+			return nil, err
+		}
+		cond, err := p.expr(0)
+		return &luaRepeatStmt{body, cond}, err
+	case p.isKeyword("if"):
+		return p.ifStatement()
+	case p.isKeyword("for"):
+		return p.forStatement()
+	case p.isKeyword("function"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		target := luaExpr(&luaNameExpr{name, line})
+		for p.isSymbol(".") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			field, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			name += "." + field
+			target = &luaIndexExpr{target, &luaString{field}, line}
+		}
+		fn, err := p.functionBody(name)
+		if err != nil {
+			return nil, err
+		}
+		return &luaAssignStmt{[]luaExpr{target}, []luaExpr{fn}}, nil
+	case p.isKeyword("local"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if ok, err := p.accept("function"); err != nil || ok {
+			if err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			fn, err := p.functionBody(name)
+			return &luaLocalFunction{name, fn}, err
+		}
+		stmt := &luaLocalStmt{}
+		for {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			stmt.names = append(stmt.names, name)
+			if ok, err := p.accept(","); err != nil || !ok {
+				if err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		if ok, err := p.accept("="); err != nil || ok {
+			if err != nil {
+				return nil, err
+			}
+			values, err := p.exprList()
+			stmt.values = values
+			return stmt, err
+		}
+		return stmt, nil
+	}
+
+	expr, err := p.suffixedExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.isSymbol("=") || p.isSymbol(",") {
+		targets := []luaExpr{expr}
+		for p.isSymbol(",") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			target, err := p.suffixedExpr()
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, target)
+		}
+		for _, target := range targets {
+			switch target.(type) {
+			case *luaNameExpr, *luaIndexExpr:
+			default:
+				return nil, p.errorf("syntax error near '%s'", p.tokenText())
+			}
+		}
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		values, err := p.exprList()
+		return &luaAssignStmt{targets, values}, err
+	}
+	switch expr.(type) {
+	case *luaCallExpr, *luaMethodCall:
+		return &luaCallStmt{expr}, nil
+	}
+	return nil, p.errorf("syntax error near '%s'", p.tokenText())
+}
+
+func (p *luaParser) ifStatement() (luaStmt, error) {
+	stmt := &luaIfStmt{}
+	for {
+		// Consumes "if" the first time and "elseif" afterwards
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		cond, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("then"); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		stmt.conds = append(stmt.conds, cond)
+		stmt.blocks = append(stmt.blocks, body)
+		if !p.isKeyword("elseif") {
+			break
+		}
+	}
+	if ok, err := p.accept("else"); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		stmt.orElse = body
+	}
+	return stmt, p.expect("end")
+}
+
+func (p *luaParser) forStatement() (luaStmt, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	first, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := p.accept("="); err != nil || ok {
+		if err != nil {
+			return nil, err
+		}
+		stmt := &luaNumericFor{name: first, step: &luaNumber{1}}
+		if stmt.start, err = p.expr(0); err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		if stmt.stop, err = p.expr(0); err != nil {
+			return nil, err
+		}
+		if ok, err := p.accept(","); err != nil || ok {
+			if err != nil {
+				return nil, err
+			}
+			if stmt.step, err = p.expr(0); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expect("do"); err != nil {
+			return nil, err
+		}
+		if stmt.body, err = p.block(); err != nil {
+			return nil, err
+		}
+		return stmt, p.expect("end")
+	}
+	stmt := &luaGenericFor{names: []string{first}}
+	for p.isSymbol(",") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		stmt.names = append(stmt.names, name)
+	}
+	if err := p.expect("in"); err != nil {
+		return nil, err
+	}
+	if stmt.exprs, err = p.exprList(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("do"); err != nil {
+		return nil, err
+	}
+	if stmt.body, err = p.block(); err != nil {
+		return nil, err
+	}
+	return stmt, p.expect("end")
+}
+
+func (p *luaParser) functionBody(name string) (*luaFunctionExpr, error) {
+	fn := &luaFunctionExpr{name: name}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.isSymbol(")") {
+		if p.isSymbol("...") {
+			return nil, p.errorf("varargs are not supported")
+		}
+		param, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		fn.params = append(fn.params, param)
+		if !p.isSymbol(")") {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	fn.body = body
+	return fn, p.expect("end")
+}
+
+func (p *luaParser) exprList() ([]luaExpr, error) {
+	var exprs []luaExpr
+	for {
+		expr, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if ok, err := p.accept(","); err != nil || !ok {
+			return exprs, err
+		}
+	}
+}
+
+// luaBinaryPriority gives the left and right binding power of each binary
+// operator; right associative operators bind weaker on the right.
+var luaBinaryPriority = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"..": {5, 4},
+	"+":  {6, 6}, "-": {6, 6},
+	"*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^": {10, 9},
+}
+
+const luaUnaryPriority = 8
+
+// expr parses an expression whose binary operators bind tighter than limit.
+func (p *luaParser) expr(limit int) (luaExpr, error) {
+	var left luaExpr
+	var err error
+	if p.isKeyword("not") || p.isSymbol("-") || p.isSymbol("#") {
+		op, line := p.tok.text, p.tok.line
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		operand, err := p.expr(luaUnaryPriority)
+		if err != nil {
+			return nil, err
+		}
+		left = &luaUnaryExpr{op, operand, line}
+	} else if left, err = p.simpleExpr(); err != nil {
+		return nil, err
+	}
+	for {
+		if p.tok.kind != tokSymbol && !p.isKeyword("and") && !p.isKeyword("or") {
+			return left, nil
+		}
+		priority, ok := luaBinaryPriority[p.tok.text]
+		if !ok || priority[0] <= limit {
+			return left, nil
+		}
+		op, line := p.tok.text, p.tok.line
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.expr(priority[1])
+		if err != nil {
+			return nil, err
+		}
+		left = &luaBinaryExpr{op, left, right, line}
+	}
+}
+
+func (p *luaParser) simpleExpr() (luaExpr, error) {
+	tok := p.tok
+	switch {
+	case tok.kind == tokNumber:
+		return &luaNumber{tok.num}, p.advance()
+	case tok.kind == tokString:
+		return &luaString{tok.text}, p.advance()
+	case p.isKeyword("nil"):
+		return &luaNil{}, p.advance()
+	case p.isKeyword("true"):
+		return &luaTrue{}, p.advance()
+	case p.isKeyword("false"):
+		return &luaFalse{}, p.advance()
+	case p.isSymbol("..."):
+		return nil, p.errorf("varargs are not supported")
+	case p.isSymbol("{"):
+		return p.tableConstructor()
+	case p.isKeyword("function"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		return p.functionBody("anonymous")
+	}
+	return p.suffixedExpr()
+}
+
+func (p *luaParser) primaryExpr() (luaExpr, error) {
+	switch {
+	case p.tok.kind == tokName:
+		expr := &luaNameExpr{p.tok.text, p.tok.line}
+		return expr, p.advance()
+	case p.isSymbol("("):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		inner, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		return &luaParenExpr{inner}, p.expect(")")
+	}
+	return nil, p.errorf("unexpected symbol near '%s'", p.tokenText())
+}
+
+// suffixedExpr parses a primary expression followed by fields, indexes and
+// calls, such as redis.call("GET", KEYS[1]).
+func (p *luaParser) suffixedExpr() (luaExpr, error) {
+	expr, err := p.primaryExpr()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		line := p.tok.line
+		switch {
+		case p.isSymbol("."):
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			field, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			expr = &luaIndexExpr{expr, &luaString{field}, line}
+		case p.isSymbol("["):
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			key, err := p.expr(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			expr = &luaIndexExpr{expr, key, line}
+		case p.isSymbol(":"):
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			method, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			expr = &luaMethodCall{expr, method, args, line}
+		case p.isSymbol("(") || p.isSymbol("{") || p.tok.kind == tokString:
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			expr = &luaCallExpr{expr, args, line}
+		default:
+			return expr, nil
+		}
+	}
+}
+
+// callArgs parses (args), a table constructor or a string literal.
+func (p *luaParser) callArgs() ([]luaExpr, error) {
+	switch {
+	case p.tok.kind == tokString:
+		arg := &luaString{p.tok.text}
+		return []luaExpr{arg}, p.advance()
+	case p.isSymbol("{"):
+		table, err := p.tableConstructor()
+		return []luaExpr{table}, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if ok, err := p.accept(")"); err != nil || ok {
+		return nil, err
+	}
+	args, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	return args, p.expect(")")
+}
+
+func (p *luaParser) tableConstructor() (luaExpr, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	table := &luaTableExpr{}
+	for !p.isSymbol("}") {
+		switch {
+		case p.isSymbol("["):
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			key, err := p.expr(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			value, err := p.expr(0)
+			if err != nil {
+				return nil, err
+			}
+			table.keys = append(table.keys, key)
+			table.values = append(table.values, value)
+		case p.tok.kind == tokName:
+			next, err := p.lookahead()
+			if err != nil {
+				return nil, err
+			}
+			if next.kind == tokSymbol && next.text == "=" {
+				key := &luaString{p.tok.text}
+				if err := p.advance(); err != nil {
+					return nil, err
+				}
+				if err := p.advance(); err != nil {
+					return nil, err
+				}
+				value, err := p.expr(0)
+				if err != nil {
+					return nil, err
+				}
+				table.keys = append(table.keys, key)
+				table.values = append(table.values, value)
+				break
+			}
+			fallthrough
+		default:
+			item, err := p.expr(0)
+			if err != nil {
+				return nil, err
+			}
+			table.items = append(table.items, item)
+		}
+		if !p.isSymbol(",") && !p.isSymbol(";") {
+			break
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	return table, p.expect("}")
+}
@@ -0,0 +1,1383 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file runs the chunks parsed by Lua.go. Values are nil, bool, float64,
+// string, *luaTable, *luaClosure and *luaBuiltin.
+type luaValue interface{}
+
+const (
+	// luaTimeLimit bounds how long a script may hold the database locks.
+	luaTimeLimit = 5 * time.Second
+	// luaMaxDepth bounds the depth of nested function calls.
+	luaMaxDepth = 200
+)
+
+var errLuaTimeout = errors.New("ERR Script killed by timeout")
+
+// luaError is an error raised by a script, with error() or by a failed
+// operation. Unlike a timeout, pcall catches it.
+type luaError struct {
+	value luaValue // a message, or a table such as the ones redis.error_reply returns
+}
+
+func (e *luaError) Error() string {
+	switch v := e.value.(type) {
+	case string:
+		return v
+	case float64:
+		return formatLuaNumber(v)
+	case *luaTable:
+		if msg, ok := v.get("err").(string); ok {
+			return msg
+		}
+	}
+	return fmt.Sprintf("(error object is a %s value)", luaTypeName(e.value))
+}
+
+type luaTable struct {
+	array    []luaValue // the values of the keys 1 to len(array)
+	hash     map[luaValue]luaValue
+	readOnly bool
+}
+
+func newLuaTable() *luaTable {
+	return &luaTable{hash: make(map[luaValue]luaValue)}
+}
+
+// arrayIndex returns the position of key in the array part, if it is an
+// integer key.
+func arrayIndex(key luaValue) (int, bool) {
+	n, ok := key.(float64)
+	if !ok || n != math.Trunc(n) || n < 1 || n > math.MaxInt32 {
+		return 0, false
+	}
+	return int(n) - 1, true
+}
+
+func (t *luaTable) get(key luaValue) luaValue {
+	if i, ok := arrayIndex(key); ok && i < len(t.array) {
+		return t.array[i]
+	}
+	return t.hash[key]
+}
+
+// set stores value under key; the caller has checked that key is neither nil
+// nor NaN.
+func (t *luaTable) set(key, value luaValue) {
+	i, ok := arrayIndex(key)
+	switch {
+	case ok && i < len(t.array):
+		t.array[i] = value
+		for len(t.array) > 0 && t.array[len(t.array)-1] == nil {
+			t.array = t.array[:len(t.array)-1]
+		}
+	case ok && i == len(t.array) && value != nil:
+		t.array = append(t.array, value)
+		delete(t.hash, key)
+		// Keys that used to follow a hole move to the array part
+		for {
+			next := float64(len(t.array) + 1)
+			v, exists := t.hash[next]
+			if !exists {
+				break
+			}
+			t.array = append(t.array, v)
+			delete(t.hash, next)
+		}
+	case value == nil:
+		delete(t.hash, key)
+	default:
+		t.hash[key] = value
+	}
+}
+
+func (t *luaTable) length() int {
+	return len(t.array)
+}
+
+type luaScope struct {
+	vars   map[string]*luaValue
+	parent *luaScope
+}
+
+func (sc *luaScope) declare(name string, value luaValue) {
+	if sc.vars == nil {
+		sc.vars = make(map[string]*luaValue)
+	}
+	sc.vars[name] = &value
+}
+
+func (sc *luaScope) lookup(name string) (*luaValue, bool) {
+	for ; sc != nil; sc = sc.parent {
+		if v, ok := sc.vars[name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+type luaClosure struct {
+	fn    *luaFunctionExpr
+	scope *luaScope
+}
+
+type luaBuiltin struct {
+	name string
+	fn   func(it *luaInterp, args []luaValue) ([]luaValue, error)
+}
+
+// luaInterp runs one script. Its globals are read only, so a script cannot
+// leave state behind or change the libraries.
+type luaInterp struct {
+	globals  *luaTable
+	deadline time.Time
+	steps    int
+	depth    int
+	line     int // of the call being made, for errors raised by builtins
+}
+
+func newLuaInterp() *luaInterp {
+	it := &luaInterp{globals: newLuaTable(), deadline: time.Now().Add(luaTimeLimit)}
+	openLuaLibraries(it)
+	return it
+}
+
+// run executes a parsed chunk and returns what it returned.
+func (it *luaInterp) run(chunk []luaStmt) ([]luaValue, error) {
+	it.globals.readOnly = true
+	_, values, err := it.execBlock(chunk, &luaScope{})
+	return values, err
+}
+
+func (it *luaInterp) errorf(line int, format string, args ...interface{}) error {
+	return &luaError{fmt.Sprintf("user_script:%d: %s", line, fmt.Sprintf(format, args...))}
+}
+
+// tick is called on every statement and loop iteration to enforce the time
+// limit.
+func (it *luaInterp) tick() error {
+	it.steps++
+	if it.steps%1000 == 0 && time.Now().After(it.deadline) {
+		return errLuaTimeout
+	}
+	return nil
+}
+
+type luaFlow int
+
+const (
+	flowNormal luaFlow = iota
+	flowBreak
+	flowReturn
+)
+
+func (it *luaInterp) execBlock(stmts []luaStmt, parent *luaScope) (luaFlow, []luaValue, error) {
+	sc := &luaScope{parent: parent}
+	for _, stmt := range stmts {
+		if err := it.tick(); err != nil {
+			return flowNormal, nil, err
+		}
+		flow, values, err := it.exec(stmt, sc)
+		if err != nil || flow != flowNormal {
+			return flow, values, err
+		}
+	}
+	return flowNormal, nil, nil
+}
+
+func (it *luaInterp) exec(stmt luaStmt, sc *luaScope) (luaFlow, []luaValue, error) {
+	switch s := stmt.(type) {
+	case *luaLocalStmt:
+		values, err := it.evalList(s.values, sc)
+		if err != nil {
+			return flowNormal, nil, err
+		}
+		for i, name := range s.names {
+			sc.declare(name, valueAt(values, i))
+		}
+	case *luaLocalFunction:
+		// Declared first so the function can call itself
+		sc.declare(s.name, nil)
+		v, _ := sc.lookup(s.name)
+		*v = &luaClosure{s.fn, sc}
+	case *luaAssignStmt:
+		values, err := it.evalList(s.values, sc)
+		if err != nil {
+			return flowNormal, nil, err
+		}
+		for i, target := range s.targets {
+			if err := it.assign(target, valueAt(values, i), sc); err != nil {
+				return flowNormal, nil, err
+			}
+		}
+	case *luaCallStmt:
+		if _, err := it.evalMulti(s.call, sc); err != nil {
+			return flowNormal, nil, err
+		}
+	case *luaDoStmt:
+		return it.execBlock(s.body, sc)
+	case *luaIfStmt:
+		for i, cond := range s.conds {
+			v, err := it.eval(cond, sc)
+			if err != nil {
+				return flowNormal, nil, err
+			}
+			if luaTruthy(v) {
+				return it.execBlock(s.blocks[i], sc)
+			}
+		}
+		if s.orElse != nil {
+			return it.execBlock(s.orElse, sc)
+		}
+	case *luaWhileStmt:
+		for {
+			v, err := it.eval(s.cond, sc)
+			if err != nil {
+				return flowNormal, nil, err
+			}
+			if !luaTruthy(v) {
+				break
+			}
+			flow, values, err := it.execBlock(s.body, sc)
+			if err != nil || flow == flowReturn {
+				return flow, values, err
+			}
+			if flow == flowBreak {
+				break
+			}
+			if err := it.tick(); err != nil {
+				return flowNormal, nil, err
+			}
+		}
+	case *luaRepeatStmt:
+		for {
+			// The condition sees the locals of the body
+			body := &luaScope{parent: sc}
+			flow, values, err := it.execBlockIn(s.body, body)
+			if err != nil || flow == flowReturn {
+				return flow, values, err
+			}
+			if flow == flowBreak {
+				break
+			}
+			v, err := it.eval(s.cond, body)
+			if err != nil {
+				return flowNormal, nil, err
+			}
+			if luaTruthy(v) {
+				break
+			}
+			if err := it.tick(); err != nil {
+				return flowNormal, nil, err
+			}
+		}
+	case *luaNumericFor:
+		return it.numericFor(s, sc)
+	case *luaGenericFor:
+		return it.genericFor(s, sc)
+	case *luaReturnStmt:
+		values, err := it.evalList(s.values, sc)
+		return flowReturn, values, err
+	case *luaBreakStmt:
+		return flowBreak, nil, nil
+	}
+	return flowNormal, nil, nil
+}
+
+// execBlockIn runs stmts in sc itself rather than in a new scope.
+func (it *luaInterp) execBlockIn(stmts []luaStmt, sc *luaScope) (luaFlow, []luaValue, error) {
+	for _, stmt := range stmts {
+		if err := it.tick(); err != nil {
+			return flowNormal, nil, err
+		}
+		flow, values, err := it.exec(stmt, sc)
+		if err != nil || flow != flowNormal {
+			return flow, values, err
+		}
+	}
+	return flowNormal, nil, nil
+}
+
+func (it *luaInterp) numericFor(s *luaNumericFor, sc *luaScope) (luaFlow, []luaValue, error) {
+	var bounds [3]float64
+	for i, e := range []luaExpr{s.start, s.stop, s.step} {
+		v, err := it.eval(e, sc)
+		if err != nil {
+			return flowNormal, nil, err
+		}
+		n, ok := luaToNumber(v)
+		if !ok {
+			return flowNormal, nil, it.errorf(it.line, "'for' %s must be a number", []string{"initial value", "limit", "step"}[i])
+		}
+		bounds[i] = n
+	}
+	start, stop, step := bounds[0], bounds[1], bounds[2]
+	for i := start; (step > 0 && i <= stop) || (step <= 0 && i >= stop); i += step {
+		body := &luaScope{parent: sc}
+		body.declare(s.name, i)
+		flow, values, err := it.execBlockIn(s.body, body)
+		if err != nil || flow == flowReturn {
+			return flow, values, err
+		}
+		if flow == flowBreak {
+			break
+		}
+		if err := it.tick(); err != nil {
+			return flowNormal, nil, err
+		}
+	}
+	return flowNormal, nil, nil
+}
+
+func (it *luaInterp) genericFor(s *luaGenericFor, sc *luaScope) (luaFlow, []luaValue, error) {
+	init, err := it.evalList(s.exprs, sc)
+	if err != nil {
+		return flowNormal, nil, err
+	}
+	fn, state, control := valueAt(init, 0), valueAt(init, 1), valueAt(init, 2)
+	for {
+		results, err := it.call(fn, []luaValue{state, control})
+		if err != nil {
+			return flowNormal, nil, err
+		}
+		if valueAt(results, 0) == nil {
+			break
+		}
+		control = results[0]
+		body := &luaScope{parent: sc}
+		for i, name := range s.names {
+			body.declare(name, valueAt(results, i))
+		}
+		flow, values, err := it.execBlockIn(s.body, body)
+		if err != nil || flow == flowReturn {
+			return flow, values, err
+		}
+		if flow == flowBreak {
+			break
+		}
+		if err := it.tick(); err != nil {
+			return flowNormal, nil, err
+		}
+	}
+	return flowNormal, nil, nil
+}
+
+func (it *luaInterp) assign(target luaExpr, value luaValue, sc *luaScope) error {
+	switch t := target.(type) {
+	case *luaNameExpr:
+		if v, ok := sc.lookup(t.name); ok {
+			*v = value
+			return nil
+		}
+		return it.errorf(t.line, "Script attempted to create global variable '%s'", t.name)
+	case *luaIndexExpr:
+		object, err := it.eval(t.object, sc)
+		if err != nil {
+			return err
+		}
+		key, err := it.eval(t.key, sc)
+		if err != nil {
+			return err
+		}
+		table, ok := object.(*luaTable)
+		if !ok {
+			return it.errorf(t.line, "attempt to index a %s value", luaTypeName(object))
+		}
+		return it.setField(table, key, value, t.line)
+	}
+	return nil
+}
+
+func (it *luaInterp) setField(t *luaTable, key, value luaValue, line int) error {
+	if t.readOnly {
+		return it.errorf(line, "Attempt to modify a readonly table")
+	}
+	if key == nil {
+		return it.errorf(line, "table index is nil")
+	}
+	if n, ok := key.(float64); ok && math.IsNaN(n) {
+		return it.errorf(line, "table index is NaN")
+	}
+	t.set(key, value)
+	return nil
+}
+
+func valueAt(values []luaValue, i int) luaValue {
+	if i < len(values) {
+		return values[i]
+	}
+	return nil
+}
+
+// evalList evaluates expressions, expanding all the results of the last one
+// when it is a call.
+func (it *luaInterp) evalList(exprs []luaExpr, sc *luaScope) ([]luaValue, error) {
+	values := make([]luaValue, 0, len(exprs))
+	for i, e := range exprs {
+		if i == len(exprs)-1 {
+			last, err := it.evalMulti(e, sc)
+			if err != nil {
+				return nil, err
+			}
+			return append(values, last...), nil
+		}
+		v, err := it.eval(e, sc)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// evalMulti evaluates an expression to all of its values.
+func (it *luaInterp) evalMulti(e luaExpr, sc *luaScope) ([]luaValue, error) {
+	switch c := e.(type) {
+	case *luaCallExpr:
+		fn, err := it.eval(c.fn, sc)
+		if err != nil {
+			return nil, err
+		}
+		args, err := it.evalList(c.args, sc)
+		if err != nil {
+			return nil, err
+		}
+		if !luaCallable(fn) {
+			return nil, it.errorf(c.line, "attempt to call a %s value", luaTypeName(fn))
+		}
+		it.line = c.line
+		return it.call(fn, args)
+	case *luaMethodCall:
+		object, err := it.eval(c.object, sc)
+		if err != nil {
+			return nil, err
+		}
+		var fn luaValue
+		switch o := object.(type) {
+		case string:
+			fn = it.globals.get("string").(*luaTable).get(c.method)
+		case *luaTable:
+			fn = o.get(c.method)
+		default:
+			return nil, it.errorf(c.line, "attempt to index a %s value", luaTypeName(object))
+		}
+		args, err := it.evalList(c.args, sc)
+		if err != nil {
+			return nil, err
+		}
+		if !luaCallable(fn) {
+			return nil, it.errorf(c.line, "attempt to call method '%s' (a %s value)", c.method, luaTypeName(fn))
+		}
+		it.line = c.line
+		return it.call(fn, append([]luaValue{object}, args...))
+	}
+	v, err := it.eval(e, sc)
+	return []luaValue{v}, err
+}
+
+func luaCallable(fn luaValue) bool {
+	switch fn.(type) {
+	case *luaClosure, *luaBuiltin:
+		return true
+	}
+	return false
+}
+
+func (it *luaInterp) call(fn luaValue, args []luaValue) ([]luaValue, error) {
+	switch f := fn.(type) {
+	case *luaBuiltin:
+		return f.fn(it, args)
+	case *luaClosure:
+		if it.depth >= luaMaxDepth {
+			return nil, it.errorf(it.line, "stack overflow")
+		}
+		it.depth++
+		defer func() { it.depth-- }()
+		sc := &luaScope{parent: f.scope}
+		for i, param := range f.fn.params {
+			sc.declare(param, valueAt(args, i))
+		}
+		_, values, err := it.execBlockIn(f.fn.body, sc)
+		return values, err
+	}
+	return nil, it.errorf(it.line, "attempt to call a %s value", luaTypeName(fn))
+}
+
+func (it *luaInterp) eval(e luaExpr, sc *luaScope) (luaValue, error) {
+	switch x := e.(type) {
+	case *luaNil:
+		return nil, nil
+	case *luaTrue:
+		return true, nil
+	case *luaFalse:
+		return false, nil
+	case *luaNumber:
+		return x.value, nil
+	case *luaString:
+		return x.value, nil
+	case *luaNameExpr:
+		if v, ok := sc.lookup(x.name); ok {
+			return *v, nil
+		}
+		v := it.globals.get(x.name)
+		if v == nil {
+			return nil, it.errorf(x.line, "Script attempted to access nonexistent global variable '%s'", x.name)
+		}
+		return v, nil
+	case *luaIndexExpr:
+		object, err := it.eval(x.object, sc)
+		if err != nil {
+			return nil, err
+		}
+		key, err := it.eval(x.key, sc)
+		if err != nil {
+			return nil, err
+		}
+		table, ok := object.(*luaTable)
+		if !ok {
+			return nil, it.errorf(x.line, "attempt to index a %s value", luaTypeName(object))
+		}
+		return table.get(key), nil
+	case *luaCallExpr, *luaMethodCall:
+		values, err := it.evalMulti(e, sc)
+		return valueAt(values, 0), err
+	case *luaParenExpr:
+		return it.eval(x.inner, sc)
+	case *luaFunctionExpr:
+		return &luaClosure{x, sc}, nil
+	case *luaTableExpr:
+		t := newLuaTable()
+		items, err := it.evalList(x.items, sc)
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range items {
+			t.set(float64(i+1), v)
+		}
+		for i := range x.keys {
+			key, err := it.eval(x.keys[i], sc)
+			if err != nil {
+				return nil, err
+			}
+			value, err := it.eval(x.values[i], sc)
+			if err != nil {
+				return nil, err
+			}
+			if err := it.setField(t, key, value, 0); err != nil {
+				return nil, err
+			}
+		}
+		return t, nil
+	case *luaUnaryExpr:
+		v, err := it.eval(x.operand, sc)
+		if err != nil {
+			return nil, err
+		}
+		switch x.op {
+		case "not":
+			return !luaTruthy(v), nil
+		case "-":
+			n, ok := luaToNumber(v)
+			if !ok {
+				return nil, it.errorf(x.line, "attempt to perform arithmetic on a %s value", luaTypeName(v))
+			}
+			return -n, nil
+		case "#":
+			switch o := v.(type) {
+			case string:
+				return float64(len(o)), nil
+			case *luaTable:
+				return float64(o.length()), nil
+			}
+			return nil, it.errorf(x.line, "attempt to get length of a %s value", luaTypeName(v))
+		}
+	case *luaBinaryExpr:
+		return it.binary(x, sc)
+	}
+	return nil, fmt.Errorf("unexpected expression %T", e)
+}
+
+func (it *luaInterp) binary(x *luaBinaryExpr, sc *luaScope) (luaValue, error) {
+	left, err := it.eval(x.left, sc)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case "and":
+		if !luaTruthy(left) {
+			return left, nil
+		}
+		return it.eval(x.right, sc)
+	case "or":
+		if luaTruthy(left) {
+			return left, nil
+		}
+		return it.eval(x.right, sc)
+	}
+	right, err := it.eval(x.right, sc)
+	if err != nil {
+		return nil, err
+	}
+	switch x.op {
+	case "==":
+		return luaEqual(left, right), nil
+	case "~=":
+		return !luaEqual(left, right), nil
+	case "<", "<=", ">", ">=":
+		return it.compare(x.op, left, right, x.line)
+	case "..":
+		ls, lok := luaToString(left)
+		rs, rok := luaToString(right)
+		if !lok || !rok {
+			bad := left
+			if lok {
+				bad = right
+			}
+			return nil, it.errorf(x.line, "attempt to concatenate a %s value", luaTypeName(bad))
+		}
+		return ls + rs, nil
+	}
+	a, aok := luaToNumber(left)
+	b, bok := luaToNumber(right)
+	if !aok || !bok {
+		bad := left
+		if aok {
+			bad = right
+		}
+		return nil, it.errorf(x.line, "attempt to perform arithmetic on a %s value", luaTypeName(bad))
+	}
+	switch x.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		return a / b, nil
+	case "%":
+		return a - math.Floor(a/b)*b, nil
+	case "^":
+		return math.Pow(a, b), nil
+	}
+	return nil, fmt.Errorf("unexpected operator %s", x.op)
+}
+
+func (it *luaInterp) compare(op string, left, right luaValue, line int) (luaValue, error) {
+	var less, equal bool
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return nil, luaCompareError(it, left, right, line)
+		}
+		less, equal = l < r, l == r
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return nil, luaCompareError(it, left, right, line)
+		}
+		less, equal = l < r, l == r
+	default:
+		return nil, luaCompareError(it, left, right, line)
+	}
+	switch op {
+	case "<":
+		return less, nil
+	case "<=":
+		return less || equal, nil
+	case ">":
+		return !less && !equal, nil
+	}
+	return !less, nil
+}
+
+func luaCompareError(it *luaInterp, left, right luaValue, line int) error {
+	if luaTypeName(left) == luaTypeName(right) {
+		return it.errorf(line, "attempt to compare two %s values", luaTypeName(left))
+	}
+	return it.errorf(line, "attempt to compare %s with %s", luaTypeName(left), luaTypeName(right))
+}
+
+func luaTruthy(v luaValue) bool {
+	return v != nil && v != false
+}
+
+func luaEqual(a, b luaValue) bool {
+	return a == b
+}
+
+func luaTypeName(v luaValue) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *luaTable:
+		return "table"
+	}
+	return "function"
+}
+
+// luaToNumber converts numbers and numeric strings, as arithmetic does.
+func luaToNumber(v luaValue) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case string:
+		return parseLuaNumber(x)
+	}
+	return 0, false
+}
+
+// luaToString converts strings and numbers, as concatenation does.
+func luaToString(v luaValue) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case float64:
+		return formatLuaNumber(x), true
+	}
+	return "", false
+}
+
+func formatLuaNumber(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	}
+	return strconv.FormatFloat(n, 'g', 14, 64)
+}
+
+// luaToStringAny is tostring: every value has a string form.
+func luaToStringAny(v luaValue) string {
+	switch x := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(x)
+	case float64:
+		return formatLuaNumber(x)
+	case string:
+		return x
+	case *luaTable:
+		return fmt.Sprintf("table: %p", x)
+	case *luaClosure:
+		return fmt.Sprintf("function: %p", x)
+	case *luaBuiltin:
+		return fmt.Sprintf("function: builtin: %p", x)
+	}
+	return "?"
+}
+
+// Helpers for builtins to read their arguments.
+
+func (it *luaInterp) argError(fn string, n int, expected string, args []luaValue) error {
+	got := "no value"
+	if n <= len(args) {
+		got = luaTypeName(args[n-1])
+	}
+	return it.errorf(it.line, "bad argument #%d to '%s' (%s expected, got %s)", n, fn, expected, got)
+}
+
+func (it *luaInterp) checkNumber(fn string, args []luaValue, n int) (float64, error) {
+	if v, ok := luaToNumber(valueAt(args, n-1)); ok {
+		return v, nil
+	}
+	return 0, it.argError(fn, n, "number", args)
+}
+
+func (it *luaInterp) optNumber(fn string, args []luaValue, n int, def float64) (float64, error) {
+	if valueAt(args, n-1) == nil {
+		return def, nil
+	}
+	return it.checkNumber(fn, args, n)
+}
+
+func (it *luaInterp) checkString(fn string, args []luaValue, n int) (string, error) {
+	if v, ok := luaToString(valueAt(args, n-1)); ok {
+		return v, nil
+	}
+	return "", it.argError(fn, n, "string", args)
+}
+
+func (it *luaInterp) checkTable(fn string, args []luaValue, n int) (*luaTable, error) {
+	if t, ok := valueAt(args, n-1).(*luaTable); ok {
+		return t, nil
+	}
+	return nil, it.argError(fn, n, "table", args)
+}
+
+func builtin(name string, fn func(it *luaInterp, args []luaValue) ([]luaValue, error)) *luaBuiltin {
+	return &luaBuiltin{name, fn}
+}
+
+func one(v luaValue) []luaValue {
+	return []luaValue{v}
+}
+
+// openLuaLibraries installs the base functions and the string, table and
+// math libraries. The redis library is added by the caller, see Scripting.go.
+func openLuaLibraries(it *luaInterp) {
+	g := it.globals
+	g.set("type", builtin("type", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+		if len(args) == 0 {
+			return nil, it.argError("type", 1, "value", args)
+		}
+		return one(luaTypeName(args[0])), nil
+	}))
+	g.set("tostring", builtin("tostring", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+		return one(luaToStringAny(valueAt(args, 0))), nil
+	}))
+	g.set("tonumber", builtin("tonumber", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+		base, err := it.optNumber("tonumber", args, 2, 10)
+		if err != nil {
+			return nil, err
+		}
+		if base == 10 {
+			if n, ok := luaToNumber(valueAt(args, 0)); ok {
+				return one(n), nil
+			}
+			return one(nil), nil
+		}
+		s, err := it.checkString("tonumber", args, 1)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(s), int(base), 64)
+		if err != nil {
+			return one(nil), nil
+		}
+		return one(float64(n)), nil
+	}))
+	g.set("ipairs", builtin("ipairs", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+		t, err := it.checkTable("ipairs", args, 1)
+		if err != nil {
+			return nil, err
+		}
+		next := builtin("ipairs_iterator", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			i, _ := luaToNumber(valueAt(args, 1))
+			i++
+			v := t.get(i)
+			if v == nil {
+				return one(nil), nil
+			}
+			return []luaValue{i, v}, nil
+		})
+		return []luaValue{next, t, float64(0)}, nil
+	}))
+	g.set("pairs", builtin("pairs", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+		t, err := it.checkTable("pairs", args, 1)
+		if err != nil {
+			return nil, err
+		}
+		// The keys are taken up front, so assigning to existing fields while
+		// iterating is safe
+		keys := make([]luaValue, 0, len(t.array)+len(t.hash))
+		for i := range t.array {
+			keys = append(keys, float64(i+1))
+		}
+		for key := range t.hash {
+			keys = append(keys, key)
+		}
+		i := 0
+		next := builtin("pairs_iterator", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			for ; i < len(keys); i++ {
+				if v := t.get(keys[i]); v != nil {
+					i++
+					return []luaValue{keys[i-1], v}, nil
+				}
+			}
+			return one(nil), nil
+		})
+		return []luaValue{next, t, nil}, nil
+	}))
+	g.set("unpack", builtin("unpack", luaUnpack))
+	g.set("error", builtin("error", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+		value := valueAt(args, 0)
+		level, err := it.optNumber("error", args, 2, 1)
+		if err != nil {
+			return nil, err
+		}
+		if msg, ok := value.(string); ok && level > 0 {
+			value = fmt.Sprintf("user_script:%d: %s", it.line, msg)
+		}
+		return nil, &luaError{value}
+	}))
+	g.set("assert", builtin("assert", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+		if len(args) == 0 {
+			return nil, it.argError("assert", 1, "value", args)
+		}
+		if !luaTruthy(args[0]) {
+			if len(args) > 1 {
+				return nil, &luaError{args[1]}
+			}
+			return nil, it.errorf(it.line, "assertion failed!")
+		}
+		return args, nil
+	}))
+	g.set("pcall", builtin("pcall", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+		if len(args) == 0 {
+			return nil, it.argError("pcall", 1, "value", args)
+		}
+		depth := it.depth
+		values, err := it.call(args[0], args[1:])
+		var luaErr *luaError
+		if errors.As(err, &luaErr) {
+			it.depth = depth
+			return []luaValue{false, luaErr.value}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return append([]luaValue{true}, values...), nil
+	}))
+	g.set("string", luaStringLibrary())
+	g.set("table", luaTableLibrary())
+	g.set("math", luaMathLibrary())
+}
+
+func luaUnpack(it *luaInterp, args []luaValue) ([]luaValue, error) {
+	t, err := it.checkTable("unpack", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	first, err := it.optNumber("unpack", args, 2, 1)
+	if err != nil {
+		return nil, err
+	}
+	last, err := it.optNumber("unpack", args, 3, float64(t.length()))
+	if err != nil {
+		return nil, err
+	}
+	if last-first >= 8000 {
+		return nil, it.errorf(it.line, "too many results to unpack")
+	}
+	var values []luaValue
+	for i := first; i <= last; i++ {
+		values = append(values, t.get(i))
+	}
+	return values, nil
+}
+
+// luaLibrary makes a read only table of functions.
+func luaLibrary(fns ...*luaBuiltin) *luaTable {
+	t := newLuaTable()
+	for _, fn := range fns {
+		t.set(fn.name, fn)
+	}
+	t.readOnly = true
+	return t
+}
+
+// stringRange converts the i and j of string.sub, which count from 1 and
+// from the end when negative, to a slice range of a string of length n.
+func stringRange(i, j float64, n int) (int, int) {
+	start, end := int(i), int(j)
+	if start < 0 {
+		start = max(n+start+1, 1)
+	} else if start == 0 {
+		start = 1
+	}
+	if end < 0 {
+		end = n + end + 1
+	} else if end > n {
+		end = n
+	}
+	if start > end {
+		return 0, 0
+	}
+	return start - 1, end
+}
+
+func luaStringLibrary() *luaTable {
+	return luaLibrary(
+		builtin("len", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			s, err := it.checkString("len", args, 1)
+			return one(float64(len(s))), err
+		}),
+		builtin("sub", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			s, err := it.checkString("sub", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			i, err := it.optNumber("sub", args, 2, 1)
+			if err != nil {
+				return nil, err
+			}
+			j, err := it.optNumber("sub", args, 3, -1)
+			if err != nil {
+				return nil, err
+			}
+			start, end := stringRange(i, j, len(s))
+			return one(s[start:end]), nil
+		}),
+		builtin("upper", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			s, err := it.checkString("upper", args, 1)
+			return one(strings.ToUpper(s)), err
+		}),
+		builtin("lower", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			s, err := it.checkString("lower", args, 1)
+			return one(strings.ToLower(s)), err
+		}),
+		builtin("rep", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			s, err := it.checkString("rep", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			n, err := it.checkNumber("rep", args, 2)
+			if err != nil {
+				return nil, err
+			}
+			if n <= 0 {
+				return one(""), nil
+			}
+			if float64(len(s))*n > maxBulkLength {
+				return nil, it.errorf(it.line, "resulting string too large")
+			}
+			return one(strings.Repeat(s, int(n))), nil
+		}),
+		builtin("reverse", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			s, err := it.checkString("reverse", args, 1)
+			b := []byte(s)
+			for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+				b[i], b[j] = b[j], b[i]
+			}
+			return one(string(b)), err
+		}),
+		builtin("byte", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			s, err := it.checkString("byte", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			i, err := it.optNumber("byte", args, 2, 1)
+			if err != nil {
+				return nil, err
+			}
+			j, err := it.optNumber("byte", args, 3, i)
+			if err != nil {
+				return nil, err
+			}
+			start, end := stringRange(i, j, len(s))
+			var values []luaValue
+			for _, b := range []byte(s[start:end]) {
+				values = append(values, float64(b))
+			}
+			return values, nil
+		}),
+		builtin("char", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			b := make([]byte, len(args))
+			for i := range args {
+				n, err := it.checkNumber("char", args, i+1)
+				if err != nil {
+					return nil, err
+				}
+				if n < 0 || n > 255 {
+					return nil, it.errorf(it.line, "bad argument #%d to 'char' (invalid value)", i+1)
+				}
+				b[i] = byte(n)
+			}
+			return one(string(b)), nil
+		}),
+		builtin("find", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			s, err := it.checkString("find", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			pattern, err := it.checkString("find", args, 2)
+			if err != nil {
+				return nil, err
+			}
+			init, err := it.optNumber("find", args, 3, 1)
+			if err != nil {
+				return nil, err
+			}
+			// Lua patterns are not supported, so only plain searches are
+			if !luaTruthy(valueAt(args, 3)) && strings.ContainsAny(pattern, "^$*+?.([%-") {
+				return nil, it.errorf(it.line, "patterns are not supported, pass true as the plain argument of 'find'")
+			}
+			start, _ := stringRange(init, -1, len(s))
+			if int(init) > len(s)+1 {
+				return one(nil), nil
+			}
+			i := strings.Index(s[start:], pattern)
+			if i < 0 {
+				return one(nil), nil
+			}
+			return []luaValue{float64(start + i + 1), float64(start + i + len(pattern))}, nil
+		}),
+		builtin("format", luaFormat),
+	)
+}
+
+// luaFormat is string.format, with the conversions of C's printf that Lua
+// supports.
+func luaFormat(it *luaInterp, args []luaValue) ([]luaValue, error) {
+	format, err := it.checkString("format", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	var sb strings.Builder
+	n := 1
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			sb.WriteByte(format[i])
+			continue
+		}
+		j := i + 1
+		for j < len(format) && strings.IndexByte("-+ #0123456789.", format[j]) >= 0 {
+			j++
+		}
+		if j == len(format) {
+			return nil, it.errorf(it.line, "invalid option '%%' to 'format'")
+		}
+		spec, verb := format[i:j], format[j]
+		i = j
+		if verb == '%' {
+			sb.WriteByte('%')
+			continue
+		}
+		n++
+		switch verb {
+		case 'd', 'i':
+			v, err := it.checkNumber("format", args, n)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&sb, spec+"d", int64(v))
+		case 'c':
+			v, err := it.checkNumber("format", args, n)
+			if err != nil {
+				return nil, err
+			}
+			sb.WriteByte(byte(v))
+		case 'x', 'X', 'o':
+			v, err := it.checkNumber("format", args, n)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&sb, spec+string(verb), int64(v))
+		case 'e', 'E', 'f', 'g', 'G':
+			v, err := it.checkNumber("format", args, n)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&sb, spec+string(verb), v)
+		case 's':
+			if n > len(args) {
+				return nil, it.argError("format", n, "string", args)
+			}
+			fmt.Fprintf(&sb, spec+"s", luaToStringAny(args[n-1]))
+		case 'q':
+			s, err := it.checkString("format", args, n)
+			if err != nil {
+				return nil, err
+			}
+			sb.WriteString(luaQuote(s))
+		default:
+			return nil, it.errorf(it.line, "invalid option '%%%c' to 'format'", verb)
+		}
+	}
+	return one(sb.String()), nil
+}
+
+func luaQuote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; ch {
+		case '"', '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(ch)
+		case '\n':
+			sb.WriteString("\\\n")
+		case '\r':
+			sb.WriteString("\\r")
+		case 0:
+			sb.WriteString("\\000")
+		default:
+			sb.WriteByte(ch)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func luaTableLibrary() *luaTable {
+	return luaLibrary(
+		builtin("insert", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			t, err := it.checkTable("insert", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			if t.readOnly {
+				return nil, it.errorf(it.line, "Attempt to modify a readonly table")
+			}
+			switch len(args) {
+			case 2:
+				t.set(float64(t.length()+1), args[1])
+			case 3:
+				pos, err := it.checkNumber("insert", args, 2)
+				if err != nil {
+					return nil, err
+				}
+				n := t.length()
+				if pos < 1 || pos > float64(n+1) || pos != math.Trunc(pos) {
+					return nil, it.errorf(it.line, "bad argument #2 to 'insert' (position out of bounds)")
+				}
+				for i := n; i >= int(pos); i-- {
+					t.set(float64(i+1), t.get(float64(i)))
+				}
+				t.set(pos, args[2])
+			default:
+				return nil, it.errorf(it.line, "wrong number of arguments to 'insert'")
+			}
+			return nil, nil
+		}),
+		builtin("remove", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			t, err := it.checkTable("remove", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			if t.readOnly {
+				return nil, it.errorf(it.line, "Attempt to modify a readonly table")
+			}
+			n := t.length()
+			pos, err := it.optNumber("remove", args, 2, float64(n))
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 {
+				return one(nil), nil
+			}
+			removed := t.get(pos)
+			for i := int(pos); i < n; i++ {
+				t.set(float64(i), t.get(float64(i+1)))
+			}
+			t.set(float64(n), nil)
+			return one(removed), nil
+		}),
+		builtin("concat", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			t, err := it.checkTable("concat", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			sep := ""
+			if valueAt(args, 1) != nil {
+				if sep, err = it.checkString("concat", args, 2); err != nil {
+					return nil, err
+				}
+			}
+			first, err := it.optNumber("concat", args, 3, 1)
+			if err != nil {
+				return nil, err
+			}
+			last, err := it.optNumber("concat", args, 4, float64(t.length()))
+			if err != nil {
+				return nil, err
+			}
+			var parts []string
+			for i := first; i <= last; i++ {
+				s, ok := luaToString(t.get(i))
+				if !ok {
+					return nil, it.errorf(it.line, "invalid value (at index %d) in table for 'concat'", int(i))
+				}
+				parts = append(parts, s)
+			}
+			return one(strings.Join(parts, sep)), nil
+		}),
+		builtin("getn", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			t, err := it.checkTable("getn", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			return one(float64(t.length())), nil
+		}),
+		builtin("sort", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			t, err := it.checkTable("sort", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			if t.readOnly {
+				return nil, it.errorf(it.line, "Attempt to modify a readonly table")
+			}
+			less := valueAt(args, 1)
+			var sortErr error
+			sort.SliceStable(t.array, func(i, j int) bool {
+				if sortErr != nil {
+					return false
+				}
+				if less != nil {
+					values, err := it.call(less, []luaValue{t.array[i], t.array[j]})
+					sortErr = err
+					return luaTruthy(valueAt(values, 0))
+				}
+				v, err := it.compare("<", t.array[i], t.array[j], it.line)
+				sortErr = err
+				return v == true
+			})
+			return nil, sortErr
+		}),
+	)
+}
+
+func luaMathLibrary() *luaTable {
+	unary := func(name string, f func(float64) float64) *luaBuiltin {
+		return builtin(name, func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			n, err := it.checkNumber(name, args, 1)
+			return one(f(n)), err
+		})
+	}
+	extreme := func(name string, pick func(a, b float64) float64) *luaBuiltin {
+		return builtin(name, func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			result, err := it.checkNumber(name, args, 1)
+			if err != nil {
+				return nil, err
+			}
+			for i := 2; i <= len(args); i++ {
+				n, err := it.checkNumber(name, args, i)
+				if err != nil {
+					return nil, err
+				}
+				result = pick(result, n)
+			}
+			return one(result), nil
+		})
+	}
+	t := luaLibrary(
+		unary("floor", math.Floor),
+		unary("ceil", math.Ceil),
+		unary("abs", math.Abs),
+		unary("sqrt", math.Sqrt),
+		extreme("max", math.Max),
+		extreme("min", math.Min),
+		builtin("fmod", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			a, err := it.checkNumber("fmod", args, 1)
+			if err != nil {
+				return nil, err
+			}
+			b, err := it.checkNumber("fmod", args, 2)
+			return one(math.Mod(a, b)), err
+		}),
+	)
+	t.hash["huge"] = math.Inf(1)
+	t.hash["pi"] = math.Pi
+	return t
+}
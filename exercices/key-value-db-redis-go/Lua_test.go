@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// runLua runs a chunk without the redis library and returns its first value.
+func runLua(t *testing.T, source string) (luaValue, error) {
+	t.Helper()
+	chunk, err := parseLua(source)
+	if err != nil {
+		t.Fatalf("Failed to parse %q: %v", source, err)
+	}
+	values, err := newLuaInterp().run(chunk)
+	return valueAt(values, 0), err
+}
+
+func TestLuaEvaluation(t *testing.T) {
+	for _, tc := range []struct {
+		source   string
+		expected luaValue
+	}{
+		{"return 1 + 2 * 3 ^ 2", float64(19)},
+		{"return 2 ^ 3 ^ 2", float64(512)},
+		{"return -2 ^ 2", float64(-4)},
+		{"return 7 % -3", float64(-2)},
+		{"return '10' + 5", float64(15)},
+		{"return 1 .. 2", "12"},
+		{"return 10 / 4 .. ''", "2.5"},
+		{"return 'a' .. 'b' .. 'c' == 'abc'", true},
+		{"return nil or false", false},
+		{"return 1 and nil", nil},
+		{"return not 0", false},
+		{"return #'hello' + #{1, 2, 3}", float64(8)},
+		{"return 'abc' < 'abd' and 2 <= 2", true},
+		{"local t = {} t[1] = 'a' t[3] = 'c' t[2] = 'b' return #t", float64(3)},
+		{"local a, b = 1 return b", nil},
+		{"local a, b = 1, 2 a, b = b, a return a .. b", "21"},
+		{"local x = 1 do local x = 2 end return x", float64(1)},
+		{"local s = 0 for i = 10, 1, -3 do s = s + i end return s", float64(22)},
+		{"local s = 0 for i = 1, 10 do if i > 4 then break end s = s + i end return s", float64(10)},
+		{"local i = 0 repeat local j = i i = i + 1 until j >= 3 return i", float64(4)},
+		{"local i = 0 while true do i = i + 1 if i == 5 then return i end end", float64(5)},
+		{"local t = {a = 1, b = 2, 3} local s = 0 for k, v in pairs(t) do s = s + v end return s", float64(6)},
+		{"local t = {} for i, v in ipairs({'x', 'y', nil, 'z'}) do t[#t + 1] = v end return table.concat(t, ',')", "x,y"},
+		{"local function fib(n) if n < 2 then return n end return fib(n - 1) + fib(n - 2) end return fib(15)", float64(610)},
+		{"local function pair() return 1, 2 end local t = {pair(), pair()} return #t", float64(3)},
+		{"local function pair() return 1, 2 end local t = {(pair())} return #t", float64(1)},
+		{"local counters = {} for i = 1, 3 do counters[i] = function() return i end end return counters[2]()", float64(2)},
+		{"local o = {n = 1} function o.get(self) return self.n end return o:get()", float64(1)},
+		{"return ('%s=%d %5.2f %x %q'):format('k', 42.9, 3.14159, 255, 'a\"b')", `k=42  3.14 ff "a\"b"`},
+		{"return string.sub('hello', 2, -2) .. string.upper('x') .. ('ab'):rep(2)", "ellXabab"},
+		{"return string.find('a.b.c', '.', 3, true)", float64(4)},
+		{"return tostring(1e15) .. ' ' .. tostring(0.1) .. ' ' .. tostring(3)", "1e+15 0.1 3"},
+		{"return tonumber('0x10') + tonumber('z', 36) + (tonumber('nope') or 0)", float64(51)},
+		{"local t = {5, 1, 4} table.sort(t) table.insert(t, 1, 0) return table.concat(t, ' ')", "0 1 4 5"},
+		{"local t = {1, 2, 3} table.remove(t, 1) return unpack(t)", float64(2)},
+		{"local ok, err = pcall(error, {code = 7}) return err.code", float64(7)},
+		{"return math.max(3, 9, 2) + math.floor(-1.5)", float64(7)},
+		{"return [[\nlong\nstring]]", "long\nstring"},
+		{"-- comment\n--[[ block\ncomment ]] return 'after'", "after"},
+		{"return '\\65\\t\\\\'", "A\t\\"},
+	} {
+		got, err := runLua(t, tc.source)
+		if err != nil {
+			t.Errorf("%q failed: %v", tc.source, err)
+			continue
+		}
+		if got != tc.expected {
+			t.Errorf("%q: expected %#v, got %#v", tc.source, tc.expected, got)
+		}
+	}
+}
+
+func TestLuaErrors(t *testing.T) {
+	for _, tc := range []struct {
+		source   string
+		expected string
+	}{
+		{"return 1 +", "user_script:1: unexpected symbol near '<eof>'"},
+		{"x = 1", "Script attempted to create global variable 'x'"},
+		{"return undefined", "Script attempted to access nonexistent global variable 'undefined'"},
+		{"string.len = nil", "Attempt to modify a readonly table"},
+		{"local t = nil\nreturn t.x", "user_script:2: attempt to index a nil value"},
+		{"return {} .. 'x'", "attempt to concatenate a table value"},
+		{"return 1 < 'x'", "attempt to compare number with string"},
+		{"return nil + 1", "attempt to perform arithmetic on a nil value"},
+		{"error('boom')", "user_script:1: boom"},
+		{"local function f() return f() + 1 end return f()", "stack overflow"},
+		{"return string.rep()", "bad argument #1 to 'rep' (string expected, got no value)"},
+	} {
+		chunk, err := parseLua(tc.source)
+		if err == nil {
+			_, err = newLuaInterp().run(chunk)
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%q: expected an error containing %q, got %v", tc.source, tc.expected, err)
+		}
+	}
+}
+
+func TestLuaTimeLimit(t *testing.T) {
+	chunk, err := parseLua("while true do end")
+	if err != nil {
+		t.Fatal(err)
+	}
+	it := newLuaInterp()
+	it.deadline = it.deadline.Add(-luaTimeLimit)
+	if _, err := it.run(chunk); err != errLuaTimeout {
+		t.Errorf("Expected the script to be killed, got %v", err)
+	}
+
+	// pcall does not catch the timeout
+	chunk, _ = parseLua("pcall(function() while true do end end) return 1")
+	it = newLuaInterp()
+	it.deadline = it.deadline.Add(-luaTimeLimit)
+	if _, err := it.run(chunk); err != errLuaTimeout {
+		t.Errorf("Expected the script to be killed inside pcall, got %v", err)
+	}
+}
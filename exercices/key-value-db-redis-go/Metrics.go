@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the command latency
+// histogram.
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// commandMetrics counts the calls of one command and how long they took.
+type commandMetrics struct {
+	buckets []atomic.Int64 // one per latency bucket and one for +Inf, not cumulative
+	sum     atomic.Int64   // nanoseconds
+}
+
+// Metrics holds the counters /metrics exposes that INFO does not already
+// keep.
+type Metrics struct {
+	commands map[string]*commandMetrics // filled once, so it needs no lock
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{commands: make(map[string]*commandMetrics, len(commandTable))}
+	for command := range commandTable {
+		m.commands[command] = &commandMetrics{buckets: make([]atomic.Int64, len(latencyBuckets)+1)}
+	}
+	return m
+}
+
+// record counts a call of command. Unknown commands are not counted, so
+// clients cannot grow the number of series.
+func (m *Metrics) record(command string, duration time.Duration) {
+	cm, ok := m.commands[command]
+	if !ok {
+		return
+	}
+	seconds := duration.Seconds()
+	i, _ := slices.BinarySearch(latencyBuckets, seconds)
+	cm.buckets[i].Add(1)
+	cm.sum.Add(int64(duration))
+}
+
+// metricsHandler serves /metrics in the Prometheus text format.
+func (s *Server) metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.writeMetrics(w)
+	})
+	return mux
+}
+
+// serveMetrics serves /metrics on listener until it is closed.
+func (s *Server) serveMetrics(listener net.Listener) error {
+	server := &http.Server{Handler: s.metricsHandler(), ReadHeaderTimeout: 10 * time.Second}
+	return server.Serve(listener)
+}
+
+func (s *Server) writeMetrics(out io.Writer) {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	writeGauge(w, "kv_uptime_seconds", "Seconds since the server started.", time.Since(s.started).Seconds())
+	s.mutex.Lock()
+	clients := len(s.clients)
+	s.mutex.Unlock()
+	writeGauge(w, "kv_connected_clients", "Number of connected clients.", clients)
+	writeGauge(w, "kv_blocked_clients", "Number of clients waiting in a blocking command.", s.blockedClients.Load())
+	writeGauge(w, "kv_monitor_clients", "Number of clients running MONITOR.", s.monitors.count.Load())
+	writeGauge(w, "kv_max_clients", "Maximum number of connected clients.", s.maxClients.Load())
+	writeCounter(w, "kv_connections_received_total", "Connections accepted by the server.", s.stats.connections.Load())
+	writeCounter(w, "kv_rejected_connections_total", "Connections rejected because of maxclients.", s.stats.rejectedConnections.Load())
+	writeCounter(w, "kv_commands_processed_total", "Commands processed by the server.", s.stats.commands.Load())
+	s.writeCommandMetrics(w)
+
+	var expired, hits, misses int64
+	for _, db := range s.databases {
+		expired += db.expiredKeys.Load()
+		hits += db.keyspaceHits.Load()
+		misses += db.keyspaceMisses.Load()
+	}
+	writeCounter(w, "kv_expired_keys_total", "Keys removed because their time to live elapsed.", expired)
+	writeCounter(w, "kv_evicted_keys_total", "Keys evicted because of maxmemory.", s.eviction.evictedKeys.Load())
+	writeCounter(w, "kv_keyspace_hits_total", "Key lookups that found the key.", hits)
+	writeCounter(w, "kv_keyspace_misses_total", "Key lookups that did not find the key.", misses)
+	s.writeKeyspaceMetrics(w)
+
+	maxMemory, _, _ := s.eviction.config()
+	writeGauge(w, "kv_used_memory_bytes", "Approximate memory used by the dataset.", s.usedMemory())
+	writeGauge(w, "kv_max_memory_bytes", "Memory limit of the dataset, 0 for no limit.", maxMemory)
+	s.writePersistenceMetrics(w)
+}
+
+func (s *Server) writeCommandMetrics(w *bufio.Writer) {
+	commands := make([]string, 0, len(s.metrics.commands))
+	for command := range s.metrics.commands {
+		commands = append(commands, command)
+	}
+	slices.Sort(commands)
+
+	writeHeader(w, "kv_command_calls_total", "counter", "Calls of each command.")
+	for _, command := range commands {
+		var calls int64
+		for i := range s.metrics.commands[command].buckets {
+			calls += s.metrics.commands[command].buckets[i].Load()
+		}
+		if calls > 0 {
+			fmt.Fprintf(w, "kv_command_calls_total{cmd=%q} %d\n", strings.ToLower(command), calls)
+		}
+	}
+
+	writeHeader(w, "kv_command_duration_seconds", "histogram", "Time spent running each command.")
+	for _, command := range commands {
+		cm := s.metrics.commands[command]
+		name := strings.ToLower(command)
+		var count int64
+		lines := make([]string, 0, len(cm.buckets))
+		for i := range cm.buckets {
+			count += cm.buckets[i].Load()
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+			}
+			lines = append(lines, fmt.Sprintf("kv_command_duration_seconds_bucket{cmd=%q,le=%q} %d\n", name, le, count))
+		}
+		if count == 0 {
+			continue
+		}
+		for _, line := range lines {
+			w.WriteString(line)
+		}
+		fmt.Fprintf(w, "kv_command_duration_seconds_sum{cmd=%q} %s\n", name, metricValue(time.Duration(cm.sum.Load()).Seconds()))
+		fmt.Fprintf(w, "kv_command_duration_seconds_count{cmd=%q} %d\n", name, count)
+	}
+}
+
+// writeKeyspaceMetrics reports the databases that hold keys, like INFO
+// keyspace.
+func (s *Server) writeKeyspaceMetrics(w *bufio.Writer) {
+	type dbSize struct{ index, keys, expires int }
+	var sizes []dbSize
+	for i, db := range s.databases {
+		keys, expires := db.sizes()
+		size := dbSize{i, keys, expires}
+		if size.keys > 0 {
+			sizes = append(sizes, size)
+		}
+	}
+	writeHeader(w, "kv_db_keys", "gauge", "Number of keys in each database.")
+	for _, size := range sizes {
+		fmt.Fprintf(w, "kv_db_keys{db=\"%d\"} %d\n", size.index, size.keys)
+	}
+	writeHeader(w, "kv_db_expiring_keys", "gauge", "Number of keys with a time to live in each database.")
+	for _, size := range sizes {
+		fmt.Fprintf(w, "kv_db_expiring_keys{db=\"%d\"} %d\n", size.index, size.expires)
+	}
+}
+
+func (s *Server) writePersistenceMetrics(w *bufio.Writer) {
+	s.saveMutex.Lock()
+	saving, lastSave, lastSaveFailed := s.saving, s.lastSave, s.lastSaveFailed
+	s.saveMutex.Unlock()
+	writeGauge(w, "kv_snapshot_in_progress", "Whether a snapshot is being written.", boolMetric(saving))
+	writeGauge(w, "kv_snapshot_last_success_timestamp_seconds", "Unix time of the last successful snapshot.", lastSave)
+	writeGauge(w, "kv_snapshot_last_status_ok", "Whether the last snapshot succeeded.", boolMetric(!lastSaveFailed))
+
+	var enabled, rewriting, rewriteFailed bool
+	if s.aof != nil {
+		s.aof.mutex.Lock()
+		enabled, rewriting, rewriteFailed = true, s.aof.rewriting, s.aof.lastRewriteFailed
+		s.aof.mutex.Unlock()
+	}
+	writeGauge(w, "kv_aof_enabled", "Whether the append only file is enabled.", boolMetric(enabled))
+	writeGauge(w, "kv_aof_rewrite_in_progress", "Whether the append only file is being rewritten.", boolMetric(rewriting))
+	writeGauge(w, "kv_aof_last_rewrite_status_ok", "Whether the last append only file rewrite succeeded.", boolMetric(!rewriteFailed))
+}
+
+func writeHeader(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeGauge[T int | int32 | int64 | float64](w *bufio.Writer, name, help string, value T) {
+	writeHeader(w, name, "gauge", help)
+	fmt.Fprintf(w, "%s %s\n", name, metricValue(float64(value)))
+}
+
+func writeCounter(w *bufio.Writer, name, help string, value int64) {
+	writeHeader(w, name, "counter", help)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func metricValue(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
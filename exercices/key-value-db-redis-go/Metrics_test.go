@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrapeMetrics(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", contentType)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+	return string(body)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	srv, addr := startServerOnFreePort(t)
+	metrics := httptest.NewServer(srv.metricsHandler())
+	defer metrics.Close()
+	c := dialTestServer(t, addr)
+
+	c.do("SET", "key", "value")
+	c.do("SET", "temp", "value", "EX", "100")
+	c.do("GET", "key")
+	c.do("GET", "missing")
+	c.do("SELECT", "2")
+	c.do("SET", "short", "value", "PX", "1")
+	time.Sleep(5 * time.Millisecond)
+	c.do("GET", "short")
+	c.do("NOSUCHCOMMAND")
+	srv.snapshotPath = filepath.Join(t.TempDir(), "missing", "dump.kvsnap")
+	c.do("SAVE")
+
+	body := scrapeMetrics(t, metrics.URL)
+	for _, expected := range []string{
+		"# TYPE kv_connected_clients gauge\nkv_connected_clients 1\n",
+		"# TYPE kv_connections_received_total counter\nkv_connections_received_total 1\n",
+		`kv_command_calls_total{cmd="set"} 3` + "\n",
+		`kv_command_calls_total{cmd="get"} 3` + "\n",
+		"# TYPE kv_command_duration_seconds histogram\n",
+		`kv_command_duration_seconds_bucket{cmd="get",le="+Inf"} 3` + "\n",
+		`kv_command_duration_seconds_count{cmd="get"} 3` + "\n",
+		`kv_db_keys{db="0"} 2` + "\n",
+		`kv_db_expiring_keys{db="0"} 1` + "\n",
+		"kv_expired_keys_total 1\n",
+		"kv_evicted_keys_total 0\n",
+		"kv_keyspace_hits_total 1\n",
+		"kv_keyspace_misses_total 2\n",
+		"kv_snapshot_in_progress 0\n",
+		"kv_snapshot_last_status_ok 0\n",
+		"kv_aof_enabled 0\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in the metrics:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, "nosuchcommand") {
+		t.Errorf("Expected unknown commands not to be counted")
+	}
+	if strings.Contains(body, `kv_db_keys{db="2"}`) {
+		t.Errorf("Expected empty databases to be left out")
+	}
+	if !strings.Contains(body, `kv_command_duration_seconds_sum{cmd="set"} `) {
+		t.Errorf("Expected the latency sum of SET")
+	}
+
+	// Scrapes follow the dataset
+	c.do("SELECT", "0")
+	c.do("DEL", "key")
+	if body := scrapeMetrics(t, metrics.URL); !strings.Contains(body, `kv_db_keys{db="0"} 1`+"\n") {
+		t.Errorf("Expected one key left in db 0:\n%s", body)
+	}
+}
+
+func TestMetricsLatencyBuckets(t *testing.T) {
+	m := NewMetrics()
+	m.record("GET", 50*time.Microsecond)
+	m.record("GET", time.Millisecond)
+	m.record("GET", 2*time.Second)
+	buckets := m.commands["GET"].buckets
+	for i, expected := range map[int]int64{0: 1, 3: 1, len(latencyBuckets): 1} {
+		if got := buckets[i].Load(); got != expected {
+			t.Errorf("Expected %d calls in bucket %d, got %d", expected, i, got)
+		}
+	}
+	if got := m.commands["GET"].sum.Load(); got != int64(2*time.Second+time.Millisecond+50*time.Microsecond) {
+		t.Errorf("Unexpected latency sum %d", got)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dumpPayload serializes a value for DUMP. The payload is a snapshot holding
+// just the value under an empty key, so it carries the version and checksum
+// of the snapshot format.
+func dumpPayload(value interface{}) string {
+	var buf bytes.Buffer
+	writeSnapshot(&buf, [][]snapshotEntry{{{value: value}}})
+	return buf.String()
+}
+
+func restorePayload(payload string) (interface{}, bool) {
+	dbs, err := readSnapshot([]byte(payload))
+	if err != nil || len(dbs) != 1 || len(dbs[0]) != 1 {
+		return nil, false
+	}
+	return dbs[0][0].value, true
+}
+
+func dumpCommand(db *Database, args []string) Reply {
+	if len(args) != 1 {
+		return ErrorReply("ERR wrong number of arguments for 'dump' command")
+	}
+	value, exists := db.lookup(args[0])
+	if !exists {
+		return NullBulk{}
+	}
+	return BulkString(dumpPayload(value))
+}
+
+// restoreCommand implements RESTORE key ttl payload [REPLACE] [ABSTTL]. The
+// ttl is in milliseconds, or a unix time in milliseconds with ABSTTL, and 0
+// for a key that does not expire.
+func restoreCommand(db *Database, args []string) Reply {
+	if len(args) < 3 {
+		return ErrorReply("ERR wrong number of arguments for 'restore' command")
+	}
+	key := args[0]
+	ttl, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return ErrorReply("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return ErrorReply("ERR Invalid TTL value, must be >= 0")
+	}
+	replace, absTTL := false, false
+	for _, opt := range args[3:] {
+		switch strings.ToUpper(opt) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		default:
+			return ErrorReply("ERR syntax error")
+		}
+	}
+	deadline := ttl
+	if ttl != 0 && !absTTL {
+		var ok bool
+		if deadline, ok = expireDeadline(nowMillis(), ttl, 1); !ok {
+			return ErrorReply("ERR invalid expire time in 'restore' command")
+		}
+	}
+	if _, exists := db.value(key); exists && !replace {
+		return ErrorReply("BUSYKEY Target key name already exists.")
+	}
+	value, ok := restorePayload(args[2])
+	if !ok {
+		return ErrorReply("ERR DUMP payload version or checksum are wrong")
+	}
+	db.set(key, value)
+	if deadline == 0 {
+		db.removeDeadline(key)
+	} else {
+		db.setDeadline(key, deadline)
+	}
+	return okReply
+}
+
+// migrateKeys returns the keys of MIGRATE host port key|"" db timeout
+// [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key...].
+func migrateKeys(args []string) []string {
+	if len(args) < 5 {
+		return nil
+	}
+	if args[2] != "" {
+		return args[2:3]
+	}
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "AUTH":
+			i++
+		case "AUTH2":
+			i += 2
+		case "KEYS":
+			return args[i+1:]
+		}
+	}
+	return nil
+}
+
+// migrateCommand implements MIGRATE, which moves keys to another server with
+// RESTORE and deletes them here, unless COPY is given. In cluster mode each
+// RESTORE follows ASKING, so the target accepts keys of a slot it is
+// importing. The locks of the keys are only held to copy and to delete them,
+// not during the round trip to the target, and a key that a client changed
+// meanwhile is kept, like WATCH would.
+func (s *Server) migrateCommand(c *Client, args []string) Reply {
+	if len(args) < 5 {
+		return ErrorReply("ERR wrong number of arguments for 'migrate' command")
+	}
+	addr := net.JoinHostPort(args[0], args[1])
+	dbIndex, err1 := strconv.Atoi(args[3])
+	timeout, err2 := strconv.Atoi(args[4])
+	if err1 != nil || err2 != nil {
+		return ErrorReply("ERR value is not an integer or out of range")
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+	copyKeys, replace, keysOption := false, false, false
+	var auth []string
+	for i := 5; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "COPY":
+			copyKeys = true
+		case opt == "REPLACE":
+			replace = true
+		case opt == "AUTH" && i+1 < len(args):
+			auth = []string{"AUTH", args[i+1]}
+			i++
+		case opt == "AUTH2" && i+2 < len(args):
+			auth = []string{"AUTH", args[i+1], args[i+2]}
+			i += 2
+		case opt == "KEYS":
+			if args[2] != "" {
+				return ErrorReply("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			keysOption = true
+			i = len(args)
+		default:
+			return ErrorReply("ERR syntax error")
+		}
+	}
+	if args[2] == "" && !keysOption {
+		return ErrorReply("ERR syntax error")
+	}
+
+	db := s.databases[c.dbIndex]
+	var keys []string
+	var request bytes.Buffer
+	w := bufio.NewWriter(&request)
+	if auth != nil {
+		writeCommand(w, auth)
+	}
+	if dbIndex != 0 {
+		writeCommand(w, []string{"SELECT", strconv.Itoa(dbIndex)})
+	}
+	shards := keyShards(migrateKeys(args))
+	watchers := make(map[string]*Client)
+	db.lock(shards)
+	now := nowMillis()
+	for _, key := range migrateKeys(args) {
+		value, exists := db.value(key)
+		if !exists || db.isExpired(key) || watchers[key] != nil {
+			continue
+		}
+		ttl := int64(0)
+		if deadline, ok := db.deadline(key); ok {
+			ttl = max(deadline-now, 1)
+		}
+		restore := []string{"RESTORE", key, strconv.FormatInt(ttl, 10), dumpPayload(value)}
+		if replace {
+			restore = append(restore, "REPLACE")
+		}
+		if s.cluster != nil {
+			writeCommand(w, []string{"ASKING"})
+		}
+		writeCommand(w, restore)
+		keys = append(keys, key)
+		watchers[key] = &Client{}
+		db.addWatcher(key, watchers[key])
+	}
+	db.unlock(shards)
+	if len(keys) == 0 {
+		return SimpleString("NOKEY")
+	}
+	// Only the keys the target accepted and no client changed meanwhile are
+	// deleted
+	var moved []string
+	defer func() {
+		db.lock(shards)
+		defer db.unlock(shards)
+		for _, key := range keys {
+			db.removeWatcher(key, watchers[key])
+		}
+		deleted := []string{"DEL"}
+		for _, key := range moved {
+			if !watchers[key].dirty.Load() {
+				db.deleteKey(key)
+				db.notifyEvent(notifyGeneric, "del", key)
+				deleted = append(deleted, key)
+			}
+		}
+		if len(deleted) > 1 {
+			s.propagate(c.dbIndex, deleted)
+		}
+	}()
+
+	w.Flush()
+
+	conn, err := net.DialTimeout("tcp", addr, time.Duration(timeout)*time.Millisecond)
+	if err != nil {
+		return ErrorReply("IOERR error or timeout connecting to the client")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		return ErrorReply("IOERR error or timeout writing to target instance")
+	}
+	reader := bufio.NewReader(conn)
+	// expectOK reads a reply of the target and returns the error MIGRATE
+	// answers with if it is not +OK, and whether the connection failed
+	expectOK := func() (Reply, bool) {
+		line, err := readReplyLine(reader)
+		if err != nil {
+			return ErrorReply("IOERR error or timeout reading to target instance"), true
+		}
+		if line != "+OK" {
+			return ErrorReply("ERR Target instance replied with error: " + strings.TrimPrefix(line, "-")), false
+		}
+		return nil, false
+	}
+	if auth != nil {
+		if errReply, _ := expectOK(); errReply != nil {
+			return errReply
+		}
+	}
+	if dbIndex != 0 {
+		if errReply, _ := expectOK(); errReply != nil {
+			return errReply
+		}
+	}
+	// Keys the target accepted are gone from here even if others failed
+	var firstErr Reply
+	for _, key := range keys {
+		var askErr Reply
+		if s.cluster != nil {
+			var failed bool
+			if askErr, failed = expectOK(); failed {
+				return askErr
+			}
+		}
+		restoreErr, failed := expectOK()
+		if failed {
+			return restoreErr
+		}
+		switch {
+		case askErr != nil && firstErr == nil:
+			firstErr = askErr
+		case restoreErr != nil && firstErr == nil:
+			firstErr = restoreErr
+		case askErr == nil && restoreErr == nil && !copyKeys:
+			moved = append(moved, key)
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return okReply
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Monitors holds the clients that ran MONITOR.
+type Monitors struct {
+	mutex   sync.Mutex
+	clients map[*Client]struct{}
+	count   atomic.Int32 // lets feed skip formatting when nobody listens
+}
+
+func NewMonitors() *Monitors {
+	return &Monitors{clients: make(map[*Client]struct{})}
+}
+
+// monitorCommand implements MONITOR. The client switches to push mode and
+// from then on receives every command the server runs.
+func (s *Server) monitorCommand(c *Client, args []string) Reply {
+	if len(args) != 0 {
+		return ErrorReply("ERR wrong number of arguments for 'monitor' command")
+	}
+	m := s.monitors
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.clients[c]; ok {
+		return okReply
+	}
+	c.startPush()
+	// Queued while holding the mutex so that it precedes the first command
+	c.enqueue(okReply)
+	m.clients[c] = struct{}{}
+	m.count.Add(1)
+	c.monitoring = true
+	return nil
+}
+
+func (s *Server) removeMonitor(c *Client) {
+	m := s.monitors
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.clients[c]; ok {
+		delete(m.clients, c)
+		m.count.Add(-1)
+	}
+}
+
+// feedMonitors sends a command that is about to run to the monitors, except
+// for administrative commands, which could reveal secrets.
+func (s *Server) feedMonitors(c *Client, dbIndex int, command string, args []string) {
+	m := s.monitors
+	if m.count.Load() == 0 || isAdminCommand(command) {
+		return
+	}
+	now := time.Now()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d.%06d [%d %s]", now.Unix(), now.Nanosecond()/1000, dbIndex, c.addr())
+	for _, arg := range redactArgs(append([]string{strings.ToLower(command)}, args...)) {
+		sb.WriteByte(' ')
+		sb.WriteString(reprString(arg))
+	}
+	line := SimpleString(sb.String())
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for monitor := range m.clients {
+		monitor.deliver(line, pubsubOutputLimit)
+	}
+}
+
+func isAdminCommand(command string) bool {
+	return slices.Contains(aclCategories["admin"], command)
+}
+
+// addr is how MONITOR and SLOWLOG show where a command came from.
+func (c *Client) addr() string {
+	if c.inScript {
+		return "lua"
+	}
+	if c.conn == nil {
+		return "master"
+	}
+	return c.conn.RemoteAddr().String()
+}
+
+// redactArgs hides passwords from MONITOR and SLOWLOG: the arguments of AUTH,
+// the password rules of ACL SETUSER and the secrets set with CONFIG SET.
+func redactArgs(args []string) []string {
+	redacted := append([]string(nil), args...)
+	command, sub := strings.ToUpper(args[0]), ""
+	if len(args) > 1 {
+		sub = strings.ToUpper(args[1])
+	}
+	switch {
+	case command == "AUTH":
+		for i := 1; i < len(redacted); i++ {
+			redacted[i] = "(redacted)"
+		}
+	case command == "ACL" && sub == "SETUSER":
+		for i := 3; i < len(redacted); i++ {
+			if rule := redacted[i]; rule != "" && strings.IndexByte("><#!", rule[0]) >= 0 {
+				redacted[i] = "(redacted)"
+			}
+		}
+	case command == "CONFIG" && sub == "SET":
+		for i := 2; i+1 < len(redacted); i += 2 {
+			switch strings.ToLower(redacted[i]) {
+			case "requirepass", "masterauth":
+				redacted[i+1] = "(redacted)"
+			}
+		}
+	}
+	return redacted
+}
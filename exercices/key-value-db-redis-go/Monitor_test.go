@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	monitor := dialTestServer(t, addr)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, monitor.do("MONITOR"), SimpleString("OK"))
+	expectReply(t, monitor.do("GET", "key"), ErrorReply("ERR only QUIT is allowed while monitoring"))
+
+	c.do("SET", "key", "hello world")
+	c.do("AUTH", "secret")
+	c.do("CONFIG", "GET", "port")
+	c.do("SELECT", "2")
+	c.do("MULTI")
+	c.do("INCR", "counter")
+	c.do("EXEC")
+
+	prefix := `^\d+\.\d{6} \[(\d+) ` + regexp.QuoteMeta(c.conn.LocalAddr().String()) + `\] `
+	for _, expected := range []struct{ db, command string }{
+		{"0", `"set" "key" "hello world"`},
+		{"0", `"auth" "\(redacted\)"`},
+		// CONFIG is an administrative command and is not shown
+		{"0", `"select" "2"`},
+		{"2", `"multi"`},
+		{"2", `"incr" "counter"`},
+		{"2", `"exec"`},
+	} {
+		line, ok := monitor.receive().(SimpleString)
+		if !ok {
+			t.Fatalf("Expected a status line, got %v", line)
+		}
+		match := regexp.MustCompile(prefix + expected.command + "$").FindStringSubmatch(string(line))
+		if match == nil || match[1] != expected.db {
+			t.Errorf("Expected %s on db %s, got %q", expected.command, expected.db, line)
+		}
+	}
+
+	// A monitor that disconnects is no longer fed
+	monitor.conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for infoField(t, c, "clients", "monitor_clients") != "0" {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the monitor to be removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"AUTH", "user", "pass"}, []string{"AUTH", "(redacted)", "(redacted)"}},
+		{[]string{"ACL", "setuser", "alice", "on", ">pass", "~*"}, []string{"ACL", "setuser", "alice", "on", "(redacted)", "~*"}},
+		{[]string{"CONFIG", "SET", "timeout", "10", "requirepass", "pass"}, []string{"CONFIG", "SET", "timeout", "10", "requirepass", "(redacted)"}},
+		{[]string{"GET", "key"}, []string{"GET", "key"}},
+	}
+	for _, test := range tests {
+		if got := redactArgs(test.args); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Expected %q, got %q", test.expected, got)
+		}
+	}
+}
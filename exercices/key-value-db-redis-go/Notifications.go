@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Classes of keyspace events, enabled by the characters of the
+// notify-keyspace-events setting.
+const (
+	notifyKeyspace  = 1 << iota // K: publish the event on __keyspace@<db>__:<key>
+	notifyKeyevent              // E: publish the key on __keyevent@<db>__:<event>
+	notifyGeneric               // g: del, expire, rename, move and persist
+	notifyString                // $
+	notifyList                  // l
+	notifySet                   // s
+	notifyHash                  // h
+	notifySortedSet             // z
+	notifyExpired               // x: keys removed once their deadline passed
+	notifyEvicted               // e: keys removed because of maxmemory
+	notifyAll       = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifySortedSet | notifyExpired | notifyEvicted
+)
+
+// notifyClassChars lists the class characters in the order CONFIG GET
+// prints them.
+var notifyClassChars = []struct {
+	char  byte
+	class int
+}{
+	{'g', notifyGeneric}, {'$', notifyString}, {'l', notifyList}, {'s', notifySet},
+	{'h', notifyHash}, {'z', notifySortedSet}, {'x', notifyExpired}, {'e', notifyEvicted},
+}
+
+// parseNotifyFlags parses a notify-keyspace-events value such as "KEA" or
+// "Elx". Without K or E nothing is published, so the result is 0.
+func parseNotifyFlags(value string) (int, error) {
+	flags := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case 'A':
+			flags |= notifyAll
+		case 'K':
+			flags |= notifyKeyspace
+		case 'E':
+			flags |= notifyKeyevent
+		default:
+			known := false
+			for _, c := range notifyClassChars {
+				if c.char == value[i] {
+					flags |= c.class
+					known = true
+				}
+			}
+			if !known {
+				return 0, errors.New("Invalid event class character. Use 'Ag$lshzxeKE'.")
+			}
+		}
+	}
+	if flags&(notifyKeyspace|notifyKeyevent) == 0 {
+		return 0, nil
+	}
+	return flags, nil
+}
+
+func formatNotifyFlags(flags int) string {
+	var b strings.Builder
+	if flags&notifyAll == notifyAll {
+		b.WriteByte('A')
+	} else {
+		for _, c := range notifyClassChars {
+			if flags&c.class != 0 {
+				b.WriteByte(c.char)
+			}
+		}
+	}
+	if flags&notifyKeyspace != 0 {
+		b.WriteByte('K')
+	}
+	if flags&notifyKeyevent != 0 {
+		b.WriteByte('E')
+	}
+	return b.String()
+}
+
+// notifyKeyspaceEvent publishes an event on key of database dbIndex, if
+// notify-keyspace-events enables its class. Subscribers get their messages
+// from a queue, so this is safe while holding shard locks.
+func (s *Server) notifyKeyspaceEvent(dbIndex, class int, event, key string) {
+	flags := int(s.notifyFlags.Load())
+	if flags&class == 0 {
+		return
+	}
+	if flags&notifyKeyspace != 0 {
+		s.publish(fmt.Sprintf("__keyspace@%d__:%s", dbIndex, key), event)
+	}
+	if flags&notifyKeyevent != 0 {
+		s.publish(fmt.Sprintf("__keyevent@%d__:%s", dbIndex, event), key)
+	}
+}
+
+// notifyEvent publishes an event on key of db. Databases created outside a
+// server have no subscribers.
+func (db *Database) notifyEvent(class int, event, key string) {
+	if db.notify != nil {
+		db.notify(class, event, key)
+	}
+}
+
+// commandEvents are the events of the write commands that emit one event on
+// their first key. The others are handled in notifyCommand.
+var commandEvents = map[string]struct {
+	class int
+	event string
+}{
+	"RESTORE":     {notifyGeneric, "restore"},
+	"PERSIST":     {notifyGeneric, "persist"},
+	"INCR":        {notifyString, "incrby"},
+	"INCRBY":      {notifyString, "incrby"},
+	"DECR":        {notifyString, "incrby"},
+	"DECRBY":      {notifyString, "incrby"},
+	"INCRBYFLOAT": {notifyString, "incrbyfloat"},
+	"APPEND":      {notifyString, "append"},
+	"SETRANGE":    {notifyString, "setrange"},
+	"GETSET":      {notifyString, "set"},
+	"GETDEL":      {notifyGeneric, "del"},
+	"SETNX":       {notifyString, "set"},
+	"LPUSH":       {notifyList, "lpush"},
+	"RPUSH":       {notifyList, "rpush"},
+	"LPOP":        {notifyList, "lpop"},
+	"RPOP":        {notifyList, "rpop"},
+	"HSET":        {notifyHash, "hset"},
+	"HDEL":        {notifyHash, "hdel"},
+	"HINCRBY":     {notifyHash, "hincrby"},
+	"SADD":        {notifySet, "sadd"},
+	"SREM":        {notifySet, "srem"},
+	"ZADD":        {notifySortedSet, "zadd"},
+	"ZINCRBY":     {notifySortedSet, "zincr"},
+}
+
+// notifyCommand publishes the events of a write command that changed the
+// dataset, while the caller still holds the locks it ran with. Commands that
+// remove the last element of a collection also emit del.
+func (s *Server) notifyCommand(db *Database, command string, args []string, reply Reply) {
+	if s.notifyFlags.Load() == 0 {
+		return
+	}
+	delIfGone := func(key string) {
+		if _, exists := db.value(key); !exists {
+			db.notifyEvent(notifyGeneric, "del", key)
+		}
+	}
+	switch command {
+	case "SET":
+		db.notifyEvent(notifyString, "set", args[0])
+		if opts, _ := parseSetOptions(args[2:]); opts.deadline != 0 {
+			db.notifyEvent(notifyGeneric, "expire", args[0])
+		}
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT":
+		// A deadline in the past deletes the key
+		if _, exists := db.value(args[0]); exists {
+			db.notifyEvent(notifyGeneric, "expire", args[0])
+		} else {
+			db.notifyEvent(notifyGeneric, "del", args[0])
+		}
+	case "MSET", "MSETNX":
+		for i := 0; i < len(args); i += 2 {
+			db.notifyEvent(notifyString, "set", args[i])
+		}
+	case "RENAME", "RENAMENX":
+		db.notifyEvent(notifyGeneric, "rename_from", args[0])
+		db.notifyEvent(notifyGeneric, "rename_to", args[1])
+	case "MOVE":
+		target, _ := strconv.Atoi(args[1])
+		db.notifyEvent(notifyGeneric, "move_from", args[0])
+		s.databases[target].notifyEvent(notifyGeneric, "move_to", args[0])
+	case "BLPOP", "BRPOP":
+		key := string(reply.(Array)[0].(BulkString))
+		db.notifyEvent(notifyList, strings.ToLower(command[1:]), key)
+		delIfGone(key)
+	case "LMOVE", "BLMOVE":
+		db.notifyEvent(notifyList, listEnd(args[2])+"pop", args[0])
+		db.notifyEvent(notifyList, listEnd(args[3])+"push", args[1])
+		delIfGone(args[0])
+	default:
+		if e, ok := commandEvents[command]; ok {
+			db.notifyEvent(e.class, e.event, args[0])
+			if e.event != "del" {
+				delIfGone(args[0])
+			}
+		}
+	}
+}
+
+// listEnd is the prefix of the pop and push events of a LEFT or RIGHT
+// argument.
+func listEnd(side string) string {
+	if strings.EqualFold(side, "LEFT") {
+		return "l"
+	}
+	return "r"
+}
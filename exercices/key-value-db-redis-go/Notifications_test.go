@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// expectEvents reads pmessages of the keyspace and keyevent channels until
+// the "sync" message published by the test, and compares their channels and
+// payloads with expected.
+func expectEvents(t *testing.T, sub, c *testClient, expected ...string) {
+	t.Helper()
+	c.do("PUBLISH", "sync", "done")
+	var got []string
+	for {
+		msg, ok := sub.receive().(Array)
+		if !ok || len(msg) < 3 {
+			t.Fatalf("Unexpected pushed reply %v", msg)
+		}
+		if msg[0] == BulkString("message") {
+			break
+		}
+		got = append(got, string(msg[2].(BulkString))+" "+string(msg[3].(BulkString)))
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected events %q, got %q", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Errorf("Expected events %q, got %q", expected, got)
+			return
+		}
+	}
+}
+
+func subscribeToEvents(t *testing.T, addr string) *testClient {
+	t.Helper()
+	sub := dialTestServer(t, addr)
+	sub.do("PSUBSCRIBE", "__key*__:*")
+	sub.send("SUBSCRIBE", "sync")
+	sub.receive()
+	return sub
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+	sub := subscribeToEvents(t, addr)
+
+	// Nothing is published by default
+	c.do("SET", "quiet", "v")
+	expectEvents(t, sub, c)
+
+	expectReply(t, c.do("CONFIG", "SET", "notify-keyspace-events", "KEA"), okReply)
+	expectReply(t, c.do("CONFIG", "GET", "notify-keyspace-events"), Array{BulkString("notify-keyspace-events"), BulkString("AKE")})
+	c.do("SET", "session", "v", "EX", "100")
+	expectEvents(t, sub, c,
+		"__keyspace@0__:session set", "__keyevent@0__:set session",
+		"__keyspace@0__:session expire", "__keyevent@0__:expire session")
+
+	expectReply(t, c.do("CONFIG", "SET", "notify-keyspace-events", "Kg$l"), okReply)
+	c.do("INCR", "counter")
+	c.do("RPUSH", "list", "a")
+	c.do("LPOP", "list")
+	c.do("RENAME", "counter", "total")
+	c.do("DEL", "total")
+	// Reads and writes that change nothing are silent
+	c.do("GET", "session")
+	c.do("DEL", "missing")
+	c.do("SELECT", "1")
+	c.do("SET", "other", "v")
+	expectEvents(t, sub, c,
+		"__keyspace@0__:counter incrby",
+		"__keyspace@0__:list rpush",
+		"__keyspace@0__:list lpop", "__keyspace@0__:list del",
+		"__keyspace@0__:counter rename_from", "__keyspace@0__:total rename_to",
+		"__keyspace@0__:total del",
+		"__keyspace@1__:other set")
+
+	// Classes that are not enabled are filtered out
+	expectReply(t, c.do("CONFIG", "SET", "notify-keyspace-events", "Eh"), okReply)
+	c.do("SADD", "set", "m")
+	c.do("HSET", "hash", "f", "v")
+	c.do("EXPIRE", "hash", "0")
+	expectEvents(t, sub, c, "__keyevent@1__:hset hash")
+
+	expectReply(t, c.do("CONFIG", "SET", "notify-keyspace-events", "KX"),
+		ErrorReply("ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events') - Invalid event class character. Use 'Ag$lshzxeKE'."))
+	// Classes without K or E publish nothing
+	expectReply(t, c.do("CONFIG", "SET", "notify-keyspace-events", "A"), okReply)
+	expectReply(t, c.do("CONFIG", "GET", "notify-keyspace-events"), Array{BulkString("notify-keyspace-events"), BulkString("")})
+}
+
+func TestExpiredAndEvictedNotifications(t *testing.T) {
+	srv, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+	sub := subscribeToEvents(t, addr)
+	c.do("CONFIG", "SET", "notify-keyspace-events", "Exe")
+
+	c.do("SET", "session", "v", "PX", "1")
+	time.Sleep(5 * time.Millisecond)
+	waitForReply(t, c, Integer(0), "EXISTS", "session")
+	expectEvents(t, sub, c, "__keyevent@0__:expired session")
+
+	c.do("SET", "big", string(make([]byte, 1000)))
+	srv.eviction.setMaxMemory(1, policyAllKeysRandom)
+	c.do("SET", "small", "v")
+	srv.eviction.setMaxMemory(0, policyNoEviction)
+	expectEvents(t, sub, c, "__keyevent@0__:evicted big")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPipelinedRepliesKeepOrder(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	var batch strings.Builder
+	for i := 1; i <= 1000; i++ {
+		batch.WriteString(encodeCommand("INCR", "counter"))
+		batch.WriteString(encodeCommand("SET", "key"+strconv.Itoa(i), strconv.Itoa(i)))
+	}
+	batch.WriteString(encodeCommand("GET", "key500"))
+	if _, err := c.conn.Write([]byte(batch.String())); err != nil {
+		t.Fatalf("Failed to send pipeline: %v", err)
+	}
+	for i := 1; i <= 1000; i++ {
+		reply, err := readTestReply(c.reader)
+		if err != nil {
+			t.Fatalf("Failed to read reply %d: %v", i, err)
+		}
+		expectReply(t, reply, Integer(i))
+		reply, _ = readTestReply(c.reader)
+		expectReply(t, reply, okReply)
+	}
+	reply, _ := readTestReply(c.reader)
+	expectReply(t, reply, BulkString("500"))
+}
+
+func TestPipelinedInlineCommands(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("SET a 1\r\n\r\nINCR a\r\nGET a\r\n"))
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{"OK\n", "(integer) 2\n", "\"2\"\n"} {
+		line, err := reader.ReadString('\n')
+		if err != nil || line != expected {
+			t.Fatalf("Expected %q, got %q: %v", expected, line, err)
+		}
+	}
+}
+
+// benchmarkCommands sends b.N SET commands, depth at a time, and waits for
+// every reply before sending the next batch.
+func benchmarkCommands(b *testing.B, depth int) {
+	srv := NewServer()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go srv.serve(listener)
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	command := []byte(encodeCommand("SET", "bench", "value"))
+	batch := []byte(strings.Repeat(string(command), depth))
+
+	b.ResetTimer()
+	for sent := 0; sent < b.N; sent += depth {
+		n := min(depth, b.N-sent)
+		if _, err := conn.Write(batch[:n*len(command)]); err != nil {
+			b.Fatalf("Failed to send: %v", err)
+		}
+		for i := 0; i < n; i++ {
+			if line, err := reader.ReadString('\n'); err != nil || line != "+OK\r\n" {
+				b.Fatalf("Unexpected reply %q: %v", line, err)
+			}
+		}
+	}
+}
+
+func BenchmarkUnpipelined(b *testing.B) {
+	benchmarkCommands(b, 1)
+}
+
+func BenchmarkPipelined16(b *testing.B) {
+	benchmarkCommands(b, 16)
+}
+
+func BenchmarkPipelined256(b *testing.B) {
+	benchmarkCommands(b, 256)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pushQueueSize bounds the number of replies waiting to be written to a
+	// subscribed client, pubsubOutputLimit the bytes they may add up to.
+	pushQueueSize     = 1024
+	pubsubOutputLimit = 8 * 1024 * 1024
+	pushDrainTimeout  = time.Second
+)
+
+// PubSub holds the channel and pattern subscriptions of all clients.
+type PubSub struct {
+	mutex    sync.Mutex
+	channels map[string]map[*Client]struct{}
+	patterns map[string]map[*Client]struct{}
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels: make(map[string]map[*Client]struct{}),
+		patterns: make(map[string]map[*Client]struct{}),
+	}
+}
+
+// subscriptions is the number of channels and patterns the client listens
+// to. A client with subscriptions is in push mode.
+func (c *Client) subscriptions() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+// startPush moves the client's replies to a queue written by a dedicated
+// goroutine, so published messages never wait on the connection and stay
+// ordered with the client's own replies.
+func (c *Client) startPush() {
+	if c.push != nil {
+		return
+	}
+	c.push = make(chan Reply, pushQueueSize)
+	c.pushDone = make(chan struct{})
+	go c.pushLoop()
+}
+
+func (c *Client) pushLoop() {
+	defer close(c.pushDone)
+	failed := false
+	for reply := range c.push {
+		if !failed {
+			writeReply(c.writer, reply, c.inline.Load())
+			if len(c.push) == 0 {
+				failed = c.writer.Flush() != nil
+			}
+			if failed {
+				c.conn.Close()
+			}
+		}
+		c.pushBytes.Add(-replySize(reply))
+	}
+	if !failed {
+		c.writer.Flush()
+	}
+}
+
+// stopPush waits for queued replies to be written, giving up after
+// pushDrainTimeout when the client does not read them.
+func (c *Client) stopPush() {
+	if c.push == nil {
+		return
+	}
+	close(c.push)
+	c.conn.SetWriteDeadline(time.Now().Add(pushDrainTimeout))
+	<-c.pushDone
+}
+
+// enqueue is used for the replies to the client's own commands and waits
+// when the queue is full instead of dropping the client.
+func (c *Client) enqueue(reply Reply) {
+	c.pushBytes.Add(replySize(reply))
+	c.push <- reply
+}
+
+// deliver queues a message without blocking. A client whose queue would
+// exceed limit bytes is disconnected so that it cannot stall publishers.
+// Caller holds the mutex of the registry the client was found in, which keeps
+// deliver from racing with stopPush.
+func (c *Client) deliver(reply Reply, limit int64) bool {
+	if c.killed.Load() {
+		return false
+	}
+	size := replySize(reply)
+	if c.pushBytes.Add(size) <= limit {
+		select {
+		case c.push <- reply:
+			return true
+		default:
+		}
+	}
+	c.pushBytes.Add(-size)
+	if !c.killed.Swap(true) {
+		log.Println("Client", c.conn.RemoteAddr(), "closed for overcoming output buffer limits")
+		c.conn.Close()
+	}
+	return false
+}
+
+// replySize approximates the encoded size of a reply.
+func replySize(reply Reply) int64 {
+	switch r := reply.(type) {
+	case BulkString:
+		return int64(len(r)) + 16
+	case SimpleString:
+		return int64(len(r)) + 3
+	case ErrorReply:
+		return int64(len(r)) + 3
+	case Array:
+		size := int64(16)
+		for _, elem := range r {
+			size += replySize(elem)
+		}
+		return size
+	}
+	return 16
+}
+
+// pubsubCommand implements SUBSCRIBE, UNSUBSCRIBE, PSUBSCRIBE and
+// PUNSUBSCRIBE. Confirmations are queued while holding the PubSub mutex so
+// that they always precede the messages of the channel, and the command
+// itself returns no reply. Only subscribing moves the client to push mode.
+func (s *Server) pubsubCommand(c *Client, command string, args []string) Reply {
+	kind := strings.ToLower(command)
+	switch {
+	case (command == "SUBSCRIBE" || command == "PSUBSCRIBE") && len(args) == 0:
+		return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", kind))
+	case command == "SUBSCRIBE" || command == "PSUBSCRIBE":
+		c.startPush()
+	case c.push == nil:
+		// A client that never subscribed has nothing to leave and stays out
+		// of push mode
+		if len(args) == 0 {
+			return Array{BulkString(kind), NullBulk{}, Integer(0)}
+		}
+		for _, name := range args {
+			c.reply(Array{BulkString(kind), BulkString(name), Integer(0)})
+		}
+		return nil
+	}
+	ps := s.pubsub
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	registry, subscribed := ps.channels, c.channels
+	if command == "PSUBSCRIBE" || command == "PUNSUBSCRIBE" {
+		registry, subscribed = ps.patterns, c.patterns
+	}
+	switch command {
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		for _, name := range args {
+			if _, ok := subscribed[name]; !ok {
+				subscribed[name] = struct{}{}
+				if registry[name] == nil {
+					registry[name] = make(map[*Client]struct{})
+				}
+				registry[name][c] = struct{}{}
+			}
+			c.deliver(Array{BulkString(kind), BulkString(name), Integer(c.subscriptions())}, pubsubOutputLimit)
+		}
+	default:
+		if len(args) == 0 {
+			for name := range subscribed {
+				args = append(args, name)
+			}
+		}
+		if len(args) == 0 {
+			c.deliver(Array{BulkString(kind), NullBulk{}, Integer(c.subscriptions())}, pubsubOutputLimit)
+		}
+		for _, name := range args {
+			unsubscribe(registry, subscribed, c, name)
+			c.deliver(Array{BulkString(kind), BulkString(name), Integer(c.subscriptions())}, pubsubOutputLimit)
+		}
+	}
+	return nil
+}
+
+func unsubscribe(registry map[string]map[*Client]struct{}, subscribed map[string]struct{}, c *Client, name string) {
+	delete(subscribed, name)
+	delete(registry[name], c)
+	if len(registry[name]) == 0 {
+		delete(registry, name)
+	}
+}
+
+// unsubscribeAll drops every subscription of a disconnecting client.
+func (s *Server) unsubscribeAll(c *Client) {
+	ps := s.pubsub
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	for name := range c.channels {
+		unsubscribe(ps.channels, c.channels, c, name)
+	}
+	for name := range c.patterns {
+		unsubscribe(ps.patterns, c.patterns, c, name)
+	}
+}
+
+// publish sends a message to the subscribers of channel and of every
+// matching pattern, and returns how many received it.
+func (s *Server) publish(channel, message string) int {
+	ps := s.pubsub
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	receivers := 0
+	for c := range ps.channels[channel] {
+		if c.deliver(Array{BulkString("message"), BulkString(channel), BulkString(message)}, pubsubOutputLimit) {
+			receivers++
+		}
+	}
+	for pattern, clients := range ps.patterns {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		for c := range clients {
+			if c.deliver(Array{BulkString("pmessage"), BulkString(pattern), BulkString(channel), BulkString(message)}, pubsubOutputLimit) {
+				receivers++
+			}
+		}
+	}
+	return receivers
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func (c *testClient) receive() Reply {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+	reply, err := readTestReply(c.reader)
+	if err != nil {
+		c.t.Fatalf("Failed to read pushed message: %v", err)
+	}
+	return reply
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	sub := dialTestServer(t, addr)
+	pub := dialTestServer(t, addr)
+
+	expectReply(t, sub.do("SUBSCRIBE", "news", "sports"), Array{BulkString("subscribe"), BulkString("news"), Integer(1)})
+	expectReply(t, sub.receive(), Array{BulkString("subscribe"), BulkString("sports"), Integer(2)})
+	expectReply(t, sub.do("PSUBSCRIBE", "news.*"), Array{BulkString("psubscribe"), BulkString("news.*"), Integer(3)})
+
+	expectReply(t, pub.do("PUBLISH", "news", "hello"), Integer(1))
+	expectReply(t, sub.receive(), Array{BulkString("message"), BulkString("news"), BulkString("hello")})
+	expectReply(t, pub.do("PUBLISH", "news.tech", "go"), Integer(1))
+	expectReply(t, sub.receive(), Array{BulkString("pmessage"), BulkString("news.*"), BulkString("news.tech"), BulkString("go")})
+	expectReply(t, pub.do("PUBLISH", "weather", "rain"), Integer(0))
+
+	// Push mode only accepts subscription commands
+	expectReply(t, sub.do("GET", "key"), ErrorReply("ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context"))
+	expectReply(t, sub.do("PING"), Array{BulkString("pong"), BulkString("")})
+
+	expectReply(t, sub.do("UNSUBSCRIBE", "news"), Array{BulkString("unsubscribe"), BulkString("news"), Integer(2)})
+	expectReply(t, pub.do("PUBLISH", "news", "missed"), Integer(0))
+	sub.do("UNSUBSCRIBE")
+	expectReply(t, sub.do("PUNSUBSCRIBE"), Array{BulkString("punsubscribe"), BulkString("news.*"), Integer(0)})
+
+	// Without subscriptions the client is back to normal commands
+	expectReply(t, sub.do("GET", "key"), NullBulk{})
+	expectReply(t, sub.do("PING"), SimpleString("PONG"))
+}
+
+func TestUnsubscribeWithoutSubscriptions(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("UNSUBSCRIBE"), Array{BulkString("unsubscribe"), NullBulk{}, Integer(0)})
+	expectReply(t, c.do("PUNSUBSCRIBE", "a.*", "b.*"), Array{BulkString("punsubscribe"), BulkString("a.*"), Integer(0)})
+	expectReply(t, c.receive(), Array{BulkString("punsubscribe"), BulkString("b.*"), Integer(0)})
+	expectReply(t, c.do("SET", "key", "value"), SimpleString("OK"))
+
+	// Clients in push mode are never idle, this one still is
+	expectReply(t, c.do("CONFIG", "SET", "timeout", "1"), SimpleString("OK"))
+	expectReply(t, c.do("UNSUBSCRIBE"), Array{BulkString("unsubscribe"), NullBulk{}, Integer(0)})
+	expectDisconnected(t, c)
+}
+
+func TestPublishToDisconnectedSubscriber(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	sub := dialTestServer(t, addr)
+	pub := dialTestServer(t, addr)
+	sub.do("SUBSCRIBE", "events")
+	sub.conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for pub.do("PUBLISH", "events", "x") != Integer(0) {
+		if time.Now().After(deadline) {
+			t.Fatal("Subscription was not removed after the client disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSlowSubscriberIsDisconnected(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	sub := dialTestServer(t, addr)
+	pub := dialTestServer(t, addr)
+	sub.do("SUBSCRIBE", "firehose")
+
+	// The subscriber never reads, so its buffers fill up. Publishing must
+	// keep going and the subscriber must eventually be dropped.
+	payload := strings.Repeat("x", 64*1024)
+	start := time.Now()
+	dropped := false
+	for i := 0; i < 1000 && !dropped; i++ {
+		dropped = pub.do("PUBLISH", "firehose", payload) == Integer(0)
+	}
+	if !dropped {
+		t.Fatal("Slow subscriber was never disconnected")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Publishing stalled for %v", elapsed)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		expected   bool
+	}{
+		{"*", "anything", true},
+		{"news.*", "news.tech", true},
+		{"news.*", "news", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.expected {
+			t.Errorf("globMatch(%q, %q) = %v, expected %v", tt.pattern, tt.s, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// replicaOutputLimit bounds the bytes queued for one replica, including
+	// the full sync payload.
+	replicaOutputLimit    = 256 * 1024 * 1024
+	replPingInterval      = 10 * time.Second
+	replAckInterval       = time.Second
+	replReconnectDelay    = time.Second
+	replHandshakeTimeout  = 5 * time.Second
+	replSyncPayloadLength = 1 << 40
+)
+
+// Replication is the leader and follower state of a server. A server streams
+// its writes to the replicas attached with SYNC, and follows a leader when it
+// is configured with REPLICAOF.
+type Replication struct {
+	mutex    sync.Mutex
+	id       string
+	offset   int64 // bytes of write stream produced, or applied on a follower
+	replicas map[*Client]*replicaLink
+	streamDB int // database of the last SELECT sent to the replicas
+
+	readOnly   bool        // followers reject writes from clients
+	rejecting  atomic.Bool // a follower with readOnly, read by every write without the mutex
+	masterUser string
+	masterAuth string
+	masterAddr string
+	stop       chan struct{} // closed to stop following the leader
+	linkUp     bool
+	syncing    bool
+	lastIO     time.Time
+	timeout    time.Duration // silence from the leader after which a follower reconnects
+}
+
+// replicaLink is what a leader knows about one of its replicas.
+type replicaLink struct {
+	port      int
+	ackOffset int64
+	ackTime   time.Time
+}
+
+func NewReplication() *Replication {
+	return &Replication{
+		id:       newReplicationID(),
+		replicas: make(map[*Client]*replicaLink),
+		streamDB: -1,
+		readOnly: true,
+		timeout:  60 * time.Second,
+	}
+}
+
+func newReplicationID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// isReadOnlyReplica reports whether writes from clients are rejected.
+func (s *Server) isReadOnlyReplica() bool {
+	return s.replication.rejecting.Load()
+}
+
+// updateRejecting refreshes rejecting after masterAddr or readOnly changed.
+// Caller holds the mutex.
+func (repl *Replication) updateRejecting() {
+	repl.rejecting.Store(repl.masterAddr != "" && repl.readOnly)
+}
+
+// feedReplicas sends a write to every replica, preceded by SELECT when it
+// targets another database than the previous one. A negative dbIndex sends
+// a command that does not depend on the database.
+func (s *Server) feedReplicas(dbIndex int, args []string) {
+	repl := s.replication
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+	if dbIndex >= 0 && repl.streamDB != dbIndex {
+		repl.feedLocked([]string{"SELECT", strconv.Itoa(dbIndex)})
+		repl.streamDB = dbIndex
+	}
+	repl.feedLocked(args)
+}
+
+// feedLocked queues a command for every replica. On a follower the offset
+// tracks the leader's stream instead. Caller holds the replication mutex.
+func (repl *Replication) feedLocked(args []string) {
+	if repl.masterAddr == "" {
+		repl.offset += commandSize(args)
+	}
+	if len(repl.replicas) == 0 {
+		return
+	}
+	command := make(Array, len(args))
+	for i, arg := range args {
+		command[i] = BulkString(arg)
+	}
+	for c := range repl.replicas {
+		c.deliver(command, replicaOutputLimit)
+	}
+}
+
+// commandSize is the length of a command encoded by writeCommand.
+func commandSize(args []string) int64 {
+	size := int64(len(strconv.Itoa(len(args)))) + 3
+	for _, arg := range args {
+		size += int64(len(strconv.Itoa(len(arg))) + len(arg) + 5)
+	}
+	return size
+}
+
+// syncReplica attaches the client as a replica. It receives the dataset as
+// the commands COMPACT prints, encoded in one bulk string, and then every
+// write. Both happen while every database is locked, so no write is lost or
+// sent twice.
+func (s *Server) syncReplica(c *Client) Reply {
+	c.startPush()
+	s.lockAll()
+	defer s.unlockAll()
+	repl := s.replication
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+	if _, ok := repl.replicas[c]; ok {
+		return ErrorReply("ERR replica already attached")
+	}
+
+	var payload bytes.Buffer
+	w := bufio.NewWriter(&payload)
+	for i, db := range s.databases {
+		commands := db.compactCommands()
+		if len(commands) == 0 {
+			continue
+		}
+		writeCommand(w, []string{"SELECT", strconv.Itoa(i)})
+		for _, args := range commands {
+			writeCommand(w, args)
+		}
+	}
+	w.Flush()
+	// The payload leaves the replica in an unknown database
+	repl.streamDB = -1
+	repl.replicas[c] = &replicaLink{port: c.replicaPort, ackOffset: repl.offset, ackTime: time.Now()}
+	c.deliver(SimpleString(fmt.Sprintf("FULLRESYNC %s %d", repl.id, repl.offset)), replicaOutputLimit)
+	c.deliver(BulkString(payload.String()), replicaOutputLimit)
+	log.Println("Replica", c.conn.RemoteAddr(), "attached, full sync of", payload.Len(), "bytes")
+	return nil
+}
+
+// removeReplica detaches a disconnecting client if it was a replica.
+func (s *Server) removeReplica(c *Client) {
+	repl := s.replication
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+	if _, ok := repl.replicas[c]; ok {
+		delete(repl.replicas, c)
+		log.Println("Replica", c.conn.RemoteAddr(), "detached")
+	}
+}
+
+// pingReplicas keeps the replication links busy so that replicas can tell a
+// quiet leader from a dead one, see applyMasterStream, until the server
+// shuts down.
+func (s *Server) pingReplicas() {
+	ticker := time.NewTicker(replPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+		repl := s.replication
+		repl.mutex.Lock()
+		if len(repl.replicas) > 0 {
+			repl.feedLocked([]string{"PING"})
+		}
+		repl.mutex.Unlock()
+	}
+}
+
+// replicationCommand implements REPLICAOF, SYNC and REPLCONF.
+func (s *Server) replicationCommand(c *Client, command string, args []string) Reply {
+	switch command {
+	case "REPLICAOF":
+		if len(args) != 2 {
+			return ErrorReply("ERR wrong number of arguments for 'replicaof' command")
+		}
+		if s.cluster != nil {
+			return ErrorReply("ERR REPLICAOF not allowed in cluster mode.")
+		}
+		if strings.EqualFold(args[0], "NO") && strings.EqualFold(args[1], "ONE") {
+			s.stopReplication()
+			return okReply
+		}
+		port, err := strconv.Atoi(args[1])
+		if err != nil || port <= 0 || port > 65535 {
+			return ErrorReply("ERR Invalid master port")
+		}
+		s.startReplication(net.JoinHostPort(args[0], strconv.Itoa(port)))
+		return okReply
+	case "SYNC":
+		if len(args) != 0 {
+			return ErrorReply("ERR wrong number of arguments for 'sync' command")
+		}
+		return s.syncReplica(c)
+	case "REPLCONF":
+		if len(args)%2 != 0 {
+			return ErrorReply("ERR wrong number of arguments for 'replconf' command")
+		}
+		for i := 0; i < len(args); i += 2 {
+			switch strings.ToLower(args[i]) {
+			case "listening-port":
+				port, err := strconv.Atoi(args[i+1])
+				if err != nil {
+					return ErrorReply("ERR value is not an integer or out of range")
+				}
+				c.replicaPort = port
+			case "ack":
+				offset, err := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil {
+					return nil
+				}
+				repl := s.replication
+				repl.mutex.Lock()
+				if link, ok := repl.replicas[c]; ok {
+					link.ackOffset, link.ackTime = offset, time.Now()
+				}
+				repl.mutex.Unlock()
+				// Acknowledgements are never answered
+				return nil
+			default:
+				return ErrorReply(fmt.Sprintf("ERR Unrecognized REPLCONF option: %s", args[i]))
+			}
+		}
+		return okReply
+	}
+	return ErrorReply("ERR unknown command")
+}
+
+// startReplication follows the leader at addr, replacing the current one.
+func (s *Server) startReplication(addr string) {
+	s.stopReplication()
+	repl := s.replication
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+	repl.masterAddr = addr
+	repl.updateRejecting()
+	repl.stop = make(chan struct{})
+	go s.followMaster(addr, repl.stop)
+	log.Println("Following master", addr)
+}
+
+// stopReplication makes the server a leader again. The dataset is kept.
+func (s *Server) stopReplication() {
+	repl := s.replication
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+	if repl.masterAddr == "" {
+		return
+	}
+	close(repl.stop)
+	repl.masterAddr, repl.stop = "", nil
+	repl.updateRejecting()
+	repl.linkUp, repl.syncing = false, false
+	// A new history starts here, replicas of this server must sync again
+	repl.id = newReplicationID()
+	repl.dropReplicasLocked()
+}
+
+func (repl *Replication) dropReplicasLocked() {
+	for c := range repl.replicas {
+		c.conn.Close()
+	}
+}
+
+// followMaster keeps a link to the leader, syncing again after every
+// disconnection, until stop is closed.
+func (s *Server) followMaster(addr string, stop chan struct{}) {
+	for {
+		err := s.syncWithMaster(addr, stop)
+		s.setLinkState(stop, false, false)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Println("Lost connection to master", addr+":", err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(replReconnectDelay):
+		}
+	}
+}
+
+// setLinkState updates the follower state unless stop belongs to a link that
+// was already replaced.
+func (s *Server) setLinkState(stop chan struct{}, linkUp, syncing bool) {
+	repl := s.replication
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+	if repl.stop == stop {
+		repl.linkUp, repl.syncing = linkUp, syncing
+		repl.lastIO = time.Now()
+	}
+}
+
+// syncWithMaster performs a full sync from the leader and then applies its
+// write stream until the connection fails or stop is closed.
+func (s *Server) syncWithMaster(addr string, stop chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", addr, replHandshakeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	s.setLinkState(stop, false, true)
+	counter := &countingReader{r: conn}
+	buffered := bufio.NewReader(counter)
+	writer := bufio.NewWriter(conn)
+	conn.SetDeadline(time.Now().Add(replHandshakeTimeout))
+	s.mutex.Lock()
+	port := s.port
+	s.mutex.Unlock()
+	repl := s.replication
+	repl.mutex.Lock()
+	user, password := repl.masterUser, repl.masterAuth
+	repl.mutex.Unlock()
+	if password != "" {
+		if user != "" {
+			writeCommand(writer, []string{"AUTH", user, password})
+		} else {
+			writeCommand(writer, []string{"AUTH", password})
+		}
+	}
+	if port != 0 {
+		writeCommand(writer, []string{"REPLCONF", "listening-port", strconv.Itoa(port)})
+	}
+	writeCommand(writer, []string{"SYNC"})
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if password != "" {
+		if line, err := readReplyLine(buffered); err != nil {
+			return err
+		} else if line != "+OK" {
+			return errors.New("master rejected AUTH: " + line)
+		}
+	}
+	if port != 0 {
+		if line, err := readReplyLine(buffered); err != nil {
+			return err
+		} else if line != "+OK" {
+			return errors.New("master rejected REPLCONF: " + line)
+		}
+	}
+	line, err := readReplyLine(buffered)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		return errors.New("unexpected reply to SYNC: " + line)
+	}
+	masterID := fields[1]
+	offset, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return errors.New("bad offset in reply to SYNC: " + line)
+	}
+	// Loading a big dataset may take longer than the handshake
+	conn.SetDeadline(time.Time{})
+	payload, err := readSyncPayload(buffered)
+	if err != nil {
+		return err
+	}
+	if err := s.loadSyncPayload(payload); err != nil {
+		return err
+	}
+
+	repl.mutex.Lock()
+	if repl.stop != stop {
+		repl.mutex.Unlock()
+		return errors.New("replication was reconfigured")
+	}
+	repl.id, repl.offset = masterID, offset
+	repl.linkUp, repl.syncing, repl.lastIO = true, false, time.Now()
+	repl.dropReplicasLocked()
+	repl.mutex.Unlock()
+	log.Printf("Full sync with master %s done, %d bytes", addr, len(payload))
+	if s.aof != nil {
+		go func() {
+			if err := s.rewriteAOF(); err != nil {
+				log.Println("AOF rewrite after sync failed:", err)
+			}
+		}()
+	}
+
+	go s.acknowledgeMaster(conn, writer, done)
+	return s.applyMasterStream(conn, buffered, counter, stop)
+}
+
+// applyMasterStream executes the leader's writes and advances the offset by
+// the bytes each command took on the wire. The leader pings every
+// replPingInterval, so a link silent for repl-timeout is dead even if it was
+// never closed.
+func (s *Server) applyMasterStream(conn net.Conn, buffered *bufio.Reader, counter *countingReader, stop chan struct{}) error {
+	master := &Client{master: true}
+	reader := NewRespReader(buffered)
+	consumed := counter.n - int64(buffered.Buffered())
+	for {
+		repl := s.replication
+		repl.mutex.Lock()
+		timeout := repl.timeout
+		repl.mutex.Unlock()
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		args, _, err := reader.ReadCommand()
+		if err != nil {
+			return err
+		}
+		read := counter.n - int64(buffered.Buffered())
+		if len(args) > 0 {
+			s.executeCommand(master, strings.ToUpper(args[0]), args[1:])
+		}
+		repl.mutex.Lock()
+		if repl.stop != stop {
+			repl.mutex.Unlock()
+			return errors.New("replication was reconfigured")
+		}
+		repl.offset += read - consumed
+		repl.lastIO = time.Now()
+		repl.mutex.Unlock()
+		consumed = read
+	}
+}
+
+// acknowledgeMaster reports the applied offset so the leader can tell how far
+// behind this replica is.
+func (s *Server) acknowledgeMaster(conn net.Conn, writer *bufio.Writer, done chan struct{}) {
+	ticker := time.NewTicker(replAckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			repl := s.replication
+			repl.mutex.Lock()
+			offset := repl.offset
+			repl.mutex.Unlock()
+			writeCommand(writer, []string{"REPLCONF", "ACK", strconv.FormatInt(offset, 10)})
+			if err := writer.Flush(); err != nil {
+				conn.Close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func readReplyLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+func readSyncPayload(r *bufio.Reader) ([]byte, error) {
+	line, err := readReplyLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "$") {
+		return nil, errors.New("expected the sync payload, got: " + line)
+	}
+	size, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil || size < 0 || size > replSyncPayloadLength {
+		return nil, errors.New("bad sync payload length: " + line)
+	}
+	payload := make([]byte, size+2)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload[:size], nil
+}
+
+// loadSyncPayload replaces the whole dataset with the one sent by the leader,
+// atomically for clients reading from this replica.
+func (s *Server) loadSyncPayload(payload []byte) error {
+	reader := NewRespReader(bytes.NewReader(payload))
+	var commands [][]string
+	for {
+		args, _, err := reader.ReadCommand()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("bad sync payload: %v", err)
+		}
+		if len(args) > 0 {
+			args[0] = strings.ToUpper(args[0])
+			commands = append(commands, args)
+		}
+	}
+	s.lockAll()
+	defer s.unlockAll()
+	for _, db := range s.databases {
+		db.flush()
+	}
+	loader := &Client{master: true}
+	for _, args := range commands {
+		if reply, ok := s.dispatch(loader, args[0], args[1:]).(ErrorReply); ok {
+			return fmt.Errorf("bad sync payload: %s failed: %s", args[0], reply)
+		}
+	}
+	return nil
+}
+
+// replicationInfo is the replication section of INFO.
+func (s *Server) replicationInfo() string {
+	repl := s.replication
+	repl.mutex.Lock()
+	defer repl.mutex.Unlock()
+	var sb strings.Builder
+	if repl.masterAddr == "" {
+		sb.WriteString("role:master\r\n")
+	} else {
+		host, port, _ := net.SplitHostPort(repl.masterAddr)
+		linkStatus, syncing := "down", 0
+		if repl.linkUp {
+			linkStatus = "up"
+		}
+		if repl.syncing {
+			syncing = 1
+		}
+		readOnly := 0
+		if repl.readOnly {
+			readOnly = 1
+		}
+		lastIO := -1
+		if !repl.lastIO.IsZero() {
+			lastIO = int(time.Since(repl.lastIO).Seconds())
+		}
+		fmt.Fprintf(&sb, "role:slave\r\nmaster_host:%s\r\nmaster_port:%s\r\n", host, port)
+		fmt.Fprintf(&sb, "master_link_status:%s\r\nmaster_last_io_seconds_ago:%d\r\n", linkStatus, lastIO)
+		fmt.Fprintf(&sb, "master_sync_in_progress:%d\r\nslave_repl_offset:%d\r\nslave_read_only:%d\r\n", syncing, repl.offset, readOnly)
+	}
+	fmt.Fprintf(&sb, "connected_slaves:%d\r\n", len(repl.replicas))
+	i := 0
+	for c, link := range repl.replicas {
+		host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+		fmt.Fprintf(&sb, "slave%d:ip=%s,port=%d,state=online,offset=%d,lag=%d\r\n",
+			i, host, link.port, link.ackOffset, int(time.Since(link.ackTime).Seconds()))
+		i++
+	}
+	fmt.Fprintf(&sb, "master_replid:%s\r\nmaster_repl_offset:%d\r\n", repl.id, repl.offset)
+	return sb.String()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForReply polls a command until it returns the expected reply.
+func waitForReply(t *testing.T, c *testClient, expected Reply, args ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := c.do(args...)
+		if formatInline(got, "") == formatInline(expected, "") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%q: expected %s, got %s", args, formatInline(expected, ""), formatInline(got, ""))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func infoField(t *testing.T, c *testClient, section, field string) string {
+	t.Helper()
+	info, ok := c.do("INFO", section).(BulkString)
+	if !ok {
+		t.Fatalf("INFO %s did not return a bulk string", section)
+	}
+	for _, line := range strings.Split(string(info), "\r\n") {
+		if value, found := strings.CutPrefix(line, field+":"); found {
+			return value
+		}
+	}
+	return ""
+}
+
+func startReplicaPair(t *testing.T) (*testClient, *testClient) {
+	t.Helper()
+	_, leaderAddr := startServerOnFreePort(t)
+	follower, followerAddr := startServerOnFreePort(t)
+	t.Cleanup(follower.stopReplication)
+	leader, replica := dialTestServer(t, leaderAddr), dialTestServer(t, followerAddr)
+
+	leader.do("SET", "before", "sync")
+	leader.do("RPUSH", "list", "a", "b")
+	host, port, _ := net.SplitHostPort(leaderAddr)
+	expectReply(t, replica.do("REPLICAOF", host, port), okReply)
+	waitForReply(t, replica, BulkString("sync"), "GET", "before")
+	return leader, replica
+}
+
+func TestReplicaFullSyncAndStream(t *testing.T) {
+	leader, replica := startReplicaPair(t)
+	expectReply(t, replica.do("LRANGE", "list", "0", "-1"), Array{BulkString("a"), BulkString("b")})
+
+	leader.do("SET", "after", "sync", "EX", "100")
+	leader.do("INCR", "counter")
+	leader.do("SELECT", "3")
+	leader.do("SADD", "set", "x")
+	leader.do("SELECT", "0")
+	leader.do("MULTI")
+	leader.do("INCR", "counter")
+	leader.do("DEL", "before")
+	leader.do("EXEC")
+
+	waitForReply(t, replica, NullBulk{}, "GET", "before")
+	expectReply(t, replica.do("GET", "counter"), BulkString("2"))
+	expectReply(t, replica.do("GET", "after"), BulkString("sync"))
+	if ttl, ok := replica.do("TTL", "after").(Integer); !ok || ttl <= 0 || ttl > 100 {
+		t.Errorf("Expected the expiry to be replicated, got TTL %v", ttl)
+	}
+	replica.do("SELECT", "3")
+	expectReply(t, replica.do("SMEMBERS", "set"), Array{BulkString("x")})
+}
+
+func TestReplicaRejectsWrites(t *testing.T) {
+	_, replica := startReplicaPair(t)
+	readOnly := ErrorReply("READONLY You can't write against a read only replica.")
+	expectReply(t, replica.do("SET", "key", "value"), readOnly)
+	expectReply(t, replica.do("MULTI"), okReply)
+	expectReply(t, replica.do("INCR", "key"), readOnly)
+	expectReply(t, replica.do("EXEC"), ErrorReply("EXECABORT Transaction discarded because of previous errors."))
+
+	// Promoting the replica keeps its data and accepts writes again
+	expectReply(t, replica.do("REPLICAOF", "NO", "ONE"), okReply)
+	expectReply(t, replica.do("SET", "key", "value"), okReply)
+	expectReply(t, replica.do("GET", "before"), BulkString("sync"))
+}
+
+func TestReplicationInfo(t *testing.T) {
+	leader, replica := startReplicaPair(t)
+	if role := infoField(t, leader, "replication", "role"); role != "master" {
+		t.Errorf("Expected leader role master, got %q", role)
+	}
+	if role := infoField(t, replica, "replication", "role"); role != "slave" {
+		t.Errorf("Expected follower role slave, got %q", role)
+	}
+	if status := infoField(t, replica, "replication", "master_link_status"); status != "up" {
+		t.Errorf("Expected master link up, got %q", status)
+	}
+	if n := infoField(t, leader, "replication", "connected_slaves"); n != "1" {
+		t.Errorf("Expected 1 connected replica, got %q", n)
+	}
+
+	leader.do("SET", "more", "data")
+	waitForReply(t, replica, BulkString("data"), "GET", "more")
+	leaderOffset := infoField(t, leader, "replication", "master_repl_offset")
+	if offset := infoField(t, replica, "replication", "slave_repl_offset"); offset != leaderOffset {
+		t.Errorf("Expected follower offset %s, got %s", leaderOffset, offset)
+	}
+	// The follower acknowledges its offset once per second
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(infoField(t, leader, "replication", "slave0"), "offset="+leaderOffset+",") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Leader never saw offset %s acknowledged: %s", leaderOffset, infoField(t, leader, "replication", "slave0"))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// A leader that stops sending without closing the connection is dropped
+// after repl-timeout, and the follower syncs again.
+func TestReplicaReconnectsToSilentLeader(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	syncs := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := NewRespReader(conn)
+			for {
+				args, _, err := reader.ReadCommand()
+				if err != nil {
+					conn.Close()
+					break
+				}
+				if strings.EqualFold(args[0], "SYNC") {
+					conn.Write([]byte("+FULLRESYNC " + newReplicationID() + " 0\r\n$0\r\n\r\n"))
+					syncs <- conn
+					break
+				}
+				conn.Write([]byte("+OK\r\n"))
+			}
+		}
+	}()
+
+	_, followerAddr := startServerOnFreePort(t)
+	replica := dialTestServer(t, followerAddr)
+	expectReply(t, replica.do("CONFIG", "SET", "repl-timeout", "1"), okReply)
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	expectReply(t, replica.do("REPLICAOF", host, port), okReply)
+	t.Cleanup(func() { replica.do("REPLICAOF", "NO", "ONE") })
+
+	first := <-syncs
+	defer first.Close()
+	select {
+	case second := <-syncs:
+		second.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the replica to reconnect to a silent leader")
+	}
+}
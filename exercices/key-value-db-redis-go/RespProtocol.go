@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxBulkLength      = 512 * 1024 * 1024
+	maxMultiBulkLength = 1024 * 1024
+	maxInlineLength    = 64 * 1024
+)
+
+// Reply is any value a command can answer with. It is encoded as RESP2 for
+// clients that speak the protocol and as redis-cli style text for inline clients.
+type Reply interface{}
+
+type SimpleString string
+type ErrorReply string
+type Integer int64
+type BulkString string
+type Array []Reply
+
+// NullBulk and NullArray are the RESP2 "$-1" and "*-1" replies.
+type NullBulk struct{}
+type NullArray struct{}
+
+var okReply = SimpleString("OK")
+
+// ProtocolError is returned by RespReader when the client sent something that
+// cannot be parsed. The connection is closed after replying with it.
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+// RespReader reads commands either as RESP multi-bulk arrays or as inline
+// space separated lines, the way telnet users type them.
+type RespReader struct {
+	r *bufio.Reader
+}
+
+func NewRespReader(r io.Reader) *RespReader {
+	if br, ok := r.(*bufio.Reader); ok {
+		return &RespReader{r: br}
+	}
+	return &RespReader{r: bufio.NewReader(r)}
+}
+
+// Buffered returns the number of bytes already read from the connection
+// that belong to the next commands.
+func (rr *RespReader) Buffered() int {
+	return rr.r.Buffered()
+}
+
+// Peek waits until n bytes can be read, and returns the error of the
+// connection if it fails first.
+func (rr *RespReader) Peek(n int) error {
+	_, err := rr.r.Peek(n)
+	return err
+}
+
+// ReadCommand returns the next command's arguments and whether it was sent
+// inline. An empty argument list means the client sent a blank line.
+func (rr *RespReader) ReadCommand() ([]string, bool, error) {
+	first, err := rr.r.Peek(1)
+	if err != nil {
+		return nil, false, err
+	}
+	if first[0] != '*' {
+		args, err := rr.readInline()
+		return args, true, err
+	}
+	args, err := rr.readMultiBulk()
+	return args, false, err
+}
+
+// readLine reads up to the next newline. Lines longer than maxInlineLength are
+// rejected as soon as they pass the limit rather than once fully buffered.
+func (rr *RespReader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := rr.r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxInlineLength {
+			return "", &ProtocolError{"too big inline request"}
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+	}
+}
+
+func (rr *RespReader) readInline() ([]string, error) {
+	line, err := rr.readLine()
+	if err != nil {
+		return nil, err
+	}
+	args, ok := splitArgs(line)
+	if !ok {
+		return nil, &ProtocolError{"unbalanced quotes in request"}
+	}
+	return args, nil
+}
+
+// splitArgs splits an inline request on whitespace. Double quoted arguments
+// may contain escapes such as \n or \x00 and single quoted ones are taken
+// literally, so telnet users can still send spaces, newlines and raw bytes.
+func splitArgs(line string) ([]string, bool) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, true
+		}
+		var arg strings.Builder
+		inDouble, inSingle, done := false, false, false
+		for !done {
+			if inDouble {
+				if i == len(line) {
+					return nil, false
+				}
+				switch {
+				case line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]):
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					arg.WriteByte(byte(b))
+					i += 3
+				case line[i] == '\\' && i+1 < len(line):
+					i++
+					switch line[i] {
+					case 'n':
+						arg.WriteByte('\n')
+					case 'r':
+						arg.WriteByte('\r')
+					case 't':
+						arg.WriteByte('\t')
+					case 'b':
+						arg.WriteByte('\b')
+					case 'a':
+						arg.WriteByte('\a')
+					default:
+						arg.WriteByte(line[i])
+					}
+				case line[i] == '"':
+					// A closing quote must be followed by a space or the end of line
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				default:
+					arg.WriteByte(line[i])
+				}
+			} else if inSingle {
+				if i == len(line) {
+					return nil, false
+				}
+				switch {
+				case line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					arg.WriteByte('\'')
+				case line[i] == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				default:
+					arg.WriteByte(line[i])
+				}
+			} else {
+				if i == len(line) {
+					break
+				}
+				switch line[i] {
+				case ' ', '\t', '\n', '\r', 0:
+					done = true
+				case '"':
+					inDouble = true
+				case '\'':
+					inSingle = true
+				default:
+					arg.WriteByte(line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, arg.String())
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == 0
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// quoteArg returns s unchanged when it can be sent inline as is, and a double
+// quoted, escaped form otherwise. splitArgs reverses it.
+func quoteArg(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || c == '"' || c == '\'' || c == '\\' {
+			return reprString(s)
+		}
+	}
+	return s
+}
+
+// reprString renders s as a double quoted string with non printable bytes
+// escaped, the same way redis-cli prints bulk replies.
+func reprString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' || c == '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c == '\n':
+			sb.WriteString(`\n`)
+		case c == '\r':
+			sb.WriteString(`\r`)
+		case c == '\t':
+			sb.WriteString(`\t`)
+		case c == '\a':
+			sb.WriteString(`\a`)
+		case c == '\b':
+			sb.WriteString(`\b`)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(&sb, "\\x%02x", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func (rr *RespReader) readMultiBulk() ([]string, error) {
+	line, err := rr.readLine()
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > maxMultiBulkLength {
+		return nil, &ProtocolError{"invalid multibulk length"}
+	}
+	if count <= 0 {
+		return []string{}, nil
+	}
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		arg, err := rr.readBulk()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+func (rr *RespReader) readBulk() (string, error) {
+	line, err := rr.readLine()
+	if err != nil {
+		return "", err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return "", &ProtocolError{fmt.Sprintf("expected '$', got '%s'", firstChar(line))}
+	}
+	size, err := strconv.Atoi(line[1:])
+	if err != nil || size < 0 || size > maxBulkLength {
+		return "", &ProtocolError{"invalid bulk length"}
+	}
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(rr.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	if buf[size] != '\r' || buf[size+1] != '\n' {
+		return "", &ProtocolError{"bulk string is not terminated by CRLF"}
+	}
+	return string(buf[:size]), nil
+}
+
+func firstChar(s string) string {
+	if s == "" {
+		return ""
+	}
+	return s[:1]
+}
+
+func isProtocolError(err error) bool {
+	var perr *ProtocolError
+	return errors.As(err, &perr)
+}
+
+// writeRESP encodes a reply using the RESP2 wire format.
+func writeRESP(w *bufio.Writer, reply Reply) {
+	switch r := reply.(type) {
+	case SimpleString:
+		w.WriteString("+" + string(r) + "\r\n")
+	case ErrorReply:
+		w.WriteString("-" + string(r) + "\r\n")
+	case Integer:
+		w.WriteString(":" + strconv.FormatInt(int64(r), 10) + "\r\n")
+	case BulkString:
+		w.WriteString("$" + strconv.Itoa(len(r)) + "\r\n")
+		w.WriteString(string(r))
+		w.WriteString("\r\n")
+	case NullBulk:
+		w.WriteString("$-1\r\n")
+	case NullArray:
+		w.WriteString("*-1\r\n")
+	case Array:
+		w.WriteString("*" + strconv.Itoa(len(r)) + "\r\n")
+		for _, elem := range r {
+			writeRESP(w, elem)
+		}
+	default:
+		w.WriteString(fmt.Sprintf("-ERR unsupported reply type %T\r\n", reply))
+	}
+}
+
+// writeCommand encodes a command the way clients send it, as an array of
+// bulk strings.
+func writeCommand(w *bufio.Writer, args []string) {
+	w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+		w.WriteString(arg)
+		w.WriteString("\r\n")
+	}
+}
+
+// writeInline encodes a reply the way redis-cli prints it, one reply per line
+// group, so telnet and netcat users keep getting readable output.
+func writeInline(w *bufio.Writer, reply Reply) {
+	w.WriteString(formatInline(reply, ""))
+	w.WriteString("\n")
+}
+
+func formatInline(reply Reply, indent string) string {
+	switch r := reply.(type) {
+	case SimpleString:
+		return string(r)
+	case ErrorReply:
+		return "(error) " + string(r)
+	case Integer:
+		return fmt.Sprintf("(integer) %d", r)
+	case BulkString:
+		return reprString(string(r))
+	case NullBulk, NullArray:
+		return "(nil)"
+	case Array:
+		if len(r) == 0 {
+			return "(empty array)"
+		}
+		width := len(strconv.Itoa(len(r)))
+		var sb strings.Builder
+		for i, elem := range r {
+			prefix := fmt.Sprintf("%*d) ", width, i+1)
+			if i > 0 {
+				sb.WriteString("\n" + indent)
+			}
+			sb.WriteString(prefix)
+			sb.WriteString(formatInline(elem, indent+strings.Repeat(" ", len(prefix))))
+		}
+		return sb.String()
+	default:
+		return fmt.Sprintf("(error) ERR unsupported reply type %T", reply)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startServerOnFreePort runs a fresh server on a loopback port and returns its address.
+func startServerOnFreePort(t *testing.T) (*Server, string) {
+	t.Helper()
+	srv := NewServer()
+	return srv, serveOnFreePort(t, srv)
+}
+
+func serveOnFreePort(t *testing.T, srv *Server) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go srv.serve(listener)
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().String()
+}
+
+func encodeCommand(args ...string) string {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	reply := Array{}
+	for _, arg := range args {
+		reply = append(reply, BulkString(arg))
+	}
+	writeRESP(w, reply)
+	w.Flush()
+	return buf.String()
+}
+
+func TestRespReaderParsesMultiBulkAndInline(t *testing.T) {
+	input := encodeCommand("SET", "key", "hello world") + "GET  key\r\n" + "\r\n"
+	reader := NewRespReader(strings.NewReader(input))
+
+	args, inline, err := reader.ReadCommand()
+	if err != nil || inline {
+		t.Fatalf("Expected multi-bulk command, got inline=%v err=%v", inline, err)
+	}
+	if len(args) != 3 || args[2] != "hello world" {
+		t.Errorf("Unexpected multi-bulk args: %q", args)
+	}
+
+	args, inline, err = reader.ReadCommand()
+	if err != nil || !inline {
+		t.Fatalf("Expected inline command, got inline=%v err=%v", inline, err)
+	}
+	if len(args) != 2 || args[0] != "GET" || args[1] != "key" {
+		t.Errorf("Unexpected inline args: %q", args)
+	}
+
+	args, _, err = reader.ReadCommand()
+	if err != nil || len(args) != 0 {
+		t.Errorf("Expected empty args for blank line, got %q err=%v", args, err)
+	}
+}
+
+func TestRespReaderRejectsMalformedInput(t *testing.T) {
+	inputs := []string{
+		"*x\r\n",
+		"*1\r\n:1\r\n",
+		"*1\r\n$3\r\nabcd\r\n",
+		"*1\r\n$-5\r\n",
+	}
+	for _, input := range inputs {
+		_, _, err := NewRespReader(strings.NewReader(input)).ReadCommand()
+		if !isProtocolError(err) {
+			t.Errorf("Expected protocol error for %q, got %v", input, err)
+		}
+	}
+}
+
+// endlessReader yields spaces forever, like a client that never ends its line.
+type endlessReader struct {
+	read int
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = ' '
+	}
+	r.read += len(p)
+	return len(p), nil
+}
+
+func TestRespReaderBoundsInlineLines(t *testing.T) {
+	source := &endlessReader{}
+	_, _, err := NewRespReader(source).ReadCommand()
+	if !isProtocolError(err) {
+		t.Fatalf("Expected protocol error for an endless line, got %v", err)
+	}
+	if source.read > 2*maxInlineLength {
+		t.Errorf("Expected the line to be rejected once past the limit, read %d bytes", source.read)
+	}
+
+	line := strings.Repeat("x", maxInlineLength-2) + "\r\n"
+	args, _, err := NewRespReader(strings.NewReader(line)).ReadCommand()
+	if err != nil || len(args) != 1 || len(args[0]) != maxInlineLength-2 {
+		t.Errorf("Expected a line at the limit to be accepted, got %d args err=%v", len(args), err)
+	}
+}
+
+func TestWriteRESPEncodesAllTypes(t *testing.T) {
+	tests := []struct {
+		reply    Reply
+		expected string
+	}{
+		{SimpleString("OK"), "+OK\r\n"},
+		{ErrorReply("ERR boom"), "-ERR boom\r\n"},
+		{Integer(-42), ":-42\r\n"},
+		{BulkString("a\r\nb"), "$4\r\na\r\nb\r\n"},
+		{NullBulk{}, "$-1\r\n"},
+		{NullArray{}, "*-1\r\n"},
+		{Array{Integer(1), Array{BulkString("x")}}, "*2\r\n:1\r\n*1\r\n$1\r\nx\r\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		writeRESP(w, tt.reply)
+		w.Flush()
+		if buf.String() != tt.expected {
+			t.Errorf("Expected %q, got %q", tt.expected, buf.String())
+		}
+	}
+}
+
+func TestFormatInlineNestedArray(t *testing.T) {
+	got := formatInline(Array{Array{BulkString("a"), BulkString("b")}, Integer(3)}, "")
+	expected := "1) 1) \"a\"\n   2) \"b\"\n2) (integer) 3"
+	if got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestServerRepliesInClientProtocol(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	exchanges := []struct {
+		request  string
+		expected string
+	}{
+		{encodeCommand("SET", "k", "v"), "+OK\r\n"},
+		{encodeCommand("GET", "k"), "$1\r\nv\r\n"},
+		{encodeCommand("GET", "missing"), "$-1\r\n"},
+		{encodeCommand("INCR", "n"), ":1\r\n"},
+		{encodeCommand("NOPE"), "-ERR unknown command\r\n"},
+		{"GET k\r\n", "\"v\"\n"},
+		{"INCR n\n", "(integer) 2\n"},
+		{encodeCommand("PING"), "+PONG\r\n"},
+	}
+	for _, ex := range exchanges {
+		if _, err := conn.Write([]byte(ex.request)); err != nil {
+			t.Fatalf("Failed to send command: %v", err)
+		}
+		buf := make([]byte, len(ex.expected))
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if string(buf) != ex.expected {
+			t.Errorf("Request %q: expected %q, got %q", ex.request, ex.expected, string(buf))
+		}
+	}
+}
+
+func TestServerClosesOnProtocolError(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("*1\r\n$x\r\n"))
+	resp, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if !strings.HasPrefix(resp, "-ERR Protocol error") {
+		t.Errorf("Expected protocol error reply, got %q", resp)
+	}
+}
+
+func TestSplitArgsHandlesQuotes(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected []string
+	}{
+		{`SET key value`, []string{"SET", "key", "value"}},
+		{`SET "a key" "line1\nline2"`, []string{"SET", "a key", "line1\nline2"}},
+		{`SET k "\x00\xff"`, []string{"SET", "k", "\x00\xff"}},
+		{`SET k 'it\'s raw \n'`, []string{"SET", "k", `it's raw \n`}},
+		{`SET k ""`, []string{"SET", "k", ""}},
+	}
+	for _, tt := range tests {
+		got, ok := splitArgs(tt.line)
+		if !ok || strings.Join(got, "|") != strings.Join(tt.expected, "|") || len(got) != len(tt.expected) {
+			t.Errorf("splitArgs(%q) = %q, %v; expected %q", tt.line, got, ok, tt.expected)
+		}
+	}
+	for _, bad := range []string{`SET "unterminated`, `SET "a"b`, `SET 'x`} {
+		if _, ok := splitArgs(bad); ok {
+			t.Errorf("Expected splitArgs(%q) to fail", bad)
+		}
+	}
+}
+
+func TestQuoteArgRoundTrip(t *testing.T) {
+	for _, value := range []string{"plain", "", "two  spaces", "tab\tnew\nline", "\x00\x01\xfe", `quo"te\`, "it's"} {
+		args, ok := splitArgs("SET " + quoteArg(value))
+		if !ok || len(args) != 2 || args[1] != value {
+			t.Errorf("Round trip of %q failed: %q", value, args)
+		}
+	}
+}
+
+func TestBinarySafeValues(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	key := "proto\x00key"
+	value := "{\"a\":  1,\n \"b\": \"x\r\ny\"}\x00\xff"
+	conn.Write([]byte(encodeCommand("SET", key, value)))
+	expected := "+OK\r\n"
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != expected {
+		t.Fatalf("Unexpected SET reply %q: %v", buf, err)
+	}
+
+	conn.Write([]byte(encodeCommand("GET", key)))
+	expected = "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+	buf = make([]byte, len(expected))
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != expected {
+		t.Errorf("Expected %q, got %q: %v", expected, buf, err)
+	}
+
+	// The COMPACT line must replay the exact bytes when sent inline
+	conn.Write([]byte(encodeCommand("COMPACT")))
+	header, _ := reader.ReadString('\n')
+	if header != "*1\r\n" {
+		t.Fatalf("Unexpected COMPACT header %q", header)
+	}
+	sizeLine, _ := reader.ReadString('\n')
+	size, _ := strconv.Atoi(strings.TrimSpace(sizeLine[1:]))
+	line := make([]byte, size+2)
+	io.ReadFull(reader, line)
+	args, ok := splitArgs(string(line[:size]))
+	if !ok || len(args) != 3 || args[1] != key || args[2] != value {
+		t.Errorf("COMPACT line %q does not round trip: %q", line[:size], args)
+	}
+
+	conn.Write([]byte("GET \"proto\\x00key\"\r\n"))
+	resp, _ := reader.ReadString('\n')
+	if strings.TrimSpace(resp) != reprString(value) {
+		t.Errorf("Expected inline reply %s, got %q", reprString(value), resp)
+	}
+}
+
+// testClient sends RESP commands and decodes the replies.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestServer(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *testClient) do(args ...string) Reply {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(encodeCommand(args...))); err != nil {
+		c.t.Fatalf("Failed to send %q: %v", args, err)
+	}
+	reply, err := readTestReply(c.reader)
+	if err != nil {
+		c.t.Fatalf("Failed to read reply to %q: %v", args, err)
+	}
+	return reply
+}
+
+func readTestReply(r *bufio.Reader) (Reply, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return SimpleString(line[1:]), nil
+	case '-':
+		return ErrorReply(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		return Integer(n), err
+	case '$':
+		size, _ := strconv.Atoi(line[1:])
+		if size < 0 {
+			return NullBulk{}, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return BulkString(buf[:size]), nil
+	case '*':
+		count, _ := strconv.Atoi(line[1:])
+		if count < 0 {
+			return NullArray{}, nil
+		}
+		arr := Array{}
+		for i := 0; i < count; i++ {
+			elem, err := readTestReply(r)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, elem)
+		}
+		return arr, nil
+	}
+	return nil, &ProtocolError{"unexpected reply " + line}
+}
+
+func expectReply(t *testing.T, got Reply, expected Reply) {
+	t.Helper()
+	if formatInline(got, "") != formatInline(expected, "") {
+		t.Errorf("Expected %s, got %s", formatInline(expected, ""), formatInline(got, ""))
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scripts caches the scripts run with EVAL or loaded with SCRIPT LOAD, by
+// the SHA1 of their source, so EVALSHA can run them without the source.
+type Scripts struct {
+	mutex     sync.RWMutex
+	scripts   map[string][]luaStmt // parsed chunks
+	timeLimit atomic.Int64         // milliseconds, see lua-time-limit
+}
+
+func NewScripts() *Scripts {
+	return &Scripts{scripts: make(map[string][]luaStmt)}
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// load parses source and caches it, returning its SHA1.
+func (sc *Scripts) load(source string) (string, []luaStmt, Reply) {
+	sha := sha1Hex(source)
+	if chunk, ok := sc.get(sha); ok {
+		return sha, chunk, nil
+	}
+	chunk, err := parseLua(source)
+	if err != nil {
+		return "", nil, ErrorReply("ERR Error compiling script (new function): " + err.Error())
+	}
+	sc.mutex.Lock()
+	sc.scripts[sha] = chunk
+	sc.mutex.Unlock()
+	return sha, chunk, nil
+}
+
+func (sc *Scripts) get(sha string) ([]luaStmt, bool) {
+	sc.mutex.RLock()
+	defer sc.mutex.RUnlock()
+	chunk, ok := sc.scripts[strings.ToLower(sha)]
+	return chunk, ok
+}
+
+func (sc *Scripts) count() int {
+	sc.mutex.RLock()
+	defer sc.mutex.RUnlock()
+	return len(sc.scripts)
+}
+
+func (sc *Scripts) flush() {
+	sc.mutex.Lock()
+	sc.scripts = make(map[string][]luaStmt)
+	sc.mutex.Unlock()
+}
+
+// evalCommand implements EVAL and EVALSHA. Like MOVE and FLUSHALL they run
+// with the lock of every database held, which makes the script atomic: no
+// other client runs a command until it returns.
+func (s *Server) evalCommand(c *Client, command string, args []string) Reply {
+	if len(args) < 2 {
+		return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+	}
+	var chunk []luaStmt
+	if command == "EVAL" {
+		var errReply Reply
+		if _, chunk, errReply = s.scripts.load(args[0]); errReply != nil {
+			return errReply
+		}
+	} else {
+		var ok bool
+		if chunk, ok = s.scripts.get(args[0]); !ok {
+			return ErrorReply("NOSCRIPT No matching script. Please use EVAL.")
+		}
+	}
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil {
+		return ErrorReply("ERR value is not an integer or out of range")
+	}
+	if numKeys < 0 {
+		return ErrorReply("ERR Number of keys can't be negative")
+	}
+	if numKeys > len(args)-2 {
+		return ErrorReply("ERR Number of keys can't be greater than number of args")
+	}
+	keys, argv := args[2:2+numKeys], args[2+numKeys:]
+	return s.runScript(c, chunk, keys, argv)
+}
+
+// scriptKeys returns the keys declared to EVAL or EVALSHA script numkeys
+// key... arg..., or none if numkeys is invalid.
+func scriptKeys(args []string) []string {
+	if len(args) < 2 {
+		return nil
+	}
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil || numKeys < 0 || numKeys > len(args)-2 {
+		return nil
+	}
+	return args[2 : 2+numKeys]
+}
+
+// runScript runs a parsed script for c. The commands of the script run as a
+// client of their own, which starts in the database of c and has its
+// permissions, and whose writes are propagated as one MULTI/EXEC block. A
+// script killed by lua-time-limit keeps the writes it made until then, and
+// the block holds exactly those.
+func (s *Server) runScript(c *Client, chunk []luaStmt, keys, argv []string) Reply {
+	caller := &Client{
+		conn:     scriptConn{},
+		user:     c.user,
+		master:   c.master,
+		dbIndex:  c.dbIndex,
+		inScript: true,
+		created:  time.Now(),
+		// Inside EXEC the writes are part of the transaction's block
+		scriptWrites: c.inExec,
+	}
+	it := newLuaInterp()
+	it.deadline = time.Now().Add(time.Duration(s.scripts.timeLimit.Load()) * time.Millisecond)
+	it.globals.set("KEYS", luaStrings(keys))
+	it.globals.set("ARGV", luaStrings(argv))
+	it.globals.set("redis", s.redisLibrary(caller))
+
+	values, err := it.run(chunk)
+	if caller.scriptWrites && !c.inExec {
+		s.propagate(caller.dbIndex, []string{"EXEC"})
+	}
+	var luaErr *luaError
+	switch {
+	case errors.As(err, &luaErr):
+		if t, ok := luaErr.value.(*luaTable); ok {
+			if msg, ok := t.get("err").(string); ok {
+				return ErrorReply(msg)
+			}
+		}
+		return ErrorReply("ERR " + luaErr.Error())
+	case err != nil:
+		return ErrorReply(err.Error())
+	}
+	return luaToReply(valueAt(values, 0))
+}
+
+// scriptConn is the connection of the client scripts run their commands as.
+// It has no peer: nothing is read from it and what is written is dropped.
+type scriptConn struct{}
+
+func (scriptConn) Read(b []byte) (int, error)         { return 0, io.EOF }
+func (scriptConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (scriptConn) Close() error                       { return nil }
+func (scriptConn) LocalAddr() net.Addr                { return scriptAddr{} }
+func (scriptConn) RemoteAddr() net.Addr               { return scriptAddr{} }
+func (scriptConn) SetDeadline(t time.Time) error      { return nil }
+func (scriptConn) SetReadDeadline(t time.Time) error  { return nil }
+func (scriptConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type scriptAddr struct{}
+
+func (scriptAddr) Network() string { return "lua" }
+func (scriptAddr) String() string  { return "lua" }
+
+func luaStrings(values []string) *luaTable {
+	t := newLuaTable()
+	for i, v := range values {
+		t.set(float64(i+1), v)
+	}
+	return t
+}
+
+// redisLibrary is the redis table scripts call commands and build replies
+// with.
+func (s *Server) redisLibrary(caller *Client) *luaTable {
+	call := func(name string, raise bool) *luaBuiltin {
+		return builtin(name, func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			reply := s.scriptCall(caller, args)
+			if errReply, ok := reply.(ErrorReply); ok && raise {
+				return nil, &luaError{replyToLua(errReply)}
+			}
+			return one(replyToLua(reply)), nil
+		})
+	}
+	lib := luaLibrary(
+		call("call", true),
+		call("pcall", false),
+		builtin("error_reply", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			msg, err := it.checkString("error_reply", args, 1)
+			t := newLuaTable()
+			t.set("err", msg)
+			return one(t), err
+		}),
+		builtin("status_reply", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			msg, err := it.checkString("status_reply", args, 1)
+			t := newLuaTable()
+			t.set("ok", msg)
+			return one(t), err
+		}),
+		builtin("sha1hex", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			s, err := it.checkString("sha1hex", args, 1)
+			return one(sha1Hex(s)), err
+		}),
+		builtin("log", func(it *luaInterp, args []luaValue) ([]luaValue, error) {
+			if _, err := it.checkNumber("log", args, 1); err != nil {
+				return nil, err
+			}
+			parts := make([]string, 0, len(args)-1)
+			for i := 2; i <= len(args); i++ {
+				part, err := it.checkString("log", args, i)
+				if err != nil {
+					return nil, err
+				}
+				parts = append(parts, part)
+			}
+			log.Println("Script:", strings.Join(parts, " "))
+			return nil, nil
+		}),
+	)
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		lib.hash[level] = float64(i)
+	}
+	return lib
+}
+
+// scriptCall runs a command of redis.call or redis.pcall.
+func (s *Server) scriptCall(caller *Client, args []luaValue) Reply {
+	if len(args) == 0 {
+		return ErrorReply("ERR Please specify at least one argument for this redis lib call")
+	}
+	argv := make([]string, len(args))
+	for i, arg := range args {
+		str, ok := luaToString(arg)
+		if !ok {
+			return ErrorReply("ERR Lua redis lib command arguments must be strings or integers")
+		}
+		argv[i] = str
+	}
+	command := strings.ToUpper(argv[0])
+	info, known := commandTable[command]
+	if !known {
+		return ErrorReply("ERR Unknown command called from script")
+	}
+	if info.flags&cmdNoScript != 0 {
+		return ErrorReply("ERR This command is not allowed from script")
+	}
+	return s.executeCommand(caller, command, argv[1:])
+}
+
+// replyToLua converts a command reply to the value redis.call returns.
+func replyToLua(reply Reply) luaValue {
+	switch r := reply.(type) {
+	case Integer:
+		return float64(r)
+	case BulkString:
+		return string(r)
+	case SimpleString:
+		t := newLuaTable()
+		t.set("ok", string(r))
+		return t
+	case ErrorReply:
+		t := newLuaTable()
+		t.set("err", string(r))
+		return t
+	case Array:
+		t := newLuaTable()
+		for i, item := range r {
+			t.set(float64(i+1), replyToLua(item))
+		}
+		return t
+	}
+	// Null replies become false, as nil would end an array
+	return false
+}
+
+// luaToReply converts what a script returned to the reply of EVAL. Numbers
+// are truncated to integers, and arrays end at their first nil.
+func luaToReply(v luaValue) Reply {
+	switch x := v.(type) {
+	case string:
+		return BulkString(x)
+	case float64:
+		return Integer(int64(x))
+	case bool:
+		if x {
+			return Integer(1)
+		}
+	case *luaTable:
+		if msg, ok := x.get("err").(string); ok {
+			return ErrorReply(msg)
+		}
+		if msg, ok := x.get("ok").(string); ok {
+			return SimpleString(msg)
+		}
+		items := make(Array, 0, x.length())
+		for _, item := range x.array {
+			if item == nil {
+				break
+			}
+			items = append(items, luaToReply(item))
+		}
+		return items
+	}
+	return NullBulk{}
+}
+
+// scriptCommand implements SCRIPT LOAD, SCRIPT EXISTS and SCRIPT FLUSH.
+func (s *Server) scriptCommand(args []string) Reply {
+	if len(args) == 0 {
+		return ErrorReply("ERR wrong number of arguments for 'script' command")
+	}
+	sub := strings.ToUpper(args[0])
+	wrongArgs := ErrorReply(fmt.Sprintf("ERR wrong number of arguments for 'script|%s' command", strings.ToLower(sub)))
+	switch sub {
+	case "LOAD":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		sha, _, errReply := s.scripts.load(args[1])
+		if errReply != nil {
+			return errReply
+		}
+		return BulkString(sha)
+	case "EXISTS":
+		if len(args) < 2 {
+			return wrongArgs
+		}
+		exists := make(Array, len(args)-1)
+		for i, sha := range args[1:] {
+			exists[i] = Integer(0)
+			if _, ok := s.scripts.get(sha); ok {
+				exists[i] = Integer(1)
+			}
+		}
+		return exists
+	case "FLUSH":
+		// Both modes flush synchronously
+		if len(args) > 2 || (len(args) == 2 && !strings.EqualFold(args[1], "SYNC") && !strings.EqualFold(args[1], "ASYNC")) {
+			return ErrorReply("ERR SCRIPT FLUSH only supports SYNC|ASYNC option")
+		}
+		s.scripts.flush()
+		return okReply
+	}
+	return ErrorReply(fmt.Sprintf("ERR unknown subcommand '%s'. Try SCRIPT HELP.", args[0]))
+}
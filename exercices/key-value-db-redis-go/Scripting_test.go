@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestEvalKeysArgvAndReplies(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("EVAL", "return {KEYS[1], KEYS[2], ARGV[1]}", "2", "k1", "k2", "a1"),
+		Array{BulkString("k1"), BulkString("k2"), BulkString("a1")})
+	expectReply(t, c.do("EVAL", "return 3.99", "0"), Integer(3))
+	expectReply(t, c.do("EVAL", "return true", "0"), Integer(1))
+	expectReply(t, c.do("EVAL", "return false", "0"), NullBulk{})
+	expectReply(t, c.do("EVAL", "return {1, 'two', {3}, nil, 5}", "0"), Array{Integer(1), BulkString("two"), Array{Integer(3)}})
+	expectReply(t, c.do("EVAL", "return redis.status_reply('FINE')", "0"), SimpleString("FINE"))
+	expectReply(t, c.do("EVAL", "return redis.error_reply('MYERR custom')", "0"), ErrorReply("MYERR custom"))
+
+	// redis.call converts replies to Lua values and back
+	expectReply(t, c.do("EVAL", "redis.call('SET', KEYS[1], ARGV[1]) return redis.call('GET', KEYS[1])", "1", "name", "John"), BulkString("John"))
+	expectReply(t, c.do("EVAL", "return redis.call('SET', 'n', 10)", "0"), okReply)
+	expectReply(t, c.do("EVAL", "return redis.call('INCR', 'n') + 1", "0"), Integer(12))
+	expectReply(t, c.do("EVAL", "return redis.call('GET', 'missing') == false", "0"), Integer(1))
+	expectReply(t, c.do("EVAL", "redis.call('RPUSH', 'l', 'a', 'b') return redis.call('LRANGE', 'l', 0, -1)", "0"), Array{BulkString("a"), BulkString("b")})
+
+	// Errors of redis.call abort the script, redis.pcall returns them
+	expectReply(t, c.do("EVAL", "redis.call('INCR', 'name') return 'unreached'", "0"), ErrorReply("ERR value is not an integer or out of range"))
+	expectReply(t, c.do("EVAL", "local r = redis.pcall('INCR', 'name') return r.err", "0"), BulkString("ERR value is not an integer or out of range"))
+	expectReply(t, c.do("EVAL", "return redis.call('NOPE')", "0"), ErrorReply("ERR Unknown command called from script"))
+	expectReply(t, c.do("EVAL", "return redis.call('MULTI')", "0"), ErrorReply("ERR This command is not allowed from script"))
+	// The commands of a script run as a client of their own
+	if info, _ := c.do("EVAL", "return redis.call('CLIENT', 'INFO')", "0").(BulkString); !strings.Contains(string(info), " addr=lua laddr=lua ") {
+		t.Errorf("Expected CLIENT INFO to describe the script client, got %q", info)
+	}
+	if list, _ := c.do("EVAL", "return redis.call('CLIENT', 'LIST')", "0").(BulkString); !strings.Contains(string(list), " cmd=eval ") {
+		t.Errorf("Expected CLIENT LIST to show the caller, got %q", list)
+	}
+	expectReply(t, c.do("EVAL", "return redis.call('CLIENT', 'KILL', '127.0.0.1:1')", "0"), ErrorReply("ERR No such client"))
+	expectReply(t, c.do("EVAL", "return redis.call('GET', {})", "0"), ErrorReply("ERR Lua redis lib command arguments must be strings or integers"))
+	expectReply(t, c.do("EVAL", "error('boom')", "0"), ErrorReply("ERR user_script:1: boom"))
+	expectReply(t, c.do("EVAL", "return undefined", "0"), ErrorReply("ERR user_script:1: Script attempted to access nonexistent global variable 'undefined'"))
+
+	expectReply(t, c.do("EVAL", "return 1 +", "0"), ErrorReply("ERR Error compiling script (new function): user_script:1: unexpected symbol near '<eof>'"))
+	expectReply(t, c.do("EVAL", "return 1", "x"), ErrorReply("ERR value is not an integer or out of range"))
+	expectReply(t, c.do("EVAL", "return 1", "-1"), ErrorReply("ERR Number of keys can't be negative"))
+	expectReply(t, c.do("EVAL", "return 1", "2", "k"), ErrorReply("ERR Number of keys can't be greater than number of args"))
+	expectReply(t, c.do("EVAL", "return 1"), ErrorReply("ERR wrong number of arguments for 'eval' command"))
+
+	// SELECT inside a script does not change the database of the caller
+	expectReply(t, c.do("EVAL", "redis.call('SELECT', 3) return redis.call('SET', 'k', 'in-3')", "0"), okReply)
+	expectReply(t, c.do("GET", "k"), NullBulk{})
+	c.do("SELECT", "3")
+	expectReply(t, c.do("GET", "k"), BulkString("in-3"))
+}
+
+func TestEvalShaAndScriptCommands(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	script := "return redis.call('INCR', KEYS[1])"
+	sha := sha1Hex(script)
+	expectReply(t, c.do("EVALSHA", sha, "1", "counter"), ErrorReply("NOSCRIPT No matching script. Please use EVAL."))
+	expectReply(t, c.do("SCRIPT", "LOAD", script), BulkString(sha))
+	expectReply(t, c.do("EVALSHA", sha, "1", "counter"), Integer(1))
+	expectReply(t, c.do("EVALSHA", strings.ToUpper(sha), "1", "counter"), Integer(2))
+	expectReply(t, c.do("EVAL", "return redis.sha1hex(ARGV[1])", "0", script), BulkString(sha))
+
+	// EVAL caches the scripts it runs
+	c.do("EVAL", "return 'cached'", "0")
+	expectReply(t, c.do("SCRIPT", "EXISTS", sha, sha1Hex("return 'cached'"), "ffff"), Array{Integer(1), Integer(1), Integer(0)})
+	if cached := infoField(t, c, "memory", "number_of_cached_scripts"); cached != "3" {
+		t.Errorf("Expected 3 cached scripts, got %s", cached)
+	}
+	expectReply(t, c.do("SCRIPT", "FLUSH"), okReply)
+	expectReply(t, c.do("SCRIPT", "EXISTS", sha), Array{Integer(0)})
+	expectReply(t, c.do("SCRIPT", "LOAD", "return +"), ErrorReply("ERR Error compiling script (new function): user_script:1: unexpected symbol near '+'"))
+	expectReply(t, c.do("SCRIPT", "FLUSH", "LATER"), ErrorReply("ERR SCRIPT FLUSH only supports SYNC|ASYNC option"))
+	expectReply(t, c.do("SCRIPT", "NOPE"), ErrorReply("ERR unknown subcommand 'NOPE'. Try SCRIPT HELP."))
+	expectReply(t, c.do("SCRIPT", "LOAD"), ErrorReply("ERR wrong number of arguments for 'script|load' command"))
+
+	c.do("MULTI")
+	expectReply(t, c.do("EVAL", "return redis.call('INCR', KEYS[1])", "1", "counter"), SimpleString("QUEUED"))
+	expectReply(t, c.do("EVAL", "return 1", "0"), SimpleString("QUEUED"))
+	expectReply(t, c.do("EXEC"), Array{Integer(3), Integer(1)})
+}
+
+// Scripts run atomically: no other client sees the key between the reads and
+// the writes of a script.
+func TestEvalIsAtomic(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	setup := dialTestServer(t, addr)
+	setup.do("SET", "counter", "0")
+
+	const workers, rounds = 4, 50
+	script := "local v = tonumber(redis.call('GET', KEYS[1])) redis.call('SET', KEYS[1], v + 1) return v + 1"
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		c := dialTestServer(t, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				c.do("EVAL", script, "1", "counter")
+				c.do("INCR", "counter")
+			}
+		}()
+	}
+	wg.Wait()
+	expectReply(t, setup.do("GET", "counter"), BulkString(strconv.Itoa(2*workers*rounds)))
+}
+
+func TestEvalRespectsACLs(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+	c.do("ACL", "SETUSER", "app", "on", "nopass", "+@scripting", "+get", "~app:*")
+	c.do("AUTH", "app", "any")
+
+	expectReply(t, c.do("EVAL", "return redis.call('GET', 'app:1')", "0"), NullBulk{})
+	expectReply(t, c.do("EVAL", "return redis.call('GET', 'other')", "0"), ErrorReply("NOPERM No permissions to access a key"))
+	expectReply(t, c.do("EVAL", "return redis.call('SET', 'app:1', 'v')", "0"), ErrorReply("NOPERM User app has no permissions to run the 'set' command"))
+}
+
+// The writes of a script are logged as one transaction, and reads are not
+// logged at all. A script that fails or is killed keeps the writes it made
+// before, and so does the log.
+func TestEvalPropagatesEffects(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	srv, c := startServerWithAOF(t, path)
+
+	c.do("EVAL", "redis.call('SET', 'a', '1') redis.call('SELECT', 2) redis.call('SET', 'b', '2')", "0")
+	c.do("EVAL", "return redis.call('GET', 'a')", "0")
+	expectReply(t, c.do("EVAL", "redis.call('SET', 'c', '3') error('after the write')", "0"), ErrorReply("ERR user_script:1: after the write"))
+	expectReply(t, c.do("CONFIG", "SET", "lua-time-limit", "50"), okReply)
+	expectReply(t, c.do("EVAL", "redis.call('SET', 'd', '4') while true do end", "0"), ErrorReply("ERR Script killed by timeout"))
+	expectReply(t, c.do("GET", "d"), BulkString("4"))
+	// Inside a transaction the writes of a script are part of its block
+	c.do("MULTI")
+	c.do("SET", "e", "5")
+	c.do("EVAL", "redis.call('SET', 'f', '6')", "0")
+	c.do("EXEC")
+	srv.aof.close()
+
+	content, _ := os.ReadFile(path)
+	if strings.Contains(string(content), "EVAL") || strings.Contains(string(content), "GET") {
+		t.Errorf("Expected only the effects of scripts to be logged:\n%q", content)
+	}
+	if multi, exec := strings.Count(string(content), "MULTI"), strings.Count(string(content), "EXEC"); multi != 4 || exec != 4 {
+		t.Errorf("Expected each writing script and the transaction in one block, got %d MULTI and %d EXEC:\n%q", multi, exec, content)
+	}
+
+	_, c2 := startServerWithAOF(t, path)
+	expectReply(t, c2.do("MGET", "a", "c", "d", "e", "f"), Array{BulkString("1"), BulkString("3"), BulkString("4"), BulkString("5"), BulkString("6")})
+	c2.do("SELECT", "2")
+	expectReply(t, c2.do("GET", "b"), BulkString("2"))
+}
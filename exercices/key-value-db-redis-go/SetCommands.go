@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// setCommand implements SADD, SREM, SMEMBERS, SISMEMBER, SINTER and SUNION.
+func setCommand(db *Database, command string, args []string) Reply {
+	switch command {
+	case "SADD", "SREM":
+		if len(args) < 2 {
+			return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+		}
+		set, exists, errReply := lookupAs[SetValue](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		if command == "SREM" {
+			if !exists {
+				return Integer(0)
+			}
+			removed := 0
+			for _, m := range args[1:] {
+				if _, ok := set[m]; ok {
+					delete(set, m)
+					removed++
+				}
+			}
+			if len(set) == 0 {
+				db.deleteKey(args[0])
+			} else if removed > 0 {
+				db.touch(args[0])
+			}
+			return Integer(removed)
+		}
+		if !exists {
+			set = SetValue{}
+			db.set(args[0], set)
+		}
+		added := 0
+		for _, m := range args[1:] {
+			if _, ok := set[m]; !ok {
+				set[m] = struct{}{}
+				added++
+			}
+		}
+		if added > 0 {
+			db.touch(args[0])
+		}
+		return Integer(added)
+	case "SMEMBERS":
+		if len(args) != 1 {
+			return ErrorReply("ERR wrong number of arguments for 'smembers' command")
+		}
+		set, _, errReply := lookupAs[SetValue](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		return stringsToArray(set.members())
+	case "SISMEMBER":
+		if len(args) != 2 {
+			return ErrorReply("ERR wrong number of arguments for 'sismember' command")
+		}
+		set, _, errReply := lookupAs[SetValue](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		if _, ok := set[args[1]]; ok {
+			return Integer(1)
+		}
+		return Integer(0)
+	case "SINTER", "SUNION":
+		if len(args) < 1 {
+			return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+		}
+		sets := make([]SetValue, len(args))
+		for i, key := range args {
+			set, _, errReply := lookupAs[SetValue](db, key)
+			if errReply != nil {
+				return errReply
+			}
+			sets[i] = set
+		}
+		result := SetValue{}
+		if command == "SUNION" {
+			for _, set := range sets {
+				for m := range set {
+					result[m] = struct{}{}
+				}
+			}
+			return stringsToArray(result.members())
+		}
+		for m := range sets[0] {
+			inAll := true
+			for _, other := range sets[1:] {
+				if _, ok := other[m]; !ok {
+					inAll = false
+					break
+				}
+			}
+			if inAll {
+				result[m] = struct{}{}
+			}
+		}
+		return stringsToArray(result.members())
+	}
+	return ErrorReply("ERR unknown command")
+}
+
+func stringsToArray(values []string) Array {
+	result := make(Array, len(values))
+	for i, v := range values {
+		result[i] = BulkString(v)
+	}
+	return result
+}
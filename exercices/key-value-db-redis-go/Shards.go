@@ -0,0 +1,197 @@
+package main
+
+import (
+	"hash/maphash"
+	"math/rand"
+	"sync"
+)
+
+// shardCount is the number of shards a database is split into. A command only
+// locks the shards of the keys it touches, so clients working on different
+// keys rarely wait for each other.
+const shardCount = 16
+
+// shardSeed differs from keyIndexSeed so that the keys of a shard still
+// spread over the buckets of its index.
+var shardSeed = maphash.MakeSeed()
+
+// shard holds the keys of a database that hash to it, and everything kept
+// per key. Its mutex guards all of it.
+type shard struct {
+	mutex    sync.RWMutex
+	data     map[string]interface{}
+	expires  map[string]int64 // unix milliseconds after which a key is gone
+	watchers map[string]map[*Client]struct{}
+	blocked  map[string][]*blockedClient // clients in BLPOP and the like, oldest first
+	dirty    uint64                      // number of modifications, see touch
+
+	stats map[string]*keyStats // size and access history, see updateStats
+	index *keyIndex            // the keys in a form SCAN can resume
+}
+
+func newShard() *shard {
+	return &shard{
+		data:     make(map[string]interface{}),
+		expires:  make(map[string]int64),
+		watchers: make(map[string]map[*Client]struct{}),
+		blocked:  make(map[string][]*blockedClient),
+		stats:    make(map[string]*keyStats),
+		index:    newKeyIndex(),
+	}
+}
+
+func shardIndex(key string) int {
+	return int(maphash.String(shardSeed, key) % shardCount)
+}
+
+func (db *Database) shardOf(key string) *shard {
+	return db.shards[shardIndex(key)]
+}
+
+// shardSet is a set of shard indexes. Locks are always taken in index order,
+// databases first and then shards, so commands never deadlock.
+type shardSet uint32
+
+const allShards shardSet = 1<<shardCount - 1
+
+// keyShards returns the shards of keys.
+func keyShards(keys []string) shardSet {
+	var set shardSet
+	for _, key := range keys {
+		set |= 1 << shardIndex(key)
+	}
+	return set
+}
+
+// commandShards returns the shards a command runs on: those of its keys, or
+// every shard for commands such as KEYS and FLUSHDB that have none.
+func commandShards(command string, args []string) shardSet {
+	if keys := commandKeys(command, args); len(keys) > 0 {
+		return keyShards(keys)
+	}
+	return allShards
+}
+
+func (db *Database) lock(set shardSet) {
+	for i, sh := range db.shards {
+		if set&(1<<i) != 0 {
+			sh.mutex.Lock()
+		}
+	}
+}
+
+func (db *Database) unlock(set shardSet) {
+	for i, sh := range db.shards {
+		if set&(1<<i) != 0 {
+			sh.mutex.Unlock()
+		}
+	}
+}
+
+func (db *Database) rlock(set shardSet) {
+	for i, sh := range db.shards {
+		if set&(1<<i) != 0 {
+			sh.mutex.RLock()
+		}
+	}
+}
+
+func (db *Database) runlock(set shardSet) {
+	for i, sh := range db.shards {
+		if set&(1<<i) != 0 {
+			sh.mutex.RUnlock()
+		}
+	}
+}
+
+// dirtyCount sums the modifications of the shards in set, which the caller
+// holds at least the read lock of.
+func (db *Database) dirtyCount(set shardSet) uint64 {
+	var dirty uint64
+	for i, sh := range db.shards {
+		if set&(1<<i) != 0 {
+			dirty += sh.dirty
+		}
+	}
+	return dirty
+}
+
+// value returns the value of key, expired or not, without counting a hit.
+// Caller holds at least the read lock of the key's shard.
+func (db *Database) value(key string) (interface{}, bool) {
+	v, exists := db.shardOf(key).data[key]
+	return v, exists
+}
+
+// deadline returns when key expires, if it does. Caller holds at least the
+// read lock of the key's shard.
+func (db *Database) deadline(key string) (int64, bool) {
+	deadline, ok := db.shardOf(key).expires[key]
+	return deadline, ok
+}
+
+// setDeadline and removeDeadline change when key expires. The caller touches
+// the key and holds the write lock of its shard.
+func (db *Database) setDeadline(key string, deadline int64) {
+	db.shardOf(key).expires[key] = deadline
+}
+
+func (db *Database) removeDeadline(key string) {
+	delete(db.shardOf(key).expires, key)
+}
+
+// size returns the number of keys. Caller holds at least the read lock of
+// every shard.
+func (db *Database) size() int {
+	n := 0
+	for _, sh := range db.shards {
+		n += len(sh.data)
+	}
+	return n
+}
+
+// sizes counts the keys and the keys that expire, locking one shard at a
+// time.
+func (db *Database) sizes() (keys, expires int) {
+	for _, sh := range db.shards {
+		sh.mutex.RLock()
+		keys += len(sh.data)
+		expires += len(sh.expires)
+		sh.mutex.RUnlock()
+	}
+	return keys, expires
+}
+
+// scan walks the key index of each shard in turn. The low bits of the
+// cursor select the shard and the others the bucket in its index. Caller
+// holds at least the read lock of every shard.
+func (db *Database) scan(cursor uint64, visit func(key string)) uint64 {
+	i, bucket := cursor%shardCount, cursor/shardCount
+	next := db.shards[i].index.scan(bucket, visit)
+	if next == 0 {
+		if i++; i == shardCount {
+			return 0
+		}
+	}
+	return next*shardCount + i
+}
+
+// randomKey returns a random key, or false when the database is empty.
+// Caller holds at least the read lock of every shard.
+func (db *Database) randomKey() (string, bool) {
+	total := 0
+	for _, sh := range db.shards {
+		total += sh.index.count
+	}
+	if total == 0 {
+		return "", false
+	}
+	n := rand.Intn(total)
+	for _, sh := range db.shards {
+		if n < sh.index.count {
+			return sh.index.random()
+		}
+		n -= sh.index.count
+	}
+	return "", false
+}
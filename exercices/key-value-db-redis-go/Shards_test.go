@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestScanVisitsEveryShard(t *testing.T) {
+	db := NewDatabase()
+	for i := 0; i < 1000; i++ {
+		db.set("key:"+strconv.Itoa(i), "v")
+	}
+	seen := make(map[string]bool)
+	cursor, calls := uint64(0), 0
+	for {
+		cursor = db.scan(cursor, func(key string) { seen[key] = true })
+		calls++
+		if cursor == 0 {
+			break
+		}
+		if calls > 100000 {
+			t.Fatal("Expected the scan to finish")
+		}
+	}
+	if len(seen) != 1000 {
+		t.Errorf("Expected every key to be visited, got %d", len(seen))
+	}
+}
+
+func TestRandomKeyAcrossShards(t *testing.T) {
+	db := NewDatabase()
+	if _, ok := db.randomKey(); ok {
+		t.Fatal("Expected no random key in an empty database")
+	}
+	for i := 0; i < 100; i++ {
+		db.set("key:"+strconv.Itoa(i), "v")
+	}
+	seen := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		key, ok := db.randomKey()
+		if !ok {
+			t.Fatal("Expected a random key")
+		}
+		seen[shardIndex(key)] = true
+	}
+	if len(seen) < shardCount/2 {
+		t.Errorf("Expected random keys from most shards, got %d", len(seen))
+	}
+}
+
+// Commands on keys of different shards run in parallel, while those sharing
+// a key, multi-key commands and transactions must not interleave.
+func TestConcurrentCommandsStayConsistent(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	setup := dialTestServer(t, addr)
+	setup.do("SET", "total", "0")
+
+	const workers, rounds = 8, 100
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		c := dialTestServer(t, addr)
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			own := "own:" + strconv.Itoa(w)
+			for i := 0; i < rounds; i++ {
+				c.do("INCR", "shared")
+				c.do("INCR", own)
+				// The set moves between two keys but always exists under one
+				c.do("MULTI")
+				c.do("SADD", "from:"+strconv.Itoa(w), strconv.Itoa(i))
+				c.do("RENAME", "from:"+strconv.Itoa(w), "to:"+strconv.Itoa(w))
+				c.do("RENAME", "to:"+strconv.Itoa(w), "from:"+strconv.Itoa(w))
+				c.do("INCR", "total")
+				c.do("EXEC")
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	expectReply(t, setup.do("GET", "shared"), BulkString(strconv.Itoa(workers*rounds)))
+	expectReply(t, setup.do("GET", "total"), BulkString(strconv.Itoa(workers*rounds)))
+	for w := 0; w < workers; w++ {
+		expectReply(t, setup.do("GET", "own:"+strconv.Itoa(w)), BulkString(strconv.Itoa(rounds)))
+		members, _ := setup.do("SMEMBERS", "from:"+strconv.Itoa(w)).(Array)
+		if len(members) != rounds {
+			t.Errorf("Expected %d members for worker %d, got %d", rounds, w, len(members))
+		}
+	}
+	expectReply(t, setup.do("DBSIZE"), Integer(2+2*workers))
+}
+
+// keysInShards returns n keys that hash to the first shards shards.
+func keysInShards(n, shards int) []string {
+	keys := make([]string, 0, n)
+	for i := 0; len(keys) < n; i++ {
+		key := "key:" + strconv.Itoa(i)
+		if shardIndex(key) < shards {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// benchmarkMixed runs GET and SET from parallel clients, writePercent of
+// them SET, over keys that hash to the given number of shards. With a single
+// shard every write waits for every other command, like a database with one
+// lock.
+func benchmarkMixed(b *testing.B, shards, writePercent int) {
+	srv := NewServer()
+	keys := keysInShards(10000, shards)
+	loader := &Client{master: true}
+	for _, key := range keys {
+		srv.executeCommand(loader, "SET", []string{key, "value"})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		c := &Client{user: srv.acl.defaultLogin()}
+		rng := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			key := keys[rng.Intn(len(keys))]
+			var reply Reply
+			if rng.Intn(100) < writePercent {
+				reply = srv.executeCommand(c, "SET", []string{key, "value"})
+			} else {
+				reply = srv.executeCommand(c, "GET", []string{key})
+			}
+			if _, ok := reply.(ErrorReply); ok {
+				b.Fatalf("Unexpected reply %v", reply)
+			}
+		}
+	})
+}
+
+func BenchmarkParallelMixed(b *testing.B) {
+	for _, writes := range []int{10, 50} {
+		b.Run(fmt.Sprintf("writes=%d%%/shards=%d", writes, shardCount), func(b *testing.B) {
+			benchmarkMixed(b, shardCount, writes)
+		})
+		b.Run(fmt.Sprintf("writes=%d%%/shards=1", writes), func(b *testing.B) {
+			benchmarkMixed(b, 1, writes)
+		})
+	}
+}
+
+// BenchmarkParallelMultiKey mixes single key writes with MULTI/EXEC, which
+// locks every shard, and RENAME, which locks the shards of two keys.
+func BenchmarkParallelMultiKey(b *testing.B) {
+	srv := NewServer()
+	b.RunParallel(func(pb *testing.PB) {
+		c := &Client{user: srv.acl.defaultLogin()}
+		rng := rand.New(rand.NewSource(rand.Int63()))
+		for i := 0; pb.Next(); i++ {
+			key := "key:" + strconv.Itoa(rng.Intn(10000))
+			switch i % 10 {
+			case 0:
+				srv.executeCommand(c, "MULTI", nil)
+				srv.executeCommand(c, "INCR", []string{key})
+				srv.executeCommand(c, "INCR", []string{"counter"})
+				srv.executeCommand(c, "EXEC", nil)
+			case 1:
+				srv.executeCommand(c, "SET", []string{key, "value"})
+				srv.executeCommand(c, "RENAME", []string{key, key + ":renamed"})
+			default:
+				srv.executeCommand(c, "INCR", []string{key})
+			}
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Long commands are shortened in the slow log like Redis does.
+	slowlogMaxArgs   = 32
+	slowlogMaxArgLen = 128
+)
+
+type slowlogEntry struct {
+	id       int64
+	time     int64 // unix seconds
+	duration int64 // microseconds
+	args     []string
+	addr     string
+	name     string
+}
+
+// Slowlog keeps the latest commands that ran longer than a threshold.
+type Slowlog struct {
+	mutex   sync.Mutex
+	entries []slowlogEntry // oldest first
+	nextID  int64
+
+	threshold atomic.Int64 // microseconds, negative to log nothing
+	maxLen    atomic.Int64
+}
+
+func NewSlowlog(threshold, maxLen int64) *Slowlog {
+	l := &Slowlog{}
+	l.threshold.Store(threshold)
+	l.maxLen.Store(maxLen)
+	return l
+}
+
+// record logs a command that took duration if it is over the threshold.
+func (l *Slowlog) record(c *Client, args []string, duration time.Duration) {
+	threshold := l.threshold.Load()
+	micros := duration.Microseconds()
+	if threshold < 0 || micros < threshold {
+		return
+	}
+	entry := slowlogEntry{
+		time:     time.Now().Unix(),
+		duration: micros,
+		args:     shortenArgs(redactArgs(args)),
+		addr:     c.addr(),
+	}
+	c.info.mutex.Lock()
+	entry.name = c.info.name
+	c.info.mutex.Unlock()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	entry.id = l.nextID
+	l.nextID++
+	l.entries = append(l.entries, entry)
+	l.trim()
+}
+
+// trim drops the oldest entries beyond maxLen. Caller holds the mutex.
+func (l *Slowlog) trim() {
+	if maxLen := int(l.maxLen.Load()); len(l.entries) > maxLen {
+		l.entries = append([]slowlogEntry(nil), l.entries[len(l.entries)-maxLen:]...)
+	}
+}
+
+func (l *Slowlog) setMaxLen(maxLen int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.maxLen.Store(maxLen)
+	l.trim()
+}
+
+func shortenArgs(args []string) []string {
+	n := len(args)
+	if n > slowlogMaxArgs {
+		n = slowlogMaxArgs - 1
+	}
+	short := make([]string, n, n+1)
+	for i, arg := range args[:n] {
+		if len(arg) > slowlogMaxArgLen {
+			arg = fmt.Sprintf("%s... (%d more bytes)", arg[:slowlogMaxArgLen], len(arg)-slowlogMaxArgLen)
+		}
+		short[i] = arg
+	}
+	if n < len(args) {
+		short = append(short, fmt.Sprintf("... (%d more arguments)", len(args)-n))
+	}
+	return short
+}
+
+// slowlogCommand implements SLOWLOG GET [count], SLOWLOG LEN and SLOWLOG
+// RESET.
+func (s *Server) slowlogCommand(args []string) Reply {
+	if len(args) == 0 {
+		return ErrorReply("ERR wrong number of arguments for 'slowlog' command")
+	}
+	l := s.slowlog
+	sub := strings.ToUpper(args[0])
+	wrongArgs := ErrorReply(fmt.Sprintf("ERR wrong number of arguments for 'slowlog|%s' command", strings.ToLower(sub)))
+	switch sub {
+	case "GET":
+		if len(args) > 2 {
+			return wrongArgs
+		}
+		count := 10
+		if len(args) == 2 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < -1 {
+				return ErrorReply("ERR count should be greater than or equal to -1")
+			}
+			count = n
+		}
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		if count == -1 || count > len(l.entries) {
+			count = len(l.entries)
+		}
+		reply := make(Array, 0, count)
+		for i := len(l.entries) - 1; i >= len(l.entries)-count; i-- {
+			entry := l.entries[i]
+			command := make(Array, len(entry.args))
+			for j, arg := range entry.args {
+				command[j] = BulkString(arg)
+			}
+			reply = append(reply, Array{
+				Integer(entry.id), Integer(entry.time), Integer(entry.duration),
+				command, BulkString(entry.addr), BulkString(entry.name),
+			})
+		}
+		return reply
+	case "LEN":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		return Integer(len(l.entries))
+	case "RESET":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.entries = nil
+		return okReply
+	}
+	return ErrorReply(fmt.Sprintf("ERR unknown subcommand '%s'. Try SLOWLOG HELP.", args[0]))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSlowlog(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("SLOWLOG", "LEN"), Integer(0))
+	expectReply(t, c.do("CONFIG", "SET", "slowlog-log-slower-than", "0"), SimpleString("OK"))
+	c.do("CLIENT", "SETNAME", "slow-client")
+	c.do("SET", "key", strings.Repeat("x", 200))
+	c.do("AUTH", "secret")
+
+	entries, ok := c.do("SLOWLOG", "GET", "2").(Array)
+	if !ok || len(entries) != 2 {
+		t.Fatalf("Expected two entries, got %v", entries)
+	}
+	// Newest first, with passwords redacted and long arguments shortened
+	expectReply(t, entries[0].(Array)[3], Array{BulkString("AUTH"), BulkString("(redacted)")})
+	set := entries[1].(Array)
+	expectReply(t, set[3], Array{BulkString("SET"), BulkString("key"), BulkString(strings.Repeat("x", 128) + "... (72 more bytes)")})
+	if id0, id1 := entries[0].(Array)[0].(Integer), set[0].(Integer); id0 != id1+1 {
+		t.Errorf("Expected increasing ids, got %d and %d", id1, id0)
+	}
+	if set[4] != BulkString(c.conn.LocalAddr().String()) || set[5] != BulkString("slow-client") {
+		t.Errorf("Expected the client address and name, got %v and %v", set[4], set[5])
+	}
+
+	expectReply(t, c.do("CONFIG", "SET", "slowlog-max-len", "2"), SimpleString("OK"))
+	expectReply(t, c.do("SLOWLOG", "LEN"), Integer(2))
+	expectReply(t, c.do("SLOWLOG", "RESET"), SimpleString("OK"))
+	// The RESET itself was slow enough to be logged
+	expectReply(t, c.do("SLOWLOG", "LEN"), Integer(1))
+	expectReply(t, c.do("SLOWLOG", "GET", "-2"), ErrorReply("ERR count should be greater than or equal to -1"))
+	expectReply(t, c.do("SLOWLOG", "NOPE"), ErrorReply("ERR unknown subcommand 'NOPE'. Try SLOWLOG HELP."))
+
+	expectReply(t, c.do("CONFIG", "SET", "slowlog-log-slower-than", "-1"), SimpleString("OK"))
+	c.do("SLOWLOG", "RESET")
+	c.do("GET", "key")
+	expectReply(t, c.do("SLOWLOG", "LEN"), Integer(0))
+}
+
+func TestSlowlogShortensManyArguments(t *testing.T) {
+	args := make([]string, 40)
+	for i := range args {
+		args[i] = "a"
+	}
+	short := shortenArgs(args)
+	if len(short) != slowlogMaxArgs || short[slowlogMaxArgs-1] != "... (9 more arguments)" {
+		t.Errorf("Unexpected shortened arguments %q", short)
+	}
+}
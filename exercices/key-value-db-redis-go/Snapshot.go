@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Snapshot file layout:
+//
+//	"KVSNAP" | version uint16
+//	records: opSelectDB uvarint(db)
+//	         [opExpireMs int64(deadline)] opString string(key) string(value)
+//	         [opExpireMs int64(deadline)] opList|opSet string(key) uvarint(n) n*string
+//	         [opExpireMs int64(deadline)] opHash string(key) uvarint(n) n*(string string)
+//	         [opExpireMs int64(deadline)] opZSet string(key) uvarint(n) n*(string float64)
+//	opEOF | crc64(everything before the checksum) uint64
+//
+// Integers and floats are little endian and strings are uvarint length
+// prefixed.
+const (
+	snapshotMagic   = "KVSNAP"
+	snapshotVersion = 2
+
+	opString   = 0x00
+	opList     = 0x01
+	opSet      = 0x02
+	opZSet     = 0x03
+	opHash     = 0x04
+	opExpireMs = 0xFC
+	opSelectDB = 0xFE
+	opEOF      = 0xFF
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+var errSaveInProgress = errors.New("Background save already in progress")
+
+type snapshotEntry struct {
+	key      string
+	value    interface{}
+	deadline int64
+}
+
+// captureSnapshot copies the dataset while holding every read lock, so the
+// snapshot is a single point in time. Readers keep running and writers only
+// wait for the copy, not for the encoding and the disk writes. Collections are
+// cloned because writers modify them in place.
+func (s *Server) captureSnapshot() [][]snapshotEntry {
+	dbs := make([][]snapshotEntry, len(s.databases))
+	for _, db := range s.databases {
+		db.rlock(allShards)
+	}
+	for i, db := range s.databases {
+		entries := make([]snapshotEntry, 0, db.size())
+		for _, sh := range db.shards {
+			for k, v := range sh.data {
+				if sh.isExpired(k) {
+					continue
+				}
+				entries = append(entries, snapshotEntry{key: k, value: cloneValue(v), deadline: sh.expires[k]})
+			}
+		}
+		dbs[i] = entries
+	}
+	for _, db := range s.databases {
+		db.runlock(allShards)
+	}
+	return dbs
+}
+
+func writeSnapshot(w io.Writer, dbs [][]snapshotEntry) error {
+	hash := crc64.New(crcTable)
+	bw := bufio.NewWriter(io.MultiWriter(w, hash))
+	var scratch [binary.MaxVarintLen64]byte
+	writeUvarint := func(n uint64) {
+		bw.Write(scratch[:binary.PutUvarint(scratch[:], n)])
+	}
+	writeString := func(str string) {
+		writeUvarint(uint64(len(str)))
+		bw.WriteString(str)
+	}
+
+	bw.WriteString(snapshotMagic)
+	binary.Write(bw, binary.LittleEndian, uint16(snapshotVersion))
+	for i, entries := range dbs {
+		if len(entries) == 0 {
+			continue
+		}
+		bw.WriteByte(opSelectDB)
+		writeUvarint(uint64(i))
+		for _, e := range entries {
+			if e.deadline != 0 {
+				bw.WriteByte(opExpireMs)
+				binary.Write(bw, binary.LittleEndian, e.deadline)
+			}
+			switch v := e.value.(type) {
+			case string:
+				bw.WriteByte(opString)
+				writeString(e.key)
+				writeString(v)
+			case *ListValue:
+				bw.WriteByte(opList)
+				writeString(e.key)
+				writeUvarint(uint64(v.len()))
+				for i := 0; i < v.len(); i++ {
+					writeString(v.at(i))
+				}
+			case SetValue:
+				bw.WriteByte(opSet)
+				writeString(e.key)
+				writeUvarint(uint64(len(v)))
+				for m := range v {
+					writeString(m)
+				}
+			case HashValue:
+				bw.WriteByte(opHash)
+				writeString(e.key)
+				writeUvarint(uint64(len(v)))
+				for f, fv := range v {
+					writeString(f)
+					writeString(fv)
+				}
+			case *SortedSetValue:
+				bw.WriteByte(opZSet)
+				writeString(e.key)
+				writeUvarint(uint64(v.len()))
+				for _, ze := range v.sorted {
+					writeString(ze.member)
+					binary.Write(bw, binary.LittleEndian, math.Float64bits(ze.score))
+				}
+			}
+		}
+	}
+	bw.WriteByte(opEOF)
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, hash.Sum64())
+}
+
+func readSnapshot(data []byte) ([][]snapshotEntry, error) {
+	var dbs [][]snapshotEntry
+	header := len(snapshotMagic) + 2
+	if len(data) < header+9 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return dbs, errors.New("not a snapshot file")
+	}
+	version := binary.LittleEndian.Uint16(data[len(snapshotMagic):header])
+	if version != snapshotVersion {
+		return dbs, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	body, sum := data[:len(data)-8], binary.LittleEndian.Uint64(data[len(data)-8:])
+	if crc64.Checksum(body, crcTable) != sum {
+		return dbs, errors.New("snapshot checksum mismatch")
+	}
+
+	r := bytes.NewReader(body[header:])
+	readString := func() (string, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return "", errors.New("bad string length")
+		}
+		buf := make([]byte, n)
+		r.Read(buf)
+		return string(buf), nil
+	}
+	readCount := func() (int, error) {
+		n, err := binary.ReadUvarint(r)
+		// Every element takes at least one byte
+		if err != nil || n > uint64(r.Len()) {
+			return 0, errors.New("bad element count")
+		}
+		return int(n), nil
+	}
+	dbIndex := 0
+	var deadline int64
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return dbs, errors.New("snapshot ends without EOF marker")
+		}
+		switch op {
+		case opEOF:
+			return dbs, nil
+		case opSelectDB:
+			n, err := binary.ReadUvarint(r)
+			if err != nil || n >= maxDBCount {
+				return dbs, fmt.Errorf("bad database index %d", n)
+			}
+			dbIndex = int(n)
+		case opExpireMs:
+			if err := binary.Read(r, binary.LittleEndian, &deadline); err != nil {
+				return dbs, err
+			}
+		case opString, opList, opSet, opHash, opZSet:
+			key, err := readString()
+			if err != nil {
+				return dbs, err
+			}
+			value, err := readSnapshotValue(op, readString, readCount, r)
+			if err != nil {
+				return dbs, err
+			}
+			for len(dbs) <= dbIndex {
+				dbs = append(dbs, nil)
+			}
+			dbs[dbIndex] = append(dbs[dbIndex], snapshotEntry{key: key, value: value, deadline: deadline})
+			deadline = 0
+		default:
+			return dbs, fmt.Errorf("unknown snapshot opcode 0x%02x", op)
+		}
+	}
+}
+
+func readSnapshotValue(op byte, readString func() (string, error), readCount func() (int, error), r *bytes.Reader) (interface{}, error) {
+	if op == opString {
+		return readString()
+	}
+	n, err := readCount()
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case opList:
+		list := &ListValue{}
+		for i := 0; i < n; i++ {
+			v, err := readString()
+			if err != nil {
+				return nil, err
+			}
+			list.pushBack(v)
+		}
+		return list, nil
+	case opSet:
+		set := make(SetValue, n)
+		for i := 0; i < n; i++ {
+			m, err := readString()
+			if err != nil {
+				return nil, err
+			}
+			set[m] = struct{}{}
+		}
+		return set, nil
+	case opHash:
+		hash := make(HashValue, n)
+		for i := 0; i < n; i++ {
+			f, err := readString()
+			if err != nil {
+				return nil, err
+			}
+			v, err := readString()
+			if err != nil {
+				return nil, err
+			}
+			hash[f] = v
+		}
+		return hash, nil
+	default: // opZSet
+		zset := newSortedSet()
+		for i := 0; i < n; i++ {
+			m, err := readString()
+			if err != nil {
+				return nil, err
+			}
+			var bits uint64
+			if err := binary.Read(r, binary.LittleEndian, &bits); err != nil {
+				return nil, err
+			}
+			zset.add(m, math.Float64frombits(bits))
+		}
+		return zset, nil
+	}
+}
+
+// saveSnapshot writes dbs to a temporary file in the target directory and
+// renames it over path, so a crash never leaves a half written snapshot.
+func saveSnapshot(path string, dbs [][]snapshotEntry) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeSnapshot(tmp, dbs); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadSnapshot replaces the dataset with the snapshot at path, if there is one.
+func (s *Server) loadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dbs, err := readSnapshot(data)
+	if err != nil {
+		return fmt.Errorf("bad snapshot %s: %v", path, err)
+	}
+	if len(dbs) > len(s.databases) {
+		return fmt.Errorf("snapshot %s has %d databases, the server only %d", path, len(dbs), len(s.databases))
+	}
+	now, keys := nowMillis(), 0
+	for i, entries := range dbs {
+		db := s.databases[i]
+		db.lock(allShards)
+		for _, e := range entries {
+			if e.deadline != 0 && e.deadline <= now {
+				continue
+			}
+			db.set(e.key, e.value)
+			if e.deadline != 0 {
+				db.setDeadline(e.key, e.deadline)
+			}
+			keys++
+		}
+		db.unlock(allShards)
+	}
+	log.Printf("Loaded %d keys from the snapshot %s", keys, path)
+	return nil
+}
+
+// save takes a snapshot synchronously.
+func (s *Server) save() error {
+	if !s.startSaving() {
+		return errSaveInProgress
+	}
+	err := saveSnapshot(s.snapshotPath, s.captureSnapshot())
+	s.finishSaving(err)
+	return err
+}
+
+// bgsave captures the dataset and writes it in the background.
+func (s *Server) bgsave() error {
+	if !s.startSaving() {
+		return errSaveInProgress
+	}
+	dbs := s.captureSnapshot()
+	go func() {
+		err := saveSnapshot(s.snapshotPath, dbs)
+		if err != nil {
+			log.Println("Background saving failed:", err)
+		}
+		s.finishSaving(err)
+	}()
+	return nil
+}
+
+func (s *Server) startSaving() bool {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+	if s.saving {
+		return false
+	}
+	s.saving = true
+	return true
+}
+
+func (s *Server) finishSaving(err error) {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+	s.saving = false
+	s.lastSaveFailed = err != nil
+	if err == nil {
+		s.lastSave = time.Now().Unix()
+	}
+}
+
+func (s *Server) snapshotCommand(command string, args []string) Reply {
+	if len(args) != 0 {
+		return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+	}
+	switch command {
+	case "SAVE":
+		if err := s.save(); err != nil {
+			return ErrorReply("ERR " + err.Error())
+		}
+		return okReply
+	case "BGSAVE":
+		if err := s.bgsave(); err != nil {
+			return ErrorReply("ERR " + err.Error())
+		}
+		return SimpleString("Background saving started")
+	default: // LASTSAVE
+		s.saveMutex.Lock()
+		defer s.saveMutex.Unlock()
+		return Integer(s.lastSave)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func startServerWithSnapshot(t *testing.T, path string) (*Server, *testClient) {
+	t.Helper()
+	srv := NewServer()
+	srv.snapshotPath = path
+	if err := srv.loadSnapshot(path); err != nil {
+		t.Fatalf("Failed to load snapshot: %v", err)
+	}
+	return srv, dialTestServer(t, serveOnFreePort(t, srv))
+}
+
+func TestSaveAndLoadSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dump.kvsnap")
+	_, c := startServerWithSnapshot(t, path)
+
+	c.do("SET", "name", "John")
+	c.do("SET", "blob", "\x00\r\n binary \xff")
+	c.do("SET", "session", "abc", "EX", "100")
+	c.do("SET", "short", "lived", "PX", "20")
+	c.do("SELECT", "15")
+	c.do("SET", "name", "in fifteen")
+	expectReply(t, c.do("SAVE"), okReply)
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the snapshot in %s, found %d files", dir, len(entries))
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	_, c2 := startServerWithSnapshot(t, path)
+	expectReply(t, c2.do("GET", "name"), BulkString("John"))
+	expectReply(t, c2.do("GET", "blob"), BulkString("\x00\r\n binary \xff"))
+	expectReply(t, c2.do("GET", "short"), NullBulk{})
+	if ttl, ok := c2.do("TTL", "session").(Integer); !ok || ttl < 99 || ttl > 100 {
+		t.Errorf("Expected the session TTL to survive a restart, got %v", ttl)
+	}
+	c2.do("SELECT", "15")
+	expectReply(t, c2.do("GET", "name"), BulkString("in fifteen"))
+}
+
+func TestBGSAVEAndLASTSAVE(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.kvsnap")
+	srv, c := startServerWithSnapshot(t, path)
+	for i := 0; i < 1000; i++ {
+		c.do("SET", "key:"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	srv.saveMutex.Lock()
+	srv.lastSave = 0
+	srv.saveMutex.Unlock()
+	expectReply(t, c.do("BGSAVE"), SimpleString("Background saving started"))
+	for i := 0; i < 200 && c.do("LASTSAVE") == Integer(0); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if last, _ := c.do("LASTSAVE").(Integer); int64(last) < time.Now().Unix()-1 {
+		t.Errorf("Expected LASTSAVE to move to now, got %d", last)
+	}
+
+	_, c2 := startServerWithSnapshot(t, path)
+	expectReply(t, c2.do("GET", "key:999"), BulkString("999"))
+
+	c.do("MULTI")
+	expectReply(t, c.do("SAVE"), ErrorReply("ERR Command not allowed inside a transaction"))
+	c.do("DISCARD")
+}
+
+func TestSaveRefusedWhileSaving(t *testing.T) {
+	srv, c := startServerWithSnapshot(t, filepath.Join(t.TempDir(), "dump.kvsnap"))
+	srv.startSaving()
+	expectReply(t, c.do("SAVE"), ErrorReply("ERR Background save already in progress"))
+	expectReply(t, c.do("BGSAVE"), ErrorReply("ERR Background save already in progress"))
+	srv.finishSaving(nil)
+	expectReply(t, c.do("SAVE"), okReply)
+}
+
+func TestLoadSnapshotRejectsDamagedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.kvsnap")
+	dbs := [][]snapshotEntry{{{key: "k", value: "v"}}}
+	if err := saveSnapshot(path, dbs); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+	good, _ := os.ReadFile(path)
+
+	corrupt := append([]byte{}, good...)
+	corrupt[len(corrupt)-10] ^= 0xff
+	os.WriteFile(path, corrupt, 0644)
+	if err := NewServer().loadSnapshot(path); err == nil {
+		t.Error("Expected a checksum error")
+	}
+
+	for _, version := range []uint16{snapshotVersion - 1, snapshotVersion + 1} {
+		other := append([]byte{}, good...)
+		binary.LittleEndian.PutUint16(other[len(snapshotMagic):], version)
+		os.WriteFile(path, other, 0644)
+		if err := NewServer().loadSnapshot(path); err == nil {
+			t.Errorf("Expected an unsupported version error for version %d", version)
+		}
+	}
+
+	os.WriteFile(path, []byte("SET k v\r\n"), 0644)
+	if err := NewServer().loadSnapshot(path); err == nil {
+		t.Error("Expected an error for a file that is not a snapshot")
+	}
+}
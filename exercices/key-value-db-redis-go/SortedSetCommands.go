@@ -0,0 +1,249 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// sortedSetCommand implements ZADD, ZRANGE, ZRANGEBYSCORE, ZRANK and ZINCRBY.
+func sortedSetCommand(db *Database, command string, args []string) Reply {
+	switch command {
+	case "ZADD":
+		return zaddCommand(db, args)
+	case "ZINCRBY":
+		if len(args) != 3 {
+			return ErrorReply("ERR wrong number of arguments for 'zincrby' command")
+		}
+		return zaddCommand(db, []string{args[0], "INCR", args[1], args[2]})
+	case "ZRANGE":
+		if len(args) < 3 {
+			return ErrorReply("ERR wrong number of arguments for 'zrange' command")
+		}
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			return ErrorReply("ERR value is not an integer or out of range")
+		}
+		withScores, reverse := false, false
+		for _, opt := range args[3:] {
+			switch strings.ToUpper(opt) {
+			case "WITHSCORES":
+				withScores = true
+			case "REV":
+				reverse = true
+			default:
+				return ErrorReply("ERR syntax error")
+			}
+		}
+		zset, _, errReply := lookupAs[*SortedSetValue](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		if zset == nil {
+			return Array{}
+		}
+		from, to := normalizeRange(start, stop, zset.len())
+		entries := make([]zsetEntry, 0, to-from)
+		for i := from; i < to; i++ {
+			if reverse {
+				entries = append(entries, zset.sorted[zset.len()-1-i])
+			} else {
+				entries = append(entries, zset.sorted[i])
+			}
+		}
+		return zsetReply(entries, withScores)
+	case "ZRANGEBYSCORE":
+		if len(args) < 3 {
+			return ErrorReply("ERR wrong number of arguments for 'zrangebyscore' command")
+		}
+		minScore, minExclusive, ok1 := parseScoreBound(args[1])
+		maxScore, maxExclusive, ok2 := parseScoreBound(args[2])
+		if !ok1 || !ok2 {
+			return ErrorReply("ERR min or max is not a float")
+		}
+		withScores, offset, count := false, 0, -1
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "WITHSCORES":
+				withScores = true
+			case "LIMIT":
+				if i+2 >= len(args) {
+					return ErrorReply("ERR syntax error")
+				}
+				var err1, err2 error
+				offset, err1 = strconv.Atoi(args[i+1])
+				count, err2 = strconv.Atoi(args[i+2])
+				if err1 != nil || err2 != nil {
+					return ErrorReply("ERR value is not an integer or out of range")
+				}
+				i += 2
+			default:
+				return ErrorReply("ERR syntax error")
+			}
+		}
+		zset, _, errReply := lookupAs[*SortedSetValue](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		if zset == nil || offset < 0 {
+			return Array{}
+		}
+		// Binary search for the first entry inside the lower bound
+		i := zset.search(zsetEntry{score: minScore})
+		var entries []zsetEntry
+		for ; i < zset.len() && count != 0; i++ {
+			e := zset.sorted[i]
+			if minExclusive && e.score == minScore {
+				continue
+			}
+			if e.score > maxScore || (maxExclusive && e.score == maxScore) {
+				break
+			}
+			if offset > 0 {
+				offset--
+				continue
+			}
+			entries = append(entries, e)
+			count--
+		}
+		return zsetReply(entries, withScores)
+	case "ZRANK":
+		if len(args) != 2 {
+			return ErrorReply("ERR wrong number of arguments for 'zrank' command")
+		}
+		zset, _, errReply := lookupAs[*SortedSetValue](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		if zset == nil {
+			return NullBulk{}
+		}
+		rank, ok := zset.rank(args[1])
+		if !ok {
+			return NullBulk{}
+		}
+		return Integer(rank)
+	}
+	return ErrorReply("ERR unknown command")
+}
+
+// zaddCommand implements ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member ...
+func zaddCommand(db *Database, args []string) Reply {
+	if len(args) < 3 {
+		return ErrorReply("ERR wrong number of arguments for 'zadd' command")
+	}
+	var nx, xx, gt, lt, ch, incr bool
+	i := 1
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+	}
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return ErrorReply("ERR syntax error")
+	}
+	if nx && xx {
+		return ErrorReply("ERR XX and NX options at the same time are not compatible")
+	}
+	if (gt && lt) || (nx && (gt || lt)) {
+		return ErrorReply("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && len(pairs) != 2 {
+		return ErrorReply("ERR INCR option supports a single increment-element pair")
+	}
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		score, ok := parseFloat(pairs[2*j])
+		if !ok {
+			return ErrorReply("ERR value is not a valid float")
+		}
+		scores[j] = score
+	}
+
+	zset, exists, errReply := lookupAs[*SortedSetValue](db, args[0])
+	if errReply != nil {
+		return errReply
+	}
+	if !exists {
+		if xx {
+			if incr {
+				return NullBulk{}
+			}
+			return Integer(0)
+		}
+		zset = newSortedSet()
+	}
+	added, changed := 0, 0
+	var result Reply = NullBulk{}
+	for j, score := range scores {
+		member := pairs[2*j+1]
+		old, present := zset.scores[member]
+		if (nx && present) || (xx && !present) {
+			continue
+		}
+		if incr {
+			score += old
+			if math.IsNaN(score) {
+				return ErrorReply("ERR resulting score is not a number (NaN)")
+			}
+		}
+		if present && ((gt && score <= old) || (lt && score >= old)) {
+			continue
+		}
+		if zset.add(member, score) {
+			added++
+		} else if present && old != score {
+			changed++
+		}
+		result = BulkString(formatFloat(score))
+	}
+	if !exists && zset.len() > 0 {
+		db.set(args[0], zset)
+	} else if added+changed > 0 {
+		db.touch(args[0])
+	}
+	if incr {
+		return result
+	}
+	if ch {
+		return Integer(added + changed)
+	}
+	return Integer(added)
+}
+
+// parseScoreBound parses a ZRANGEBYSCORE bound such as 5, (5, -inf or +inf.
+func parseScoreBound(s string) (float64, bool, bool) {
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+	f, ok := parseFloat(s)
+	return f, exclusive, ok
+}
+
+func zsetReply(entries []zsetEntry, withScores bool) Array {
+	result := make(Array, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, BulkString(e.member))
+		if withScores {
+			result = append(result, BulkString(formatFloat(e.score)))
+		}
+	}
+	return result
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// stringCommand implements the string commands other than SET and GET:
+// INCR, INCRBY, DECR, DECRBY, INCRBYFLOAT, APPEND, STRLEN, GETRANGE,
+// SETRANGE, GETSET, GETDEL, SETNX, MSET, MSETNX and MGET. The multi-key
+// commands run with the locks of every key held, so they are atomic.
+func stringCommand(db *Database, command string, args []string) Reply {
+	name := strings.ToLower(command)
+	wrongArgs := ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+	switch command {
+	case "INCR", "DECR":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		if command == "DECR" {
+			return incrBy(db, args[0], -1)
+		}
+		return incrBy(db, args[0], 1)
+	case "INCRBY", "DECRBY":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		incr, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return ErrorReply("ERR value is not an integer or out of range")
+		}
+		if command == "DECRBY" {
+			if incr == math.MinInt64 {
+				return ErrorReply("ERR decrement would overflow")
+			}
+			incr = -incr
+		}
+		return incrBy(db, args[0], incr)
+	case "INCRBYFLOAT":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		incr, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || math.IsNaN(incr) || math.IsInf(incr, 0) {
+			return ErrorReply("ERR value is not a valid float")
+		}
+		val, exists, errReply := lookupAs[string](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		var current float64
+		if exists {
+			current, err = strconv.ParseFloat(val, 64)
+			if err != nil || math.IsNaN(current) || math.IsInf(current, 0) {
+				return ErrorReply("ERR value is not a valid float")
+			}
+		}
+		result := current + incr
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return ErrorReply("ERR increment would produce NaN or Infinity")
+		}
+		formatted := strconv.FormatFloat(result, 'f', -1, 64)
+		db.set(args[0], formatted)
+		return BulkString(formatted)
+	case "APPEND":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		val, _, errReply := lookupAs[string](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		if len(val)+len(args[1]) > maxBulkLength {
+			return ErrorReply("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+		}
+		db.set(args[0], val+args[1])
+		return Integer(len(val) + len(args[1]))
+	case "STRLEN":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		val, _, errReply := lookupAs[string](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		return Integer(len(val))
+	case "GETRANGE":
+		if len(args) != 3 {
+			return wrongArgs
+		}
+		start, err1 := strconv.Atoi(args[1])
+		end, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			return ErrorReply("ERR value is not an integer or out of range")
+		}
+		val, _, errReply := lookupAs[string](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		from, to := normalizeRange(start, end, len(val))
+		return BulkString(val[from:to])
+	case "SETRANGE":
+		if len(args) != 3 {
+			return wrongArgs
+		}
+		offset, err := strconv.Atoi(args[1])
+		if err != nil {
+			return ErrorReply("ERR value is not an integer or out of range")
+		}
+		if offset < 0 {
+			return ErrorReply("ERR offset is out of range")
+		}
+		val, _, errReply := lookupAs[string](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		// Writing nothing neither creates nor pads the string
+		if args[2] == "" {
+			return Integer(len(val))
+		}
+		if offset > maxBulkLength-len(args[2]) {
+			return ErrorReply("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+		}
+		buf := []byte(val)
+		if end := offset + len(args[2]); end > len(buf) {
+			buf = append(buf, make([]byte, end-len(buf))...)
+		}
+		copy(buf[offset:], args[2])
+		db.set(args[0], string(buf))
+		return Integer(len(buf))
+	case "GETSET", "GETDEL":
+		if (command == "GETSET" && len(args) != 2) || (command == "GETDEL" && len(args) != 1) {
+			return wrongArgs
+		}
+		val, exists, errReply := lookupAs[string](db, args[0])
+		if errReply != nil {
+			return errReply
+		}
+		if command == "GETSET" {
+			db.set(args[0], args[1])
+			db.removeDeadline(args[0])
+		} else if exists {
+			db.deleteKey(args[0])
+		}
+		if !exists {
+			return NullBulk{}
+		}
+		return BulkString(val)
+	case "SETNX":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		if _, exists := db.value(args[0]); exists {
+			return Integer(0)
+		}
+		db.set(args[0], args[1])
+		return Integer(1)
+	case "MSET", "MSETNX":
+		if len(args) == 0 || len(args)%2 != 0 {
+			return wrongArgs
+		}
+		if command == "MSETNX" {
+			for i := 0; i < len(args); i += 2 {
+				if _, exists := db.value(args[i]); exists {
+					return Integer(0)
+				}
+			}
+		}
+		for i := 0; i < len(args); i += 2 {
+			db.set(args[i], args[i+1])
+			db.removeDeadline(args[i])
+		}
+		if command == "MSETNX" {
+			return Integer(1)
+		}
+		return okReply
+	case "MGET":
+		if len(args) == 0 {
+			return wrongArgs
+		}
+		values := make(Array, len(args))
+		for i, key := range args {
+			// Keys of other types read as missing
+			if val, ok, _ := lookupAs[string](db, key); ok {
+				values[i] = BulkString(val)
+			} else {
+				values[i] = NullBulk{}
+			}
+		}
+		return values
+	}
+	return ErrorReply("ERR unknown command")
+}
+
+// incrBy adds incr to the integer stored at key, which starts at 0, and
+// keeps its time to live.
+func incrBy(db *Database, key string, incr int64) Reply {
+	val, exists, errReply := lookupAs[string](db, key)
+	if errReply != nil {
+		return errReply
+	}
+	var current int64
+	if exists {
+		var err error
+		current, err = strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return ErrorReply("ERR value is not an integer or out of range")
+		}
+	}
+	if (incr > 0 && current > math.MaxInt64-incr) || (incr < 0 && current < math.MinInt64-incr) {
+		return ErrorReply("ERR increment or decrement would overflow")
+	}
+	db.set(key, strconv.FormatInt(current+incr, 10))
+	return Integer(current + incr)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCounterCommands(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("INCRBY", "n", "10"), Integer(10))
+	expectReply(t, c.do("DECR", "n"), Integer(9))
+	expectReply(t, c.do("DECRBY", "n", "20"), Integer(-11))
+	expectReply(t, c.do("INCRBY", "n", "-1"), Integer(-12))
+	expectReply(t, c.do("INCRBY", "n", "x"), ErrorReply("ERR value is not an integer or out of range"))
+
+	c.do("SET", "max", "9223372036854775807")
+	expectReply(t, c.do("INCR", "max"), ErrorReply("ERR increment or decrement would overflow"))
+	expectReply(t, c.do("DECRBY", "n", "-9223372036854775808"), ErrorReply("ERR decrement would overflow"))
+	c.do("SET", "min", "-9223372036854775808")
+	expectReply(t, c.do("DECR", "min"), ErrorReply("ERR increment or decrement would overflow"))
+	expectReply(t, c.do("GET", "min"), BulkString("-9223372036854775808"))
+
+	expectReply(t, c.do("INCRBYFLOAT", "f", "10.5"), BulkString("10.5"))
+	expectReply(t, c.do("INCRBYFLOAT", "f", "0.1"), BulkString("10.6"))
+	expectReply(t, c.do("INCRBYFLOAT", "f", "-5e1"), BulkString("-39.4"))
+	expectReply(t, c.do("INCRBYFLOAT", "f", "nope"), ErrorReply("ERR value is not a valid float"))
+	c.do("SET", "f", "1.7e308")
+	expectReply(t, c.do("INCRBYFLOAT", "f", "1.7e308"), ErrorReply("ERR increment would produce NaN or Infinity"))
+
+	// Counters keep their time to live
+	c.do("SET", "limited", "1", "EX", "100")
+	c.do("INCRBY", "limited", "5")
+	if ttl, ok := c.do("TTL", "limited").(Integer); !ok || ttl <= 0 {
+		t.Errorf("Expected INCRBY to keep the TTL, got %v", ttl)
+	}
+	c.do("RPUSH", "list", "a")
+	expectReply(t, c.do("DECR", "list"), wrongTypeError)
+}
+
+func TestStringCommands(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("APPEND", "s", "Hello"), Integer(5))
+	expectReply(t, c.do("APPEND", "s", " World"), Integer(11))
+	expectReply(t, c.do("STRLEN", "s"), Integer(11))
+	expectReply(t, c.do("STRLEN", "missing"), Integer(0))
+	expectReply(t, c.do("GETRANGE", "s", "0", "4"), BulkString("Hello"))
+	expectReply(t, c.do("GETRANGE", "s", "-5", "-1"), BulkString("World"))
+	expectReply(t, c.do("GETRANGE", "s", "20", "30"), BulkString(""))
+	expectReply(t, c.do("GETRANGE", "missing", "0", "-1"), BulkString(""))
+
+	expectReply(t, c.do("SETRANGE", "s", "6", "Redis"), Integer(11))
+	expectReply(t, c.do("GET", "s"), BulkString("Hello Redis"))
+	expectReply(t, c.do("SETRANGE", "padded", "3", "x"), Integer(4))
+	expectReply(t, c.do("GET", "padded"), BulkString("\x00\x00\x00x"))
+	expectReply(t, c.do("SETRANGE", "empty", "5", ""), Integer(0))
+	expectReply(t, c.do("EXISTS", "empty"), Integer(0))
+	expectReply(t, c.do("SETRANGE", "s", "-1", "x"), ErrorReply("ERR offset is out of range"))
+	expectReply(t, c.do("SETRANGE", "s", "536870911", "xx"), ErrorReply("ERR string exceeds maximum allowed size (proto-max-bulk-len)"))
+
+	c.do("SET", "flag", "on", "EX", "100")
+	expectReply(t, c.do("GETSET", "flag", "off"), BulkString("on"))
+	expectReply(t, c.do("TTL", "flag"), Integer(-1))
+	expectReply(t, c.do("GETSET", "new", "v"), NullBulk{})
+	expectReply(t, c.do("GETDEL", "flag"), BulkString("off"))
+	expectReply(t, c.do("GETDEL", "flag"), NullBulk{})
+	expectReply(t, c.do("EXISTS", "flag"), Integer(0))
+
+	expectReply(t, c.do("SETNX", "lock", "me"), Integer(1))
+	expectReply(t, c.do("SETNX", "lock", "you"), Integer(0))
+	expectReply(t, c.do("GET", "lock"), BulkString("me"))
+
+	c.do("RPUSH", "list", "a")
+	for _, args := range [][]string{{"APPEND", "list", "x"}, {"STRLEN", "list"}, {"GETRANGE", "list", "0", "1"}, {"SETRANGE", "list", "0", "x"}, {"GETSET", "list", "x"}, {"GETDEL", "list"}} {
+		expectReply(t, c.do(args...), wrongTypeError)
+	}
+}
+
+func TestMultiKeyStringCommands(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("MSET", "a", "1", "b", "2"), okReply)
+	c.do("RPUSH", "list", "x")
+	expectReply(t, c.do("MGET", "a", "missing", "list", "b"), Array{BulkString("1"), NullBulk{}, NullBulk{}, BulkString("2")})
+	expectReply(t, c.do("MSET", "a", "1", "b"), ErrorReply("ERR wrong number of arguments for 'mset' command"))
+	expectReply(t, c.do("MGET"), ErrorReply("ERR wrong number of arguments for 'mget' command"))
+
+	expectReply(t, c.do("MSETNX", "c", "3", "a", "changed"), Integer(0))
+	expectReply(t, c.do("MGET", "a", "c"), Array{BulkString("1"), NullBulk{}})
+	expectReply(t, c.do("MSETNX", "c", "3", "d", "4"), Integer(1))
+	expectReply(t, c.do("MGET", "c", "d"), Array{BulkString("3"), BulkString("4")})
+
+	// Readers never see half of an MSET, whichever shards the keys are on
+	keys := []string{"k1", "k2", "k3", "k4", "k5", "k6", "k7", "k8"}
+	var wg sync.WaitGroup
+	writer := dialTestServer(t, addr)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			args := []string{"MSET"}
+			for _, key := range keys {
+				args = append(args, key, string(rune('a'+i%2)))
+			}
+			writer.do(args...)
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		values := c.do(append([]string{"MGET"}, keys...)...).(Array)
+		for _, v := range values[1:] {
+			if v != values[0] {
+				t.Fatalf("Expected MGET to see one MSET at a time, got %v", values)
+			}
+		}
+	}
+	wg.Wait()
+}
+
+// Float increments are logged as the value they produced.
+func TestStringCommandsPropagate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	srv, c := startServerWithAOF(t, path)
+	c.do("SET", "f", "1.1", "EX", "100")
+	c.do("INCRBYFLOAT", "f", "2.2")
+	c.do("MSET", "a", "1", "b", "2")
+	c.do("APPEND", "a", "0")
+	c.do("GETDEL", "b")
+	srv.aof.close()
+
+	_, c2 := startServerWithAOF(t, path)
+	expectReply(t, c2.do("MGET", "f", "a", "b"), Array{BulkString("3.3000000000000003"), BulkString("10"), NullBulk{}})
+	if ttl, ok := c2.do("TTL", "f").(Integer); !ok || ttl <= 0 {
+		t.Errorf("Expected INCRBYFLOAT to keep the TTL, got %v", ttl)
+	}
+}
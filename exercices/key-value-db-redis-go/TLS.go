@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds how long a client may take to complete the TLS
+// handshake before it is disconnected.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// loadTLSConfig builds the server TLS configuration from a certificate and
+// key in PEM files. With a CA bundle, client certificates are verified
+// against it and required unless requireClientCert is false.
+func loadTLSConfig(certFile, keyFile, caFile string, requireClientCert bool) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS needs both a certificate and a key file")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// serveTLS accepts TLS connections on listener. Unlike serve it does not
+// record the port, which replicas announce to their leader for plaintext.
+func (s *Server) serveTLS(listener net.Listener, config *tls.Config) error {
+	return s.accept(tls.NewListener(listener, config))
+}
+
+// handshake completes the TLS handshake of conn, if it is a TLS connection,
+// so that bad certificates are reported when the client connects.
+func handshake(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+	if err := tlsConn.Handshake(); err != nil {
+		log.Println("TLS handshake failed:", conn.RemoteAddr(), err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate generated for a test, with its PEM files.
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+var testSerial int64
+
+// generateCert creates a certificate signed by parent, or self-signed when
+// parent is nil, and writes it to PEM files in a temporary directory.
+func generateCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	tc := &testCert{cert: cert, key: key, certFile: filepath.Join(dir, name+".crt"), keyFile: filepath.Join(dir, name+".key")}
+	writePEM(t, tc.certFile, "CERTIFICATE", der)
+	writePEM(t, tc.keyFile, "EC PRIVATE KEY", keyDER)
+	return tc
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTLSServer serves plaintext and TLS from the same server, with client
+// certificates verified against ca when it is not nil.
+func startTLSServer(t *testing.T, server *testCert, ca *testCert) (plainAddr, tlsAddr string) {
+	t.Helper()
+	caFile := ""
+	if ca != nil {
+		caFile = ca.certFile
+	}
+	config, err := loadTLSConfig(server.certFile, server.keyFile, caFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, plainAddr := startServerOnFreePort(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go srv.serveTLS(listener, config)
+	return plainAddr, listener.Addr().String()
+}
+
+func dialTLSTestServer(t *testing.T, addr string, ca *testCert, client *testCert) (*testClient, error) {
+	t.Helper()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: roots}
+	if client != nil {
+		cert, err := tls.LoadX509KeyPair(client.certFile, client.keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func TestTLSAndPlaintextListeners(t *testing.T) {
+	ca := generateCert(t, "ca", true, nil)
+	server := generateCert(t, "server", false, ca)
+	plainAddr, tlsAddr := startTLSServer(t, server, nil)
+
+	secure, err := dialTLSTestServer(t, tlsAddr, ca, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect with TLS: %v", err)
+	}
+	expectReply(t, secure.do("SET", "key", "over tls"), SimpleString("OK"))
+	plain := dialTestServer(t, plainAddr)
+	expectReply(t, plain.do("GET", "key"), BulkString("over tls"))
+
+	// Plaintext on the TLS port is not understood as commands
+	raw := dialTestServer(t, tlsAddr)
+	raw.conn.Write([]byte(encodeCommand("PING")))
+	raw.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if line, err := raw.reader.ReadString('\n'); err == nil && line == "+PONG\r\n" {
+		t.Fatal("Expected the TLS port to reject plaintext commands")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := generateCert(t, "ca", true, nil)
+	server := generateCert(t, "server", false, ca)
+	_, tlsAddr := startTLSServer(t, server, ca)
+
+	trusted := generateCert(t, "client", false, ca)
+	c, err := dialTLSTestServer(t, tlsAddr, ca, trusted)
+	if err != nil {
+		t.Fatalf("Failed to connect with a trusted client certificate: %v", err)
+	}
+	expectReply(t, c.do("PING"), SimpleString("PONG"))
+
+	otherCA := generateCert(t, "other-ca", true, nil)
+	untrusted := generateCert(t, "intruder", false, otherCA)
+	for name, cert := range map[string]*testCert{"no certificate": nil, "untrusted certificate": untrusted} {
+		c, err := dialTLSTestServer(t, tlsAddr, ca, cert)
+		if err != nil {
+			continue
+		}
+		// TLS 1.3 clients learn that the server rejected them on first read
+		c.conn.Write([]byte(encodeCommand("PING")))
+		c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := c.reader.ReadString('\n'); err == nil {
+			t.Errorf("Expected a client with %s to be rejected", name)
+		}
+	}
+}
+
+func TestLoadTLSConfigErrors(t *testing.T) {
+	ca := generateCert(t, "ca", true, nil)
+	if _, err := loadTLSConfig("", ca.keyFile, "", true); err == nil {
+		t.Error("Expected an error without a certificate file")
+	}
+	if _, err := loadTLSConfig(ca.certFile, ca.keyFile, ca.keyFile, true); err == nil {
+		t.Error("Expected an error for a CA bundle without certificates")
+	}
+	config, err := loadTLSConfig(ca.certFile, ca.keyFile, ca.certFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("Expected optional client certificates, got %v", config.ClientAuth)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+// watchedKey is a key a client is WATCHing for optimistic locking.
+type watchedKey struct {
+	db  *Database
+	key string
+}
+
+// touch records a modification of key, updates its memory accounting and
+// marks every client watching it as dirty so that its next EXEC aborts.
+// Clients blocked on the key are woken if it now holds a list.
+// Caller holds the write lock of the key's shard.
+func (db *Database) touch(key string) {
+	sh := db.shardOf(key)
+	sh.dirty++
+	db.updateStats(key)
+	for c := range sh.watchers[key] {
+		c.dirty.Store(true)
+	}
+	db.wakeBlocked(key)
+}
+
+// lockAll takes the write lock of every shard of every database in index
+// order, which is the order every multi-database operation must use.
+func (s *Server) lockAll() {
+	for _, db := range s.databases {
+		db.lock(allShards)
+	}
+}
+
+func (s *Server) unlockAll() {
+	for _, db := range s.databases {
+		db.unlock(allShards)
+	}
+}
+
+func (s *Server) transactionCommand(c *Client, command string, args []string) Reply {
+	switch command {
+	case "MULTI":
+		if len(args) != 0 {
+			return ErrorReply("ERR wrong number of arguments for 'multi' command")
+		}
+		if c.inMulti {
+			return ErrorReply("ERR MULTI calls can not be nested")
+		}
+		c.inMulti = true
+		return okReply
+	case "DISCARD":
+		if len(args) != 0 {
+			return ErrorReply("ERR wrong number of arguments for 'discard' command")
+		}
+		if !c.inMulti {
+			return ErrorReply("ERR DISCARD without MULTI")
+		}
+		c.resetMulti()
+		s.unwatchAll(c)
+		return okReply
+	case "EXEC":
+		if len(args) != 0 {
+			return ErrorReply("ERR wrong number of arguments for 'exec' command")
+		}
+		if !c.inMulti {
+			return ErrorReply("ERR EXEC without MULTI")
+		}
+		return s.exec(c)
+	case "WATCH":
+		if len(args) == 0 {
+			return ErrorReply("ERR wrong number of arguments for 'watch' command")
+		}
+		if c.inMulti {
+			return ErrorReply("ERR WATCH inside MULTI is not allowed")
+		}
+		s.watch(c, args)
+		return okReply
+	case "UNWATCH":
+		if len(args) != 0 {
+			return ErrorReply("ERR wrong number of arguments for 'unwatch' command")
+		}
+		s.unwatchAll(c)
+		return okReply
+	}
+	return ErrorReply("ERR unknown command")
+}
+
+// exec runs the queued commands while holding every shard lock, so no
+// other client can observe or interleave with a partially applied transaction.
+func (s *Server) exec(c *Client) Reply {
+	queued, aborted := c.queued, c.multiError
+	c.resetMulti()
+	if aborted {
+		s.unwatchAll(c)
+		return ErrorReply("EXECABORT Transaction discarded because of previous errors.")
+	}
+	for _, cmd := range queued {
+		if commandTable[cmd[0]].flags&cmdDenyOOM != 0 && !c.master && !s.freeMemoryIfNeeded() {
+			s.unwatchAll(c)
+			return errOOM
+		}
+	}
+
+	s.lockAll()
+	// A watched key that expired since WATCH counts as modified
+	for _, w := range c.watched {
+		w.db.expireIfNeeded(w.key)
+	}
+	if c.dirty.Load() {
+		s.unlockAll()
+		s.unwatchAll(c)
+		return NullArray{}
+	}
+	// Wrapping the writes in MULTI/EXEC lets a replay drop a transaction that
+	// was only partially logged. Scripts may write too, and leave the
+	// wrapping to the transaction, see runScript.
+	startDB, writes := c.dbIndex, false
+	for _, cmd := range queued {
+		writes = writes || commandTable[cmd[0]].flags&cmdWrite != 0 || cmd[0] == "EVAL" || cmd[0] == "EVALSHA"
+	}
+	if writes {
+		s.propagate(startDB, []string{"MULTI"})
+	}
+	replies := make(Array, 0, len(queued))
+	c.inExec = true
+	for _, cmd := range queued {
+		s.feedMonitors(c, c.dbIndex, cmd[0], cmd[1:])
+		replies = append(replies, s.callLocked(c, cmd[0], cmd[1:]))
+	}
+	c.inExec = false
+	s.feedMonitors(c, c.dbIndex, "EXEC", nil)
+	if writes {
+		s.propagate(c.dbIndex, []string{"EXEC"})
+	}
+	s.unlockAll()
+	s.unwatchAll(c)
+	return replies
+}
+
+func (c *Client) resetMulti() {
+	c.inMulti = false
+	c.multiError = false
+	c.queued = nil
+}
+
+func (s *Server) watch(c *Client, keys []string) {
+	db := s.databases[c.dbIndex]
+	shards := keyShards(keys)
+	db.lock(shards)
+	defer db.unlock(shards)
+	for _, key := range keys {
+		db.expireIfNeeded(key)
+		if db.addWatcher(key, c) {
+			c.watched = append(c.watched, watchedKey{db: db, key: key})
+		}
+	}
+}
+
+// addWatcher makes touch flag c as dirty when key changes, and reports false
+// if c already watched it. Caller holds the write lock of the key's shard.
+func (db *Database) addWatcher(key string, c *Client) bool {
+	watchers := db.shardOf(key).watchers
+	if _, ok := watchers[key][c]; ok {
+		return false
+	}
+	if watchers[key] == nil {
+		watchers[key] = make(map[*Client]struct{})
+	}
+	watchers[key][c] = struct{}{}
+	return true
+}
+
+// removeWatcher undoes addWatcher. Caller holds the write lock of the key's
+// shard.
+func (db *Database) removeWatcher(key string, c *Client) {
+	watchers := db.shardOf(key).watchers
+	delete(watchers[key], c)
+	if len(watchers[key]) == 0 {
+		delete(watchers, key)
+	}
+}
+
+// unwatchAll forgets every watched key of the client. It must not be called
+// while holding a shard lock.
+func (s *Server) unwatchAll(c *Client) {
+	for _, w := range c.watched {
+		sh := w.db.shardOf(w.key)
+		sh.mutex.Lock()
+		w.db.removeWatcher(w.key, c)
+		sh.mutex.Unlock()
+	}
+	c.watched = nil
+	c.dirty.Store(false)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMultiExecDiscard(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	expectReply(t, c.do("EXEC"), ErrorReply("ERR EXEC without MULTI"))
+	expectReply(t, c.do("DISCARD"), ErrorReply("ERR DISCARD without MULTI"))
+
+	expectReply(t, c.do("MULTI"), okReply)
+	expectReply(t, c.do("MULTI"), ErrorReply("ERR MULTI calls can not be nested"))
+	expectReply(t, c.do("INCR", "counter"), SimpleString("QUEUED"))
+	expectReply(t, c.do("SET", "foo", "bar"), SimpleString("QUEUED"))
+	expectReply(t, c.do("GET", "foo"), SimpleString("QUEUED"))
+	expectReply(t, c.do("EXEC"), Array{Integer(1), okReply, BulkString("bar")})
+
+	expectReply(t, c.do("MULTI"), okReply)
+	c.do("SET", "foo", "discarded")
+	expectReply(t, c.do("DISCARD"), okReply)
+	expectReply(t, c.do("GET", "foo"), BulkString("bar"))
+
+	// Runtime errors are reported per command and do not roll back the rest
+	expectReply(t, c.do("MULTI"), okReply)
+	c.do("INCR", "foo")
+	c.do("SET", "after", "error")
+	expectReply(t, c.do("EXEC"), Array{ErrorReply("ERR value is not an integer or out of range"), okReply})
+
+	// Unknown commands abort the whole transaction
+	expectReply(t, c.do("MULTI"), okReply)
+	c.do("SET", "never", "set")
+	expectReply(t, c.do("NOPE"), ErrorReply("ERR unknown command"))
+	expectReply(t, c.do("EXEC"), ErrorReply("EXECABORT Transaction discarded because of previous errors."))
+	expectReply(t, c.do("GET", "never"), NullBulk{})
+}
+
+func TestExecFollowsSelect(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	c.do("MULTI")
+	c.do("SELECT", "3")
+	c.do("SET", "k", "in-db-3")
+	expectReply(t, c.do("EXEC"), Array{okReply, okReply})
+	expectReply(t, c.do("GET", "k"), BulkString("in-db-3"))
+	c.do("SELECT", "0")
+	expectReply(t, c.do("GET", "k"), NullBulk{})
+}
+
+func TestWatchAbortsOnConcurrentChange(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	c1 := dialTestServer(t, addr)
+	c2 := dialTestServer(t, addr)
+
+	c1.do("SET", "balance", "10")
+	expectReply(t, c1.do("WATCH", "balance"), okReply)
+	c1.do("MULTI")
+	expectReply(t, c1.do("WATCH", "other"), ErrorReply("ERR WATCH inside MULTI is not allowed"))
+	c1.do("SET", "balance", "20")
+	c2.do("SET", "balance", "15")
+	expectReply(t, c1.do("EXEC"), NullArray{})
+	expectReply(t, c1.do("GET", "balance"), BulkString("15"))
+
+	// EXEC forgets the watched keys, so the next transaction goes through
+	c1.do("MULTI")
+	c1.do("SET", "balance", "20")
+	expectReply(t, c1.do("EXEC"), Array{okReply})
+
+	// UNWATCH drops interest in earlier changes
+	c1.do("WATCH", "balance")
+	c2.do("INCR", "balance")
+	c1.do("UNWATCH")
+	c1.do("MULTI")
+	c1.do("INCR", "balance")
+	expectReply(t, c1.do("EXEC"), Array{Integer(22)})
+
+	// A watched key that does not exist aborts once someone creates it
+	c1.do("WATCH", "fresh")
+	c2.do("SET", "fresh", "x")
+	c1.do("MULTI")
+	c1.do("GET", "fresh")
+	expectReply(t, c1.do("EXEC"), NullArray{})
+}
+
+func TestWatchAbortsWhenKeyExpires(t *testing.T) {
+	srv, addr := startServerOnFreePort(t)
+	c := dialTestServer(t, addr)
+
+	c.do("SET", "lock", "owner", "PX", "60000")
+	c.do("WATCH", "lock")
+	// Move the deadline into the past without touching the key
+	db := srv.databases[0]
+	db.lock(allShards)
+	db.setDeadline("lock", nowMillis()-1)
+	db.unlock(allShards)
+	c.do("MULTI")
+	c.do("SET", "lock", "me")
+	expectReply(t, c.do("EXEC"), NullArray{})
+}
+
+func TestTransactionsAreAtomicAcrossClients(t *testing.T) {
+	_, addr := startServerOnFreePort(t)
+	const workers, rounds = 8, 50
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		c := dialTestServer(t, addr)
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				c.do("MULTI")
+				c.do("INCR", "counter")
+				c.do("SET", "flag", strconv.Itoa(id))
+				c.do("INCR", "counter")
+				reply, ok := c.do("EXEC").(Array)
+				if !ok || len(reply) != 3 {
+					t.Errorf("Unexpected EXEC reply %v", reply)
+					return
+				}
+				// Both increments must be adjacent, so the first one is always odd
+				if first, _ := reply[0].(Integer); first%2 != 1 || reply[2] != first+1 {
+					t.Errorf("Transaction interleaved with another client: %v", reply)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	c := dialTestServer(t, addr)
+	expectReply(t, c.do("GET", "counter"), BulkString(strconv.Itoa(workers*rounds*2)))
+}
@@ -0,0 +1,251 @@
+// Package client is a Go client for the key-value server. A Client is safe
+// for concurrent use and keeps a pool of connections; every command has a
+// typed method returning a Cmd that holds the reply and the error.
+//
+//	c := client.NewClient(&client.Options{Addr: "localhost:9736"})
+//	defer c.Close()
+//	value, err := c.Get(ctx, "key").Result()
+//	if err == client.Nil {
+//		// the key does not exist
+//	}
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"runtime"
+	"time"
+)
+
+// Options configure a Client. Zero values get the defaults.
+type Options struct {
+	Addr string // host:port, localhost:9736 by default
+
+	// Username and Password are sent with AUTH on every new connection. An
+	// empty Username logs in as the default user.
+	Username string
+	Password string
+
+	DB         int    // database selected on every new connection
+	ClientName string // name set with CLIENT SETNAME on every new connection
+
+	PoolSize     int           // open connections at most, 10 per CPU by default
+	DialTimeout  time.Duration // 5 seconds by default
+	ReadTimeout  time.Duration // 3 seconds by default, -1 for none
+	WriteTimeout time.Duration // ReadTimeout by default, -1 for none
+	PoolTimeout  time.Duration // wait for a free connection, ReadTimeout + 1 second by default
+
+	TLSConfig *tls.Config // connect with TLS when set
+}
+
+func (opts *Options) init() {
+	if opts.Addr == "" {
+		opts.Addr = "localhost:9736"
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 10 * runtime.GOMAXPROCS(0)
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	switch opts.ReadTimeout {
+	case 0:
+		opts.ReadTimeout = 3 * time.Second
+	case -1:
+		opts.ReadTimeout = 0
+	}
+	switch opts.WriteTimeout {
+	case 0:
+		opts.WriteTimeout = opts.ReadTimeout
+	case -1:
+		opts.WriteTimeout = 0
+	}
+	if opts.PoolTimeout == 0 {
+		opts.PoolTimeout = opts.ReadTimeout + time.Second
+	}
+}
+
+// Client is a pool of connections to one server.
+type Client struct {
+	cmdable
+	opts *Options
+	pool *pool
+}
+
+func NewClient(opts *Options) *Client {
+	o := *opts
+	o.init()
+	c := &Client{opts: &o, pool: newPool(&o)}
+	c.cmdable = c.process
+	return c
+}
+
+// Options returns the options the client runs with, defaults included.
+func (c *Client) Options() *Options {
+	return c.opts
+}
+
+func (c *Client) process(ctx context.Context, cmd Cmder) error {
+	cn, err := c.pool.get(ctx)
+	if err != nil {
+		cmd.setErr(err)
+		return err
+	}
+	cn.roundTrip(ctx, []Cmder{cmd})
+	c.pool.put(cn)
+	return cmd.Err()
+}
+
+// Close closes the connections. Commands running on other goroutines finish
+// first.
+func (c *Client) Close() error {
+	return c.pool.close()
+}
+
+// Pipeline returns a pipeline sending its commands in one write.
+func (c *Client) Pipeline() *Pipeline {
+	return newPipeline(c.execPipeline, false)
+}
+
+// TxPipeline returns a pipeline wrapping its commands in MULTI and EXEC.
+func (c *Client) TxPipeline() *Pipeline {
+	return newPipeline(c.execPipeline, true)
+}
+
+// Pipelined queues the commands fn runs on a pipeline and sends them.
+func (c *Client) Pipelined(ctx context.Context, fn func(*Pipeline) error) ([]Cmder, error) {
+	return c.Pipeline().run(ctx, fn)
+}
+
+// TxPipelined runs the commands fn queues as one transaction.
+func (c *Client) TxPipelined(ctx context.Context, fn func(*Pipeline) error) ([]Cmder, error) {
+	return c.TxPipeline().run(ctx, fn)
+}
+
+func (c *Client) execPipeline(ctx context.Context, cmds []Cmder, tx bool) error {
+	cn, err := c.pool.get(ctx)
+	if err != nil {
+		setErrors(cmds, err)
+		return err
+	}
+	defer c.pool.put(cn)
+	if tx {
+		return execTx(ctx, cn, cmds)
+	}
+	return cn.roundTrip(ctx, cmds)
+}
+
+// Conn takes a connection out of the pool for commands that change the state
+// of a connection, such as SELECT or WATCH. It must be closed to give the
+// connection back.
+func (c *Client) Conn(ctx context.Context) (*Conn, error) {
+	cn, err := c.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn := &Conn{pool: c.pool, cn: cn}
+	conn.cmdable = conn.process
+	return conn, nil
+}
+
+// Watch runs fn on a connection watching keys. A transaction fn runs with
+// TxPipelined fails with ErrTxFailed if another client modified a watched key
+// in the meantime, and fn can simply be run again.
+func (c *Client) Watch(ctx context.Context, fn func(*Conn) error, keys ...string) error {
+	conn, err := c.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if len(keys) > 0 {
+		if err := conn.Watch(ctx, keys...).Err(); err != nil {
+			return err
+		}
+	}
+	err = fn(conn)
+	if unwatchErr := conn.Unwatch(ctx).Err(); err == nil {
+		err = unwatchErr
+	}
+	return err
+}
+
+// Conn is a single connection taken out of the pool.
+type Conn struct {
+	cmdable
+	pool   *pool
+	cn     *conn
+	dirty  bool // SELECT, AUTH or CLIENT SETNAME changed the connection
+	closed bool
+}
+
+func (c *Conn) process(ctx context.Context, cmd Cmder) error {
+	if c.closed {
+		cmd.setErr(ErrClosed)
+		return ErrClosed
+	}
+	c.cn.roundTrip(ctx, []Cmder{cmd})
+	return cmd.Err()
+}
+
+// Close gives the connection back to the pool, unless its state was changed.
+func (c *Conn) Close() error {
+	if c.closed {
+		return ErrClosed
+	}
+	c.closed = true
+	if c.dirty {
+		c.pool.remove(c.cn)
+	} else {
+		c.pool.put(c.cn)
+	}
+	return nil
+}
+
+func (c *Conn) Select(ctx context.Context, db int) *StatusCmd {
+	c.dirty = true
+	return c.status(ctx, "SELECT", itoa(db))
+}
+
+// Auth logs in as the default user. An AUTH error is a *ServerError with the
+// WRONGPASS code.
+func (c *Conn) Auth(ctx context.Context, password string) *StatusCmd {
+	c.dirty = true
+	return c.status(ctx, "AUTH", password)
+}
+
+func (c *Conn) AuthACL(ctx context.Context, username, password string) *StatusCmd {
+	c.dirty = true
+	return c.status(ctx, "AUTH", username, password)
+}
+
+func (c *Conn) ClientSetName(ctx context.Context, name string) *StatusCmd {
+	c.dirty = true
+	return c.status(ctx, "CLIENT", "SETNAME", name)
+}
+
+func (c *Conn) Watch(ctx context.Context, keys ...string) *StatusCmd {
+	return c.status(ctx, append([]string{"WATCH"}, keys...)...)
+}
+
+func (c *Conn) Unwatch(ctx context.Context) *StatusCmd {
+	return c.status(ctx, "UNWATCH")
+}
+
+func (c *Conn) Pipelined(ctx context.Context, fn func(*Pipeline) error) ([]Cmder, error) {
+	return newPipeline(c.execPipeline, false).run(ctx, fn)
+}
+
+func (c *Conn) TxPipelined(ctx context.Context, fn func(*Pipeline) error) ([]Cmder, error) {
+	return newPipeline(c.execPipeline, true).run(ctx, fn)
+}
+
+func (c *Conn) execPipeline(ctx context.Context, cmds []Cmder, tx bool) error {
+	if c.closed {
+		setErrors(cmds, ErrClosed)
+		return ErrClosed
+	}
+	if tx {
+		return execTx(ctx, c.cn, cmds)
+	}
+	return c.cn.roundTrip(ctx, cmds)
+}
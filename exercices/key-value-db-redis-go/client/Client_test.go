@@ -0,0 +1,171 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer accepts one connection and answers every command with the next
+// canned reply.
+func fakeServer(t *testing.T, replies ...string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for _, reply := range replies {
+			if _, err := readValue(reader); err != nil {
+				return
+			}
+			conn.Write([]byte(reply))
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestReadValue(t *testing.T) {
+	input := "+OK\r\n-ERR bad thing\r\n:42\r\n$5\r\nhe\r\no\r\n$-1\r\n*2\r\n$1\r\na\r\n*1\r\n:1\r\n*-1\r\n"
+	reader := bufio.NewReader(strings.NewReader(input))
+	expected := []interface{}{
+		"OK",
+		&ServerError{Code: "ERR", Message: "bad thing"},
+		int64(42),
+		"he\r\no",
+		nil,
+		[]interface{}{"a", []interface{}{int64(1)}},
+		nil,
+	}
+	for _, want := range expected {
+		got, err := readValue(reader)
+		if err != nil {
+			t.Fatalf("Failed to read %#v: %v", want, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %#v, got %#v", want, got)
+		}
+	}
+
+	for _, input := range []string{"?\r\n", ":x\r\n", "$-2\r\n", "+OK\n", "$3\r\nab"} {
+		if _, err := readValue(bufio.NewReader(strings.NewReader(input))); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	ctx := context.Background()
+	addr := fakeServer(t, "$-1\r\n", "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", "&bogus\r\n")
+	c := NewClient(&Options{Addr: addr, PoolSize: 1, ReadTimeout: 200 * time.Millisecond})
+	defer c.Close()
+
+	if err := c.Get(ctx, "missing").Err(); err != Nil {
+		t.Errorf("Expected Nil, got %v", err)
+	}
+
+	err := c.Get(ctx, "list").Err()
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.Code != "WRONGTYPE" || IsNetworkError(err) {
+		t.Errorf("Expected a WRONGTYPE server error, got %#v", err)
+	}
+
+	err = c.Get(ctx, "key").Err()
+	if !IsNetworkError(err) || IsServerError(err) {
+		t.Errorf("Expected a network error for a protocol violation, got %#v", err)
+	}
+
+	// The broken connection was dropped and the new one is never answered
+	if err := c.Ping(ctx).Err(); !IsNetworkError(err) {
+		t.Errorf("Expected a network error once the server is gone, got %#v", err)
+	}
+}
+
+func TestDialError(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := listener.Addr().String()
+	listener.Close()
+
+	c := NewClient(&Options{Addr: addr})
+	defer c.Close()
+	var netErr *NetworkError
+	if err := c.Ping(context.Background()).Err(); !errors.As(err, &netErr) || netErr.Op != "dial" {
+		t.Fatalf("Expected a dial error, got %#v", err)
+	}
+}
+
+func TestPoolTimeout(t *testing.T) {
+	ctx := context.Background()
+	addr := fakeServer(t, "+OK\r\n")
+	c := NewClient(&Options{Addr: addr, PoolSize: 1, PoolTimeout: 50 * time.Millisecond})
+	defer c.Close()
+
+	conn, err := c.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ping(ctx).Err(); err != ErrPoolTimeout {
+		t.Errorf("Expected a pool timeout, got %v", err)
+	}
+	conn.Close()
+	if err := c.Ping(ctx).Err(); err != nil {
+		t.Errorf("Expected the connection back in the pool, got %v", err)
+	}
+	c.Close()
+	if err := c.Ping(ctx).Err(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestSetArgs(t *testing.T) {
+	at := time.UnixMilli(1700000000123)
+	tests := []struct {
+		args     SetArgs
+		expected string
+	}{
+		{SetArgs{}, "SET k v"},
+		{SetArgs{TTL: 10 * time.Second}, "SET k v EX 10"},
+		{SetArgs{Mode: "NX", TTL: 1500 * time.Millisecond}, "SET k v NX PX 1500"},
+		{SetArgs{Mode: "XX", KeepTTL: true}, "SET k v XX KEEPTTL"},
+		{SetArgs{ExpireAt: at}, "SET k v PXAT 1700000000123"},
+	}
+	for _, test := range tests {
+		if got := strings.Join(setArgs("k", "v", test.args), " "); got != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, got)
+		}
+	}
+}
+
+func TestParsePush(t *testing.T) {
+	tests := []struct {
+		reply    interface{}
+		expected interface{}
+	}{
+		{[]interface{}{"message", "news", "hello"}, &Message{Channel: "news", Payload: "hello"}},
+		{[]interface{}{"pmessage", "n*", "news", "hello"}, &Message{Pattern: "n*", Channel: "news", Payload: "hello"}},
+		{[]interface{}{"subscribe", "news", int64(1)}, &Subscription{Kind: "subscribe", Channel: "news", Count: 1}},
+		{[]interface{}{"unsubscribe", nil, int64(0)}, &Subscription{Kind: "unsubscribe"}},
+		{[]interface{}{"pong", ""}, &Pong{}},
+	}
+	for _, test := range tests {
+		got, err := parsePush(test.reply)
+		if err != nil || !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Expected %#v, got %#v (%v)", test.expected, got, err)
+		}
+	}
+	if _, err := parsePush("OK"); err == nil {
+		t.Error("Expected an error for a reply that is not a push")
+	}
+}
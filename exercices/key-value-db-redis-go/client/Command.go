@@ -0,0 +1,340 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Cmder is a command whose reply is read later, in a pipeline or a
+// transaction.
+type Cmder interface {
+	Args() []string
+	Err() error
+	setReply(reply interface{})
+	setErr(err error)
+	blockTimeout() time.Duration
+}
+
+// Cmd is a command and its decoded reply. Err is Nil for a nil reply, a
+// *ServerError for an error reply and a *NetworkError when the connection
+// failed.
+type Cmd[T any] struct {
+	args   []string
+	val    T
+	err    error
+	decode func(reply interface{}) (T, error)
+	block  time.Duration // how long the server may hold the reply, -1 for ever
+}
+
+func newCmd[T any](decode func(interface{}) (T, error), args ...string) *Cmd[T] {
+	return &Cmd[T]{args: args, decode: decode}
+}
+
+func (cmd *Cmd[T]) Args() []string {
+	return cmd.args
+}
+
+func (cmd *Cmd[T]) Val() T {
+	return cmd.val
+}
+
+func (cmd *Cmd[T]) Err() error {
+	return cmd.err
+}
+
+func (cmd *Cmd[T]) Result() (T, error) {
+	return cmd.val, cmd.err
+}
+
+func (cmd *Cmd[T]) String() string {
+	if cmd.err != nil {
+		return fmt.Sprintf("%v: %v", cmd.args, cmd.err)
+	}
+	return fmt.Sprintf("%v: %v", cmd.args, cmd.val)
+}
+
+func (cmd *Cmd[T]) setReply(reply interface{}) {
+	if err, ok := reply.(*ServerError); ok {
+		cmd.err = err
+		return
+	}
+	cmd.val, cmd.err = cmd.decode(reply)
+}
+
+func (cmd *Cmd[T]) setErr(err error) {
+	cmd.err = err
+}
+
+func (cmd *Cmd[T]) blockTimeout() time.Duration {
+	return cmd.block
+}
+
+type (
+	StatusCmd      = Cmd[string]
+	StringCmd      = Cmd[string]
+	IntCmd         = Cmd[int64]
+	BoolCmd        = Cmd[bool]
+	FloatCmd       = Cmd[float64]
+	StringSliceCmd = Cmd[[]string]
+	SliceCmd       = Cmd[[]interface{}]
+	BoolSliceCmd   = Cmd[[]bool]
+	StringMapCmd   = Cmd[map[string]string]
+	DurationCmd    = Cmd[time.Duration]
+	TimeCmd        = Cmd[time.Time]
+	ScanCmd        = Cmd[ScanResult]
+	ZSliceCmd      = Cmd[[]Z]
+	SlowLogCmd     = Cmd[[]SlowLog]
+)
+
+// NoExpiration is what TTL and PTTL return for a key without a timeout.
+const NoExpiration time.Duration = -1
+
+// Z is a member of a sorted set and its score.
+type Z struct {
+	Score  float64
+	Member string
+}
+
+// ScanResult is one page of SCAN. A zero Cursor means the iteration is done.
+type ScanResult struct {
+	Keys   []string
+	Cursor uint64
+}
+
+func unexpected(reply interface{}) error {
+	return fmt.Errorf("kv: unexpected reply %#v", reply)
+}
+
+func decodeRaw(reply interface{}) (interface{}, error) {
+	if reply == nil {
+		return nil, Nil
+	}
+	return reply, nil
+}
+
+func decodeString(reply interface{}) (string, error) {
+	switch reply := reply.(type) {
+	case nil:
+		return "", Nil
+	case string:
+		return reply, nil
+	case int64:
+		return strconv.FormatInt(reply, 10), nil
+	}
+	return "", unexpected(reply)
+}
+
+func decodeInt(reply interface{}) (int64, error) {
+	switch reply := reply.(type) {
+	case nil:
+		return 0, Nil
+	case int64:
+		return reply, nil
+	case string:
+		n, err := strconv.ParseInt(reply, 10, 64)
+		if err != nil {
+			return 0, unexpected(reply)
+		}
+		return n, nil
+	}
+	return 0, unexpected(reply)
+}
+
+// decodeBool reads 1/0 integers and OK statuses. A nil reply is false, which
+// is how SET NX and SET XX report that nothing was set.
+func decodeBool(reply interface{}) (bool, error) {
+	switch reply := reply.(type) {
+	case nil:
+		return false, nil
+	case int64:
+		return reply == 1, nil
+	case string:
+		return reply == "OK", nil
+	}
+	return false, unexpected(reply)
+}
+
+func decodeFloat(reply interface{}) (float64, error) {
+	switch reply := reply.(type) {
+	case nil:
+		return 0, Nil
+	case int64:
+		return float64(reply), nil
+	case string:
+		f, err := strconv.ParseFloat(reply, 64)
+		if err != nil {
+			return 0, unexpected(reply)
+		}
+		return f, nil
+	}
+	return 0, unexpected(reply)
+}
+
+func decodeStringSlice(reply interface{}) ([]string, error) {
+	if reply == nil {
+		return nil, Nil
+	}
+	values, ok := reply.([]interface{})
+	if !ok {
+		return nil, unexpected(reply)
+	}
+	result := make([]string, len(values))
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			return nil, unexpected(reply)
+		}
+		result[i] = s
+	}
+	return result, nil
+}
+
+// decodeSlice keeps the nil elements of an array, such as the missing keys
+// of MGET.
+func decodeSlice(reply interface{}) ([]interface{}, error) {
+	if reply == nil {
+		return nil, Nil
+	}
+	values, ok := reply.([]interface{})
+	if !ok {
+		return nil, unexpected(reply)
+	}
+	return values, nil
+}
+
+func decodeBoolSlice(reply interface{}) ([]bool, error) {
+	values, ok := reply.([]interface{})
+	if !ok {
+		return nil, unexpected(reply)
+	}
+	result := make([]bool, len(values))
+	for i, value := range values {
+		b, err := decodeBool(value)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = b
+	}
+	return result, nil
+}
+
+func decodeStringMap(reply interface{}) (map[string]string, error) {
+	values, err := decodeStringSlice(reply)
+	if err != nil {
+		return nil, err
+	}
+	if len(values)%2 != 0 {
+		return nil, unexpected(reply)
+	}
+	result := make(map[string]string, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		result[values[i]] = values[i+1]
+	}
+	return result, nil
+}
+
+// decodeDuration reads a TTL in unit. A missing key is Nil.
+func decodeDuration(unit time.Duration) func(interface{}) (time.Duration, error) {
+	return func(reply interface{}) (time.Duration, error) {
+		n, err := decodeInt(reply)
+		switch {
+		case err != nil:
+			return 0, err
+		case n == -2:
+			return 0, Nil
+		case n == -1:
+			return NoExpiration, nil
+		}
+		return time.Duration(n) * unit, nil
+	}
+}
+
+func decodeUnixTime(reply interface{}) (time.Time, error) {
+	n, err := decodeInt(reply)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(n, 0), nil
+}
+
+func decodeScan(reply interface{}) (ScanResult, error) {
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return ScanResult{}, unexpected(reply)
+	}
+	cursor, ok := values[0].(string)
+	if !ok {
+		return ScanResult{}, unexpected(reply)
+	}
+	n, err := strconv.ParseUint(cursor, 10, 64)
+	if err != nil {
+		return ScanResult{}, unexpected(reply)
+	}
+	keys, err := decodeStringSlice(values[1])
+	if err != nil {
+		return ScanResult{}, err
+	}
+	return ScanResult{Keys: keys, Cursor: n}, nil
+}
+
+func decodeZSlice(reply interface{}) ([]Z, error) {
+	values, err := decodeStringSlice(reply)
+	if err != nil {
+		return nil, err
+	}
+	if len(values)%2 != 0 {
+		return nil, unexpected(reply)
+	}
+	result := make([]Z, len(values)/2)
+	for i := range result {
+		score, err := strconv.ParseFloat(values[2*i+1], 64)
+		if err != nil {
+			return nil, unexpected(reply)
+		}
+		result[i] = Z{Score: score, Member: values[2*i]}
+	}
+	return result, nil
+}
+
+// SlowLog is an entry of SLOWLOG GET.
+type SlowLog struct {
+	ID         int64
+	Time       time.Time
+	Duration   time.Duration
+	Args       []string
+	ClientAddr string
+	ClientName string
+}
+
+func decodeSlowLogs(reply interface{}) ([]SlowLog, error) {
+	values, ok := reply.([]interface{})
+	if !ok {
+		return nil, unexpected(reply)
+	}
+	logs := make([]SlowLog, len(values))
+	for i, value := range values {
+		fields, ok := value.([]interface{})
+		if !ok || len(fields) != 6 {
+			return nil, unexpected(reply)
+		}
+		id, ok1 := fields[0].(int64)
+		unix, ok2 := fields[1].(int64)
+		micros, ok3 := fields[2].(int64)
+		addr, ok4 := fields[4].(string)
+		name, ok5 := fields[5].(string)
+		args, err := decodeStringSlice(fields[3])
+		if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || err != nil {
+			return nil, unexpected(reply)
+		}
+		logs[i] = SlowLog{
+			ID:         id,
+			Time:       time.Unix(unix, 0),
+			Duration:   time.Duration(micros) * time.Microsecond,
+			Args:       args,
+			ClientAddr: addr,
+			ClientName: name,
+		}
+	}
+	return logs, nil
+}
@@ -0,0 +1,617 @@
+package client
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// cmdable gives the typed command methods to Client, Conn and Pipeline,
+// which only differ in how they run a command.
+type cmdable func(ctx context.Context, cmd Cmder) error
+
+// KeepTTL as the expiration of Set keeps the timeout the key already has.
+const KeepTTL time.Duration = -1
+
+func run[T any](ctx context.Context, c cmdable, decode func(interface{}) (T, error), args ...string) *Cmd[T] {
+	cmd := newCmd(decode, args...)
+	c(ctx, cmd)
+	return cmd
+}
+
+func (c cmdable) status(ctx context.Context, args ...string) *StatusCmd {
+	return run(ctx, c, decodeString, args...)
+}
+
+func (c cmdable) integer(ctx context.Context, args ...string) *IntCmd {
+	return run(ctx, c, decodeInt, args...)
+}
+
+func (c cmdable) boolean(ctx context.Context, args ...string) *BoolCmd {
+	return run(ctx, c, decodeBool, args...)
+}
+
+func (c cmdable) strings(ctx context.Context, args ...string) *StringSliceCmd {
+	return run(ctx, c, decodeStringSlice, args...)
+}
+
+// blocking runs a command the server holds for up to timeout, or for ever if
+// timeout is 0, and extends the read timeout to match.
+func blocking[T any](ctx context.Context, c cmdable, decode func(interface{}) (T, error), timeout time.Duration, args ...string) *Cmd[T] {
+	cmd := newCmd(decode, append(args, formatFloat(timeout.Seconds()))...)
+	cmd.block = timeout
+	if timeout == 0 {
+		cmd.block = -1
+	}
+	c(ctx, cmd)
+	return cmd
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func formatInt(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+// formatDuration renders d in seconds, or in milliseconds if it is not a
+// whole number of seconds.
+func formatDuration(d time.Duration) (value string, millis bool) {
+	if d%time.Second != 0 {
+		return formatInt(d.Milliseconds()), true
+	}
+	return formatInt(int64(d / time.Second)), false
+}
+
+// Do runs any command and returns the raw reply: a string, an int64, a
+// []interface{} or nil, which is reported as Nil.
+func (c cmdable) Do(ctx context.Context, args ...string) *Cmd[interface{}] {
+	return run(ctx, c, decodeRaw, args...)
+}
+
+func (c cmdable) Ping(ctx context.Context) *StatusCmd {
+	return c.status(ctx, "PING")
+}
+
+func (c cmdable) Echo(ctx context.Context, message string) *StringCmd {
+	return run(ctx, c, decodeString, "ECHO", message)
+}
+
+// Set sets a key, with a timeout when expiration is positive. KeepTTL keeps
+// the current timeout of the key.
+func (c cmdable) Set(ctx context.Context, key, value string, expiration time.Duration) *StatusCmd {
+	return c.SetArgs(ctx, key, value, SetArgs{TTL: expiration, KeepTTL: expiration == KeepTTL})
+}
+
+// SetArgs are the options of SET.
+type SetArgs struct {
+	Mode     string // NX or XX
+	TTL      time.Duration
+	ExpireAt time.Time
+	KeepTTL  bool
+}
+
+// SetArgs sets a key with options. A Mode that prevents the write makes the
+// reply Nil.
+func (c cmdable) SetArgs(ctx context.Context, key, value string, a SetArgs) *StatusCmd {
+	return c.status(ctx, setArgs(key, value, a)...)
+}
+
+func setArgs(key, value string, a SetArgs) []string {
+	args := []string{"SET", key, value}
+	if a.Mode != "" {
+		args = append(args, a.Mode)
+	}
+	switch {
+	case a.KeepTTL:
+		args = append(args, "KEEPTTL")
+	case a.TTL > 0:
+		if ttl, millis := formatDuration(a.TTL); millis {
+			args = append(args, "PX", ttl)
+		} else {
+			args = append(args, "EX", ttl)
+		}
+	case !a.ExpireAt.IsZero():
+		args = append(args, "PXAT", formatInt(a.ExpireAt.UnixMilli()))
+	}
+	return args
+}
+
+// SetNX sets a key that does not exist yet and reports whether it did.
+func (c cmdable) SetNX(ctx context.Context, key, value string, expiration time.Duration) *BoolCmd {
+	return c.boolean(ctx, setArgs(key, value, SetArgs{Mode: "NX", TTL: expiration})...)
+}
+
+// SetXX sets a key that already exists and reports whether it did.
+func (c cmdable) SetXX(ctx context.Context, key, value string, expiration time.Duration) *BoolCmd {
+	return c.boolean(ctx, setArgs(key, value, SetArgs{Mode: "XX", TTL: expiration, KeepTTL: expiration == KeepTTL})...)
+}
+
+func (c cmdable) Get(ctx context.Context, key string) *StringCmd {
+	return run(ctx, c, decodeString, "GET", key)
+}
+
+func (c cmdable) Incr(ctx context.Context, key string) *IntCmd {
+	return c.integer(ctx, "INCR", key)
+}
+
+func (c cmdable) IncrBy(ctx context.Context, key string, incr int64) *IntCmd {
+	return c.integer(ctx, "INCRBY", key, formatInt(incr))
+}
+
+func (c cmdable) Decr(ctx context.Context, key string) *IntCmd {
+	return c.integer(ctx, "DECR", key)
+}
+
+func (c cmdable) DecrBy(ctx context.Context, key string, decr int64) *IntCmd {
+	return c.integer(ctx, "DECRBY", key, formatInt(decr))
+}
+
+func (c cmdable) IncrByFloat(ctx context.Context, key string, incr float64) *FloatCmd {
+	return run(ctx, c, decodeFloat, "INCRBYFLOAT", key, formatFloat(incr))
+}
+
+// Append appends value to the string at key and returns its new length.
+func (c cmdable) Append(ctx context.Context, key, value string) *IntCmd {
+	return c.integer(ctx, "APPEND", key, value)
+}
+
+func (c cmdable) StrLen(ctx context.Context, key string) *IntCmd {
+	return c.integer(ctx, "STRLEN", key)
+}
+
+func (c cmdable) GetRange(ctx context.Context, key string, start, end int64) *StringCmd {
+	return run(ctx, c, decodeString, "GETRANGE", key, formatInt(start), formatInt(end))
+}
+
+// SetRange overwrites the string at key from offset, padding it with zero
+// bytes, and returns its new length.
+func (c cmdable) SetRange(ctx context.Context, key string, offset int64, value string) *IntCmd {
+	return c.integer(ctx, "SETRANGE", key, formatInt(offset), value)
+}
+
+// GetSet sets a key and returns its previous value, or Nil.
+func (c cmdable) GetSet(ctx context.Context, key, value string) *StringCmd {
+	return run(ctx, c, decodeString, "GETSET", key, value)
+}
+
+func (c cmdable) GetDel(ctx context.Context, key string) *StringCmd {
+	return run(ctx, c, decodeString, "GETDEL", key)
+}
+
+// MSet sets pairs of keys and values at once.
+func (c cmdable) MSet(ctx context.Context, pairs ...string) *StatusCmd {
+	return c.status(ctx, append([]string{"MSET"}, pairs...)...)
+}
+
+// MSetNX sets pairs of keys and values only if none of the keys exists, and
+// reports whether it did.
+func (c cmdable) MSetNX(ctx context.Context, pairs ...string) *BoolCmd {
+	return c.boolean(ctx, append([]string{"MSETNX"}, pairs...)...)
+}
+
+// MGet returns the values of keys, with nil for the keys that do not hold a
+// string.
+func (c cmdable) MGet(ctx context.Context, keys ...string) *SliceCmd {
+	return run(ctx, c, decodeSlice, append([]string{"MGET"}, keys...)...)
+}
+
+// Del deletes keys and returns how many existed.
+func (c cmdable) Del(ctx context.Context, keys ...string) *IntCmd {
+	return c.integer(ctx, append([]string{"DEL"}, keys...)...)
+}
+
+// Exists counts how many of keys exist.
+func (c cmdable) Exists(ctx context.Context, keys ...string) *IntCmd {
+	return c.integer(ctx, append([]string{"EXISTS"}, keys...)...)
+}
+
+// Expire sets a timeout in seconds, or in milliseconds when expiration is not
+// a whole number of seconds.
+func (c cmdable) Expire(ctx context.Context, key string, expiration time.Duration) *BoolCmd {
+	if ttl, millis := formatDuration(expiration); millis {
+		return c.boolean(ctx, "PEXPIRE", key, ttl)
+	}
+	return c.boolean(ctx, "EXPIRE", key, formatInt(int64(expiration/time.Second)))
+}
+
+func (c cmdable) PExpire(ctx context.Context, key string, expiration time.Duration) *BoolCmd {
+	return c.boolean(ctx, "PEXPIRE", key, formatInt(expiration.Milliseconds()))
+}
+
+func (c cmdable) ExpireAt(ctx context.Context, key string, tm time.Time) *BoolCmd {
+	return c.boolean(ctx, "EXPIREAT", key, formatInt(tm.Unix()))
+}
+
+func (c cmdable) PExpireAt(ctx context.Context, key string, tm time.Time) *BoolCmd {
+	return c.boolean(ctx, "PEXPIREAT", key, formatInt(tm.UnixMilli()))
+}
+
+func (c cmdable) Persist(ctx context.Context, key string) *BoolCmd {
+	return c.boolean(ctx, "PERSIST", key)
+}
+
+// TTL returns the time a key has left, NoExpiration if it has no timeout, or
+// Nil if it does not exist.
+func (c cmdable) TTL(ctx context.Context, key string) *DurationCmd {
+	return run(ctx, c, decodeDuration(time.Second), "TTL", key)
+}
+
+func (c cmdable) PTTL(ctx context.Context, key string) *DurationCmd {
+	return run(ctx, c, decodeDuration(time.Millisecond), "PTTL", key)
+}
+
+// Type returns string, list, hash, set, zset or none.
+func (c cmdable) Type(ctx context.Context, key string) *StatusCmd {
+	return c.status(ctx, "TYPE", key)
+}
+
+func (c cmdable) Keys(ctx context.Context, pattern string) *StringSliceCmd {
+	return c.strings(ctx, "KEYS", pattern)
+}
+
+// Scan returns a page of keys from cursor. An empty match and a zero count
+// use the server defaults.
+func (c cmdable) Scan(ctx context.Context, cursor uint64, match string, count int64) *ScanCmd {
+	return c.ScanType(ctx, cursor, match, count, "")
+}
+
+// ScanType is Scan limited to keys of one type.
+func (c cmdable) ScanType(ctx context.Context, cursor uint64, match string, count int64, keyType string) *ScanCmd {
+	args := []string{"SCAN", strconv.FormatUint(cursor, 10)}
+	if match != "" {
+		args = append(args, "MATCH", match)
+	}
+	if count > 0 {
+		args = append(args, "COUNT", formatInt(count))
+	}
+	if keyType != "" {
+		args = append(args, "TYPE", keyType)
+	}
+	return run(ctx, c, decodeScan, args...)
+}
+
+func (c cmdable) DBSize(ctx context.Context) *IntCmd {
+	return c.integer(ctx, "DBSIZE")
+}
+
+// RandomKey returns a random key, or Nil if the database is empty.
+func (c cmdable) RandomKey(ctx context.Context) *StringCmd {
+	return run(ctx, c, decodeString, "RANDOMKEY")
+}
+
+func (c cmdable) Rename(ctx context.Context, key, newKey string) *StatusCmd {
+	return c.status(ctx, "RENAME", key, newKey)
+}
+
+func (c cmdable) RenameNX(ctx context.Context, key, newKey string) *BoolCmd {
+	return c.boolean(ctx, "RENAMENX", key, newKey)
+}
+
+func (c cmdable) Move(ctx context.Context, key string, db int) *BoolCmd {
+	return c.boolean(ctx, "MOVE", key, itoa(db))
+}
+
+func (c cmdable) FlushDB(ctx context.Context) *StatusCmd {
+	return c.status(ctx, "FLUSHDB")
+}
+
+func (c cmdable) FlushAll(ctx context.Context) *StatusCmd {
+	return c.status(ctx, "FLUSHALL")
+}
+
+func (c cmdable) LPush(ctx context.Context, key string, values ...string) *IntCmd {
+	return c.integer(ctx, append([]string{"LPUSH", key}, values...)...)
+}
+
+func (c cmdable) RPush(ctx context.Context, key string, values ...string) *IntCmd {
+	return c.integer(ctx, append([]string{"RPUSH", key}, values...)...)
+}
+
+func (c cmdable) LPop(ctx context.Context, key string) *StringCmd {
+	return run(ctx, c, decodeString, "LPOP", key)
+}
+
+func (c cmdable) RPop(ctx context.Context, key string) *StringCmd {
+	return run(ctx, c, decodeString, "RPOP", key)
+}
+
+// LPopCount pops up to count elements, or returns Nil if the list does not
+// exist.
+func (c cmdable) LPopCount(ctx context.Context, key string, count int) *StringSliceCmd {
+	return c.strings(ctx, "LPOP", key, itoa(count))
+}
+
+func (c cmdable) RPopCount(ctx context.Context, key string, count int) *StringSliceCmd {
+	return c.strings(ctx, "RPOP", key, itoa(count))
+}
+
+func (c cmdable) LRange(ctx context.Context, key string, start, stop int64) *StringSliceCmd {
+	return c.strings(ctx, "LRANGE", key, formatInt(start), formatInt(stop))
+}
+
+func (c cmdable) LLen(ctx context.Context, key string) *IntCmd {
+	return c.integer(ctx, "LLEN", key)
+}
+
+// LMove moves an element from the srcpos side ("LEFT" or "RIGHT") of source
+// to the destpos side of destination and returns it.
+func (c cmdable) LMove(ctx context.Context, source, destination, srcpos, destpos string) *StringCmd {
+	return run(ctx, c, decodeString, "LMOVE", source, destination, srcpos, destpos)
+}
+
+// BLPop waits up to timeout, or for ever if it is 0, for one of keys to hold
+// a list and pops its first element. The reply is the key and the element,
+// or Nil once the timeout expired.
+func (c cmdable) BLPop(ctx context.Context, timeout time.Duration, keys ...string) *StringSliceCmd {
+	return blocking(ctx, c, decodeStringSlice, timeout, append([]string{"BLPOP"}, keys...)...)
+}
+
+func (c cmdable) BRPop(ctx context.Context, timeout time.Duration, keys ...string) *StringSliceCmd {
+	return blocking(ctx, c, decodeStringSlice, timeout, append([]string{"BRPOP"}, keys...)...)
+}
+
+// BLMove is LMove waiting up to timeout for source to hold a list.
+func (c cmdable) BLMove(ctx context.Context, source, destination, srcpos, destpos string, timeout time.Duration) *StringCmd {
+	return blocking(ctx, c, decodeString, timeout, "BLMOVE", source, destination, srcpos, destpos)
+}
+
+// HSet sets fields given as field, value pairs and returns how many are new.
+func (c cmdable) HSet(ctx context.Context, key string, fieldsAndValues ...string) *IntCmd {
+	return c.integer(ctx, append([]string{"HSET", key}, fieldsAndValues...)...)
+}
+
+func (c cmdable) HGet(ctx context.Context, key, field string) *StringCmd {
+	return run(ctx, c, decodeString, "HGET", key, field)
+}
+
+func (c cmdable) HDel(ctx context.Context, key string, fields ...string) *IntCmd {
+	return c.integer(ctx, append([]string{"HDEL", key}, fields...)...)
+}
+
+func (c cmdable) HGetAll(ctx context.Context, key string) *StringMapCmd {
+	return run(ctx, c, decodeStringMap, "HGETALL", key)
+}
+
+func (c cmdable) HIncrBy(ctx context.Context, key, field string, incr int64) *IntCmd {
+	return c.integer(ctx, "HINCRBY", key, field, formatInt(incr))
+}
+
+func (c cmdable) SAdd(ctx context.Context, key string, members ...string) *IntCmd {
+	return c.integer(ctx, append([]string{"SADD", key}, members...)...)
+}
+
+func (c cmdable) SRem(ctx context.Context, key string, members ...string) *IntCmd {
+	return c.integer(ctx, append([]string{"SREM", key}, members...)...)
+}
+
+func (c cmdable) SMembers(ctx context.Context, key string) *StringSliceCmd {
+	return c.strings(ctx, "SMEMBERS", key)
+}
+
+func (c cmdable) SIsMember(ctx context.Context, key, member string) *BoolCmd {
+	return c.boolean(ctx, "SISMEMBER", key, member)
+}
+
+func (c cmdable) SInter(ctx context.Context, keys ...string) *StringSliceCmd {
+	return c.strings(ctx, append([]string{"SINTER"}, keys...)...)
+}
+
+func (c cmdable) SUnion(ctx context.Context, keys ...string) *StringSliceCmd {
+	return c.strings(ctx, append([]string{"SUNION"}, keys...)...)
+}
+
+// ZAddArgs are the options of ZADD.
+type ZAddArgs struct {
+	NX, XX  bool
+	GT, LT  bool
+	Ch      bool // count changed members, not only added ones
+	Members []Z
+}
+
+// ZAdd adds members and returns how many are new.
+func (c cmdable) ZAdd(ctx context.Context, key string, members ...Z) *IntCmd {
+	return c.ZAddArgs(ctx, key, ZAddArgs{Members: members})
+}
+
+func (c cmdable) ZAddArgs(ctx context.Context, key string, a ZAddArgs) *IntCmd {
+	args := []string{"ZADD", key}
+	for _, flag := range []struct {
+		set  bool
+		name string
+	}{{a.NX, "NX"}, {a.XX, "XX"}, {a.GT, "GT"}, {a.LT, "LT"}, {a.Ch, "CH"}} {
+		if flag.set {
+			args = append(args, flag.name)
+		}
+	}
+	for _, z := range a.Members {
+		args = append(args, formatFloat(z.Score), z.Member)
+	}
+	return c.integer(ctx, args...)
+}
+
+// ZIncrBy adds incr to the score of member and returns the new score.
+func (c cmdable) ZIncrBy(ctx context.Context, key string, incr float64, member string) *FloatCmd {
+	return run(ctx, c, decodeFloat, "ZINCRBY", key, formatFloat(incr), member)
+}
+
+func (c cmdable) ZRange(ctx context.Context, key string, start, stop int64) *StringSliceCmd {
+	return c.strings(ctx, "ZRANGE", key, formatInt(start), formatInt(stop))
+}
+
+func (c cmdable) ZRangeWithScores(ctx context.Context, key string, start, stop int64) *ZSliceCmd {
+	return run(ctx, c, decodeZSlice, "ZRANGE", key, formatInt(start), formatInt(stop), "WITHSCORES")
+}
+
+func (c cmdable) ZRevRange(ctx context.Context, key string, start, stop int64) *StringSliceCmd {
+	return c.strings(ctx, "ZRANGE", key, formatInt(start), formatInt(stop), "REV")
+}
+
+func (c cmdable) ZRevRangeWithScores(ctx context.Context, key string, start, stop int64) *ZSliceCmd {
+	return run(ctx, c, decodeZSlice, "ZRANGE", key, formatInt(start), formatInt(stop), "REV", "WITHSCORES")
+}
+
+// ZRangeBy selects members by score. Min and Max are scores, "-inf", "+inf"
+// or scores prefixed with "(" to exclude them. A zero Count means no limit.
+type ZRangeBy struct {
+	Min, Max      string
+	Offset, Count int64
+}
+
+func zrangeByArgs(key string, opt ZRangeBy, withScores bool) []string {
+	args := []string{"ZRANGEBYSCORE", key, opt.Min, opt.Max}
+	if withScores {
+		args = append(args, "WITHSCORES")
+	}
+	if opt.Offset != 0 || opt.Count != 0 {
+		count := opt.Count
+		if count == 0 {
+			count = -1
+		}
+		args = append(args, "LIMIT", formatInt(opt.Offset), formatInt(count))
+	}
+	return args
+}
+
+func (c cmdable) ZRangeByScore(ctx context.Context, key string, opt ZRangeBy) *StringSliceCmd {
+	return c.strings(ctx, zrangeByArgs(key, opt, false)...)
+}
+
+func (c cmdable) ZRangeByScoreWithScores(ctx context.Context, key string, opt ZRangeBy) *ZSliceCmd {
+	return run(ctx, c, decodeZSlice, zrangeByArgs(key, opt, true)...)
+}
+
+// ZRank returns the rank of member, or Nil if it is not in the set.
+func (c cmdable) ZRank(ctx context.Context, key, member string) *IntCmd {
+	return c.integer(ctx, "ZRANK", key, member)
+}
+
+// Compact returns the commands that rebuild the selected database.
+func (c cmdable) Compact(ctx context.Context) *StringSliceCmd {
+	return c.strings(ctx, "COMPACT")
+}
+
+func (c cmdable) BgRewriteAOF(ctx context.Context) *StatusCmd {
+	return c.status(ctx, "BGREWRITEAOF")
+}
+
+func (c cmdable) Save(ctx context.Context) *StatusCmd {
+	return c.status(ctx, "SAVE")
+}
+
+func (c cmdable) BgSave(ctx context.Context) *StatusCmd {
+	return c.status(ctx, "BGSAVE")
+}
+
+func (c cmdable) LastSave(ctx context.Context) *TimeCmd {
+	return run(ctx, c, decodeUnixTime, "LASTSAVE")
+}
+
+func (c cmdable) Info(ctx context.Context, sections ...string) *StringCmd {
+	return run(ctx, c, decodeString, append([]string{"INFO"}, sections...)...)
+}
+
+// SlowLogGet returns the latest count slow log entries, newest first, or all
+// of them when count is -1.
+func (c cmdable) SlowLogGet(ctx context.Context, count int64) *SlowLogCmd {
+	return run(ctx, c, decodeSlowLogs, "SLOWLOG", "GET", formatInt(count))
+}
+
+func (c cmdable) SlowLogLen(ctx context.Context) *IntCmd {
+	return c.integer(ctx, "SLOWLOG", "LEN")
+}
+
+func (c cmdable) SlowLogReset(ctx context.Context) *StatusCmd {
+	return c.status(ctx, "SLOWLOG", "RESET")
+}
+
+func (c cmdable) ReplicaOf(ctx context.Context, host, port string) *StatusCmd {
+	return c.status(ctx, "REPLICAOF", host, port)
+}
+
+func (c cmdable) ReplicaOfNoOne(ctx context.Context) *StatusCmd {
+	return c.status(ctx, "REPLICAOF", "NO", "ONE")
+}
+
+func (c cmdable) ConfigGet(ctx context.Context, pattern string) *StringMapCmd {
+	return run(ctx, c, decodeStringMap, "CONFIG", "GET", pattern)
+}
+
+func (c cmdable) ConfigSet(ctx context.Context, parameter, value string) *StatusCmd {
+	return c.status(ctx, "CONFIG", "SET", parameter, value)
+}
+
+func (c cmdable) ClientID(ctx context.Context) *IntCmd {
+	return c.integer(ctx, "CLIENT", "ID")
+}
+
+func (c cmdable) ClientGetName(ctx context.Context) *StringCmd {
+	return run(ctx, c, decodeString, "CLIENT", "GETNAME")
+}
+
+func (c cmdable) ClientInfo(ctx context.Context) *StringCmd {
+	return run(ctx, c, decodeString, "CLIENT", "INFO")
+}
+
+func (c cmdable) ClientList(ctx context.Context) *StringCmd {
+	return run(ctx, c, decodeString, "CLIENT", "LIST")
+}
+
+// ClientKill disconnects the client connected from addr.
+func (c cmdable) ClientKill(ctx context.Context, addr string) *StatusCmd {
+	return c.status(ctx, "CLIENT", "KILL", addr)
+}
+
+// ClientKillByFilter disconnects the clients matching filters given as
+// name, value pairs such as "USER", "alice", and returns how many.
+func (c cmdable) ClientKillByFilter(ctx context.Context, filters ...string) *IntCmd {
+	return c.integer(ctx, append([]string{"CLIENT", "KILL"}, filters...)...)
+}
+
+func (c cmdable) ACLWhoAmI(ctx context.Context) *StringCmd {
+	return run(ctx, c, decodeString, "ACL", "WHOAMI")
+}
+
+func (c cmdable) ACLList(ctx context.Context) *StringSliceCmd {
+	return c.strings(ctx, "ACL", "LIST")
+}
+
+func (c cmdable) ACLSetUser(ctx context.Context, username string, rules ...string) *StatusCmd {
+	return c.status(ctx, append([]string{"ACL", "SETUSER", username}, rules...)...)
+}
+
+// Publish sends a message to a channel and returns how many subscribers got
+// it.
+func (c cmdable) Publish(ctx context.Context, channel, message string) *IntCmd {
+	return c.integer(ctx, "PUBLISH", channel, message)
+}
+
+// Eval runs a script with the given keys and arguments, and returns its raw
+// reply like Do.
+func (c cmdable) Eval(ctx context.Context, script string, keys []string, args ...string) *Cmd[interface{}] {
+	return run(ctx, c, decodeRaw, evalArgs("EVAL", script, keys, args)...)
+}
+
+// EvalSha runs a script loaded with ScriptLoad or run before by Eval.
+func (c cmdable) EvalSha(ctx context.Context, sha1 string, keys []string, args ...string) *Cmd[interface{}] {
+	return run(ctx, c, decodeRaw, evalArgs("EVALSHA", sha1, keys, args)...)
+}
+
+func evalArgs(command, script string, keys, args []string) []string {
+	argv := append([]string{command, script, strconv.Itoa(len(keys))}, keys...)
+	return append(argv, args...)
+}
+
+// ScriptLoad caches a script without running it and returns its SHA1.
+func (c cmdable) ScriptLoad(ctx context.Context, script string) *StringCmd {
+	return run(ctx, c, decodeString, "SCRIPT", "LOAD", script)
+}
+
+func (c cmdable) ScriptExists(ctx context.Context, hashes ...string) *BoolSliceCmd {
+	return run(ctx, c, decodeBoolSlice, append([]string{"SCRIPT", "EXISTS"}, hashes...)...)
+}
+
+func (c cmdable) ScriptFlush(ctx context.Context) *StatusCmd {
+	return c.status(ctx, "SCRIPT", "FLUSH")
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"errors"
+	"strings"
+)
+
+// Nil is returned when the server answers with a nil reply, such as GET of a
+// missing key.
+var Nil = errors.New("kv: nil reply")
+
+var (
+	// ErrClosed is returned when the client or the subscription was closed.
+	ErrClosed = errors.New("kv: client is closed")
+	// ErrPoolTimeout is returned when no connection became free in time.
+	ErrPoolTimeout = errors.New("kv: connection pool timeout")
+	// ErrTxFailed is returned by EXEC when a watched key was modified.
+	ErrTxFailed = errors.New("kv: transaction failed, a watched key was modified")
+)
+
+// ServerError is an error reply of the server. Code is its first word, such
+// as ERR, WRONGTYPE or NOAUTH.
+type ServerError struct {
+	Code    string
+	Message string
+}
+
+func parseServerError(line string) *ServerError {
+	code, message, _ := strings.Cut(line, " ")
+	return &ServerError{Code: code, Message: message}
+}
+
+func (e *ServerError) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + " " + e.Message
+}
+
+// NetworkError is a failure to reach the server or to talk to it, including
+// replies that do not follow the protocol. The connection is not reused.
+type NetworkError struct {
+	Op   string // dial, write or read
+	Addr string
+	Err  error
+}
+
+func (e *NetworkError) Error() string {
+	return "kv: " + e.Op + " " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+// IsServerError reports whether err is an error reply of the server, as
+// opposed to a nil reply or a network error.
+func IsServerError(err error) bool {
+	var serverErr *ServerError
+	return errors.As(err, &serverErr)
+}
+
+// IsNetworkError reports whether err comes from the connection.
+func IsNetworkError(err error) bool {
+	var netErr *NetworkError
+	return errors.As(err, &netErr)
+}
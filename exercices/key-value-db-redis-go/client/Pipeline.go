@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"errors"
+)
+
+// Pipeline queues commands and sends them together with Exec. The Cmd
+// values its methods return are filled in by Exec.
+type Pipeline struct {
+	cmdable
+	exec func(ctx context.Context, cmds []Cmder, tx bool) error
+	tx   bool
+	cmds []Cmder
+}
+
+func newPipeline(exec func(context.Context, []Cmder, bool) error, tx bool) *Pipeline {
+	p := &Pipeline{exec: exec, tx: tx}
+	p.cmdable = p.queue
+	return p
+}
+
+func (p *Pipeline) queue(ctx context.Context, cmd Cmder) error {
+	p.cmds = append(p.cmds, cmd)
+	return nil
+}
+
+// Len is the number of queued commands.
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+// Discard drops the queued commands.
+func (p *Pipeline) Discard() {
+	p.cmds = nil
+}
+
+// Exec sends the queued commands and returns them with their replies. The
+// error is the first one a command got, nil replies aside.
+func (p *Pipeline) Exec(ctx context.Context) ([]Cmder, error) {
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+	if err := p.exec(ctx, cmds, p.tx); err != nil {
+		return cmds, err
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil && err != Nil {
+			return cmds, err
+		}
+	}
+	return cmds, nil
+}
+
+func (p *Pipeline) run(ctx context.Context, fn func(*Pipeline) error) ([]Cmder, error) {
+	if err := fn(p); err != nil {
+		return nil, err
+	}
+	return p.Exec(ctx)
+}
+
+// execTx sends cmds between MULTI and EXEC. Commands the server refused to
+// queue keep their error and the others get EXECABORT; when a watched key
+// changed every command gets ErrTxFailed.
+func execTx(ctx context.Context, cn *conn, cmds []Cmder) error {
+	commands := make([][]string, 0, len(cmds)+2)
+	commands = append(commands, []string{"MULTI"})
+	for _, cmd := range cmds {
+		commands = append(commands, cmd.Args())
+	}
+	commands = append(commands, []string{"EXEC"})
+	if err := cn.writeCommands(ctx, commands...); err != nil {
+		setErrors(cmds, err)
+		return err
+	}
+
+	// The MULTI reply, then a QUEUED status or an error per command
+	queued := make([]bool, len(cmds))
+	for i := -1; i < len(cmds); i++ {
+		reply, err := cn.readReply(ctx)
+		if err != nil {
+			setErrors(cmds, err)
+			return err
+		}
+		if serverErr, ok := reply.(*ServerError); ok {
+			if i == -1 {
+				// MULTI itself failed, EXEC will fail too
+				cn.broken.Store(true)
+				setErrors(cmds, serverErr)
+				return serverErr
+			}
+			cmds[i].setErr(serverErr)
+			continue
+		}
+		if i >= 0 {
+			queued[i] = true
+		}
+	}
+
+	reply, err := cn.readReply(ctx)
+	if err != nil {
+		setErrors(cmds, err)
+		return err
+	}
+	switch reply := reply.(type) {
+	case nil:
+		setErrors(cmds, ErrTxFailed)
+		return ErrTxFailed
+	case *ServerError:
+		for i, cmd := range cmds {
+			if queued[i] {
+				cmd.setErr(reply)
+			}
+		}
+		return reply
+	case []interface{}:
+		if len(reply) != len(cmds) {
+			err := cn.fail("read", errors.New("protocol error: EXEC returned the wrong number of replies"))
+			setErrors(cmds, err)
+			return err
+		}
+		for i, cmd := range cmds {
+			cmd.setReply(reply[i])
+		}
+		return nil
+	}
+	err = cn.fail("read", unexpected(reply))
+	setErrors(cmds, err)
+	return err
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pool keeps idle connections for reuse and caps the number of open ones.
+// Connections that saw a network error are closed instead of being reused.
+type pool struct {
+	opts  *Options
+	slots chan struct{} // one token per open connection
+	idle  chan *conn
+
+	mutex  sync.Mutex
+	closed bool
+}
+
+func newPool(opts *Options) *pool {
+	return &pool{
+		opts:  opts,
+		slots: make(chan struct{}, opts.PoolSize),
+		idle:  make(chan *conn, opts.PoolSize),
+	}
+}
+
+// get returns an idle connection or dials a new one, waiting up to
+// PoolTimeout when PoolSize connections are already in use.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	if p.isClosed() {
+		return nil, ErrClosed
+	}
+	timer := time.NewTimer(p.opts.PoolTimeout)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, ErrPoolTimeout
+	}
+	select {
+	case cn := <-p.idle:
+		return cn, nil
+	default:
+	}
+	cn, err := p.dial(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return cn, nil
+}
+
+// dial opens a connection and logs it in, selects the database and names it.
+func (p *pool) dial(ctx context.Context) (*conn, error) {
+	cn, err := dial(ctx, p.opts)
+	if err != nil {
+		return nil, err
+	}
+	var cmds []Cmder
+	switch {
+	case p.opts.Username != "":
+		cmds = append(cmds, newCmd(decodeString, "AUTH", p.opts.Username, p.opts.Password))
+	case p.opts.Password != "":
+		cmds = append(cmds, newCmd(decodeString, "AUTH", p.opts.Password))
+	}
+	if p.opts.DB != 0 {
+		cmds = append(cmds, newCmd(decodeString, "SELECT", itoa(p.opts.DB)))
+	}
+	if p.opts.ClientName != "" {
+		cmds = append(cmds, newCmd(decodeString, "CLIENT", "SETNAME", p.opts.ClientName))
+	}
+	if len(cmds) == 0 {
+		return cn, nil
+	}
+	if err := cn.roundTrip(ctx, cmds); err != nil {
+		cn.close()
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			cn.close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// put gives a connection back, or closes it if it is broken.
+func (p *pool) put(cn *conn) {
+	p.mutex.Lock()
+	if p.closed || cn.broken.Load() {
+		cn.close()
+	} else {
+		p.idle <- cn
+	}
+	p.mutex.Unlock()
+	<-p.slots
+}
+
+// remove closes a connection that must not be reused.
+func (p *pool) remove(cn *conn) {
+	cn.close()
+	<-p.slots
+}
+
+func (p *pool) isClosed() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.closed
+}
+
+// close closes the idle connections. Those in use are closed when they are
+// given back.
+func (p *pool) close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	p.closed = true
+	for {
+		select {
+		case cn := <-p.idle:
+			cn.close()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Message is a message published to a channel. Pattern is set when it was
+// received through PSUBSCRIBE.
+type Message struct {
+	Channel string
+	Pattern string
+	Payload string
+}
+
+// Subscription confirms a SUBSCRIBE, UNSUBSCRIBE, PSUBSCRIBE or
+// PUNSUBSCRIBE. Count is the number of subscriptions left on the connection.
+type Subscription struct {
+	Kind    string // subscribe, unsubscribe, psubscribe or punsubscribe
+	Channel string
+	Count   int
+}
+
+// Pong answers a Ping sent while subscribed.
+type Pong struct {
+	Payload string
+}
+
+// PubSub is a subscription on a dedicated connection. Subscribing only sends
+// the command; the confirmations come back through Receive in order with the
+// messages.
+type PubSub struct {
+	cn   *conn
+	done chan struct{} // closed by Close
+
+	mutex  sync.Mutex // serializes writes, reads are done by the receiver
+	closed bool
+
+	chOnce sync.Once
+	ch     chan *Message
+}
+
+// Subscribe opens a connection subscribed to channels.
+func (c *Client) Subscribe(ctx context.Context, channels ...string) (*PubSub, error) {
+	return c.newPubSub(ctx, "SUBSCRIBE", channels)
+}
+
+// PSubscribe opens a connection subscribed to patterns.
+func (c *Client) PSubscribe(ctx context.Context, patterns ...string) (*PubSub, error) {
+	return c.newPubSub(ctx, "PSUBSCRIBE", patterns)
+}
+
+func (c *Client) newPubSub(ctx context.Context, command string, names []string) (*PubSub, error) {
+	if c.pool.isClosed() {
+		return nil, ErrClosed
+	}
+	// Subscribers wait for messages as long as needed, outside of the pool
+	cn, err := c.pool.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ps := &PubSub{cn: cn, done: make(chan struct{})}
+	if len(names) > 0 {
+		if err := ps.write(ctx, command, names); err != nil {
+			cn.close()
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+func (ps *PubSub) write(ctx context.Context, command string, args []string) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if ps.closed {
+		return ErrClosed
+	}
+	return ps.cn.writeCommands(ctx, append([]string{command}, args...))
+}
+
+func (ps *PubSub) Subscribe(ctx context.Context, channels ...string) error {
+	if len(channels) == 0 {
+		return errors.New("kv: Subscribe needs at least one channel")
+	}
+	return ps.write(ctx, "SUBSCRIBE", channels)
+}
+
+func (ps *PubSub) PSubscribe(ctx context.Context, patterns ...string) error {
+	if len(patterns) == 0 {
+		return errors.New("kv: PSubscribe needs at least one pattern")
+	}
+	return ps.write(ctx, "PSUBSCRIBE", patterns)
+}
+
+// Unsubscribe leaves channels, or every channel when none is given.
+func (ps *PubSub) Unsubscribe(ctx context.Context, channels ...string) error {
+	return ps.write(ctx, "UNSUBSCRIBE", channels)
+}
+
+// PUnsubscribe leaves patterns, or every pattern when none is given.
+func (ps *PubSub) PUnsubscribe(ctx context.Context, patterns ...string) error {
+	return ps.write(ctx, "PUNSUBSCRIBE", patterns)
+}
+
+// Ping asks the server for a Pong, to check the connection is alive.
+func (ps *PubSub) Ping(ctx context.Context, payload ...string) error {
+	return ps.write(ctx, "PING", payload)
+}
+
+// Receive waits for the next *Message, *Subscription or *Pong. Only one
+// goroutine may receive at a time. When ctx is done first its error is
+// returned and the subscription can still be used.
+func (ps *PubSub) Receive(ctx context.Context) (interface{}, error) {
+	reply, err := ps.cn.readPush(ctx)
+	if err != nil {
+		ps.mutex.Lock()
+		closed := ps.closed
+		ps.mutex.Unlock()
+		if closed {
+			return nil, ErrClosed
+		}
+		return nil, err
+	}
+	return parsePush(reply)
+}
+
+func parsePush(reply interface{}) (interface{}, error) {
+	if err, ok := reply.(*ServerError); ok {
+		return nil, err
+	}
+	values, _ := reply.([]interface{})
+	strs := make([]string, len(values))
+	for i, value := range values {
+		switch value := value.(type) {
+		case string:
+			strs[i] = value
+		case int64:
+			strs[i] = itoa(int(value))
+		}
+	}
+	switch {
+	case len(values) == 3 && strs[0] == "message":
+		return &Message{Channel: strs[1], Payload: strs[2]}, nil
+	case len(values) == 4 && strs[0] == "pmessage":
+		return &Message{Pattern: strs[1], Channel: strs[2], Payload: strs[3]}, nil
+	case len(values) == 2 && strs[0] == "pong":
+		return &Pong{Payload: strs[1]}, nil
+	case len(values) == 3:
+		switch strs[0] {
+		case "subscribe", "unsubscribe", "psubscribe", "punsubscribe":
+			count, ok := values[2].(int64)
+			if ok {
+				return &Subscription{Kind: strs[0], Channel: strs[1], Count: int(count)}, nil
+			}
+		}
+	}
+	return nil, unexpected(reply)
+}
+
+// ReceiveMessage waits for the next message, skipping confirmations and
+// pongs.
+func (ps *PubSub) ReceiveMessage(ctx context.Context) (*Message, error) {
+	for {
+		received, err := ps.Receive(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if msg, ok := received.(*Message); ok {
+			return msg, nil
+		}
+	}
+}
+
+// Channel returns a channel receiving the messages, closed with the
+// subscription or when the connection fails. It must not be mixed with
+// Receive.
+func (ps *PubSub) Channel() <-chan *Message {
+	ps.chOnce.Do(func() {
+		ps.ch = make(chan *Message, 100)
+		go func() {
+			defer close(ps.ch)
+			for {
+				msg, err := ps.ReceiveMessage(context.Background())
+				if err != nil {
+					return
+				}
+				select {
+				case ps.ch <- msg:
+				case <-ps.done:
+					return
+				}
+			}
+		}()
+	})
+	return ps.ch
+}
+
+// Close closes the connection, which ends every subscription.
+func (ps *PubSub) Close() error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if ps.closed {
+		return ErrClosed
+	}
+	ps.closed = true
+	close(ps.done)
+	return ps.cn.close()
+}
@@ -0,0 +1,218 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// conn is one connection to the server with its buffers.
+type conn struct {
+	netConn net.Conn
+	addr    string
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	broken  atomic.Bool // a network error happened, the connection must not be reused
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func dial(ctx context.Context, opts *Options) (*conn, error) {
+	dialer := &net.Dialer{Timeout: opts.DialTimeout}
+	var netConn net.Conn
+	var err error
+	if opts.TLSConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: opts.TLSConfig}
+		netConn, err = tlsDialer.DialContext(ctx, "tcp", opts.Addr)
+	} else {
+		netConn, err = dialer.DialContext(ctx, "tcp", opts.Addr)
+	}
+	if err != nil {
+		return nil, &NetworkError{Op: "dial", Addr: opts.Addr, Err: err}
+	}
+	return &conn{
+		netConn:      netConn,
+		addr:         opts.Addr,
+		reader:       bufio.NewReader(netConn),
+		writer:       bufio.NewWriter(netConn),
+		readTimeout:  opts.ReadTimeout,
+		writeTimeout: opts.WriteTimeout,
+	}, nil
+}
+
+func (cn *conn) close() error {
+	return cn.netConn.Close()
+}
+
+// deadline is the earliest of the context deadline and now plus timeout.
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	var t time.Time
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (t.IsZero() || d.Before(t)) {
+		t = d
+	}
+	return t
+}
+
+func (cn *conn) fail(op string, err error) error {
+	cn.broken.Store(true)
+	return &NetworkError{Op: op, Addr: cn.addr, Err: err}
+}
+
+// writeCommands sends commands in one write.
+func (cn *conn) writeCommands(ctx context.Context, commands ...[]string) error {
+	cn.netConn.SetWriteDeadline(deadline(ctx, cn.writeTimeout))
+	for _, args := range commands {
+		fmt.Fprintf(cn.writer, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(cn.writer, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := cn.writer.Flush(); err != nil {
+		return cn.fail("write", err)
+	}
+	return nil
+}
+
+// readReply reads one reply. Strings come back as string, integers as int64,
+// arrays as []interface{}, nil replies as nil and error replies as
+// *ServerError values; only network and protocol failures are errors.
+func (cn *conn) readReply(ctx context.Context) (interface{}, error) {
+	return cn.readBlockedReply(ctx, 0)
+}
+
+// readBlockedReply reads the reply of a command the server may hold for up
+// to block before answering, or for ever if block is -1.
+func (cn *conn) readBlockedReply(ctx context.Context, block time.Duration) (interface{}, error) {
+	timeout := cn.readTimeout
+	if block < 0 {
+		timeout = 0
+	} else if timeout > 0 {
+		timeout += block
+	}
+	cn.netConn.SetReadDeadline(deadline(ctx, timeout))
+	reply, err := readValue(cn.reader)
+	if err != nil {
+		return nil, cn.fail("read", err)
+	}
+	return reply, nil
+}
+
+// readPush waits for a reply as long as ctx allows, for subscribers waiting
+// for messages. Nothing is consumed while waiting, so the connection is still
+// usable when ctx is done first.
+func (cn *conn) readPush(ctx context.Context) (interface{}, error) {
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		cn.netConn.SetReadDeadline(time.Unix(1, 0))
+		close(fired)
+	})
+	d, _ := ctx.Deadline()
+	cn.netConn.SetReadDeadline(d)
+	_, err := cn.reader.Peek(1)
+	if !stop() {
+		<-fired
+		return nil, ctx.Err()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nil, context.DeadlineExceeded
+	}
+	if err != nil {
+		return nil, cn.fail("read", err)
+	}
+	return cn.readReply(context.Background())
+}
+
+func readValue(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("protocol error: bad line " + strconv.Quote(line))
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return parseServerError(body), nil
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, errors.New("protocol error: bad integer " + strconv.Quote(body))
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 {
+			return nil, errors.New("protocol error: bad bulk length " + strconv.Quote(body))
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 {
+			return nil, errors.New("protocol error: bad array length " + strconv.Quote(body))
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readValue(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, errors.New("protocol error: unexpected reply type " + strconv.Quote(string(kind)))
+}
+
+// roundTrip sends commands in one write and stores their replies.
+func (cn *conn) roundTrip(ctx context.Context, cmds []Cmder) error {
+	commands := make([][]string, len(cmds))
+	for i, cmd := range cmds {
+		commands[i] = cmd.Args()
+	}
+	if err := cn.writeCommands(ctx, commands...); err != nil {
+		setErrors(cmds, err)
+		return err
+	}
+	for i, cmd := range cmds {
+		reply, err := cn.readBlockedReply(ctx, cmd.blockTimeout())
+		if err != nil {
+			setErrors(cmds[i:], err)
+			return err
+		}
+		cmd.setReply(reply)
+	}
+	return nil
+}
+
+func itoa(n int) string {
+	return strconv.Itoa(n)
+}
+
+func setErrors(cmds []Cmder, err error) {
+	for _, cmd := range cmds {
+		cmd.setErr(err)
+	}
+}